@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variable of every flag, e.g. S3SYNC_STORAGE_CLASS for --storage-class.
+const envPrefix = "S3SYNC_"
+
+// configFlag is the global --config option, read by loadConfig before any command runs.
+var configFlag = &cli.PathFlag{
+	Name:    "config",
+	Usage:   "YAML or TOML file with default settings, keyed by flag name",
+	EnvVars: []string{envPrefix + "CONFIG"},
+}
+
+// bindEnv lets every flag of every command be set from its S3SYNC_ environment variable as well.
+func bindEnv(commands []*cli.Command) {
+	for _, cmd := range commands {
+		for _, f := range cmd.Flags {
+			env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Names()[0], "-", "_"))
+			switch f := f.(type) {
+			case *cli.StringFlag:
+				f.EnvVars = append(f.EnvVars, env)
+			case *cli.PathFlag:
+				f.EnvVars = append(f.EnvVars, env)
+			case *cli.BoolFlag:
+				f.EnvVars = append(f.EnvVars, env)
+			case *cli.IntFlag:
+				f.EnvVars = append(f.EnvVars, env)
+			case *cli.DurationFlag:
+				f.EnvVars = append(f.EnvVars, env)
+			case *cli.StringSliceFlag:
+				f.EnvVars = append(f.EnvVars, env)
+			}
+		}
+		bindEnv(cmd.Subcommands)
+	}
+}
+
+// loadConfig makes the settings in the --config file the defaults of the matching flags of every command. So a
+// flag given on the command line wins over its environment variable, which wins over the file, which wins over
+// the built in default. Required flags are satisfied by the file.
+func loadConfig(c *cli.Context) error {
+	path := c.Path("config")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	settings := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &settings)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &settings)
+	default:
+		return fmt.Errorf("config %s: expected a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	for name, v := range settings {
+		found := false
+		for _, cmd := range c.App.Commands {
+			for _, f := range cmd.Flags {
+				if f.Names()[0] != name {
+					continue
+				}
+				found = true
+				err = setDefault(f, v)
+				if err != nil {
+					return fmt.Errorf("config %s: %s: %w", path, name, err)
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("config %s: unknown setting %q", path, name)
+		}
+	}
+	return nil
+}
+
+// setDefault replaces the default value of f with v from a config file.
+func setDefault(f cli.Flag, v interface{}) error {
+	s := fmt.Sprint(v)
+	var err error
+	switch f := f.(type) {
+	case *cli.StringFlag:
+		f.Value, f.Required = s, false
+	case *cli.PathFlag:
+		f.Value, f.Required = s, false
+	case *cli.BoolFlag:
+		f.Value, err = strconv.ParseBool(s)
+		f.Required = false
+	case *cli.IntFlag:
+		f.Value, err = strconv.Atoi(s)
+		f.Required = false
+	case *cli.DurationFlag:
+		f.Value, err = time.ParseDuration(s)
+		f.Required = false
+	case *cli.StringSliceFlag:
+		list, ok := v.([]interface{})
+		if !ok {
+			list = []interface{}{v}
+		}
+		values := make([]string, len(list))
+		for i, item := range list {
+			values[i] = fmt.Sprint(item)
+		}
+		f.Value, f.Required = cli.NewStringSlice(values...), false
+	default:
+		return fmt.Errorf("can't be set from a config file")
+	}
+	return err
+}
@@ -2,116 +2,2537 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
 	"s3sync/syncer"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pterm/pterm"
 	"github.com/urfave/cli/v2"
 )
 
 func main() {
 	app := &cli.App{
-		Name:  "s3sync",
-		Usage: "Sync with the provided s3 bucket",
+		Name:    "s3sync",
+		Usage:   "Sync with the provided s3 bucket",
+		Version: syncer.Version,
+		Flags:   []cli.Flag{configFlag},
+		Before:  loadConfig,
 		Commands: []*cli.Command{
 			{
 				Name:  "sync",
 				Usage: "upload new files to the provided bucket",
+				Flags: append([]cli.Flag{
+					&cli.PathFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "The source (local) folder to sync with S3",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket to sysnc to",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:     "filter",
+						Aliases:  []string{"f"},
+						Usage:    "files to sync: an extension like .jpg, a glob like IMG_*.CR2 or raw/*, a /regexp/, a path, or any of those after ! to leave out. Can be specified multiple times.",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "deep",
+						Aliases:  []string{"d"},
+						Usage:    "deep archive in S3",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "storage-class",
+						Usage:    "storage class for uploads, e.g. STANDARD_IA or ONEZONE_IA. Checked against the bucket before uploading.",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "class-rule",
+						Usage:    "upload the files matching size and age conditions in another storage class, as CLASS:condition,..., e.g. GLACIER:age>90d or STANDARD_IA:size>128K. The first rule that matches wins over --deep and --storage-class. Can be repeated.",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "accelerate",
+						Usage:    "send the uploads through the S3 Transfer Acceleration endpoint, the bucket needs acceleration enabled",
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "max-duration",
+						Usage:    "stop cleanly once the sync has run this long, after the file in flight, leaving the rest for the next sync (0 for no limit)",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "max-files",
+						Usage:    "stop cleanly after uploading this many files, the next syncs carry on with the rest without walking the folders until it is all up (0 for no limit)",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "max-bytes",
+						Usage:    "stop cleanly before going over this many bytes uploaded, e.g. 500G, the next syncs carry on with the rest without walking the folders until it is all up",
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "stall-timeout",
+						Usage:    "start an upload over when no bytes move for this long (0 to turn off)",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "stall-retries",
+						Usage:    "how often to start a stalled upload over before failing it",
+						Value:    syncer.DefaultStallRetries,
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "retries",
+						Usage:    "how often to send an upload again that failed on a dropped connection or an error on the side of S3 (-1 for never)",
+						Value:    syncer.DefaultMaxRetries,
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "permissions",
+						Usage:    "store file mode, ownership and modification time as object metadata",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "symlinks",
+						Usage:    "what to do with symlinks: follow uploads what they point to, skip leaves them out, record uploads them as links that download makes again",
+						Value:    syncer.SymlinksFollow,
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "keep-empty-dirs",
+						Usage:    "upload empty directories as empty objects ending in a slash, so a restore brings them back",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "xattrs",
+						Usage:    "store extended attributes with the objects, in a sidecar object when they are too big for the metadata. Linux and macOS only.",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "source",
+						Usage:    "another folder to sync in the same run, as folder[,prefix[,storage class]]. Can be specified multiple times.",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "max-failures",
+						Usage:    "skip files that failed this many runs in a row, 0 to always retry",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "keep-going",
+						Usage:    "upload the rest of the files when one fails instead of stopping, and list every failure at the end",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "reset-quarantine",
+						Usage:    "give every quarantined file another chance",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "delta",
+						Usage:    "upload only the changed blocks of files that were uploaded before",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "skip-empty",
+						Usage:    "leave out empty and completely sparse files",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "skip-incompressible",
+						Usage:    "leave out files that look already encrypted or compressed",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "skip-larger-than",
+						Usage:    "leave out files bigger than this size (e.g. 20G) with a warning for each one",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "part-keys",
+						Usage:    "key template for the pieces of split files, with {key}, {index}, {number} and {total}, e.g. parts/{key}.p{number:4}of{total:4}",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "order",
+						Usage:    "upload order: given, largest, smallest or path",
+						Value:    "given",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "start-after",
+						Usage:    "only upload the files whose path sorts after this one, to pick up an interrupted run by hand",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "include-dir",
+						Usage:    "only sync this folder inside --path. Can be specified multiple times, combines with --filter.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "subpath",
+						Usage:    "only sync this folder inside --path, keys and the manifest stay the same as a full sync",
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "retention",
+						Usage:    "delete objects of files removed locally once they have been gone this long, 0 keeps them forever",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "hardlinks",
+						Usage:    "upload files with several hardlinks once and record the other paths as links to it",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "no-split",
+						Usage:    "fail files too big for a single PUT instead of splitting them into part objects",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "multipart",
+						Usage:    "upload files too big for a single PUT as one object with the S3 multipart API instead of splitting them into part objects. An upload a run didn't finish is carried on from its last part",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "force-restart",
+						Usage:    "split and upload every piece of a file an earlier run left partly uploaded again, instead of resuming it",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "checkpoint",
+						Usage:    "save the local file inventory as it is taken, so an interrupted sync resumes it",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "one-file-system",
+						Aliases:  []string{"x"},
+						Usage:    "don't cross into other filesystems (mounts, network shares) below the source folders",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "detect-drift",
+						Usage:    "fail instead of overwriting objects someone else changed since the last sync",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "event-webhook",
+						Usage:    "POST a JSON event with the key, size and sha256 of every uploaded file to this URL, failures only warn",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "event-sns-topic",
+						Usage:    "publish a JSON event for every uploaded file to this SNS topic ARN, failures only warn",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "content-md5",
+						Usage:    "send the MD5 of every upload so S3 turns down one corrupted on the way, at the cost of reading each file twice",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "strict-walk",
+						Usage:    "fail the sync on any file or folder that can't be read instead of leaving it out",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "content-only",
+						Usage:    "only upload files whose content hash changed, ignoring modification times. Hashes every file on every sync.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "hash-mode",
+						Usage:    "how changed files are told: mtime, or sha256 or etag to compare every file by that hash like --content-only",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "hash-skewed",
+						Usage:    "compare files whose modification time is in the future or older than recorded by content, for clocks that jumped",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "skip-existing",
+						Usage:    "record files as uploaded without sending them when their key already holds the same content, checked with one bucket listing",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "only-new",
+						Usage:    "only upload paths that were never synced, never modified files again, for append-only folders",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "large-file",
+						Usage:    "give files from this size (e.g. 100M) a byte progress bar each and batch the smaller ones under one bar",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "compact",
+						Usage:    "show a single progress bar instead of a line per file, for large syncs",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "group-by-dir",
+						Usage:    "show the progress per directory instead of a line per file, for deep trees",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "report",
+						Usage:    "how to report the run: terminal, log for a plain log line per file on stderr, slog for structured JSON log records on stderr, or json for a JSON event per line on stdout, for cron jobs and other programs",
+						Required: false,
+					},
+					&cli.PathFlag{
+						Name:     "summary-file",
+						Usage:    "write a JSON summary of the run to this file when it ends, failed or not: files scanned, skipped, uploaded and failed, bytes, wall time and throughput. - for stdout.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "label",
+						Usage:    "name this run, e.g. weekly-2024w23. Recorded in the run history and set on every object it uploads as metadata and the s3sync-run tag (needs s3:PutObjectTagging).",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "sparse",
+						Usage:    "upload only the data of sparse files like disk images, download puts the holes back. Linux only.",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "low-priority",
+						Usage:    "run with idle IO priority and nice 19 (background mode on Windows) to keep the machine responsive",
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "file-pause",
+						Usage:    "rest this long between two uploads, e.g. 500ms, to leave the disk to others",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "sanitize-keys",
+						Usage:    "percent encode control characters, spaces around path segments and . and .. segments in new keys",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "shorten-keys",
+						Usage:    "replace the tail of keys over the 1024 bytes S3 allows with a hash, instead of failing those files",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "rename-collisions",
+						Usage:    "give files whose keys differ only in case keys of their own, like photo~1.jpg, so a case-insensitive restore keeps them all",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "split-budget",
+						Usage:    "split the big files ahead of their upload, several at once, using up to this much temp space (e.g. 50G)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "adaptive-parts",
+						Usage:    "size the pieces of split files to make about 1000 even parts, instead of 2GB pieces",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "part-size",
+						Usage:    "split big files into pieces of this size, e.g. 500M, instead of 2GB",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "split-concurrency",
+						Usage:    "write this many pieces of a split file at once, on fast disks",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "concurrency",
+						Usage:    "upload this many files at once",
+						Value:    syncer.DefaultMaxConcurrency,
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "bwlimit",
+						Usage:    "upload no faster than this many bytes a second (e.g. 2M) across all the files going up at once",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "part-concurrency",
+						Usage:    "upload this many pieces of a split file at once",
+						Value:    1,
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "concurrency-auto",
+						Usage:    "tune how many pieces of a split file upload at once from their throughput, up to --part-concurrency or 16, and print what was fastest",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "checksum-file",
+						Usage:    "at the end of every run write a SHA256SUMS file of the bucket to this key, to check a copy with sha256sum -c",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "checksum",
+						Usage:    "hash the manifest and the checksum file record file contents with: sha256, sha512, etag as S3 works out multipart ETags, or crc64 which is quicker but only catches accidental corruption. A manifest keeps the one it has sums of",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "snapshot",
+						Usage:    "keep this run as a point in time snapshot under a timestamped prefix, unchanged files are stored once across snapshots",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "reconcile",
+						Usage:    "after the upload, list the bucket and fail if it doesn't hold exactly the objects of the local files",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "remote-diff",
+						Usage:    "work out what to upload from a listing of the bucket instead of the manifest, for a lost manifest or a bucket filled by another tool",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "plan",
+						Usage:    "record the uploads as a plan in the manifest and print it instead of uploading, see --apply",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "shared-manifest",
+						Usage:    "keep the manifest in the bucket too, pulling it before the sync when another machine pushed and pushing it after",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "watch",
+						Usage:    "keep running and sync again whenever files change, until interrupted",
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "watch-interval",
+						Usage:    "with --watch, how often to look for changes inotify didn't report, or for any on systems without it",
+						Value:    syncer.DefaultWatchInterval,
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "watch-debounce",
+						Usage:    "with --watch, how long the folders have to be quiet after a change before syncing",
+						Value:    syncer.DefaultWatchDebounce,
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "dry-run",
+						Usage:    "list the files that would be uploaded with their storage class and how big files would be split, skipped and purged, leaving the manifest and the bucket as they are",
+						Required: false,
+					},
+					&cli.Int64Flag{
+						Name:     "apply",
+						Usage:    "upload the files of the plan with this id, leaving out any that changed since the plan was made",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "header",
+						Usage:    "set a header on the files matching a pattern, as pattern:Name=value for Cache-Control, Content-Disposition, Content-Language or Expires, e.g. *.css:Cache-Control=max-age=86400. Can be repeated.",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "metadata",
+						Usage:    "set custom metadata on every object of the run, as key=value with a lowercase key. Can be repeated.",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "tag",
+						Usage:    "set an object tag on every object of the run, as key=value. Can be repeated, up to 10 tags.",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "content-type",
+						Usage:    "set the Content-Type of every object from the file extension",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "compress",
+						Usage:    "compress text files before uploading them: gzip, or none. Restore and download decompress them again.",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "compress-type",
+						Usage:    "with --compress, compress the files with this extension (.csv), MIME type (application/json) or MIME prefix (text/) instead of the usual text types. Can be repeated.",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "page-size",
+						Usage:    "read the files to upload from the manifest this many at a time instead of all at once, for very large syncs. 0 reads them all.",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "key-prefix",
+						Usage:    "put every key under this prefix, e.g. hostname/ to back up several machines into one bucket",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "relative-keys",
+						Usage:    "key files by their path relative to --path with forward slashes instead of their full local path, for the same keys from any machine or OS",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "sse",
+						Usage:    "server-side encryption to ask for on every object: AES256, aws:kms or aws:kms:dsse, aws:kms with --kms-key-id or --kms-context when not given",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "kms-key-id",
+						Usage:    "encrypt every object with SSE-KMS under this key ID or ARN",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "kms-context",
+						Usage:    "add key=value to the KMS encryption context sent with every upload, for key policies that require one. Can be repeated.",
+						Required: false,
+					},
+					&cli.PathFlag{
+						Name:     "encryption-key-file",
+						Usage:    "encrypt every file on this machine before upload with AES-256-GCM, under the 32 byte key in this file (raw, hex or base64). Keep it safe, nothing uploaded can be read back without it.",
+						Required: false,
+					},
+				}, uploadFlags()...),
+				Action: func(c *cli.Context) error {
+					app := syncer.Syncer{
+						Bucket:              c.String("bucket"),
+						FolderPath:          c.String("path"),
+						UploadTimeout:       c.Duration("timeout"),
+						MaxDuration:         c.Duration("max-duration"),
+						MaxFilesPerRun:      c.Int("max-files"),
+						StallTimeout:        c.Duration("stall-timeout"),
+						StallRetries:        c.Int("stall-retries"),
+						MaxRetries:          c.Int("retries"),
+						PreservePermissions: c.Bool("permissions"),
+						PreserveXattrs:      c.Bool("xattrs"),
+						DeltaMode:           c.Bool("delta"),
+						Compact:             c.Bool("compact"),
+						GroupByDir:          c.Bool("group-by-dir"),
+						DetectDrift:         c.Bool("detect-drift"),
+						ContentMD5:          c.Bool("content-md5"),
+						OneFileSystem:       c.Bool("one-file-system"),
+						CheckpointWalk:      c.Bool("checkpoint"),
+						NoSplit:             c.Bool("no-split"),
+						NativeMultipart:     c.Bool("multipart"),
+						ForceRestart:        c.Bool("force-restart"),
+						DryRun:              c.Bool("dry-run"),
+						Hardlinks:           c.Bool("hardlinks"),
+						RequesterPays:       c.Bool("requester-pays"),
+						ExpectedBucketOwner: c.String("expected-bucket-owner"),
+						KMSKeyID:            c.String("kms-key-id"),
+						KeyPrefix:           c.String("key-prefix"),
+						RelativeKeys:        c.Bool("relative-keys"),
+						ContentOnly:         c.Bool("content-only"),
+						HashSkewed:          c.Bool("hash-skewed"),
+						OnlyNew:             c.Bool("only-new"),
+						SkipExisting:        c.Bool("skip-existing"),
+						StrictWalk:          c.Bool("strict-walk"),
+						StartAfter:          c.String("start-after"),
+						Sparse:              c.Bool("sparse"),
+						ChecksumFile:        c.String("checksum-file"),
+						SanitizeKeys:        c.Bool("sanitize-keys"),
+						RenameCollisions:    c.Bool("rename-collisions"),
+						ShortenKeys:         c.Bool("shorten-keys"),
+						LowPriority:         c.Bool("low-priority"),
+						FilePause:           c.Duration("file-pause"),
+						TargetParts:         targetParts(c.Bool("adaptive-parts")),
+						MaxConcurrency:      c.Int("concurrency"),
+						PartConcurrency:     c.Int("part-concurrency"),
+						PartConcurrencyAuto: c.Bool("concurrency-auto"),
+						RunLabel:            c.String("label"),
+						Subpath:             c.String("subpath"),
+						IncludeDirs:         c.StringSlice("include-dir"),
+						Retention:           c.Duration("retention"),
+						MaxFailures:         c.Int("max-failures"),
+						StorageClass:        types.StorageClass(strings.ToUpper(c.String("storage-class"))),
+					}
+					if c.Bool("snapshot") {
+						app.Snapshot = time.Now().UTC().Format(syncer.SnapshotLayout)
+					}
+					order, err := syncer.ParseOrder(c.String("order"))
+					if err != nil {
+						return err
+					}
+					app.ServerSideEncryption = types.ServerSideEncryption(c.String("sse"))
+					app.KMSEncryptionContext, err = kmsContext(c.StringSlice("kms-context"))
+					if err != nil {
+						return err
+					}
+					app.EncryptionKey, err = encryptionKey(c.Path("encryption-key-file"))
+					if err != nil {
+						return err
+					}
+					app.UploadOrder = order
+					app.KeepGoing = c.Bool("keep-going")
+					app.SharedManifest = c.Bool("shared-manifest")
+					app.WatchInterval = c.Duration("watch-interval")
+					app.WatchDebounce = c.Duration("watch-debounce")
+					for _, v := range c.StringSlice("class-rule") {
+						rule, err := syncer.ParseClassRule(v)
+						if err != nil {
+							return err
+						}
+						app.ClassRules = append(app.ClassRules, rule)
+					}
+					if v := c.String("checksum"); v != "" {
+						app.Checksum, err = syncer.ParseChecksum(v)
+						if err != nil {
+							return err
+						}
+					}
+					app.HashMode, err = syncer.ParseHashMode(c.String("hash-mode"))
+					if err != nil {
+						return err
+					}
+					switch v := c.String("report"); v {
+					case "", "terminal":
+					case "log":
+						app.Reporter = syncer.LogReporter{}
+					case "slog":
+						app.Reporter = syncer.SlogReporter{Logger: slog.New(slog.NewJSONHandler(os.Stderr, nil))}
+					case "json":
+						app.Reporter = syncer.JSONReporter{W: os.Stdout}
+					default:
+						return fmt.Errorf("unknown report %q, want terminal, log, slog or json", v)
+					}
+					if t := c.String("part-keys"); t != "" {
+						err = syncer.ValidatePartTemplate(t)
+						if err != nil {
+							return err
+						}
+						app.PartKeyTemplate = t
+					}
+					if v := c.String("large-file"); v != "" {
+						app.LargeFile, err = syncer.ParseSize(v)
+						if err != nil {
+							return err
+						}
+					}
+					if v := c.String("skip-larger-than"); v != "" {
+						app.SkipLargerThan, err = syncer.ParseSize(v)
+						if err != nil {
+							return err
+						}
+					}
+					if v := c.String("split-budget"); v != "" {
+						app.SplitBudget, err = syncer.ParseSize(v)
+						if err != nil {
+							return err
+						}
+					}
+					if v := c.String("part-size"); v != "" {
+						app.PartSize, err = syncer.ParseSize(v)
+						if err != nil {
+							return err
+						}
+					}
+					app.SplitConcurrency = c.Int("split-concurrency")
+					if v := c.String("bwlimit"); v != "" {
+						app.MaxBytesPerSecond, err = syncer.ParseSize(v)
+						if err != nil {
+							return err
+						}
+					}
+					if v := c.String("max-bytes"); v != "" {
+						app.MaxBytesPerRun, err = syncer.ParseSize(v)
+						if err != nil {
+							return err
+						}
+					}
+					var events syncer.Publishers
+					if v := c.String("event-webhook"); v != "" {
+						events = append(events, &syncer.WebhookPublisher{URL: v})
+					}
+					if v := c.String("event-sns-topic"); v != "" {
+						// signed with the credentials of the S3 client once sync has it
+						events = append(events, &syncer.SNSPublisher{TopicARN: v})
+					}
+					if len(events) > 0 {
+						app.Events = events
+					}
+					var rules []syncer.HeaderRule
+					for _, v := range c.StringSlice("header") {
+						rule, err := syncer.ParseHeaderRule(v)
+						if err != nil {
+							return err
+						}
+						rules = append(rules, rule)
+					}
+					if len(rules) > 0 {
+						app.Headers = syncer.HeaderRules(rules)
+					}
+					for _, v := range c.StringSlice("metadata") {
+						key, value, ok := strings.Cut(v, "=")
+						if !ok {
+							return fmt.Errorf("metadata %q: expected key=value", v)
+						}
+						if app.Metadata == nil {
+							app.Metadata = map[string]string{}
+						}
+						app.Metadata[key] = value
+					}
+					err = syncer.ValidateMetadata(app.Metadata)
+					if err != nil {
+						return err
+					}
+					for _, v := range c.StringSlice("tag") {
+						key, value, ok := strings.Cut(v, "=")
+						if !ok {
+							return fmt.Errorf("tag %q: expected key=value", v)
+						}
+						if app.Tags == nil {
+							app.Tags = map[string]string{}
+						}
+						app.Tags[key] = value
+					}
+					err = syncer.ValidateTags(app.Tags)
+					if err != nil {
+						return err
+					}
+					app.DetectContentType = c.Bool("content-type")
+					app.Compression, err = syncer.ParseCompression(c.String("compress"))
+					if err != nil {
+						return err
+					}
+					app.CompressTypes = c.StringSlice("compress-type")
+					app.Symlinks, err = syncer.ParseSymlinks(c.String("symlinks"))
+					if err != nil {
+						return err
+					}
+					app.KeepEmptyDirs = c.Bool("keep-empty-dirs")
+					var skips []syncer.SkipFunc
+					if c.Bool("skip-empty") {
+						skips = append(skips, syncer.SkipEmpty)
+					}
+					if c.Bool("skip-incompressible") {
+						skips = append(skips, syncer.SkipIncompressible)
+					}
+					if len(skips) > 0 {
+						app.Skip = syncer.SkipAny(skips...)
+					}
+					if extra := c.StringSlice("source"); len(extra) > 0 {
+						app.Sources = append(app.Sources, syncer.Source{FolderPath: app.FolderPath})
+						for _, v := range extra {
+							app.Sources = append(app.Sources, parseSource(v))
+						}
+					}
+					err = sync(&app, clientOptions(c), c.StringSlice("filter"), c.Bool("deep"), c.Bool("reset-quarantine"), c.Int("page-size"), c.Bool("reconcile"), c.Bool("plan"), c.Int64("apply"), c.Bool("watch"), c.Bool("remote-diff"))
+					if p := c.Path("summary-file"); p != "" {
+						summaryErr := writeSummary(&app, p, err)
+						if err == nil {
+							err = summaryErr
+						}
+					}
+					return err
+				},
+			},
+			{
+				Name:  "selftest",
+				Usage: "round trip a generated file tree through the bucket to check credentials and config, then clean up",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of a bucket to test against",
+						Required: true,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					err = syncer.TestRoundTrip(ctx, client, c.String("bucket"))
+					if err != nil {
+						return err
+					}
+					pterm.Success.Println("Self test passed, everything landed and matched.")
+					return nil
+				},
+			},
+			{
+				Name:  "doctor",
+				Usage: "check the credentials, bucket, region, clock, manifest and temp space a sync needs, for a report to attach to an issue",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket to sync to",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "storage-class",
+						Usage:    "storage class the uploads will use, STANDARD if not given",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "split-budget",
+						Usage:    "the --split-budget of the sync, to check the temp dir has room for it",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "accelerate",
+						Usage:    "send the uploads through the S3 Transfer Acceleration endpoint, the bucket needs acceleration enabled",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "sse",
+						Usage:    "server-side encryption to ask for on every object: AES256, aws:kms or aws:kms:dsse, aws:kms with --kms-key-id or --kms-context when not given",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "kms-key-id",
+						Usage:    "encrypt every object with SSE-KMS under this key ID or ARN",
+						Required: false,
+					},
+					&cli.StringSliceFlag{
+						Name:     "kms-context",
+						Usage:    "add key=value to the KMS encryption context sent with every upload, for key policies that require one. Can be repeated.",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{
+						Bucket:              c.String("bucket"),
+						S3Client:            client,
+						StorageClass:        types.StorageClass(strings.ToUpper(c.String("storage-class"))),
+						RequesterPays:       c.Bool("requester-pays"),
+						ExpectedBucketOwner: c.String("expected-bucket-owner"),
+						KMSKeyID:            c.String("kms-key-id"),
+					}
+					app.ServerSideEncryption = types.ServerSideEncryption(c.String("sse"))
+					app.KMSEncryptionContext, err = kmsContext(c.StringSlice("kms-context"))
+					if err != nil {
+						return err
+					}
+					if v := c.String("split-budget"); v != "" {
+						app.SplitBudget, err = syncer.ParseSize(v)
+						if err != nil {
+							return err
+						}
+					}
+					// a sound manifest is opened too, so the temp space is checked against the files waiting to upload
+					if _, err := os.Stat("manifest.db"); err == nil && syncer.SoundManifest("manifest.db") == nil {
+						err = app.InitDb("manifest.db")
+						if err != nil {
+							return err
+						}
+						defer app.Close()
+					}
+					report := app.Doctor(ctx, "manifest.db")
+					printDoctor(report)
+					if n := report.Failed(); n > 0 {
+						return fmt.Errorf("%d of %d checks failed", n, len(report.Checks))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "download",
+				Usage: "download a synced file, or any key, from the bucket. Interrupted downloads resume when run again.",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket to download from",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "file",
+						Usage:    "a file path as it was synced, looked up in the manifest. Split files are joined back together.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "key",
+						Aliases:  []string{"k"},
+						Usage:    "an object key to download instead of a synced file",
+						Required: false,
+					},
+					&cli.PathFlag{
+						Name:     "out",
+						Aliases:  []string{"o"},
+						Usage:    "where to write the file",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "from-snapshot",
+						Usage:    "restore --file as it was in this snapshot, see the snapshots command",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "xattrs",
+						Usage:    "set the extended attributes stored by sync --xattrs again",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "permissions",
+						Usage:    "set the mode, ownership and modification time stored by sync --permissions again",
+						Required: false,
+					},
+					&cli.PathFlag{
+						Name:     "encryption-key-file",
+						Usage:    "the key file the files were encrypted with by sync --encryption-key-file",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner"), FromSnapshot: c.String("from-snapshot"), PreserveXattrs: c.Bool("xattrs"), PreservePermissions: c.Bool("permissions")}
+					app.EncryptionKey, err = encryptionKey(c.Path("encryption-key-file"))
+					if err != nil {
+						return err
+					}
+					switch {
+					case c.String("key") != "":
+						err = app.DownloadKey(ctx, c.String("key"), c.String("out"))
+					case c.String("file") != "":
+						err = app.InitDb("manifest.db")
+						if err != nil {
+							return err
+						}
+						defer app.Close()
+						err = app.Download(ctx, c.String("file"), c.String("out"))
+					default:
+						return fmt.Errorf("one of --file or --key is required")
+					}
+					if err != nil {
+						return err
+					}
+					pterm.Success.Printfln("Downloaded %s", c.String("out"))
+					return nil
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: "download every synced file back from the bucket, asking for archived objects to be restored first",
+				Flags: append([]cli.Flag{
+					&cli.PathFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "The source (local) folder that was synced",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket that was synced to",
+						Required: true,
+					},
+					&cli.PathFlag{
+						Name:     "out",
+						Aliases:  []string{"o"},
+						Usage:    "folder to restore into, the files go back where they were synced from without it",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "restore-days",
+						Usage:    "how many days the restored copies of archived objects stay readable",
+						Value:    syncer.DefaultRestoreDays,
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "from-snapshot",
+						Usage:    "restore the files as they were in this snapshot, see the snapshots command",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "xattrs",
+						Usage:    "set the extended attributes stored by sync --xattrs again",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "permissions",
+						Usage:    "set the mode, ownership and modification time stored by sync --permissions again",
+						Required: false,
+					},
+					&cli.PathFlag{
+						Name:     "encryption-key-file",
+						Usage:    "the key file the files were encrypted with by sync --encryption-key-file",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), FolderPath: c.String("path"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner"), PreserveXattrs: c.Bool("xattrs"), PreservePermissions: c.Bool("permissions"), RestoreDays: int32(c.Int("restore-days"))}
+					app.EncryptionKey, err = encryptionKey(c.Path("encryption-key-file"))
+					if err != nil {
+						return err
+					}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					var report *syncer.RestoreReport
+					if snap := c.String("from-snapshot"); snap != "" {
+						report, err = app.RestoreSnapshot(ctx, snap, c.String("out"))
+					} else {
+						report, err = app.RestoreFolder(ctx, c.String("out"))
+					}
+					if report != nil && len(report.Pending) > 0 {
+						for _, p := range report.Pending {
+							pterm.Warning.Printfln("Waiting on a restore from the archive: %s", p)
+						}
+						pterm.Info.Printfln("Run restore again once the archived objects are readable, 3 to 5 hours for Glacier and up to 12 for Deep Archive.")
+					}
+					return err
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "check every uploaded object is still in the bucket with the size and ETag it was uploaded with, that the local files match the manifest and no objects are left unaccounted for, without changing anything",
+				Flags: append([]cli.Flag{
+					&cli.PathFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "The source (local) folder that was synced",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket that was synced to",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "json",
+						Usage:    "print the report as JSON instead of a table, for scripts",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), FolderPath: c.String("path"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner")}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					report, err := app.Verify(ctx)
+					if err != nil {
+						return err
+					}
+					if c.Bool("json") {
+						out, err := json.MarshalIndent(report, "", "  ")
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(out))
+						return report.Err()
+					}
+					printVerify(report)
+					return report.Err()
+				},
+			},
+			{
+				Name:  "heal",
+				Usage: "check every uploaded object in the bucket and upload the missing or changed ones again from the local files",
+				Flags: append([]cli.Flag{
+					&cli.PathFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "The source (local) folder that was synced",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket that was synced to",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:     "deep",
+						Aliases:  []string{"d"},
+						Usage:    "upload repairs to deep archive",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "dry-run",
+						Usage:    "only report what is broken, don't upload anything",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+					&cli.PathFlag{
+						Name:     "encryption-key-file",
+						Usage:    "encrypt the repairs with the key file given to sync --encryption-key-file",
+						Required: false,
+					},
+				}, uploadFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), FolderPath: c.String("path"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner"), UploadTimeout: c.Duration("timeout")}
+					app.EncryptionKey, err = encryptionKey(c.Path("encryption-key-file"))
+					if err != nil {
+						return err
+					}
+					if c.Bool("deep") {
+						app.StorageClass = types.StorageClassDeepArchive
+					}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					if c.Bool("dry-run") {
+						report, err := app.Verify(ctx)
+						if err != nil {
+							return err
+						}
+						printVerify(report)
+						return nil
+					}
+					report, err := app.Heal(ctx)
+					if report != nil {
+						printVerify(report.Verify)
+						for _, p := range report.Unrecoverable {
+							pterm.Error.Printfln("Unrecoverable, gone locally too: %s", p)
+						}
+						if len(report.Repaired) > 0 {
+							pterm.Success.Printfln("Repaired %d files.", len(report.Repaired))
+						}
+					}
+					return err
+				},
+			},
+			{
+				Name:  "prune",
+				Usage: "report the objects of synced files that are gone locally, and with --confirm delete them and forget the files",
+				Flags: append([]cli.Flag{
+					&cli.PathFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "The source (local) folder that was synced",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket that was synced to",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:     "confirm",
+						Usage:    "delete the objects, without it they are only reported",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), FolderPath: c.String("path"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner")}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					report, err := app.PruneDeleted(ctx, c.Bool("confirm"))
+					if err != nil {
+						return err
+					}
+					for _, p := range report.Files {
+						pterm.Info.Printfln("Gone locally: %s", p)
+					}
+					if report.Deleted {
+						pterm.Success.Printfln("Deleted %d objects of %d files, %d bytes.", len(report.Keys), len(report.Files), report.Bytes)
+					} else {
+						pterm.Info.Printfln("%d objects of %d files hold %d bytes, run again with --confirm to delete them.", len(report.Keys), len(report.Files), report.Bytes)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "catch-up",
+				Usage: "build the manifest from the objects already in the bucket, for a bucket filled by another tool or a lost manifest.db",
+				Flags: append([]cli.Flag{
+					&cli.PathFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "The source (local) folder the bucket holds",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket to catch up with",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "key-prefix",
+						Usage:    "the --key-prefix of the sync, only the objects under it are caught up with",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "relative-keys",
+						Usage:    "the objects were synced with --relative-keys",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), FolderPath: c.String("path"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner"), KeyPrefix: c.String("key-prefix"), RelativeKeys: c.Bool("relative-keys")}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					report, err := app.BuildManifestFromBucket(ctx)
+					if err != nil {
+						return err
+					}
+					for _, p := range report.Missing {
+						pterm.Warning.Printfln("In the bucket but not here: %s", p)
+					}
+					pterm.Success.Printfln("Adopted %d files, %d changed and will upload on the next sync, %d were already in the manifest.", len(report.Adopted), len(report.Pending), len(report.Known))
+					return nil
+				},
+			},
+			{
+				Name:  "prove",
+				Usage: "check that synced files can really be got back from the bucket, restoring archived objects first if need be",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket that was synced to",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:     "file",
+						Usage:    "a file path as it was synced. Can be specified multiple times.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "depth",
+						Usage:    "head checks the objects exist unchanged, sample compares the first bytes of each and full reads them back in full",
+						Value:    "head",
+						Required: false,
+					},
+					&cli.DurationFlag{
+						Name:     "poll",
+						Usage:    "how often to check on restores of archived objects",
+						Value:    15 * time.Minute,
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					depth, err := syncer.ParseProveDepth(c.String("depth"))
+					if err != nil {
+						return err
+					}
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner")}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					for _, p := range c.StringSlice("file") {
+						err = app.Prove(ctx, p, syncer.ProveOptions{Depth: depth, PollInterval: c.Duration("poll")})
+						if err != nil {
+							return err
+						}
+						pterm.Success.Printfln("Proven: %s", p)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "restorable",
+				Usage: "walk through downloading and reassembling synced files with HEAD requests only, to find pieces that are missing or wrong",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket that was synced to",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:     "file",
+						Usage:    "a file path as it was synced, every uploaded file if not given. Can be specified multiple times.",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner")}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					checks, err := app.ValidateRestore(ctx, c.StringSlice("file"))
+					if err != nil {
+						return err
+					}
+					broken := 0
+					for _, check := range checks {
+						if !check.Restorable() {
+							broken++
+							pterm.Error.Printfln("%s: %s", check.Path, strings.Join(check.Problems, "; "))
+							continue
+						}
+						if check.Archived > 0 {
+							pterm.Info.Printfln("Restorable after restoring %d archived objects: %s", check.Archived, check.Path)
+							continue
+						}
+						pterm.Success.Printfln("Restorable: %s (%d objects, %d bytes)", check.Path, check.Objects, check.Size)
+					}
+					if broken > 0 {
+						return fmt.Errorf("%d of %d files can't be restored: %w", broken, len(checks), syncer.ErrUnproven)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "fsck",
+				Usage: "re-hash the local files and check them against the manifest, without touching the bucket",
 				Flags: []cli.Flag{
 					&cli.PathFlag{
 						Name:     "path",
 						Aliases:  []string{"p"},
-						Usage:    "The source (local) folder to sync with S3",
+						Usage:    "The source (local) folder that was synced",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:     "filter",
+						Aliases:  []string{"f"},
+						Usage:    "files to check, like sync --filter. Should match the filters used to sync.",
+						Required: false,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					app := syncer.Syncer{FolderPath: c.String("path")}
+					err := app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					filters := c.StringSlice("filter")
+					if len(filters) == 0 {
+						filters = []string{""}
+					}
+					ctx, stop := interruptible()
+					defer stop()
+					report, err := app.Fsck(ctx, filters)
+					if err != nil {
+						return err
+					}
+					printFsck(report)
+					if !report.Clean() {
+						return fmt.Errorf("manifest does not match %s", app.FolderPath)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "transition",
+				Usage: "move the objects under a prefix to another storage class in place, without uploading them again",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket that was synced to",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "prefix",
+						Usage:    "only move keys under this prefix",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "class",
+						Usage:    "storage class to move the objects to, e.g. DEEP_ARCHIVE",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:     "requester-pays",
+						Usage:    "accept the request charges of a requester pays bucket",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), S3Client: client, RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner")}
+					class := types.StorageClass(strings.ToUpper(c.String("class")))
+					err = app.ValidateStorageClass(ctx, class)
+					if err != nil {
+						return err
+					}
+					err = app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					report, err := app.Transition(ctx, c.String("prefix"), class)
+					for _, key := range report.NeedsRestore {
+						pterm.Warning.Printfln("Needs a restore before it can be moved: %s", key)
+					}
+					pterm.Info.Printfln("Moved %d objects to %s, %d were already there.", len(report.Moved), class, len(report.Unchanged))
+					return err
+				},
+			},
+			{
+				Name:  "snapshots",
+				Usage: "list the snapshots kept by sync --snapshot",
+				Action: func(c *cli.Context) error {
+					app := syncer.Syncer{}
+					err := app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					snaps, err := app.Snapshots()
+					if err != nil {
+						return err
+					}
+					for _, s := range snaps {
+						fmt.Printf("%s  %d files\n", s.Name, s.Files)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "integrity",
+				Usage: "check manifest.db for damage, and repair it from a copy or by rebuilding it from the bucket",
+				Flags: append([]cli.Flag{
+					&cli.PathFlag{
+						Name:     "restore-from",
+						Usage:    "replace a damaged manifest with this copy of it",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "rebuild",
+						Usage:    "replace a damaged manifest with one built from the bucket, like catch-up. Needs --bucket and --path.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket to rebuild from",
+						Required: false,
+					},
+					&cli.PathFlag{
+						Name:     "path",
+						Aliases:  []string{"p"},
+						Usage:    "The source (local) folder the bucket holds",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					problems, err := syncer.CheckManifest("manifest.db", false)
+					if err != nil {
+						return err
+					}
+					if len(problems) == 0 {
+						pterm.Success.Println("manifest.db is sound.")
+						return nil
+					}
+					for _, p := range problems {
+						pterm.Error.Println(p)
+					}
+					switch {
+					case c.String("restore-from") != "":
+						aside, err := syncer.RestoreManifest("manifest.db", c.String("restore-from"))
+						if err != nil {
+							return err
+						}
+						pterm.Success.Printfln("Restored manifest.db from %s, the damaged one is %s.", c.String("restore-from"), aside)
+						return nil
+					case c.Bool("rebuild"):
+						if c.String("bucket") == "" || c.String("path") == "" {
+							return fmt.Errorf("--rebuild needs --bucket and --path")
+						}
+						ctx, stop := interruptible()
+						defer stop()
+						client, err := getAwsClient(ctx, clientOptions(c))
+						if err != nil {
+							return err
+						}
+						app := syncer.Syncer{Bucket: c.String("bucket"), FolderPath: c.String("path"), S3Client: client}
+						aside, report, err := app.RebuildManifest(ctx, "manifest.db")
+						if err != nil {
+							return err
+						}
+						defer app.Close()
+						pterm.Success.Printfln("Rebuilt manifest.db with %d files, %d will upload on the next sync. The damaged one is %s.", len(report.Adopted), len(report.Pending), aside)
+						return nil
+					}
+					return fmt.Errorf("manifest.db: %w", syncer.ErrCorruptManifest)
+				},
+			},
+			{
+				Name:  "diff",
+				Usage: "list the files added, removed and modified between two manifests, e.g. copies kept after two runs",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "old",
+						Usage:    "the earlier manifest",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:     "new",
+						Usage:    "the later manifest",
+						Value:    "manifest.db",
+						Required: false,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					diff, err := syncer.DiffManifests(c.String("old"), c.String("new"))
+					if err != nil {
+						return err
+					}
+					for _, f := range diff.Added {
+						fmt.Printf("+ %s  %d bytes\n", f.Path, f.NewSize)
+					}
+					for _, f := range diff.Removed {
+						fmt.Printf("- %s  %d bytes\n", f.Path, f.OldSize)
+					}
+					for _, f := range diff.Modified {
+						fmt.Printf("~ %s  %d -> %d bytes\n", f.Path, f.OldSize, f.NewSize)
+					}
+					fmt.Printf("%d added, %d removed, %d modified, %+d bytes\n", len(diff.Added), len(diff.Removed), len(diff.Modified), diff.Growth())
+					return nil
+				},
+			},
+			{
+				Name:  "manifest",
+				Usage: "export the manifest to JSON or import it, or share it through the bucket, to sync from another machine",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "export",
+						Usage: "write what the manifest knows of the bucket as JSON, for import on another machine or as a backup",
+						Flags: []cli.Flag{
+							&cli.PathFlag{
+								Name:     "out",
+								Aliases:  []string{"o"},
+								Usage:    "the file to write, stdout if not given",
+								Required: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							app := syncer.Syncer{}
+							err := app.InitDb("manifest.db")
+							if err != nil {
+								return err
+							}
+							defer app.Close()
+							if c.Path("out") == "" {
+								return app.ExportManifest(os.Stdout)
+							}
+							f, err := os.Create(c.Path("out"))
+							if err != nil {
+								return err
+							}
+							err = app.ExportManifest(f)
+							if err != nil {
+								f.Close()
+								return err
+							}
+							return f.Close()
+						},
+					},
+					{
+						Name:  "import",
+						Usage: "replace what the manifest knows of the bucket with an export, moving its paths under --path",
+						Flags: []cli.Flag{
+							&cli.PathFlag{
+								Name:     "in",
+								Aliases:  []string{"i"},
+								Usage:    "the exported manifest, stdin if not given",
+								Required: false,
+							},
+							&cli.PathFlag{
+								Name:     "path",
+								Aliases:  []string{"p"},
+								Usage:    "The source (local) folder the files are in on this machine, if not where they were exported from",
+								Required: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							var in io.Reader = os.Stdin
+							if c.Path("in") != "" {
+								f, err := os.Open(c.Path("in"))
+								if err != nil {
+									return err
+								}
+								defer f.Close()
+								in = f
+							}
+							app := syncer.Syncer{FolderPath: c.Path("path")}
+							err := app.InitDb("manifest.db")
+							if err != nil {
+								return err
+							}
+							defer app.Close()
+							return app.ImportManifest(in)
+						},
+					},
+					{
+						Name:  "push",
+						Usage: "upload the manifest to the bucket for the other machines syncing to it, see sync --shared-manifest",
+						Flags: manifestBucketFlags(),
+						Action: func(c *cli.Context) error {
+							return sharedManifest(c, func(ctx context.Context, app *syncer.Syncer) error {
+								err := app.PushManifest(ctx)
+								if err != nil {
+									return err
+								}
+								pterm.Success.Printfln("Pushed the manifest to %s.", app.Bucket)
+								return nil
+							})
+						},
+					},
+					{
+						Name:  "pull",
+						Usage: "replace the manifest with the one pushed to the bucket, if another machine pushed since",
+						Flags: manifestBucketFlags(),
+						Action: func(c *cli.Context) error {
+							return sharedManifest(c, func(ctx context.Context, app *syncer.Syncer) error {
+								pulled, err := app.PullManifest(ctx)
+								if err != nil {
+									return err
+								}
+								if pulled {
+									pterm.Success.Printfln("Pulled the manifest from %s.", app.Bucket)
+								} else {
+									pterm.Info.Println("The manifest is up to date.")
+								}
+								return nil
+							})
+						},
+					},
+				},
+			},
+			{
+				Name:  "estimate",
+				Usage: "estimate from the manifest what restoring archived objects costs and how long it takes at each retrieval tier",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:     "key",
+						Usage:    "an object key, or the key of a split file for all of its pieces. Can be specified multiple times.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "prefix",
+						Usage:    "estimate every object recorded under this prefix when no --key is given",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "tier",
+						Usage:    "only estimate this tier: Expedited, Standard or Bulk",
+						Required: false,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					tiers := []types.Tier{types.TierExpedited, types.TierStandard, types.TierBulk}
+					if t := c.String("tier"); t != "" {
+						if !slices.Contains(types.Tier("").Values(), types.Tier(t)) {
+							return fmt.Errorf("unknown tier %q, expected one of %v", t, types.Tier("").Values())
+						}
+						tiers = []types.Tier{types.Tier(t)}
+					}
+					app := syncer.Syncer{}
+					err := app.InitDb("manifest.db")
+					if err != nil {
+						return err
+					}
+					defer app.Close()
+					for _, tier := range tiers {
+						est, err := app.EstimateRestore(c.StringSlice("key"), c.String("prefix"), tier)
+						if err != nil {
+							return err
+						}
+						printEstimate(est)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "lifecycle",
+				Usage: "print (and optionally apply) a bucket lifecycle policy matching the sync settings",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "bucket",
 						Aliases:  []string{"b"},
-						Usage:    "The name of the bucket to sysnc to",
+						Usage:    "The name of the bucket the policy is for",
 						Required: true,
 					},
-					&cli.StringSliceFlag{
-						Name:     "filter",
-						Aliases:  []string{"f"},
-						Usage:    "file types to filter for. Can be specified multiple times for multiple file types.",
+					&cli.StringFlag{
+						Name:     "prefix",
+						Usage:    "only apply the policy to keys under this prefix",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "transition-days",
+						Usage:    "transition objects to Deep Archive after this many days, 0 for never",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "expire-days",
+						Usage:    "expire objects after this many days, 0 for never",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "noncurrent-expire-days",
+						Usage:    "delete older versions in a versioned bucket this many days after they were replaced, 0 for never",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "abort-days",
+						Usage:    "abort incomplete multipart uploads after this many days",
+						Value:    7,
 						Required: false,
 					},
 					&cli.BoolFlag{
-						Name:     "deep",
-						Aliases:  []string{"d"},
-						Usage:    "deep archive in S3",
+						Name:     "apply",
+						Usage:    "apply the policy to the bucket instead of only printing it",
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+				}, clientFlags()...),
+				Action: func(c *cli.Context) error {
+					policy := syncer.GenerateLifecycle(syncer.LifecycleOptions{
+						Prefix:               c.String("prefix"),
+						TransitionDays:       int32(c.Int("transition-days")),
+						ExpireDays:           int32(c.Int("expire-days")),
+						NoncurrentExpireDays: int32(c.Int("noncurrent-expire-days")),
+						AbortIncompleteDays:  int32(c.Int("abort-days")),
+					})
+					out, err := json.MarshalIndent(policy, "", "  ")
+					if err != nil {
+						return err
+					}
+					fmt.Println(string(out))
+					if !c.Bool("apply") {
+						return nil
+					}
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), S3Client: client, ExpectedBucketOwner: c.String("expected-bucket-owner")}
+					return app.ApplyLifecycle(ctx, policy)
 				},
+			},
+			{
+				Name:  "ensure-bucket",
+				Usage: "create the bucket if it is missing and set up its versioning, lifecycle and default encryption",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "bucket",
+						Aliases:  []string{"b"},
+						Usage:    "The name of the bucket to set up",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:     "create",
+						Usage:    "create the bucket when it doesn't exist instead of failing",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "versioning",
+						Usage:    "turn on versioning, so overwritten and deleted objects are kept as older versions",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "prefix",
+						Usage:    "put the s3sync lifecycle rule for keys under this prefix. The rule is only put on the bucket when this or one of the day flags is given, other rules are kept",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "transition-days",
+						Usage:    "transition objects to Deep Archive after this many days, 0 for never",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "expire-days",
+						Usage:    "expire objects after this many days, 0 for never",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "noncurrent-expire-days",
+						Usage:    "delete older versions this many days after they were replaced, 0 for never",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:     "abort-days",
+						Usage:    "abort incomplete multipart uploads after this many days",
+						Value:    7,
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "sse",
+						Usage:    "default encryption of new objects: AES256, aws:kms or aws:kms:dsse, left as it is when not given",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "kms-key-id",
+						Usage:    "KMS key ID or ARN of the aws:kms default encryption",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "expected-bucket-owner",
+						Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+						Required: false,
+					},
+				}, clientFlags()...),
 				Action: func(c *cli.Context) error {
-					err := sync(c.String("bucket"), c.String("path"), c.StringSlice("filter"), c.Bool("deep"))
+					ctx, stop := interruptible()
+					defer stop()
+					client, err := getAwsClient(ctx, clientOptions(c))
+					if err != nil {
+						return err
+					}
+					app := syncer.Syncer{Bucket: c.String("bucket"), S3Client: client, ExpectedBucketOwner: c.String("expected-bucket-owner")}
+					opts := syncer.BucketOptions{
+						Create:     c.Bool("create"),
+						Region:     c.String("region"),
+						Versioning: c.Bool("versioning"),
+						Encryption: types.ServerSideEncryption(c.String("sse")),
+						KMSKeyID:   c.String("kms-key-id"),
+					}
+					// the lifecycle rule is only put when asked for, the bucket may have one set up by hand
+					if c.IsSet("prefix") || c.IsSet("transition-days") || c.IsSet("expire-days") || c.IsSet("noncurrent-expire-days") || c.IsSet("abort-days") {
+						opts.Lifecycle = &syncer.LifecycleOptions{
+							Prefix:               c.String("prefix"),
+							TransitionDays:       int32(c.Int("transition-days")),
+							ExpireDays:           int32(c.Int("expire-days")),
+							NoncurrentExpireDays: int32(c.Int("noncurrent-expire-days")),
+							AbortIncompleteDays:  int32(c.Int("abort-days")),
+						}
+					}
+					report, err := app.EnsureBucket(ctx, opts)
 					if err != nil {
 						return err
 					}
+					fmt.Printf("created: %v, versioning turned on: %v, lifecycle applied: %v, encryption set: %v\n", report.Created, report.Versioning, report.Lifecycle, report.Encryption)
 					return nil
 				},
 			},
 		},
 	}
+	bindEnv(app.Commands)
 	if err := app.Run(os.Args); err != nil {
 		fmt.Println(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCodes are what the process exits with for each failure category, so scripts can tell them apart.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{syncer.ErrPermission, 3},
+	{syncer.ErrNotFound, 4},
+	{syncer.ErrThrottled, 5},
+	{syncer.ErrTooLarge, 6},
+	{syncer.ErrFileChanged, 7},
+	{syncer.ErrSplitFailed, 8},
+	{syncer.ErrConflict, 9},
+	{syncer.ErrReconcile, 10},
+	{syncer.ErrUnproven, 11},
+	{syncer.ErrStalled, 12},
+	{syncer.ErrCorruptManifest, 13},
+	{syncer.ErrKeyTooLong, 14},
+	{syncer.ErrBadDigest, 15},
+	// interrupted, like a shell would report it
+	{context.Canceled, 130},
+}
+
+// exitCode returns the exit code for err, 1 for failures without a category.
+func exitCode(err error) int {
+	for _, c := range exitCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
 	}
+	return 1
 }
 
-func sync(bucket string, p string, filters []string, deep bool) error {
-	ctx := context.Background()
+func sync(app *syncer.Syncer, opts syncer.ClientOptions, filters []string, deep bool, resetQuarantine bool, pageSize int, reconcile bool, plan bool, apply int64, watch bool, remoteDiff bool) error {
+	ctx, stop := interruptible()
+	defer stop()
+	if app.DryRun && (plan || apply != 0 || resetQuarantine || watch) {
+		return errors.New("--dry-run leaves the manifest as it is, it can't be combined with --plan, --apply, --reset-quarantine or --watch")
+	}
+	if remoteDiff && (reconcile || watch || apply != 0) {
+		return errors.New("--remote-diff can't be combined with --reconcile, --watch or --apply")
+	}
+
+	client, err := getAwsClient(ctx, opts)
+	if err != nil {
+		return err
+	}
+	app.S3Client = client
+	// the accelerate endpoint turns down every request to a bucket without acceleration
+	if opts.Accelerate {
+		on, err := app.AccelerationEnabled(ctx)
+		if err != nil {
+			return err
+		}
+		if !on {
+			pterm.Warning.Printfln("Transfer Acceleration isn't enabled on %s, uploading through its regional endpoint.", app.Bucket)
+			app.WithoutAcceleration()
+		}
+	}
+	if events, ok := app.Events.(syncer.Publishers); ok {
+		for _, p := range events {
+			if sns, ok := p.(*syncer.SNSPublisher); ok {
+				sns.Credentials = client.Options().Credentials
+			}
+		}
+	}
 
-	client, err := getAwsClient(ctx)
+	if app.StorageClass != "" {
+		err = app.ValidateStorageClass(ctx, app.StorageClass)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rule := range app.ClassRules {
+		err = app.ValidateStorageClass(ctx, rule.Class)
+		if err != nil {
+			return err
+		}
+	}
+	err = app.ValidateEncryption(ctx)
 	if err != nil {
 		return err
 	}
 
-	app := syncer.Syncer{
-		Bucket:     bucket,
-		FolderPath: p,
-		S3Client:   client,
+	// A damaged manifest would make for wrong diffs
+	err = syncer.SoundManifest("manifest.db")
+	if err != nil {
+		return fmt.Errorf("%w, repair it with s3sync integrity first", err)
 	}
 
 	err = app.InitDb("manifest.db")
 	if err != nil {
 		return err
 	}
+	defer app.Close()
 
-	// get a list of the actual files in the folder
-	fileMap, err := app.WalkAndHash(filters)
-	if err != nil {
+	if resetQuarantine {
+		err = app.ResetQuarantine()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Start from what the other machines sharing the bucket uploaded
+	if app.SharedManifest && !watch {
+		pulled, err := app.PullManifest(ctx)
+		if err != nil {
+			return err
+		}
+		if pulled {
+			pterm.Info.Println("Pulled the manifest another machine pushed.")
+		}
+	}
+
+	// An approved plan uploads just what it lists, the walk and cleanup wait for the next sync
+	if apply != 0 {
+		stale, err := app.Apply(ctx, apply)
+		for _, p := range stale {
+			pterm.Warning.Printfln("%s changed since plan %d was made and was left out.", p, apply)
+		}
 		return err
 	}
 
-	// Update the manifest with any new or updated files
-	err = app.UpdateManifest(fileMap)
+	// Keep syncing as the files change until interrupted
+	if watch {
+		return app.Watch(ctx, filters, deep)
+	}
+
+	// A batch stopped by --max-files, --max-bytes or --max-duration carries on with the files still pending, the
+	// folders are walked again by the sync after the one that finishes it
+	cursor, err := app.BatchCursor()
 	if err != nil {
 		return err
 	}
+	batch := cursor != "" && !plan && !app.DryRun
+	var fileMap map[string]int64
+	if batch {
+		pterm.Info.Printfln("Carrying on with the batch stopped after %s, the folders are walked again once it is done.", cursor)
+	} else if remoteDiff {
+		// the bucket tells what is up already, the manifest is brought in line with it
+		_, err = app.DiffAgainstRemote(ctx, filters)
+		if err != nil {
+			return err
+		}
+	} else {
+		// get a list of the actual files in the folder
+		fileMap, err = app.WalkAndHash(ctx, filters)
+		if err != nil {
+			return err
+		}
 
-	// Get any items that has not been set as uploaded
-	uploads, err := app.GetUploadList()
+		// Update the manifest with any new or updated files
+		err = app.UpdateManifest(fileMap)
+		if err != nil {
+			return err
+		}
+	}
+
+	if plan {
+		p, err := app.Plan(deep)
+		if err != nil {
+			return err
+		}
+		printPlan(p)
+		return nil
+	}
+
+	// Upload any items that has not been set as uploaded, a page at a time if asked to
+	if pageSize > 0 {
+		err = app.UploadPending(ctx, pageSize, deep)
+	} else {
+		var uploads []string
+		uploads, err = app.GetUploadList()
+		if err == nil {
+			err = app.UploadDiffs(ctx, uploads, deep)
+		}
+	}
+	var failed *syncer.UploadErrors
+	if errors.As(err, &failed) {
+		for _, f := range failed.Failed {
+			pterm.Error.Printfln("%v", f)
+		}
+	}
+	if err != nil || app.DryRun {
+		return err
+	}
+
+	// Share what was uploaded with the other machines
+	if app.SharedManifest {
+		err = app.PushManifest(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Out of time or at the end of a batch, the snapshot, purge, checksums and reconcile wait for a run that
+	// finishes the upload after walking the folders
+	if n, _ := app.Remaining(); n > 0 || batch {
+		return nil
+	}
+
+	// Record the point in time copy
+	if app.Snapshot != "" {
+		n, err := app.RecordSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		pterm.Success.Printfln("Snapshot %s holds %d files.", app.Snapshot, n)
+	}
+
+	// Remove what was deleted locally longer ago than the retention
+	_, err = app.Purge(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Upload the files that need it
-	err = app.UploadDiffs(ctx, uploads, deep)
+	// Publish the checksums for tools that don't read the manifest
+	if app.ChecksumFile != "" {
+		n, err := app.WriteChecksums(ctx)
+		if err != nil {
+			return err
+		}
+		pterm.Success.Printfln("Wrote %d checksums to %s.", n, app.ChecksumFile)
+	}
+
+	// Let the user know about anything that keeps failing
+	quarantined, err := app.Quarantined()
 	if err != nil {
 		return err
 	}
+	for _, q := range quarantined {
+		pterm.Warning.Printfln("Quarantined after %d failures: %s", q.Failures, q.Path)
+	}
+
+	// Check that every local file made it into the bucket
+	if reconcile {
+		report, err := app.Reconcile(ctx, fileMap)
+		if err != nil {
+			return err
+		}
+		for _, k := range report.Missing {
+			pterm.Error.Printfln("Missing from the bucket: %s", k)
+		}
+		for _, k := range report.Unexpected {
+			pterm.Warning.Printfln("Not from any local file: %s", k)
+		}
+		return report.Err()
+	}
 
 	return nil
 }
 
-func getAwsClient(ctx context.Context) (*s3.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+// manifestBucketFlags are the flags of manifest push and pull.
+func manifestBucketFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "bucket",
+			Aliases:  []string{"b"},
+			Usage:    "The name of the bucket the manifest is shared through",
+			Required: true,
+		},
+		&cli.PathFlag{
+			Name:     "path",
+			Aliases:  []string{"p"},
+			Usage:    "The source (local) folder the files are in on this machine",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "key-prefix",
+			Usage:    "the --key-prefix of the sync, the manifest is kept under it",
+			Required: false,
+		},
+		&cli.BoolFlag{
+			Name:     "requester-pays",
+			Usage:    "accept the request charges of a requester pays bucket",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "expected-bucket-owner",
+			Usage:    "AWS account ID the bucket must belong to, S3 turns down every request if it belongs to anyone else",
+			Required: false,
+		},
+	}, clientFlags()...)
+}
+
+// clientFlags are the flags of every command that talks to S3, read back by clientOptions. They are made anew
+// for each command, so bindEnv and loadConfig set up the copy of that command only.
+func clientFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "profile",
+			Usage:    "aws config profile to use, including SSO and assume role profiles",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "region",
+			Usage:    "aws region of the bucket, overrides the profile and environment",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "endpoint-url",
+			Usage:    "URL of an S3 compatible store to use instead of AWS, e.g. MinIO, Backblaze B2 or Wasabi",
+			Required: false,
+		},
+		&cli.BoolFlag{
+			Name:     "path-style",
+			Usage:    "put the bucket in the URL path instead of the host name, for stores like self-hosted MinIO",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "proxy",
+			Usage:    "HTTP proxy to send all S3 traffic through",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "user-agent",
+			Usage:    "User-Agent suffix sent with every S3 request (default: s3sync/<version>)",
+			Required: false,
+		},
+	}
+}
+
+// uploadFlags are the clientFlags of a command that uploads files, with the --timeout of each upload.
+func uploadFlags() []cli.Flag {
+	return append(clientFlags(), &cli.DurationFlag{
+		Name:     "timeout",
+		Usage:    "give up on a single file upload after this long",
+		Value:    syncer.DefaultUploadTimeout,
+		Required: false,
+	})
+}
+
+// clientOptions are the syncer.ClientOptions of the clientFlags of a command, and of --accelerate where the
+// command has it.
+func clientOptions(c *cli.Context) syncer.ClientOptions {
+	return syncer.ClientOptions{
+		Profile:    c.String("profile"),
+		Region:     c.String("region"),
+		Endpoint:   c.String("endpoint-url"),
+		PathStyle:  c.Bool("path-style"),
+		Proxy:      c.String("proxy"),
+		UserAgent:  c.String("user-agent"),
+		Accelerate: c.Bool("accelerate"),
+	}
+}
+
+// sharedManifest runs f with a Syncer for the bucket and manifest of a manifest push or pull.
+func sharedManifest(c *cli.Context, f func(context.Context, *syncer.Syncer) error) error {
+	ctx, stop := interruptible()
+	defer stop()
+	client, err := getAwsClient(ctx, clientOptions(c))
+	if err != nil {
+		return err
+	}
+	app := syncer.Syncer{Bucket: c.String("bucket"), FolderPath: c.Path("path"), S3Client: client, KeyPrefix: c.String("key-prefix"), RequesterPays: c.Bool("requester-pays"), ExpectedBucketOwner: c.String("expected-bucket-owner")}
+	err = app.InitDb("manifest.db")
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+	return f(ctx, &app)
+}
+
+// writeSummary writes the summary of the sync that ended with runErr to the file p, or stdout for -.
+func writeSummary(app *syncer.Syncer, p string, runErr error) error {
+	if p == "-" {
+		return app.WriteSummary(os.Stdout, runErr)
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	err = app.WriteSummary(f, runErr)
 	if err != nil {
-		return nil, err
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// interruptible returns a context the first Ctrl-C or SIGTERM cancels, so the walk, the splits and the uploads
+// stop and clean up after themselves. A second one stops s3sync right away.
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// parseSource reads a --source value of the form folder[,prefix[,storage class]].
+func parseSource(v string) syncer.Source {
+	parts := strings.SplitN(v, ",", 3)
+	src := syncer.Source{FolderPath: parts[0]}
+	if len(parts) > 1 {
+		src.KeyPrefix = parts[1]
+	}
+	if len(parts) > 2 {
+		src.StorageClass = types.StorageClass(strings.ToUpper(parts[2]))
+	}
+	return src
+}
+
+// kmsContext is the Syncer.KMSEncryptionContext for the key=value pairs of --kms-context, nil for none.
+func kmsContext(pairs []string) (map[string]string, error) {
+	var res map[string]string
+	for _, v := range pairs {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("kms context %q: expected key=value", v)
+		}
+		if res == nil {
+			res = map[string]string{}
+		}
+		res[key] = value
 	}
+	return res, nil
+}
+
+// encryptionKey is the Syncer.EncryptionKey in the file of --encryption-key-file, nil without one.
+func encryptionKey(p string) ([]byte, error) {
+	if p == "" {
+		return nil, nil
+	}
+	return syncer.LoadKeyFile(p)
+}
+
+// targetParts is the Syncer.TargetParts for --adaptive-parts.
+func targetParts(adaptive bool) int {
+	if !adaptive {
+		return 0
+	}
+	return syncer.DefaultTargetParts
+}
+
+// getAwsClient builds the S3 client of a command from its clientOptions. Every command with clientFlags takes
+// --endpoint-url and --path-style from S3SYNC_ENDPOINT_URL and S3SYNC_PATH_STYLE too, see bindEnv, so one S3
+// compatible store can be set up for all.
+func getAwsClient(ctx context.Context, opts syncer.ClientOptions) (*s3.Client, error) {
+	return syncer.NewS3Client(ctx, opts)
+}
+
+// printFsck lists every problem Fsck found, grouped by kind.
+func printFsck(report *syncer.FsckReport) {
+	groups := []struct {
+		title string
+		paths []string
+	}{
+		{"Corrupt (changed without a new modification time)", report.Corrupt},
+		{"Modified since the last sync", report.Modified},
+		{"Missing locally", report.Missing},
+		{"Not in the manifest", report.Untracked},
+	}
+	for _, g := range groups {
+		if len(g.paths) == 0 {
+			continue
+		}
+		pterm.Warning.Printfln("%s: %d", g.title, len(g.paths))
+		for _, p := range g.paths {
+			fmt.Println("  " + p)
+		}
+	}
+	if len(report.Unhashed) > 0 {
+		pterm.Info.Printfln("%d files were uploaded before hashes were recorded, only their modification time was checked.", len(report.Unhashed))
+	}
+	if report.Clean() {
+		pterm.Success.Printfln("Checked %d files, the manifest matches.", report.Checked)
+	}
+}
+
+// printEstimate shows what a restore at one tier would cost and take.
+func printEstimate(est *syncer.RestoreEstimate) {
+	window := fmt.Sprintf("%s to %s", est.MinTime, est.MaxTime)
+	if est.MinTime == 0 {
+		window = fmt.Sprintf("within %s", est.MaxTime)
+	}
+	if est.Objects > 0 {
+		pterm.Info.Printfln("%s: %d objects, %d bytes, about $%.2f, readable %s.", est.Tier, est.Objects, est.Bytes, est.Cost, window)
+	}
+	if len(est.Unsupported) > 0 {
+		pterm.Warning.Printfln("%s: %d objects can't be restored at this tier.", est.Tier, len(est.Unsupported))
+	}
+	if len(est.Unknown) > 0 {
+		pterm.Warning.Printfln("%s: %d objects have no recorded size or storage class and are left out.", est.Tier, len(est.Unknown))
+	}
+	if est.Objects == 0 && len(est.Unsupported)+len(est.Unknown) == 0 {
+		pterm.Success.Printfln("%s: nothing to restore, %d objects are readable as they are.", est.Tier, len(est.Ready))
+	}
+}
+
+// printDoctor shows the outcome of every check Doctor ran.
+func printDoctor(report *syncer.DoctorReport) {
+	for _, c := range report.Checks {
+		switch {
+		case c.Skipped:
+			pterm.Info.Printfln("SKIP %s: %s", c.Name, c.Detail)
+		case c.Err != nil:
+			pterm.Error.Printfln("FAIL %s: %v", c.Name, c.Err)
+		default:
+			pterm.Success.Printfln("PASS %s: %s", c.Name, c.Detail)
+		}
+	}
+}
+
+// printPlan lists what a plan will upload and how to run it.
+func printPlan(p *syncer.UploadPlan) {
+	for _, f := range p.Files {
+		pterm.Info.Printfln("%-7s %s (%d bytes)", f.Action, f.Path, f.Size)
+	}
+	if len(p.Files) == 0 {
+		pterm.Success.Printfln("Plan %d has nothing to upload.", p.ID)
+		return
+	}
+	pterm.Success.Printfln("Plan %d uploads %d files, %d bytes. Run sync again with --apply %d to upload them.", p.ID, len(p.Files), p.Bytes(), p.ID)
+}
 
-	client := s3.NewFromConfig(cfg)
-	return client, nil
+// printVerify lists the objects Verify found broken.
+func printVerify(report *syncer.VerifyReport) {
+	rows := [][]string{{"Status", "Path or key"}}
+	for _, group := range []struct {
+		status string
+		paths  []string
+	}{
+		{"missing in the bucket", report.Missing},
+		{"changed in the bucket", report.Mismatched},
+		{"not in the manifest", report.Orphaned},
+		{"gone locally", report.Gone},
+		{"modified locally", report.Modified},
+	} {
+		for _, p := range group.paths {
+			rows = append(rows, []string{group.status, p})
+		}
+	}
+	if len(rows) > 1 {
+		pterm.DefaultTable.WithHasHeader().WithData(rows).Render()
+	}
+	if len(report.Missing)+len(report.Mismatched) == 0 {
+		pterm.Success.Printfln("Checked %d files, the bucket matches.", report.Checked)
+		return
+	}
+	pterm.Warning.Printfln("Checked %d files: %d OK, %d missing, %d changed in the bucket.", report.Checked, report.OK(), len(report.Missing), len(report.Mismatched))
 }
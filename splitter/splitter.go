@@ -1,56 +1,241 @@
 package splitter
 
 import (
+	"context"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
-const chunkSize = 2 * 1024 * 1024 * 1024 // 2GB
+// MaxPieceSize is the biggest piece SplitFile writes.
+const MaxPieceSize = 2 * 1024 * 1024 * 1024 // 2GB
 
+// copyStep is how much of a piece is copied between two looks at the context of SplitFileContext.
+const copyStep = 16 * 1024 * 1024
+
+// SplitFile splits filePath into 2GB pieces, see SplitFileSize.
 func SplitFile(filePath string, progress chan string, retErr chan error) {
+	SplitFileSize(filePath, MaxPieceSize, progress, retErr)
+}
+
+// SplitFileSize splits filePath into pieces of at most size bytes in a new temp folder.
+// Each piece path is sent on progress as it is written, then nil or the error that stopped it is sent on retErr.
+func SplitFileSize(filePath string, size int64, progress chan string, retErr chan error) {
+	SplitFileContext(context.Background(), filePath, size, progress, retErr)
+}
+
+// SplitFileContext is SplitFileSize stopping as soon as ctx is done, with the error of ctx sent on retErr. The
+// temp folder is removed then, with the pieces written so far and the one that was cut short.
+func SplitFileContext(ctx context.Context, filePath string, size int64, progress chan string, retErr chan error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		retErr <- err
+		return
 	}
 	defer file.Close()
 
 	var chunkIndex int
-	buffer := make([]byte, chunkSize)
 	tmpDir, err := os.MkdirTemp("", "s3sync")
 	if err != nil {
 		retErr <- err
+		return
 	}
+	// pieces are streamed rather than buffered, so big piece sizes don't need the memory to match
 	for {
-		n, err := file.Read(buffer)
-		if n > 0 {
-
-			chunkFilePath := fmt.Sprintf("%s.part%d", filepath.Base(filePath), chunkIndex)
-			chunkFilePath = filepath.Join(tmpDir, chunkFilePath)
-			chunkFile, err := os.Create(chunkFilePath)
-			if err != nil {
-				retErr <- fmt.Errorf("failed to create chunk file: %v", err)
-			}
-			_, err = chunkFile.Write(buffer[:n])
-			chunkFile.Close()
-			if err != nil {
-				retErr <- fmt.Errorf("failed to write chunk file: %v", err)
-			}
-
-			progress <- chunkFilePath
-			chunkIndex++
+		chunkFilePath := fmt.Sprintf("%s.part%d", filepath.Base(filePath), chunkIndex)
+		chunkFilePath = filepath.Join(tmpDir, chunkFilePath)
+		chunkFile, err := os.Create(chunkFilePath)
+		if err != nil {
+			retErr <- fmt.Errorf("failed to create chunk file: %v", err)
+			return
 		}
-		if err == io.EOF {
+		n, err := copyChunk(ctx, chunkFile, file, size)
+		closeErr := chunkFile.Close()
+		if ctx.Err() != nil {
+			os.RemoveAll(tmpDir)
+			retErr <- ctx.Err()
+			return
+		}
+		if err != nil && err != io.EOF {
+			retErr <- fmt.Errorf("failed to write chunk file: %v", err)
+			return
+		}
+		if closeErr != nil {
+			retErr <- fmt.Errorf("failed to write chunk file: %v", closeErr)
+			return
+		}
+		if n == 0 {
+			os.Remove(chunkFilePath)
 			break
 		}
-		if err != nil {
-			retErr <- fmt.Errorf("failed to read file: %v", err)
+		select {
+		case progress <- chunkFilePath:
+		case <-ctx.Done():
+			os.RemoveAll(tmpDir)
+			retErr <- ctx.Err()
+			return
+		}
+		chunkIndex++
+		if n < size {
+			break
 		}
 	}
 	retErr <- nil
 }
 
+// Options tunes SplitFileOptions.
+type Options struct {
+	// Size is the biggest piece, MaxPieceSize when 0.
+	Size int64
+	// Concurrency is how many pieces are written at once, one after another when 0 or 1.
+	Concurrency int
+	// Hash, when set, sums every piece as it is written, see Piece.Sum.
+	Hash func() hash.Hash
+}
+
+// Piece is a piece written by SplitFileOptions.
+type Piece struct {
+	Path   string
+	Index  int
+	Offset int64
+	Size   int64
+	// Sum is the Options.Hash of the piece, nil without one.
+	Sum []byte
+}
+
+// SplitFileOptions is SplitFileContext writing up to opts.Concurrency pieces at once, each read from its own
+// offset of filePath so a big file doesn't have to be read front to back, and summing them on the way. The
+// pieces are still sent on progress in order.
+func SplitFileOptions(ctx context.Context, filePath string, opts Options, progress chan Piece, retErr chan error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		retErr <- err
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		retErr <- err
+		return
+	}
+	size := opts.Size
+	if size <= 0 {
+		size = MaxPieceSize
+	}
+	tmpDir, err := os.MkdirTemp("", "s3sync")
+	if err != nil {
+		retErr <- err
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	count := int((info.Size() + size - 1) / size)
+	type written struct {
+		piece Piece
+		err   error
+	}
+	results := make([]chan written, count)
+	var wg sync.WaitGroup
+	fail := func(err error) {
+		cancel()
+		wg.Wait()
+		os.RemoveAll(tmpDir)
+		retErr <- err
+	}
+	// send waits for piece i and hands it on, false when it or ctx failed
+	send := func(i int) bool {
+		res := <-results[i]
+		if res.err == nil && ctx.Err() != nil {
+			res.err = ctx.Err()
+		}
+		if res.err != nil {
+			fail(res.err)
+			return false
+		}
+		select {
+		case progress <- res.piece:
+			return true
+		case <-ctx.Done():
+			fail(ctx.Err())
+			return false
+		}
+	}
+	workers := max(opts.Concurrency, 1)
+	next := 0
+	for i := 0; i < count; i++ {
+		// at most workers pieces in flight, the sends keep them in order
+		for i-next >= workers {
+			if !send(next) {
+				return
+			}
+			next++
+		}
+		results[i] = make(chan written, 1)
+		piece := Piece{Path: filepath.Join(tmpDir, fmt.Sprintf("%s.part%d", filepath.Base(filePath), i)), Index: i, Offset: int64(i) * size, Size: min(size, info.Size()-int64(i)*size)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := writePiece(ctx, file, &piece, opts.Hash)
+			results[piece.Index] <- written{piece, err}
+		}()
+	}
+	for ; next < count; next++ {
+		if !send(next) {
+			return
+		}
+	}
+	retErr <- nil
+}
+
+// writePiece copies piece.Size bytes from piece.Offset of file to piece.Path, setting piece.Sum with newHash.
+func writePiece(ctx context.Context, file *os.File, piece *Piece, newHash func() hash.Hash) error {
+	out, err := os.Create(piece.Path)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk file: %v", err)
+	}
+	var w io.Writer = out
+	var h hash.Hash
+	if newHash != nil {
+		h = newHash()
+		w = io.MultiWriter(out, h)
+	}
+	_, err = copyChunk(ctx, w, io.NewSectionReader(file, piece.Offset, piece.Size), piece.Size)
+	closeErr := out.Close()
+	if err == io.EOF {
+		return fmt.Errorf("%s got shorter while it was split", file.Name())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write chunk file: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to write chunk file: %v", closeErr)
+	}
+	if h != nil {
+		piece.Sum = h.Sum(nil)
+	}
+	return nil
+}
+
+// copyChunk is io.CopyN in steps of copyStep, stopping with the error of ctx once it is done.
+func copyChunk(ctx context.Context, dst io.Writer, src io.Reader, size int64) (int64, error) {
+	var written int64
+	for written < size {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := io.CopyN(dst, src, min(copyStep, size-written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
 func RecombineFile(partPrefix string) (string, error) {
 
 	combinedFile, err := os.Create(partPrefix)
@@ -81,11 +266,12 @@ func RecombineFile(partPrefix string) (string, error) {
 	return partPrefix, nil
 }
 
+// CleanUp removes the temp folder that holds the pieces in objs.
 func CleanUp(objs []string) error {
 	if len(objs) < 1 {
 		return fmt.Errorf("nothing to clean up")
 	}
-	folder := filepath.Base(objs[0])
+	folder := filepath.Dir(objs[0])
 	err := os.RemoveAll(folder)
 	if err != nil {
 		return err
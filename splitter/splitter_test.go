@@ -1,16 +1,31 @@
 package splitter
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestSplitFile(t *testing.T) {
 	org := "X:\\shows\\Battlestar Galactica (2004)\\Season 4\\Battlestar Galactica (2003)  S04e19e20  Daybreak (1080P Bluray X265 Rzerox)-1.mp4"
-	res, err := SplitFile(org)
-	if err != nil {
-		t.Fatal(err)
+	progress := make(chan string)
+	retErr := make(chan error)
+	go SplitFile(org, progress, retErr)
+	var res []string
+	for {
+		select {
+		case piece := <-progress:
+			res = append(res, piece)
+		case err := <-retErr:
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Fatalf("Success: %s", res)
+		}
 	}
-	t.Fatalf("Success: %s", res)
 
 }
 
@@ -23,3 +38,46 @@ func TestRecombineFile(t *testing.T) {
 	t.Fatal(res)
 
 }
+
+func TestSplitFileOptions(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "big.bin")
+	data := make([]byte, 10_000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	os.WriteFile(p, data, 0644)
+
+	progress := make(chan Piece)
+	retErr := make(chan error)
+	go SplitFileOptions(context.Background(), p, Options{Size: 3000, Concurrency: 3, Hash: sha256.New}, progress, retErr)
+	var pieces []Piece
+	for done := false; !done; {
+		select {
+		case piece := <-progress:
+			pieces = append(pieces, piece)
+		case err := <-retErr:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		}
+	}
+	defer CleanUp([]string{pieces[0].Path})
+	if len(pieces) != 4 {
+		t.Fatalf("pieces = %+v", pieces)
+	}
+	for i, piece := range pieces {
+		want := data[piece.Offset : piece.Offset+piece.Size]
+		got, err := os.ReadFile(piece.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(want)
+		if piece.Index != i || piece.Offset != int64(i)*3000 || !bytes.Equal(got, want) || !bytes.Equal(piece.Sum, sum[:]) {
+			t.Fatalf("piece %d = %+v", i, piece)
+		}
+	}
+	if pieces[3].Size != 1000 {
+		t.Fatalf("last piece is %d bytes", pieces[3].Size)
+	}
+}
@@ -0,0 +1,33 @@
+package syncer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// AccelerationEnabled tells whether the bucket has Transfer Acceleration enabled. Every request to the
+// s3-accelerate endpoint fails when it hasn't, so check it before syncing with ClientOptions.Accelerate.
+func (app *Syncer) AccelerationEnabled(ctx context.Context) (bool, error) {
+	out, err := app.S3Client.GetBucketAccelerateConfiguration(ctx, &s3.GetBucketAccelerateConfigurationInput{
+		Bucket:              aws.String(app.Bucket),
+		ExpectedBucketOwner: app.bucketOwner(),
+		RequestPayer:        (&S3Store{RequesterPays: app.RequesterPays}).payer(),
+	}, func(o *s3.Options) {
+		// the accelerate endpoint only serves object requests
+		o.UseAccelerate = false
+	})
+	if err != nil {
+		return false, err
+	}
+	return out.Status == types.BucketAccelerateStatusEnabled, nil
+}
+
+// WithoutAcceleration switches S3Client back to the regional endpoint of the bucket.
+func (app *Syncer) WithoutAcceleration() {
+	app.S3Client = s3.New(app.S3Client.Options(), func(o *s3.Options) {
+		o.UseAccelerate = false
+	})
+}
@@ -0,0 +1,203 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// AdoptReport is what BuildManifestFromBucket found in the bucket.
+type AdoptReport struct {
+	// Adopted files match their objects and are recorded as uploaded.
+	Adopted []string
+	// Pending files differ in size from their objects and are recorded to be uploaded again.
+	Pending []string
+	// Missing are the local paths of objects with no local file, they are left out of the manifest.
+	Missing []string
+	// Known files were already in the manifest and left alone.
+	Known []string
+}
+
+// BuildManifestFromBucket records the files already in the bucket in the manifest, for a bucket filled by some
+// other tool or a lost manifest, so the next sync only uploads what changed. Every object is looked up with a
+// HEAD. Its local file comes from the srcpath metadata when it has it, so split files are put back together,
+// otherwise from its key the way the sync maps keys. A file whose size matches its objects is taken as
+// uploaded, with the local modification time.
+func (app *Syncer) BuildManifestFromBucket(ctx context.Context) (*AdoptReport, error) {
+	if err := app.needSQLite("BuildManifestFromBucket"); err != nil {
+		return nil, err
+	}
+	objs, err := app.store().List(ctx, app.KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]ObjectInfo{}
+	for _, o := range objs {
+		info, err := app.store().Head(ctx, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := app.adoptPath(info)
+		if ok {
+			files[p] = append(files[p], info)
+		}
+	}
+
+	report := &AdoptReport{}
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		err = app.adoptFile(p, files[p], report)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// adoptPath works out the local file the object info holds, false if it belongs to no source.
+func (app *Syncer) adoptPath(info ObjectInfo) (string, bool) {
+	if !strings.HasPrefix(info.Key, app.KeyPrefix) || info.Key == app.manifestKey() {
+		return "", false
+	}
+	key := strings.TrimPrefix(info.Key, app.KeyPrefix)
+	var candidates []Source
+	for _, src := range app.sources() {
+		if prefix, _ := app.sourcePrefix(src); strings.HasPrefix(key, prefix) {
+			candidates = append(candidates, src)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	if rel, ok := info.Metadata[MetaSrcPath]; ok {
+		if strings.Contains(rel, "%") {
+			if unescaped, err := url.PathUnescape(rel); err == nil {
+				rel = unescaped
+			}
+		}
+		// with several sources that could have it, the one that has the file wins
+		for _, src := range candidates {
+			p := filepath.Join(src.FolderPath, filepath.FromSlash(rel))
+			if _, err := os.Stat(p); err == nil {
+				return p, true
+			}
+		}
+		return filepath.Join(candidates[0].FolderPath, filepath.FromSlash(rel)), true
+	}
+	for _, src := range candidates {
+		if prefix, relative := app.sourcePrefix(src); relative {
+			return filepath.Join(src.FolderPath, filepath.FromSlash(strings.TrimPrefix(key, prefix))), true
+		}
+	}
+	p := app.localize(key)
+	if _, ok := app.sourceFor(p); !ok && strings.HasSuffix(app.KeyPrefix, "/") {
+		// prefixKey took the slash of an absolute path
+		p = app.localize("/" + key)
+	}
+	_, ok := app.sourceFor(p)
+	return p, ok
+}
+
+// adoptFile records the file p held by objs, the pieces of a split file when there are several.
+func (app *Syncer) adoptFile(p string, objs []ObjectInfo, report *AdoptReport) error {
+	_, err := app.getStatus(p)
+	if err == nil {
+		report.Known = append(report.Known, p)
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	local, err := os.Stat(p)
+	if err != nil {
+		report.Missing = append(report.Missing, p)
+		return nil
+	}
+	sort.Slice(objs, func(i, j int) bool { return naturalLess(objs[i].Key, objs[j].Key) })
+	var size int64
+	for _, o := range objs {
+		size += o.Size
+	}
+	status, uploaded := StatusComplete, 1
+	if size != local.Size() {
+		status, uploaded = StatusPending, 0
+	}
+	key := objs[0].Key
+	multipart := 0
+	if len(objs) > 1 {
+		key, multipart = app.objectKey(p), 1
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(INSERTADOPTED, p, local.ModTime().Unix(), key, uploaded, multipart, status, size)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if multipart == 1 {
+		var offset int64
+		for i, o := range objs {
+			_, err = tx.Exec(INSERTADOPTEDPART, id, o.Key, o.Key, i, offset, o.Size)
+			offset += o.Size
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		err = app.recordETag(o.Key, o.ETag, types.StorageClass(o.StorageClass))
+		if err != nil {
+			return err
+		}
+	}
+	if status == StatusPending {
+		report.Pending = append(report.Pending, p)
+	} else {
+		report.Adopted = append(report.Adopted, p)
+	}
+	return nil
+}
+
+// digits splits keys into text and numbers for naturalLess.
+var digits = regexp.MustCompile(`\d+|\D+`)
+
+// naturalLess orders keys with the numbers in them compared by value, so movie.part10 comes after movie.part9.
+func naturalLess(a, b string) bool {
+	as, bs := digits.FindAllString(a, -1), digits.FindAllString(b, -1)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aErr := strconv.ParseUint(as[i], 10, 64)
+		bn, bErr := strconv.ParseUint(bs[i], 10, 64)
+		if aErr == nil && bErr == nil && an != bn {
+			return an < bn
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
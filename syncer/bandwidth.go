@@ -0,0 +1,118 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk is the most a limited read takes at once, so the uploads sharing a bandwidth take turns in
+// small steps instead of one of them waiting out a whole buffer.
+const bandwidthChunk = 32 << 10
+
+// bandwidth is a token bucket of bytes shared by every upload of a run, see Syncer.MaxBytesPerSecond. It holds
+// at most a second's worth, so a pause doesn't turn into a burst over the limit afterwards.
+type bandwidth struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newBandwidth is a bandwidth of rate bytes per second, nil for no limit.
+func newBandwidth(rate int64) *bandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidth{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n bytes out of b, waiting until they would have been sent at the rate or ctx is done. Uploads
+// going up at once queue behind each other's debt, so together they keep to the rate.
+func (b *bandwidth) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate) - float64(n)
+	b.last = now
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader reads r no faster than b allows.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *bandwidth
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p[:min(len(p), bandwidthChunk)])
+	if n > 0 {
+		if waitErr := l.b.wait(l.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Seek lets the SDK work out the length of r, and a retry start over, like stallReader.
+func (l *limitedReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := l.r.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("body can't seek")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+// limitedReaderAt is limitedReader for the parts of a multipart upload.
+type limitedReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+	b   *bandwidth
+}
+
+func (l *limitedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		n, err := l.r.ReadAt(p[read:min(len(p), read+bandwidthChunk)], off+int64(read))
+		read += n
+		if n > 0 {
+			if waitErr := l.b.wait(l.ctx, n); waitErr != nil {
+				return read, waitErr
+			}
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// limited is body read no faster than MaxBytesPerSecond across the run, body itself without a limit.
+func (app *Syncer) limited(ctx context.Context, body io.Reader) io.Reader {
+	if app.bandwidth == nil {
+		return body
+	}
+	return &limitedReader{ctx: ctx, r: body, b: app.bandwidth}
+}
+
+// limitedAt is limited for an io.ReaderAt.
+func (app *Syncer) limitedAt(ctx context.Context, body io.ReaderAt) io.ReaderAt {
+	if app.bandwidth == nil {
+		return body
+	}
+	return &limitedReaderAt{ctx: ctx, r: body, b: app.bandwidth}
+}
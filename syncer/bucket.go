@@ -0,0 +1,137 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// BucketOptions describes how EnsureBucket sets up the bucket for syncing to.
+type BucketOptions struct {
+	// Create makes the bucket in Region when it doesn't exist, the region of S3Client when Region is empty.
+	// Without it a missing bucket fails with ErrNotFound.
+	Create bool
+	Region string
+	// Versioning turns on versioning, so objects that are overwritten or deleted are kept as older versions.
+	// It can't be turned off again once on, only suspended, so EnsureBucket never does.
+	Versioning bool
+	// Lifecycle, when set, puts the rule GenerateLifecycle makes of it on the bucket, see ApplyLifecycle. The
+	// other lifecycle rules of the bucket are left alone, and without it so is the rule.
+	Lifecycle *LifecycleOptions
+	// Encryption and KMSKeyID are the default encryption of new objects, AES256, aws:kms or aws:kms:dsse, empty
+	// to leave it as it is. KMSKeyID is only for the aws:kms ones, the bucket key is enabled with them.
+	Encryption types.ServerSideEncryption
+	KMSKeyID   string
+}
+
+// BucketReport is what EnsureBucket changed.
+type BucketReport struct {
+	Created    bool
+	Versioning bool
+	Lifecycle  bool
+	Encryption bool
+}
+
+// EnsureBucket makes sure the bucket exists and is set up like opts says, creating it and turning on versioning
+// only when needed. It can be run before every sync: the lifecycle rule and encryption it is given are put again
+// each time, so the bucket ends up with them even when they were changed from the console, and what opts leaves
+// out is left as it is.
+func (app *Syncer) EnsureBucket(ctx context.Context, opts BucketOptions) (*BucketReport, error) {
+	report := &BucketReport{}
+	_, err := app.S3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(app.Bucket), ExpectedBucketOwner: app.bucketOwner()})
+	if err != nil {
+		if classify(err) != ErrNotFound {
+			return report, err
+		}
+		if !opts.Create {
+			return report, fmt.Errorf("bucket %s: %w", app.Bucket, ErrNotFound)
+		}
+		err = app.createBucket(ctx, opts.Region)
+		if err != nil {
+			return report, err
+		}
+		report.Created = true
+	}
+	if opts.Versioning {
+		report.Versioning, err = app.enableVersioning(ctx)
+		if err != nil {
+			return report, err
+		}
+	}
+	if opts.Lifecycle != nil {
+		err = app.ApplyLifecycle(ctx, GenerateLifecycle(*opts.Lifecycle))
+		if err != nil {
+			return report, err
+		}
+		report.Lifecycle = true
+	}
+	if opts.Encryption != "" {
+		err = app.putEncryption(ctx, opts.Encryption, opts.KMSKeyID)
+		if err != nil {
+			return report, err
+		}
+		report.Encryption = true
+	}
+	return report, nil
+}
+
+// createBucket creates the bucket in region, the one of S3Client when it is empty.
+func (app *Syncer) createBucket(ctx context.Context, region string) error {
+	if region == "" {
+		region = app.S3Client.Options().Region
+	}
+	in := &s3.CreateBucketInput{Bucket: aws.String(app.Bucket)}
+	// us-east-1 is the default location and can't be asked for
+	if region != "" && region != "us-east-1" {
+		in.CreateBucketConfiguration = &types.CreateBucketConfiguration{LocationConstraint: types.BucketLocationConstraint(region)}
+	}
+	_, err := app.S3Client.CreateBucket(ctx, in, func(o *s3.Options) {
+		o.Region = region
+	})
+	var owned *types.BucketAlreadyOwnedByYou
+	if errors.As(err, &owned) {
+		// created by someone else in the meantime
+		return nil
+	}
+	return err
+}
+
+// enableVersioning turns on versioning of the bucket and reports whether it wasn't already.
+func (app *Syncer) enableVersioning(ctx context.Context) (bool, error) {
+	out, err := app.S3Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(app.Bucket), ExpectedBucketOwner: app.bucketOwner()})
+	if err != nil {
+		return false, err
+	}
+	if out.Status == types.BucketVersioningStatusEnabled {
+		return false, nil
+	}
+	_, err = app.S3Client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+		Bucket:                  aws.String(app.Bucket),
+		VersioningConfiguration: &types.VersioningConfiguration{Status: types.BucketVersioningStatusEnabled},
+		ExpectedBucketOwner:     app.bucketOwner(),
+	})
+	return err == nil, err
+}
+
+// putEncryption sets the default encryption of the bucket to algorithm, under kmsKeyID for the KMS ones.
+func (app *Syncer) putEncryption(ctx context.Context, algorithm types.ServerSideEncryption, kmsKeyID string) error {
+	rule := types.ServerSideEncryptionRule{ApplyServerSideEncryptionByDefault: &types.ServerSideEncryptionByDefault{SSEAlgorithm: algorithm}}
+	if algorithm != types.ServerSideEncryptionAes256 {
+		if kmsKeyID != "" {
+			rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID = aws.String(kmsKeyID)
+		}
+		rule.BucketKeyEnabled = aws.Bool(true)
+	} else if kmsKeyID != "" {
+		return fmt.Errorf("a KMS key only goes with aws:kms encryption, not %s", algorithm)
+	}
+	_, err := app.S3Client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+		Bucket:                            aws.String(app.Bucket),
+		ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{Rules: []types.ServerSideEncryptionRule{rule}},
+		ExpectedBucketOwner:               app.bucketOwner(),
+	})
+	return err
+}
@@ -0,0 +1,84 @@
+package syncer
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// caseCollisions finds the files of objs whose keys differ only in case, like Photo.JPG and photo.jpg, which
+// overwrite each other on a case-insensitive filesystem or store. Each group is warned about, and with
+// RenameCollisions every file but the first keeps its own object under a caseKey recorded in the manifest.
+// The file already uploaded under the shared key is the one kept, so nothing goes up again needlessly.
+func (app *Syncer) caseCollisions(objs map[string]int64) ([][]string, error) {
+	groups := map[string][]string{}
+	for p := range objs {
+		key, err := app.keyFor(p)
+		if err != nil {
+			return nil, err
+		}
+		folded := strings.ToLower(key)
+		groups[folded] = append(groups[folded], p)
+	}
+	var found [][]string
+	for folded, paths := range groups {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		keep, err := app.uploadedOf(paths)
+		if err != nil {
+			return nil, err
+		}
+		paths[0], paths[keep] = paths[keep], paths[0]
+		found = append(found, paths)
+		if !app.RenameCollisions {
+			if !app.NoSpinners {
+				app.term().warning().Printfln("%s have keys that differ only in case, one overwrites the others on a case-insensitive restore. See --rename-collisions.", strings.Join(paths, ", "))
+			}
+			continue
+		}
+		n := 1
+		for _, p := range paths[1:] {
+			key, err := app.keyFor(p)
+			if err != nil {
+				return nil, err
+			}
+			for ; groups[strings.ToLower(caseKey(key, n))] != nil; n++ {
+			}
+			renamed := caseKey(key, n)
+			groups[strings.ToLower(renamed)] = []string{p}
+			err = app.records().RenameKey(p, renamed)
+			if err != nil {
+				return nil, err
+			}
+			if !app.NoSpinners {
+				app.term().warning().Printfln("%s: its key differs only in case from %s, it goes up as %s.", p, paths[0], renamed)
+			}
+		}
+		groups[folded] = paths[:1]
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i][0] < found[j][0] })
+	return found, nil
+}
+
+// uploadedOf returns the index of the first of paths that is uploaded, 0 if none is.
+func (app *Syncer) uploadedOf(paths []string) (int, error) {
+	for i, p := range paths {
+		rec, _, err := app.records().Get(p)
+		if err != nil {
+			return 0, err
+		}
+		if rec.Uploaded {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+// caseKey is key with ~n before its extension, so photo.jpg becomes photo~1.jpg.
+func caseKey(key string, n int) string {
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + "~" + strconv.Itoa(n) + ext
+}
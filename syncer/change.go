@@ -0,0 +1,125 @@
+package syncer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Change detection is layered to keep both re-uploads and hashing down. A file whose modification time matches
+// the manifest is skipped without a look. Otherwise a different size means it changed, and only when the size is
+// the same is the file hashed and compared with the hash recorded at upload, so a touched but identical file
+// does not go up again. With Syncer.ContentOnly the modification time is not trusted at all, every file is
+// compared with its recorded hash on every sync, and with Syncer.HashSkewed only the files whose time a clock
+// jump made implausible are. Syncer.HashMode picks the same by name, along with the hash.
+
+// HashMode is how UpdateManifest tells a file changed.
+type HashMode string
+
+const (
+	// HashModTime trusts the modification time and hashes only files whose time changed but size didn't.
+	HashModTime HashMode = "mtime"
+	// HashSHA256 compares every file by its SHA256, like ContentOnly.
+	HashSHA256 HashMode = "sha256"
+	// HashETag compares every file by its multipart ETag, see the ETag checksum, like ContentOnly.
+	HashETag HashMode = "etag"
+)
+
+// ParseHashMode reads a hash mode from its name: mtime, sha256 or etag.
+func ParseHashMode(s string) (HashMode, error) {
+	switch mode := HashMode(s); mode {
+	case "":
+		return HashModTime, nil
+	case HashModTime, HashSHA256, HashETag:
+		return mode, nil
+	}
+	return HashModTime, fmt.Errorf("unknown hash mode %q, want mtime, sha256 or etag", s)
+}
+
+// initHashMode sets Checksum for HashMode, a Checksum set to another hash is an error.
+func (app *Syncer) initHashMode() error {
+	var want Checksum
+	switch app.HashMode {
+	case "", HashModTime:
+		return nil
+	case HashSHA256:
+		want = SHA256
+	case HashETag:
+		want = ETag
+	default:
+		_, err := ParseHashMode(string(app.HashMode))
+		return err
+	}
+	if app.Checksum.New != nil && app.Checksum.Name != want.Name {
+		return fmt.Errorf("hash mode %s can't be used with the %s checksum", app.HashMode, app.Checksum.Name)
+	}
+	app.Checksum = want
+	return nil
+}
+
+// contentOnly reports whether every file is compared by content, see ContentOnly and HashMode.
+func (app *Syncer) contentOnly() bool {
+	return app.ContentOnly || app.HashMode == HashSHA256 || app.HashMode == HashETag
+}
+
+// sameContent reports whether the uploaded file p still has the size and hash recorded when it was uploaded.
+func (app *Syncer) sameContent(p string) (bool, error) {
+	size, hash, status, err := app.recordedContent(p)
+	if err != nil {
+		return false, err
+	}
+	if status != StatusComplete || hash == "" {
+		return false, nil
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != size {
+		return false, nil
+	}
+	sum, _, err := app.sumFile(p)
+	if err != nil {
+		return false, err
+	}
+	return sum == hash, nil
+}
+
+// recordedContent returns the size and hash recorded at upload and the status of p. The size is -1 and the
+// hash empty when they were never recorded.
+func (app *Syncer) recordedContent(p string) (int64, string, string, error) {
+	rec, ok, err := app.records().Get(p)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if !ok {
+		return -1, "", "", nil
+	}
+	return rec.Size, rec.SHA256, rec.Status, nil
+}
+
+// sumFile returns the hex sum in the Checksum of the manifest and the size of the file at p. A symlink or empty
+// directory uploaded as a marker object is summed by what the object holds, see markerContent.
+func (app *Syncer) sumFile(p string) (string, int64, error) {
+	content, marker, err := app.markerContent(p)
+	if err != nil {
+		return "", 0, err
+	}
+	if marker {
+		h := app.checksum().New()
+		io.WriteString(h, content)
+		return hex.EncodeToString(h.Sum(nil)), int64(len(content)), nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := app.checksum().New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,166 @@
+package syncer
+
+import (
+	"strings"
+)
+
+// checkpointBatch is how many walk results are buffered before they are written to the manifest.
+const checkpointBatch = 500
+
+// walkCheckpoint saves WalkAndHash progress in scratch tables so a crashed walk can resume. Directories are walked
+// in lexical order, so once the walk reaches a path outside a directory that directory is done. Done directories
+// are skipped on resume and their files come back from the scratch table. The scratch tables are cleared by
+// UpdateManifest, so a crash between the walk and the manifest update doesn't lose the walk either.
+type walkCheckpoint struct {
+	app   *Syncer
+	done  map[string]bool
+	open  []string
+	files []walkEntry
+	dirs  []string
+}
+
+type walkEntry struct {
+	path string
+	mod  int64
+	size int64
+}
+
+// startCheckpoint returns the checkpoint for a walk of roots with filters, nil unless CheckpointWalk is set
+// and DryRun is not.
+// A checkpoint left by a walk with other settings is thrown away.
+func (app *Syncer) startCheckpoint(roots []string, filters []string) (*walkCheckpoint, error) {
+	if !app.CheckpointWalk || app.DryRun {
+		return nil, nil
+	}
+	signature := strings.Join(roots, "\x00") + "\x01" + strings.Join(filters, "\x00") + "\x01" + strings.Join(app.IncludeDirs, "\x00")
+	var saved string
+	err := app.db.QueryRow(SELECTWALKSIGNATURE).Scan(&saved)
+	if err != nil || saved != signature {
+		err = app.clearCheckpoint()
+		if err != nil {
+			return nil, err
+		}
+		_, err = app.db.Exec(SETWALKSIGNATURE, signature)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dirs, err := app.queryPaths(SELECTWALKDIRS)
+	if err != nil {
+		return nil, err
+	}
+	cp := &walkCheckpoint{app: app, done: make(map[string]bool, len(dirs))}
+	for _, d := range dirs {
+		cp.done[d] = true
+	}
+	return cp, nil
+}
+
+// load adds the files found before the crash to retMap and sizes.
+func (cp *walkCheckpoint) load(retMap map[string]int64, sizes map[string]int64) error {
+	if cp == nil {
+		return nil
+	}
+	rows, err := cp.app.db.Query(SELECTWALKFILES)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e walkEntry
+		err = rows.Scan(&e.path, &e.mod, &e.size)
+		if err != nil {
+			return err
+		}
+		retMap[e.path] = e.mod
+		sizes[e.path] = e.size
+	}
+	return rows.Err()
+}
+
+// visit is called for every path the walk reaches. It closes the directories the walk has left and reports
+// whether p is a directory finished by an earlier walk, which can be skipped.
+func (cp *walkCheckpoint) visit(p string, dir bool) (bool, error) {
+	if cp == nil {
+		return false, nil
+	}
+	for len(cp.open) > 0 && !within(cp.open[len(cp.open)-1], p) {
+		cp.dirs = append(cp.dirs, cp.open[len(cp.open)-1])
+		cp.open = cp.open[:len(cp.open)-1]
+	}
+	if !dir {
+		return false, nil
+	}
+	if cp.done[p] {
+		return true, nil
+	}
+	cp.open = append(cp.open, p)
+	return false, cp.maybeFlush()
+}
+
+// file records a file the walk kept.
+func (cp *walkCheckpoint) file(p string, mod int64, size int64) error {
+	if cp == nil {
+		return nil
+	}
+	cp.files = append(cp.files, walkEntry{path: p, mod: mod, size: size})
+	return cp.maybeFlush()
+}
+
+// finish closes every directory still open once a root is walked completely.
+func (cp *walkCheckpoint) finish() error {
+	if cp == nil {
+		return nil
+	}
+	for i := len(cp.open) - 1; i >= 0; i-- {
+		cp.dirs = append(cp.dirs, cp.open[i])
+	}
+	cp.open = nil
+	return cp.flush()
+}
+
+func (cp *walkCheckpoint) maybeFlush() error {
+	if len(cp.files)+len(cp.dirs) < checkpointBatch {
+		return nil
+	}
+	return cp.flush()
+}
+
+// flush writes the buffered files before the directories they are in, so a done directory always has its files saved.
+func (cp *walkCheckpoint) flush() error {
+	tx, err := cp.app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range cp.files {
+		_, err = tx.Exec(INSERTWALKFILE, e.path, e.mod, e.size)
+		if err != nil {
+			return err
+		}
+	}
+	for _, d := range cp.dirs {
+		_, err = tx.Exec(INSERTWALKDIR, d)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	cp.files = cp.files[:0]
+	cp.dirs = cp.dirs[:0]
+	return nil
+}
+
+// clearCheckpoint drops a saved walk, once its results are in the manifest.
+func (app *Syncer) clearCheckpoint() error {
+	for _, q := range []string{DELETEWALKFILES, DELETEWALKDIRS, DELETEWALKSIGNATURE} {
+		_, err := app.manifest().Exec(q)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package syncer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"strings"
+)
+
+// Checksum is the hash the manifest records the content of files and split pieces with, for change detection,
+// Fsck and WriteChecksums. Name is recorded with the sums, so whoever checks them knows what made them.
+type Checksum struct {
+	Name string
+	New  func() hash.Hash
+}
+
+// The checksums ParseChecksum knows. SHA256 is the default, SHA512 is quicker on 64 bit CPUs without SHA
+// instructions, and CRC64 is much quicker still but only catches accidental corruption, anyone can forge it.
+// ETag is the ETag S3 gives an object uploaded in ETagPartSize parts, without the -parts suffix, so sums can be
+// held up against buckets filled by other tools.
+var (
+	SHA256 = Checksum{Name: "sha256", New: sha256.New}
+	SHA512 = Checksum{Name: "sha512", New: sha512.New}
+	CRC64  = Checksum{Name: "crc64", New: func() hash.Hash { return crc64.New(crc64.MakeTable(crc64.ECMA)) }}
+	ETag   = Checksum{Name: "etag", New: func() hash.Hash { return newETagHash(ETagPartSize) }}
+)
+
+// Checksums are the checksums ParseChecksum knows by name.
+var Checksums = []Checksum{SHA256, SHA512, CRC64, ETag}
+
+// ETagPartSize is the part size the ETag checksum is worked out for, the multipart chunk size of the AWS CLI.
+const ETagPartSize = 8 << 20
+
+// etagHash is the multipart ETag algorithm: the MD5 of the MD5s of every part, or the MD5 of the content when it
+// fits in one part.
+type etagHash struct {
+	partSize int64
+	part     hash.Hash
+	n        int64
+	sums     []byte
+}
+
+func newETagHash(partSize int64) *etagHash {
+	return &etagHash{partSize: partSize, part: md5.New()}
+}
+
+func (h *etagHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		chunk := p[:min(int64(len(p)), h.partSize-h.n)]
+		h.part.Write(chunk)
+		h.n += int64(len(chunk))
+		p = p[len(chunk):]
+		if h.n == h.partSize {
+			h.sums = h.part.Sum(h.sums)
+			h.part.Reset()
+			h.n = 0
+		}
+	}
+	return written, nil
+}
+
+func (h *etagHash) Sum(b []byte) []byte {
+	sums := h.sums
+	if h.n > 0 || len(sums) == 0 {
+		sums = h.part.Sum(sums[:len(sums):len(sums)])
+	}
+	if len(sums) == md5.Size {
+		return append(b, sums...)
+	}
+	all := md5.Sum(sums)
+	return append(b, all[:]...)
+}
+
+func (h *etagHash) Reset() {
+	h.part.Reset()
+	h.n = 0
+	h.sums = nil
+}
+
+func (h *etagHash) Size() int { return md5.Size }
+
+func (h *etagHash) BlockSize() int { return md5.BlockSize }
+
+// ParseChecksum returns the checksum called name, like sha256 or crc64.
+func ParseChecksum(name string) (Checksum, error) {
+	var names []string
+	for _, c := range Checksums {
+		if c.Name == strings.ToLower(name) {
+			return c, nil
+		}
+		names = append(names, c.Name)
+	}
+	return Checksum{}, fmt.Errorf("unknown checksum %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// checksum returns the Checksum of this manifest, SHA256 unless another one is set.
+func (app *Syncer) checksum() Checksum {
+	if app.Checksum.New == nil {
+		return SHA256
+	}
+	return app.Checksum
+}
+
+// initChecksum reconciles Checksum with the one the manifest records. An unset Checksum takes the recorded one,
+// a manifest without any sums yet takes the one set, and a manifest with sums of another algorithm is an error,
+// they can't be compared.
+func (app *Syncer) initChecksum() error {
+	err := app.initHashMode()
+	if err != nil {
+		return err
+	}
+	var recorded string
+	err = app.db.QueryRow(SELECTCHECKSUM).Scan(&recorded)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if app.Checksum.New == nil {
+		if recorded == "" {
+			return nil
+		}
+		app.Checksum, err = ParseChecksum(recorded)
+		if err != nil {
+			return fmt.Errorf("the manifest records %s sums, set Syncer.Checksum to read them", recorded)
+		}
+		return nil
+	}
+	if recorded == app.Checksum.Name {
+		return nil
+	}
+	var sums int
+	err = app.db.QueryRow(COUNTSUMS).Scan(&sums)
+	if err != nil {
+		return err
+	}
+	if sums > 0 {
+		return fmt.Errorf("the manifest holds %d %s sums, sync with --checksum %s or start a new manifest", sums, recorded, recorded)
+	}
+	_, err = app.db.Exec(SETCHECKSUM, app.Checksum.Name)
+	return err
+}
@@ -0,0 +1,74 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// WriteChecksums uploads a file in the format of sha256sum to ChecksumFile, with a line for every object that holds
+// a synced file, so a copy of the bucket can be checked with sha256sum -c and no manifest. Split files are listed
+// part by part. The sums are those of the files as they were uploaded, so transformed and sparse objects only match
+// once restored by Download. The file is replaced with a single PUT, readers see the old or the new one.
+// With a Checksum other than SHA256 every line names it as in the tagged format of cksum, like CRC64 (key) = sum.
+func (app *Syncer) WriteChecksums(ctx context.Context) (int, error) {
+	if err := app.needSQLite("WriteChecksums"); err != nil {
+		return 0, err
+	}
+	if app.ChecksumFile == "" {
+		return 0, fmt.Errorf("no checksum file set")
+	}
+	paths, err := app.queryPaths(SELECTVERIFY)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	listed := map[string]bool{}
+	algorithm := app.checksum().Name
+	line := func(sum string, key string) {
+		if sum == "" || listed[key] {
+			return
+		}
+		listed[key] = true
+		if algorithm == SHA256.Name {
+			fmt.Fprintf(&buf, "%s  %s\n", sum, key)
+			return
+		}
+		fmt.Fprintf(&buf, "%s (%s) = %s\n", strings.ToUpper(algorithm), key, sum)
+	}
+	for _, p := range paths {
+		// a hardlink is stored as the file it links to
+		src, err := app.contentPath(p)
+		if err != nil {
+			return 0, err
+		}
+		parts, err := app.Parts(src)
+		if err != nil {
+			return 0, err
+		}
+		for _, part := range parts {
+			line(part.SHA256, part.Key)
+		}
+		if len(parts) > 0 {
+			continue
+		}
+		var sum string
+		err = app.db.QueryRow(SELECTHASHBYPATH, src).Scan(&sum)
+		if err != nil {
+			return 0, err
+		}
+		key, err := app.keyFor(src)
+		if err != nil {
+			return 0, err
+		}
+		line(sum, key)
+	}
+	err = app.putBody(ctx, app.ChecksumFile, bytes.NewReader(buf.Bytes()), types.StorageClassStandard, PutOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return len(listed), nil
+}
@@ -0,0 +1,230 @@
+package syncer
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Object metadata of a file encrypted with EncryptionKey: the cipher, the ID of the key, see KeyID, and the nonce
+// the chunk nonces are derived from. The same nonce and key ID are recorded in the manifest.
+const (
+	MetaCipher = "cipher"
+	MetaKeyID  = "key-id"
+	MetaNonce  = "nonce"
+)
+
+// CipherAESGCM is the only cipher so far: the content is sealed in chunks of cipherChunk bytes with AES-256-GCM,
+// each under the nonce with the chunk number in its last 8 bytes, and the last chunk is marked so a truncated
+// object fails to decrypt instead of coming back short.
+const CipherAESGCM = "aes-256-gcm"
+
+// cipherChunk is how much of the file goes in one sealed chunk, each grows by the 16 bytes of its tag.
+const cipherChunk = 64 * 1024
+
+// lastChunk is the additional data of the last chunk.
+var lastChunk = []byte("last")
+
+// ErrWrongKey is an encrypted object that EncryptionKey can't decrypt, missing or for another key.
+var ErrWrongKey = errors.New("the object is encrypted with another key")
+
+// LoadKeyFile reads a 32 byte AES-256 key for EncryptionKey from the file p, as the raw bytes or written out in
+// hex or base64. Keep the file somewhere other than the bucket, nothing uploaded can be read back without it.
+func LoadKeyFile(p string) ([]byte, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: expected a 32 byte key, raw or in hex or base64", p)
+}
+
+// KeyID names key without giving it away, the first 8 bytes of its SHA-256 in hex.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// newGCM is the AES-256-GCM AEAD of key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the encryption key is %d bytes, AES-256 needs 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce of chunk n of a file encrypted under base.
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:])
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter^n)
+	return nonce
+}
+
+// sealReader reads the content of r encrypted in chunks, see CipherAESGCM.
+type sealReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	buf   []byte
+	out   []byte
+	done  bool
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(s.r, s.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		var ad []byte
+		if _, peek := s.r.Peek(1); peek == io.EOF {
+			ad, s.done = lastChunk, true
+		} else if peek != nil {
+			return 0, peek
+		}
+		s.out = s.aead.Seal(s.out[:0], chunkNonce(s.nonce, s.n), s.buf[:n], ad)
+		s.n++
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// encryptTransform is a TransformFunc that encrypts the content with key under nonce.
+func encryptTransform(key []byte, nonce []byte) TransformFunc {
+	return func(p string, r io.Reader) (io.Reader, string, error) {
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, "", err
+		}
+		return &sealReader{r: bufio.NewReaderSize(r, cipherChunk), aead: aead, nonce: nonce, buf: make([]byte, cipherChunk)}, "", nil
+	}
+}
+
+// putEncrypted uploads obj encrypted with EncryptionKey under a new nonce, after Transform when there is one and
+// compressed first if asked to. The nonce and key ID go in the object metadata and the manifest, and Download
+// decrypts the file again.
+func (app *Syncer) putEncrypted(ctx context.Context, obj string, key string, class types.StorageClass, opts PutOptions, compressed bool) error {
+	nonce := make([]byte, 12)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	id := KeyID(app.EncryptionKey)
+	_, err = app.manifest().Exec(SETENCRYPTED, obj, CipherAESGCM, id, hex.EncodeToString(nonce))
+	if err != nil {
+		return err
+	}
+	meta := map[string]string{MetaCipher: CipherAESGCM, MetaKeyID: id, MetaNonce: hex.EncodeToString(nonce)}
+	for k, v := range opts.Metadata {
+		meta[k] = v
+	}
+	opts.Metadata = meta
+	var transforms []TransformFunc
+	if app.Transform != nil {
+		transforms = append(transforms, app.Transform)
+	}
+	if compressed {
+		// encrypted content doesn't compress
+		transforms = append(transforms, gzipTransform)
+	}
+	transform := ChainTransforms(append(transforms, encryptTransform(app.EncryptionKey, nonce))...)
+	return app.putTransformedWith(ctx, obj, key, class, opts, transform)
+}
+
+// decryptFile decrypts the file downloaded to dest in place, with the cipher, key ID and nonce of its object
+// metadata.
+func (app *Syncer) decryptFile(dest string, meta map[string]string) error {
+	if meta[MetaCipher] != CipherAESGCM {
+		return fmt.Errorf("%s: unknown cipher %q", dest, meta[MetaCipher])
+	}
+	if app.EncryptionKey == nil || KeyID(app.EncryptionKey) != meta[MetaKeyID] {
+		return fmt.Errorf("%s needs key %s: %w", dest, meta[MetaKeyID], ErrWrongKey)
+	}
+	nonce, err := hex.DecodeString(meta[MetaNonce])
+	if err != nil || len(nonce) != 12 {
+		return fmt.Errorf("%s: bad nonce %q", dest, meta[MetaNonce])
+	}
+	aead, err := newGCM(app.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer sealed.Close()
+	tmp := dest + ".s3sync-decrypt"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = openChunks(out, bufio.NewReaderSize(sealed, cipherChunk+aead.Overhead()), aead, nonce)
+	closeErr := out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp, dest)
+}
+
+// openChunks writes the content of the chunks read from r to w, failing on any chunk that was changed, moved or
+// cut off.
+func openChunks(w io.Writer, r *bufio.Reader, aead cipher.AEAD, nonce []byte) error {
+	buf := make([]byte, cipherChunk+aead.Overhead())
+	var plain []byte
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		var ad []byte
+		if _, peek := r.Peek(1); peek == io.EOF {
+			ad = lastChunk
+		} else if peek != nil {
+			return peek
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(nonce, n), buf[:size], ad)
+		if err != nil {
+			return fmt.Errorf("chunk %d doesn't decrypt, the object was changed or cut off: %w", n, err)
+		}
+		_, err = w.Write(plain)
+		if err != nil || ad != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package syncer
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ClassRule picks the storage class of the files it matches by size and age, the time since they were last
+// modified. Unset bounds match any file, a rule with several bounds needs all of them to match.
+type ClassRule struct {
+	Class types.StorageClass
+	// MinSize and MinAge are the smallest size and age that match, MaxSize and MaxAge the first that don't.
+	MinSize int64
+	MaxSize int64
+	MinAge  time.Duration
+	MaxAge  time.Duration
+}
+
+// ParseClassRule reads a rule written as CLASS:condition,..., where a condition is size or age, > or < and a
+// size like 128M or an age like 90d or 36h, e.g. GLACIER:age>90d or STANDARD_IA:size>128K,age>30d.
+func ParseClassRule(s string) (ClassRule, error) {
+	class, conds, ok := strings.Cut(s, ":")
+	rule := ClassRule{Class: types.StorageClass(strings.ToUpper(strings.TrimSpace(class)))}
+	if !ok || conds == "" {
+		return ClassRule{}, fmt.Errorf("class rule %q: want CLASS:condition, e.g. GLACIER:age>90d", s)
+	}
+	if !slices.Contains(rule.Class.Values(), rule.Class) {
+		return ClassRule{}, fmt.Errorf("class rule %q: unknown storage class, expected one of %v", s, rule.Class.Values())
+	}
+	for _, cond := range strings.Split(conds, ",") {
+		cond = strings.TrimSpace(cond)
+		i := strings.IndexAny(cond, "<>")
+		if i < 0 {
+			return ClassRule{}, fmt.Errorf("class rule %q: condition %q wants size or age, > or < and a value", s, cond)
+		}
+		name, op, value := cond[:i], cond[i], cond[i+1:]
+		switch name {
+		case "size":
+			n, err := ParseSize(value)
+			if err != nil {
+				return ClassRule{}, fmt.Errorf("class rule %q: %w", s, err)
+			}
+			if op == '>' {
+				rule.MinSize = n + 1
+			} else {
+				rule.MaxSize = n
+			}
+		case "age":
+			d, err := parseAge(value)
+			if err != nil {
+				return ClassRule{}, fmt.Errorf("class rule %q: %w", s, err)
+			}
+			if op == '>' {
+				rule.MinAge = d + time.Nanosecond
+			} else {
+				rule.MaxAge = d
+			}
+		default:
+			return ClassRule{}, fmt.Errorf("class rule %q: condition %q wants size or age", s, cond)
+		}
+	}
+	return rule, nil
+}
+
+// parseAge reads an age in days like 90d, or any time.ParseDuration takes.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad age %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad age %q", s)
+	}
+	return d, nil
+}
+
+// match reports whether a file of size last modified at mod falls within r, at now.
+func (r ClassRule) match(size int64, mod time.Time, now time.Time) bool {
+	age := now.Sub(mod)
+	return size >= r.MinSize && (r.MaxSize == 0 || size < r.MaxSize) && age >= r.MinAge && (r.MaxAge == 0 || age < r.MaxAge)
+}
+
+// ruleClass returns the class of the first of ClassRules that matches the file p, if any does.
+func (app *Syncer) ruleClass(p string) (types.StorageClass, bool) {
+	if len(app.ClassRules) == 0 {
+		return "", false
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", false
+	}
+	now := time.Now()
+	for _, r := range app.ClassRules {
+		if r.match(app.sizeOf(p), info.ModTime(), now) {
+			return r.Class, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,161 @@
+package syncer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Version is the s3sync release, set at build time with -ldflags "-X s3sync/syncer.Version=1.2.3".
+var Version = "dev"
+
+// DefaultMaxConcurrency is how many files upload at once when Syncer.MaxConcurrency is not set.
+const DefaultMaxConcurrency = 4
+
+// DefaultUploadTimeout bounds a single putObject when Syncer.UploadTimeout is not set.
+const DefaultUploadTimeout = 6 * time.Hour
+
+// ClientOptions controls how NewS3Client builds the s3.Client.
+type ClientOptions struct {
+	// HTTPClient is used as is when set, the rest of the transport options are ignored.
+	HTTPClient *http.Client
+	// Proxy is the URL of an HTTP proxy for all S3 traffic. Falls back to the HTTPS_PROXY environment if empty.
+	Proxy string
+	// TLSConfig overrides the TLS settings of the connection to S3.
+	TLSConfig *tls.Config
+	// MaxConnsPerHost limits the connection pool, 0 means no limit.
+	MaxConnsPerHost int
+	// ResponseTimeout is how long to wait for S3 to answer once a request is sent. Defaults to 2 minutes.
+	ResponseTimeout time.Duration
+	// Profile picks a profile from the shared aws config instead of AWS_PROFILE or default.
+	Profile string
+	// Region overrides the region from the environment or profile.
+	Region string
+	// UserAgent is appended to the SDK User-Agent of every request, s3sync/Version when empty.
+	UserAgent string
+	// Accelerate sends the requests to the S3 Transfer Acceleration endpoint, the bucket needs it enabled,
+	// see Syncer.AccelerationEnabled.
+	Accelerate bool
+	// Endpoint is the URL of an S3 compatible store to use instead of AWS, like MinIO, Backblaze B2 or Wasabi.
+	// AWS_ENDPOINT_URL_S3 in the environment or endpoint_url in the profile do the same.
+	Endpoint string
+	// PathStyle puts the bucket in the path of the URL instead of the host name, for stores that don't resolve
+	// bucket.host, like most self-hosted MinIO.
+	PathStyle bool
+}
+
+// DefaultEndpointRegion is the region requests to an Endpoint are signed for when none is configured, the one
+// MinIO and most other S3 compatible stores answer to.
+const DefaultEndpointRegion = "us-east-1"
+
+// NewS3Client builds an s3.Client from the default aws config using the HTTP settings in opts.
+// Credentials come from the standard SDK chain: environment keys, web identity token files (IRSA), the shared
+// config and its SSO, assume role and process profiles, then container and instance roles.
+//
+// With Endpoint the client talks to an S3 compatible store instead, Transfer Acceleration is AWS only.
+func NewS3Client(ctx context.Context, opts ClientOptions) (*s3.Client, error) {
+	if opts.Endpoint != "" && opts.Accelerate {
+		return nil, errors.New("transfer acceleration is only offered by AWS, it can't be used with a custom endpoint")
+	}
+	if opts.Endpoint != "" {
+		u, err := url.Parse(opts.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("endpoint %q: want a URL like https://minio.example.com:9000", opts.Endpoint)
+		}
+	}
+	cfg, err := opts.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Endpoint != "" && cfg.Region == "" {
+		cfg.Region = DefaultEndpointRegion
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UseAccelerate = opts.Accelerate
+		o.UsePathStyle = opts.PathStyle
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+	}), nil
+}
+
+// loadConfig runs config.LoadDefaultConfig with the settings in opts.
+func (opts ClientOptions) loadConfig(ctx context.Context) (aws.Config, error) {
+	httpClient, err := opts.httpClient()
+	if err != nil {
+		return aws.Config{}, err
+	}
+	load := []func(*config.LoadOptions) error{
+		config.WithHTTPClient(httpClient),
+		config.WithAPIOptions([]func(*middleware.Stack) error{opts.userAgent()}),
+	}
+	if opts.Profile != "" {
+		load = append(load, config.WithSharedConfigProfile(opts.Profile))
+	}
+	if opts.Region != "" {
+		load = append(load, config.WithRegion(opts.Region))
+	}
+	return config.LoadDefaultConfig(ctx, load...)
+}
+
+// userAgent returns the middleware adding UserAgent to the User-Agent header. A name/version pair is added as
+// such, the SDK would otherwise escape the slash.
+func (opts ClientOptions) userAgent() func(*middleware.Stack) error {
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = "s3sync/" + Version
+	}
+	if name, version, ok := strings.Cut(userAgent, "/"); ok {
+		return awsmiddleware.AddUserAgentKeyValue(name, version)
+	}
+	return awsmiddleware.AddUserAgentKey(userAgent)
+}
+
+// httpClient returns the configured HTTP client, or builds one with sane timeouts so a dead connection can't hang forever.
+// The built one is an SDK BuildableClient, so settings like AWS_CA_BUNDLE can still be layered on top of it.
+func (opts ClientOptions) httpClient() (aws.HTTPClient, error) {
+	if opts.HTTPClient != nil {
+		return opts.HTTPClient, nil
+	}
+	proxy := http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+	responseTimeout := opts.ResponseTimeout
+	if responseTimeout == 0 {
+		responseTimeout = 2 * time.Minute
+	}
+	client := awshttp.NewBuildableClient().WithDialerOptions(func(d *net.Dialer) {
+		d.Timeout = 30 * time.Second
+		d.KeepAlive = 30 * time.Second
+	}).WithTransportOptions(func(tr *http.Transport) {
+		tr.Proxy = proxy
+		if opts.TLSConfig != nil {
+			tr.TLSClientConfig = opts.TLSConfig
+		}
+		tr.TLSHandshakeTimeout = 10 * time.Second
+		tr.ResponseHeaderTimeout = responseTimeout
+		tr.IdleConnTimeout = 90 * time.Second
+		tr.MaxConnsPerHost = opts.MaxConnsPerHost
+		tr.MaxIdleConnsPerHost = opts.MaxConnsPerHost
+		tr.ForceAttemptHTTP2 = true
+	})
+	return client, nil
+}
@@ -0,0 +1,49 @@
+package syncer
+
+import (
+	"time"
+)
+
+// FutureModTolerance is how far in the future a modification time may be before it counts as skewed. Past it
+// the clock that wrote the file was off, like after an NTP correction or a VM snapshot restore.
+const FutureModTolerance = time.Hour
+
+// skewedModTime reports whether the modification time mod of p can't be right: it is past FutureModTolerance,
+// or older than the one recorded while the size is still the recorded one, which is how a clock set back
+// looks on a file that didn't change.
+func (app *Syncer) skewedModTime(p string, mod int64) (bool, error) {
+	if time.Unix(mod, 0).After(time.Now().Add(FutureModTolerance)) {
+		return true, nil
+	}
+	rec, ok, err := app.records().Get(p)
+	if err != nil || !ok {
+		return false, err
+	}
+	if mod >= rec.Modified {
+		return false, nil
+	}
+	size, _, _, err := app.recordedContent(p)
+	if err != nil {
+		return false, err
+	}
+	current, ok := app.sizes[p]
+	return ok && size == current, nil
+}
+
+// reportSkewed warns about the files of the last UpdateManifest with a skewed modification time.
+func (app *Syncer) reportSkewed() {
+	if len(app.skewed) == 0 || app.NoSpinners {
+		return
+	}
+	if app.HashSkewed {
+		app.term().warning().Printfln("%d files have a modification time in the future or older than recorded, they were compared by content.", len(app.skewed))
+		return
+	}
+	app.term().warning().Printfln("%d files have a modification time in the future or older than recorded, check the clock or sync with --hash-skewed.", len(app.skewed))
+}
+
+// Skewed returns the files the last UpdateManifest found with a modification time the clock can't have given
+// them, see skewedModTime. With HashSkewed they were compared by content instead of by the time.
+func (app *Syncer) Skewed() []string {
+	return app.skewed
+}
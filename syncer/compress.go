@@ -0,0 +1,144 @@
+package syncer
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MetaCompression is the object metadata naming how the content of a file was compressed before upload, also
+// recorded in the manifest.
+const MetaCompression = "compression"
+
+// CompressionGzip is the only compression so far, the file gzipped at the default level.
+const CompressionGzip = "gzip"
+
+// DefaultCompressTypes are the files Compression applies to when CompressTypes is not set: text, and the formats
+// written out as text. Media and archives are compressed already and left as they are.
+var DefaultCompressTypes = []string{"text/", "application/json", "application/xml", "application/javascript", "application/x-javascript", "application/sql", "image/svg+xml", ".csv", ".log", ".md", ".sql", ".tsv", ".yaml", ".yml", ".toml", ".ini"}
+
+// ParseCompression checks s names a Compression, the empty string for none.
+func ParseCompression(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return "", nil
+	case CompressionGzip:
+		return CompressionGzip, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, expected %s or none", s, CompressionGzip)
+}
+
+// compresses reports whether p is uploaded compressed: Compression is set and p matches one of CompressTypes, or
+// DefaultCompressTypes without them. A type is an extension like .csv, a MIME type like application/json or a
+// MIME prefix ending in / like text/, the MIME type being the one of the file extension.
+func (app *Syncer) compresses(p string) bool {
+	if app.Compression == "" {
+		return false
+	}
+	allowed := app.CompressTypes
+	if len(allowed) == 0 {
+		allowed = DefaultCompressTypes
+	}
+	ext := strings.ToLower(filepath.Ext(p))
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(ext), ";")
+	for _, t := range allowed {
+		t = strings.ToLower(t)
+		switch {
+		case strings.HasPrefix(t, "."):
+			if ext == t {
+				return true
+			}
+		case strings.HasSuffix(t, "/"):
+			if strings.HasPrefix(mimeType, t) {
+				return true
+			}
+		case mimeType == t:
+			return true
+		}
+	}
+	return false
+}
+
+// gzipTransform is a TransformFunc that gzips the content.
+func gzipTransform(p string, r io.Reader) (io.Reader, string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, "", nil
+}
+
+// markCompressed records in the manifest and opts.Metadata that obj is uploaded compressed, or in the manifest
+// that it isn't.
+func (app *Syncer) markCompressed(obj string, compressed bool, opts *PutOptions) error {
+	if !compressed {
+		if app.db == nil {
+			// without SQLite nothing is compressed, see sqliteOnly
+			return nil
+		}
+		_, err := app.manifest().Exec(CLEARCOMPRESSED, obj)
+		return err
+	}
+	_, err := app.manifest().Exec(SETCOMPRESSED, obj, app.Compression)
+	if err != nil {
+		return err
+	}
+	if opts.Metadata == nil {
+		opts.Metadata = map[string]string{}
+	}
+	opts.Metadata[MetaCompression] = app.Compression
+	return nil
+}
+
+// putCompressed uploads obj compressed with Compression, after Transform when there is one. Download decompresses
+// it again.
+func (app *Syncer) putCompressed(ctx context.Context, obj string, key string, class types.StorageClass, opts PutOptions) error {
+	transform := TransformFunc(gzipTransform)
+	if app.Transform != nil {
+		transform = ChainTransforms(app.Transform, transform)
+	}
+	return app.putTransformedWith(ctx, obj, key, class, opts, transform)
+}
+
+// decompressFile decompresses the file downloaded to dest in place, with the compression of its object metadata.
+func decompressFile(dest string, meta map[string]string) error {
+	if meta[MetaCompression] != CompressionGzip {
+		return fmt.Errorf("%s: unknown compression %q", dest, meta[MetaCompression])
+	}
+	compressed, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	tmp := dest + ".s3sync-decompress"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, zr)
+	closeErr := out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp, dest)
+}
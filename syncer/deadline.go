@@ -0,0 +1,70 @@
+package syncer
+
+import (
+	"database/sql"
+	"time"
+)
+
+// startClock starts the MaxDuration of a run, unless WalkAndHash already did.
+func (app *Syncer) startClock() {
+	if app.started.IsZero() {
+		app.started = time.Now()
+	}
+}
+
+// overTime reports whether the run has gone past MaxDuration.
+func (app *Syncer) overTime() bool {
+	return app.MaxDuration > 0 && !app.started.IsZero() && time.Since(app.started) > app.MaxDuration
+}
+
+// batchFull reports whether starting p would take the run past MaxFilesPerRun or MaxBytesPerRun. The first file
+// always goes, so one bigger than MaxBytesPerRun doesn't hold up every run.
+func (app *Syncer) batchFull(progress *uploadProgress, p string) bool {
+	if progress.started == 0 {
+		return false
+	}
+	return app.MaxFilesPerRun > 0 && progress.started >= app.MaxFilesPerRun || app.MaxBytesPerRun > 0 && progress.done+app.sizeOf(p) > app.MaxBytesPerRun
+}
+
+// BatchCursor returns the last file handed out by an upload that MaxDuration, MaxFilesPerRun or MaxBytesPerRun
+// stopped, empty when the last upload got through every file. The sync command skips the walk while there is
+// one and carries on with the files still pending.
+func (app *Syncer) BatchCursor() (string, error) {
+	if app.db == nil {
+		return "", nil
+	}
+	var cursor string
+	err := app.manifest().QueryRow(SELECTBATCH).Scan(&cursor)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return cursor, err
+}
+
+// saveBatch keeps where the upload stopped for BatchCursor, or forgets it when stopped is false.
+func (app *Syncer) saveBatch(stopped bool, last string) error {
+	if app.db == nil {
+		// only the SQLite manifest keeps the cursor, the next sync walks again and finds the rest pending
+		return nil
+	}
+	if !stopped {
+		_, err := app.manifest().Exec(CLEARBATCH)
+		return err
+	}
+	_, err := app.manifest().Exec(SETBATCH, last)
+	return err
+}
+
+// Remaining returns the files and bytes the last upload left pending because it ran into MaxDuration,
+// MaxFilesPerRun or MaxBytesPerRun, 0 when it uploaded everything or failed. The next sync picks them up.
+func (app *Syncer) Remaining() (int, int64) {
+	return app.remaining, app.remainingBytes
+}
+
+// reportStopped prints what the upload left for the next run when MaxDuration or a batch limit stopped it.
+func (app *Syncer) reportStopped() {
+	if app.remaining == 0 || app.NoSpinners {
+		return
+	}
+	app.term().warning().Printfln("Stopped after %s with %d files (%s) left, the next sync picks them up.", time.Since(app.started).Round(time.Second), app.remaining, formatBytes(app.remainingBytes))
+}
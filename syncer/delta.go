@@ -0,0 +1,410 @@
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DefaultDeltaBlockSize is the signature block size used by DeltaMode when DeltaBlockSize is not set.
+const DefaultDeltaBlockSize = 1024 * 1024 // 1MB
+
+// Delta mode works like rsync. After every upload the manifest keeps a weak rolling checksum and a sha256 for each
+// block of the file. On the next upload the new contents are scanned with the rolling checksum, blocks that still
+// exist somewhere in the old version become copy instructions and everything else is literal data. The literal
+// data goes up as <key>.delta<N> and the instructions as <key>.delta<N>.json, the patch descriptor. A restore
+// fetches the full upload at <key> and applies every patch in order. A full upload starts the chain over.
+
+// blockSig is the signature of one block of the previously uploaded version of a file.
+type blockSig struct {
+	Index  int
+	Weak   uint32
+	Strong string
+}
+
+// deltaOp is one instruction of a patch, either copy Blocks blocks starting at Block from the base,
+// or copy Length bytes starting at Offset from the literal data object.
+type deltaOp struct {
+	Block  int   `json:"block,omitempty"`
+	Blocks int   `json:"blocks,omitempty"`
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+}
+
+// deltaPatch is the descriptor uploaded as <key>.delta<N>.json.
+type deltaPatch struct {
+	Base      string    `json:"base"`
+	Data      string    `json:"data"`
+	BlockSize int       `json:"block_size"`
+	Size      int64     `json:"size"`
+	Ops       []deltaOp `json:"ops"`
+}
+
+// literalBytes is how much of the new version has to be uploaded.
+func (patch *deltaPatch) literalBytes() int64 {
+	var n int64
+	for _, op := range patch.Ops {
+		if op.Blocks == 0 {
+			n += op.Length
+		}
+	}
+	return n
+}
+
+// deltaKey returns the key of the literal data for generation gen of key, the descriptor is at deltaKey + ".json".
+func deltaKey(key string, gen int) string {
+	return fmt.Sprintf("%s.delta%d", key, gen)
+}
+
+func (app *Syncer) deltaBlockSize() int {
+	if app.DeltaBlockSize > 0 {
+		return app.DeltaBlockSize
+	}
+	return DefaultDeltaBlockSize
+}
+
+// takeDeltaState returns the id, delta generation and block size recorded for obj and clears the generation and
+// block size, for an upload about to replace what is in the bucket. Whatever goes up next, a patch or the whole
+// file, records them again once it is there, so an upload that fails leaves the next one to start over in full
+// rather than patch against a version that never made it. A file the manifest doesn't have has no state.
+func (app *Syncer) takeDeltaState(obj string) (int, int, int, error) {
+	if app.db == nil {
+		// only the SQLite manifest keeps delta state, see DeltaMode
+		return 0, 0, 0, nil
+	}
+	id, gen, blockSize, err := app.deltaState(obj)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, nil
+	}
+	if err != nil || (gen == 0 && blockSize == 0) {
+		return id, gen, blockSize, err
+	}
+	_, err = app.db.Exec(UPDATEDELTASTATE, 0, 0, id)
+	return id, gen, blockSize, err
+}
+
+// putDelta uploads obj as a patch against its previous version, generation gen of the file with id in the
+// manifest whose signatures were made with blockSize. It returns false without uploading anything when there is
+// no usable previous version or so much changed that a full upload is cheaper.
+func (app *Syncer) putDelta(ctx context.Context, obj string, key string, info os.FileInfo, class types.StorageClass, opts PutOptions, id int, gen int, blockSize int) (bool, error) {
+	if blockSize != app.deltaBlockSize() {
+		return false, nil
+	}
+	sigs, err := app.getBlocks(id)
+	if err != nil || len(sigs) == 0 {
+		return false, err
+	}
+
+	f, err := os.Open(obj)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	data, err := os.CreateTemp("", "s3sync-delta")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	patch, err := computeDelta(f, sigs, blockSize, data)
+	if err != nil {
+		return false, err
+	}
+	if patch.literalBytes() > info.Size()/2 {
+		return false, nil
+	}
+
+	patch.Base = key
+	if gen > 0 {
+		patch.Base = deltaKey(key, gen) + ".json"
+	}
+	patch.Data = deltaKey(key, gen+1)
+	_, err = data.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	err = app.putBody(ctx, patch.Data, data, class, opts)
+	if err != nil {
+		return false, err
+	}
+	descriptor, err := json.Marshal(patch)
+	if err != nil {
+		return false, err
+	}
+	err = app.putBody(ctx, patch.Data+".json", bytes.NewReader(descriptor), class, opts)
+	if err != nil {
+		return false, err
+	}
+	return true, app.recordSignatures(obj, gen+1)
+}
+
+// recordSignatures stores the block signatures of the file p as generation gen.
+func (app *Syncer) recordSignatures(p string, gen int) error {
+	id, _, _, err := app.deltaState(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sigs, err := computeSignatures(f, app.deltaBlockSize())
+	if err != nil {
+		return err
+	}
+	return app.setBlocks(id, gen, app.deltaBlockSize(), sigs)
+}
+
+// computeSignatures returns the signature of every full block read from r, a short last block is left out
+// since the rolling window can never match it.
+func computeSignatures(r io.Reader, blockSize int) ([]blockSig, error) {
+	var sigs []blockSig
+	buf := make([]byte, blockSize)
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sigs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		strong := sha256.Sum256(buf)
+		sigs = append(sigs, blockSig{Index: i, Weak: weakSum(buf), Strong: hex.EncodeToString(strong[:])})
+	}
+}
+
+// weakSum is the rsync rolling checksum of block.
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	l := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+	return (a & 0xffff) | (b&0xffff)<<16
+}
+
+// computeDelta scans r against the signatures of the base version, writing literal data to data.
+func computeDelta(r io.Reader, sigs []blockSig, blockSize int, data io.Writer) (*deltaPatch, error) {
+	byWeak := make(map[uint32][]blockSig, len(sigs))
+	for _, sig := range sigs {
+		byWeak[sig.Weak] = append(byWeak[sig.Weak], sig)
+	}
+
+	patch := &deltaPatch{BlockSize: blockSize}
+	in := bufio.NewReaderSize(r, 1024*1024)
+	out := bufio.NewWriter(data)
+	var literal int64
+
+	addLiteral := func(c byte) error {
+		n := len(patch.Ops)
+		if n > 0 && patch.Ops[n-1].Blocks == 0 {
+			patch.Ops[n-1].Length++
+		} else {
+			patch.Ops = append(patch.Ops, deltaOp{Offset: literal, Length: 1})
+		}
+		literal++
+		return out.WriteByte(c)
+	}
+	addBlock := func(index int) {
+		n := len(patch.Ops)
+		if n > 0 && patch.Ops[n-1].Blocks > 0 && patch.Ops[n-1].Block+patch.Ops[n-1].Blocks == index {
+			patch.Ops[n-1].Blocks++
+			return
+		}
+		patch.Ops = append(patch.Ops, deltaOp{Block: index, Blocks: 1})
+	}
+
+	// window is a ring buffer holding the current blockSize bytes, starting at start
+	window := make([]byte, blockSize)
+	fill := func() (int, error) {
+		n, err := io.ReadFull(in, window)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+
+	n, err := fill()
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	var a, b uint32
+	if n == blockSize {
+		sum := weakSum(window)
+		a, b = sum&0xffff, sum>>16
+	}
+	for n == blockSize {
+		if index, ok := matchBlock(byWeak, a|b<<16, window, start); ok {
+			addBlock(index)
+			patch.Size += int64(blockSize)
+			n, err = fill()
+			if err != nil {
+				return nil, err
+			}
+			start = 0
+			if n == blockSize {
+				sum := weakSum(window)
+				a, b = sum&0xffff, sum>>16
+			}
+			continue
+		}
+
+		// no match, the first byte of the window becomes literal data and the window rolls one byte on
+		first := window[start]
+		next, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = addLiteral(first)
+		if err != nil {
+			return nil, err
+		}
+		patch.Size++
+		window[start] = next
+		start = (start + 1) % blockSize
+		a = (a - uint32(first) + uint32(next)) & 0xffff
+		b = (b - uint32(blockSize)*uint32(first) + a) & 0xffff
+	}
+
+	// whatever is left in the window never matched
+	for i := 0; i < n; i++ {
+		err = addLiteral(window[(start+i)%blockSize])
+		if err != nil {
+			return nil, err
+		}
+		patch.Size++
+	}
+	return patch, out.Flush()
+}
+
+// matchBlock looks up the window in the base signatures, confirming a weak match with the strong hash.
+func matchBlock(byWeak map[uint32][]blockSig, weak uint32, window []byte, start int) (int, bool) {
+	candidates, ok := byWeak[weak]
+	if !ok {
+		return 0, false
+	}
+	h := sha256.New()
+	h.Write(window[start:])
+	h.Write(window[:start])
+	strong := hex.EncodeToString(h.Sum(nil))
+	for _, sig := range candidates {
+		if sig.Strong == strong {
+			return sig.Index, true
+		}
+	}
+	return 0, false
+}
+
+// applyDelta rebuilds the new version described by patch from base and the literal data, writing it to w.
+func applyDelta(base io.ReaderAt, patch *deltaPatch, data io.ReaderAt, w io.Writer) error {
+	for _, op := range patch.Ops {
+		var err error
+		if op.Blocks > 0 {
+			off := int64(op.Block) * int64(patch.BlockSize)
+			_, err = io.Copy(w, io.NewSectionReader(base, off, int64(op.Blocks)*int64(patch.BlockSize)))
+		} else {
+			_, err = io.Copy(w, io.NewSectionReader(data, op.Offset, op.Length))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDeltas brings the version of the file downloaded to dest from key up to date, applying the gen patches
+// uploaded for it since one after the other, and reapplies the metadata of the last one.
+func (app *Syncer) applyDeltas(ctx context.Context, key string, gen int, dest string) error {
+	var meta map[string]string
+	for g := 1; g <= gen; g++ {
+		info, err := app.store().Head(ctx, deltaKey(key, g))
+		if err != nil {
+			return fmt.Errorf("%s: %w", deltaKey(key, g), err)
+		}
+		err = app.applyDeltaObject(ctx, info, dest)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dest, err)
+		}
+		meta = info.Metadata
+	}
+	return app.restoreMetadata(ctx, dest, meta)
+}
+
+// applyDeltaObject replaces the file at dest with the version the patch with the literal data in data rebuilds
+// from it.
+func (app *Syncer) applyDeltaObject(ctx context.Context, data ObjectInfo, dest string) error {
+	body, err := app.store().GetRange(ctx, data.Key+".json", GetOptions{})
+	if err != nil {
+		return err
+	}
+	var patch deltaPatch
+	err = json.NewDecoder(body).Decode(&patch)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("reading the patch %s.json: %w", data.Key, err)
+	}
+	literal, err := os.CreateTemp(filepath.Dir(dest), ".s3sync-delta")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(literal.Name())
+	defer literal.Close()
+	body, err = app.store().GetRange(ctx, data.Key, GetOptions{IfMatch: data.ETag})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(literal, body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	base, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	tmp := dest + ".s3sync-patch"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	err = applyDelta(base, &patch, literal, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Stat(tmp)
+		if err == nil && info.Size() != patch.Size {
+			err = fmt.Errorf("the patch %s rebuilt %d bytes, expected %d: %w", data.Key, info.Size(), patch.Size, ErrCorrupt)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
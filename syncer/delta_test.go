@@ -0,0 +1,47 @@
+package syncer
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	const blockSize = 64
+	base := make([]byte, blockSize*20+10)
+	rand.New(rand.NewSource(1)).Read(base)
+
+	// insert a few bytes near the front and overwrite some in the back
+	changed := append([]byte{}, base[:100]...)
+	changed = append(changed, []byte("inserted")...)
+	changed = append(changed, base[100:]...)
+	copy(changed[900:], []byte("overwritten"))
+
+	sigs, err := computeSignatures(bytes.NewReader(base), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sigs) != 20 {
+		t.Fatalf("got %d signatures", len(sigs))
+	}
+	var data bytes.Buffer
+	patch, err := computeDelta(bytes.NewReader(changed), sigs, blockSize, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch.Size != int64(len(changed)) {
+		t.Fatalf("patch size = %d, want %d", patch.Size, len(changed))
+	}
+	if patch.literalBytes() >= int64(len(changed))/2 {
+		t.Fatalf("literal bytes = %d, delta found too few matches", patch.literalBytes())
+	}
+
+	var out bytes.Buffer
+	err = applyDelta(bytes.NewReader(base), patch, bytes.NewReader(data.Bytes()), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), changed) {
+		t.Fatal("applied delta does not match the new version")
+	}
+}
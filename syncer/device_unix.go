@@ -0,0 +1,35 @@
+//go:build !windows
+
+package syncer
+
+import (
+	"os"
+	"syscall"
+)
+
+// device returns the st_dev of the file described by info, false if it is unknown.
+func device(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// allocated returns the number of blocks the file described by info takes up on disk, false if it is unknown.
+func allocated(info os.FileInfo) (int64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int64(st.Blocks), true
+}
+
+// hardlinkID returns the st_dev and st_ino of the file described by info, false unless it has other hardlinks.
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
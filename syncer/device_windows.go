@@ -0,0 +1,20 @@
+//go:build windows
+
+package syncer
+
+import "os"
+
+// device is unknown on windows, so OneFileSystem never skips anything there.
+func device(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// allocated is unknown on windows, so sparse files are never skipped there.
+func allocated(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+// hardlinkID is unknown on windows, so Hardlinks uploads every path there.
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,117 @@
+package syncer
+
+import (
+	"os"
+)
+
+// FileChange is one file that differs between two manifests, with its size in each. The size is -1 where the
+// file isn't in that manifest, or was recorded before sizes were.
+type FileChange struct {
+	Path    string
+	OldSize int64
+	NewSize int64
+}
+
+// ManifestDiff is what changed between two manifests, each list sorted by path.
+type ManifestDiff struct {
+	Added    []FileChange
+	Removed  []FileChange
+	Modified []FileChange
+}
+
+// Growth is how many bytes the files grew by from the old manifest to the new one, negative if they shrank.
+func (d *ManifestDiff) Growth() int64 {
+	var n int64
+	for _, changes := range [][]FileChange{d.Added, d.Removed, d.Modified} {
+		for _, c := range changes {
+			n += max(c.NewSize, 0) - max(c.OldSize, 0)
+		}
+	}
+	return n
+}
+
+// manifestEntry is a file as a manifest recorded it.
+type manifestEntry struct {
+	modified int64
+	size     int64
+	sum      string
+}
+
+// DiffManifests compares the manifest at oldPath with the one at newPath, e.g. copies kept after two runs. A file
+// is modified when its sum changed, or its size or modification time for files recorded without one. Files
+// deleted locally count as removed.
+func DiffManifests(oldPath string, newPath string) (*ManifestDiff, error) {
+	a, err := readManifest(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readManifest(newPath)
+	if err != nil {
+		return nil, err
+	}
+	diff := &ManifestDiff{}
+	for _, p := range a.paths {
+		old := a.files[p]
+		cur, ok := b.files[p]
+		switch {
+		case !ok:
+			diff.Removed = append(diff.Removed, FileChange{Path: p, OldSize: old.size, NewSize: -1})
+		case old.changed(cur, a.checksum == b.checksum):
+			diff.Modified = append(diff.Modified, FileChange{Path: p, OldSize: old.size, NewSize: cur.size})
+		}
+	}
+	for _, p := range b.paths {
+		if _, ok := a.files[p]; !ok {
+			diff.Added = append(diff.Added, FileChange{Path: p, OldSize: -1, NewSize: b.files[p].size})
+		}
+	}
+	return diff, nil
+}
+
+// changed compares the sums too if sums is set, manifests recorded with different checksums can only compare
+// sizes and times.
+func (e manifestEntry) changed(other manifestEntry, sums bool) bool {
+	if sums && e.sum != "" && other.sum != "" {
+		return e.sum != other.sum
+	}
+	return e.size != other.size || e.modified != other.modified
+}
+
+// manifestFiles are the live files of a manifest in path order.
+type manifestFiles struct {
+	paths []string
+	files map[string]manifestEntry
+	// checksum is the name of the Checksum of the sums
+	checksum string
+}
+
+// readManifest loads the live files of the manifest at dbpath. The manifest is brought up to the current schema
+// like any other, but one that doesn't exist is an error rather than a new empty manifest.
+func readManifest(dbpath string) (*manifestFiles, error) {
+	if _, err := os.Stat(dbpath); err != nil {
+		return nil, err
+	}
+	app := Syncer{}
+	err := app.InitDb(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	defer app.Close()
+	rows, err := app.db.Query(SELECTMANIFESTFILES)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := &manifestFiles{files: map[string]manifestEntry{}, checksum: app.checksum().Name}
+	for rows.Next() {
+		var p string
+		var e manifestEntry
+		err = rows.Scan(&p, &e.modified, &e.size, &e.sum)
+		if err != nil {
+			return nil, err
+		}
+		res.paths = append(res.paths, p)
+		res.files[p] = e
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,229 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// doctorKey is the object Doctor writes and removes to prove the bucket is writable.
+const doctorKey = ".s3sync-doctor"
+
+// MaxClockSkew is how far the local clock may be off the one of S3 before Doctor fails it. S3 turns down
+// requests signed more than 15 minutes off, this leaves room for the clock to keep drifting.
+const MaxClockSkew = 5 * time.Minute
+
+// Check is the outcome of one of the checks Doctor runs. Err is nil when it passed, Skipped is set when it
+// couldn't run because of an earlier failure or doesn't apply, like the credentials of a custom Store.
+type Check struct {
+	Name    string
+	Detail  string
+	Err     error
+	Skipped bool
+}
+
+// DoctorReport is every check Doctor ran, in the order it ran them.
+type DoctorReport struct {
+	Checks []Check
+}
+
+// Failed is the number of checks that failed.
+func (r *DoctorReport) Failed() int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *DoctorReport) add(name string, detail string, err error) {
+	r.Checks = append(r.Checks, Check{Name: name, Detail: detail, Err: err})
+}
+
+func (r *DoctorReport) skip(name string, detail string) {
+	r.Checks = append(r.Checks, Check{Name: name, Detail: detail, Skipped: true})
+}
+
+// Doctor checks what a sync needs, for a report to attach to an issue: the manifest at dbpath, the credentials,
+// that the bucket is in the region of the client and can be listed and written, the clock against the one of
+// S3, the temp dir, the storage class, the KMS key if one is set and Transfer Acceleration if the client uses it. Every check runs even after one fails, only an unreachable bucket
+// skips the checks that need it. The preflight object it writes is removed again.
+func (app *Syncer) Doctor(ctx context.Context, dbpath string) *DoctorReport {
+	report := &DoctorReport{}
+
+	err := SoundManifest(dbpath)
+	detail := dbpath + " is sound"
+	if _, statErr := os.Stat(dbpath); os.IsNotExist(statErr) {
+		detail = dbpath + " doesn't exist yet, the first sync creates it"
+	}
+	report.add("manifest", detail, err)
+
+	if app.Store == nil {
+		app.doctorCredentials(ctx, report)
+		app.doctorRegion(ctx, report)
+		if app.S3Client != nil && app.S3Client.Options().UseAccelerate {
+			app.doctorAcceleration(ctx, report)
+		}
+	} else {
+		report.skip("credentials", "a custom store is configured")
+		report.skip("region", "a custom store is configured")
+	}
+
+	_, err = app.store().List(ctx, doctorKey)
+	report.add("bucket", fmt.Sprintf("%s can be listed", app.Bucket), err)
+	if err != nil {
+		report.skip("write", "the bucket isn't reachable")
+		report.skip("clock", "the bucket isn't reachable")
+		report.skip("storage class", "the bucket isn't reachable")
+		if app.ServerSideEncryption != "" || app.KMSKeyID != "" || len(app.KMSEncryptionContext) > 0 {
+			report.skip("encryption", "the bucket isn't reachable")
+		}
+	} else {
+		app.doctorWrite(ctx, report)
+		class := app.StorageClass
+		if class == "" {
+			class = types.StorageClassStandard
+		}
+		report.add("storage class", fmt.Sprintf("%s is accepted by the bucket", class), app.ValidateStorageClass(ctx, class))
+		if app.ServerSideEncryption != "" || app.KMSKeyID != "" || len(app.KMSEncryptionContext) > 0 {
+			report.add("encryption", "the server-side encryption is accepted", app.ValidateEncryption(ctx))
+		}
+	}
+
+	app.doctorTemp(report)
+	return report
+}
+
+// doctorCredentials checks the client has credentials it can load, without telling whether S3 accepts them,
+// the bucket checks do that.
+func (app *Syncer) doctorCredentials(ctx context.Context, report *DoctorReport) {
+	if app.S3Client == nil || app.S3Client.Options().Credentials == nil {
+		report.add("credentials", "", errors.New("no credentials are configured"))
+		return
+	}
+	creds, err := app.S3Client.Options().Credentials.Retrieve(ctx)
+	report.add("credentials", fmt.Sprintf("loaded from %s", creds.Source), err)
+}
+
+// doctorRegion checks the bucket is in the region the client signs for.
+func (app *Syncer) doctorRegion(ctx context.Context, report *DoctorReport) {
+	if app.S3Client == nil {
+		report.skip("region", "no client is configured")
+		return
+	}
+	loc, err := app.S3Client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(app.Bucket), ExpectedBucketOwner: app.bucketOwner()})
+	if err != nil {
+		report.add("region", "", err)
+		return
+	}
+	region := string(loc.LocationConstraint)
+	if region == "" {
+		region = "us-east-1"
+	}
+	if client := app.S3Client.Options().Region; client != region {
+		report.add("region", "", fmt.Errorf("the bucket is in %s but the client uses %s, set --region %s", region, client, region))
+		return
+	}
+	report.add("region", fmt.Sprintf("the bucket is in %s", region), nil)
+}
+
+// doctorAcceleration checks the bucket has Transfer Acceleration enabled, the client sends everything to its
+// endpoint.
+func (app *Syncer) doctorAcceleration(ctx context.Context, report *DoctorReport) {
+	on, err := app.AccelerationEnabled(ctx)
+	if err == nil && !on {
+		err = fmt.Errorf("Transfer Acceleration isn't enabled on %s, enable it or leave out --accelerate", app.Bucket)
+	}
+	report.add("acceleration", "the bucket has Transfer Acceleration enabled", err)
+}
+
+// doctorWrite writes, reads back and removes doctorKey, and compares its LastModified with the local clock.
+func (app *Syncer) doctorWrite(ctx context.Context, report *DoctorReport) {
+	before := time.Now()
+	_, err := app.store().Put(ctx, doctorKey, bytes.NewReader(nil), PutOptions{})
+	after := time.Now()
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RequestTimeTooSkewed" {
+		report.add("write", "", err)
+		report.add("clock", "", errors.New("S3 turned down the request, the local clock is more than 15 minutes off"))
+		return
+	}
+	if err != nil {
+		report.add("write", "", err)
+		report.skip("clock", "nothing could be written to compare with")
+		return
+	}
+	info, err := app.store().Head(ctx, doctorKey)
+	if err == nil {
+		err = app.store().Delete(ctx, doctorKey)
+	}
+	report.add("write", fmt.Sprintf("%s can be written and deleted", app.Bucket), err)
+	if err != nil {
+		report.skip("clock", "the test object couldn't be read back")
+		return
+	}
+
+	// LastModified is in whole seconds, so only skew outside the request counts
+	var skew time.Duration
+	switch {
+	case info.LastModified.Before(before.Truncate(time.Second)):
+		skew = before.Sub(info.LastModified)
+	case info.LastModified.After(after):
+		skew = info.LastModified.Sub(after)
+	}
+	if skew > MaxClockSkew {
+		report.add("clock", "", fmt.Errorf("the local clock is %s off the one of S3, over the %s allowed", skew.Round(time.Second), MaxClockSkew))
+		return
+	}
+	report.add("clock", fmt.Sprintf("within %s of S3", skew.Round(time.Second)), nil)
+}
+
+// doctorTemp checks a file can be written to the temp dir and that it has room for the pieces of the biggest
+// file waiting to be split, or SplitBudget if that is more. The pending files are only known with the manifest open.
+func (app *Syncer) doctorTemp(report *DoctorReport) {
+	dir, err := os.MkdirTemp("", "s3sync-doctor")
+	if err != nil {
+		report.add("temp dir", "", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	err = os.WriteFile(filepath.Join(dir, "probe"), []byte("s3sync"), 0644)
+	if err != nil {
+		report.add("temp dir", "", err)
+		return
+	}
+
+	need := app.SplitBudget
+	if _, native := app.multipart(); app.db != nil && !native {
+		uploads, err := app.GetUploadList()
+		if err != nil {
+			report.add("temp dir", "", err)
+			return
+		}
+		for _, p := range uploads {
+			if size := app.sizeOf(p); size > app.putLimit(app.storageClassFor(p, false)) {
+				need = max(need, size)
+			}
+		}
+	}
+	free, ok := freeSpace(dir)
+	switch {
+	case !ok:
+		report.add("temp dir", fmt.Sprintf("%s is writable, its free space is unknown", os.TempDir()), nil)
+	case free < need:
+		report.add("temp dir", "", fmt.Errorf("%s has %s free, splitting needs %s", os.TempDir(), formatBytes(free), formatBytes(need)))
+	default:
+		report.add("temp dir", fmt.Sprintf("%s is writable with %s free", os.TempDir(), formatBytes(free)), nil)
+	}
+}
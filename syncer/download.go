@@ -0,0 +1,295 @@
+package syncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultDownloadRetries is how many times a download retries in a row without receiving any bytes.
+const DefaultDownloadRetries = 5
+
+// remotePiece is one object making up a downloaded file, with where it starts in the file.
+type remotePiece struct {
+	info  ObjectInfo
+	start int64
+}
+
+// Download restores the synced file p from the bucket to dest, joining the parts of split files.
+// Bytes are written to a partial file next to dest first. A dropped connection resumes from the end of it
+// with a range request, and so does calling Download again after an interrupted run, as long as the
+// objects did not change in between.
+// A hardlink recorded by Hardlinks is linked to the copy of its content already downloaded by this Syncer
+// when it can be, and downloaded on its own otherwise. A file DeltaMode uploaded patches of is rebuilt from the
+// last full upload and the patches. With FromSnapshot set, p is restored as it was then.
+func (app *Syncer) Download(ctx context.Context, p string, dest string) error {
+	if app.FromSnapshot != "" {
+		keys, err := app.snapshotKeys(app.FromSnapshot, p)
+		if err != nil {
+			return err
+		}
+		return app.downloadKeys(ctx, keys, dest)
+	}
+	src, err := app.contentPath(p)
+	if err != nil {
+		return err
+	}
+	if prev, ok := app.restored[src]; ok && os.Link(prev, dest) == nil {
+		return nil
+	}
+	keys, err := app.partKeys(src)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		key, err := app.keyFor(src)
+		if err != nil {
+			return err
+		}
+		keys = []string{key}
+	}
+	sums, err := app.pieceSums(src, keys)
+	if err != nil {
+		return err
+	}
+	err = app.downloadSummed(ctx, keys, sums, dest)
+	if err != nil {
+		return err
+	}
+	_, gen, _, err := app.deltaState(src)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if gen > 0 {
+		// what came down is the last full upload, DeltaMode patched it since
+		key, err := app.keyFor(src)
+		if err != nil {
+			return err
+		}
+		err = app.applyDeltas(ctx, key, gen, dest)
+		if err != nil {
+			return err
+		}
+	}
+	if app.restored == nil {
+		app.restored = make(map[string]string)
+	}
+	app.restored[src] = dest
+	return nil
+}
+
+// DownloadKey downloads the object key to dest, resuming like Download.
+func (app *Syncer) DownloadKey(ctx context.Context, key string, dest string) error {
+	return app.downloadKeys(ctx, []string{key}, dest)
+}
+
+// downloadKeys downloads the objects in keys one after the other into dest.
+func (app *Syncer) downloadKeys(ctx context.Context, keys []string, dest string) error {
+	return app.downloadSummed(ctx, keys, nil, dest)
+}
+
+// pieceSums returns the sums the pieces of the split file p were recorded with when they were split, matching
+// keys, or nil when p wasn't split or its parts were adopted without sums.
+func (app *Syncer) pieceSums(p string, keys []string) ([]string, error) {
+	parts, err := app.Parts(p)
+	if err != nil || len(parts) != len(keys) {
+		return nil, err
+	}
+	sums := make([]string, len(parts))
+	for i, part := range parts {
+		if part.Key != keys[i] {
+			return nil, nil
+		}
+		sums[i] = part.SHA256
+	}
+	return sums, nil
+}
+
+// downloadSummed is downloadKeys checking each object against the sum in sums at its index, if there is one,
+// once it is all down. A piece that doesn't match fails with ErrCorrupt and the partial file is started over.
+func (app *Syncer) downloadSummed(ctx context.Context, keys []string, sums []string, dest string) error {
+	var pieces []remotePiece
+	var size int64
+	etags := sha256.New()
+	for _, k := range keys {
+		info, err := app.store().Head(ctx, k)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		pieces = append(pieces, remotePiece{info: info, start: size})
+		size += info.Size
+		io.WriteString(etags, info.ETag)
+	}
+	if len(pieces) == 1 && size == 0 && strings.HasSuffix(pieces[0].info.Key, "/") {
+		// an empty directory, see KeepEmptyDirs
+		err := os.MkdirAll(dest, 0755)
+		if err != nil {
+			return err
+		}
+		return app.restoreMetadata(ctx, dest, pieces[0].info.Metadata)
+	}
+
+	// the partial file is named after the ETags, so a changed object never resumes onto stale bytes
+	partial := fmt.Sprintf("%s.s3sync-%s.partial", dest, hex.EncodeToString(etags.Sum(nil))[:16])
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, piece := range pieces {
+		err = app.downloadPiece(ctx, piece, f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(partial)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("downloaded %d bytes of %s, expected %d", info.Size(), dest, size)
+	}
+	err = app.checkPieces(partial, pieces, sums)
+	if err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	err = os.Rename(partial, dest)
+	if err != nil {
+		return err
+	}
+	if pieces[0].info.Metadata[MetaCipher] != "" {
+		err = app.decryptFile(dest, pieces[0].info.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+	if pieces[0].info.Metadata[MetaCompression] != "" {
+		err = decompressFile(dest, pieces[0].info.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+	if layout := pieces[0].info.Metadata[MetaSparse]; layout != "" {
+		err = expandSparse(dest, layout)
+		if err != nil {
+			return err
+		}
+	}
+	if pieces[0].info.Metadata[MetaSymlink] != "" {
+		// the mode, times and attributes would land on what the link points to
+		return restoreSymlink(dest)
+	}
+	return app.restoreMetadata(ctx, dest, pieces[0].info.Metadata)
+}
+
+// restoreMetadata reapplies the extended attributes, mode, ownership and modification time stored in the object
+// metadata meta to dest, as far as PreserveXattrs and PreservePermissions ask for them.
+func (app *Syncer) restoreMetadata(ctx context.Context, dest string, meta map[string]string) error {
+	if app.PreserveXattrs {
+		err := app.restoreXattrs(ctx, dest, meta)
+		if err != nil {
+			return err
+		}
+	}
+	if !app.PreservePermissions {
+		return nil
+	}
+	err := restorePosixMetadata(dest, meta)
+	if err != nil {
+		return err
+	}
+	return restoreModTime(dest, meta)
+}
+
+// checkPieces sums each of pieces in the downloaded file p with the manifest Checksum and holds it up against
+// the sum in sums at its index, skipping the pieces without one.
+func (app *Syncer) checkPieces(p string, pieces []remotePiece, sums []string) error {
+	if len(sums) == 0 {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i, piece := range pieces {
+		if i >= len(sums) || sums[i] == "" {
+			continue
+		}
+		h := app.checksum().New()
+		_, err = io.Copy(h, io.NewSectionReader(f, piece.start, piece.info.Size))
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != sums[i] {
+			return fmt.Errorf("%s doesn't match the sum it was split with: %w", piece.info.Key, ErrCorrupt)
+		}
+	}
+	return nil
+}
+
+// downloadPiece fills in the bytes of piece that f does not have yet, retrying with range requests.
+func (app *Syncer) downloadPiece(ctx context.Context, piece remotePiece, f *os.File) error {
+	end := piece.start + piece.info.Size
+	retries := 0
+	for {
+		have, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if have >= end {
+			return nil
+		}
+		if have < piece.start {
+			return fmt.Errorf("partial download is missing bytes before %s", piece.info.Key)
+		}
+
+		body, err := app.store().GetRange(ctx, piece.info.Key, GetOptions{Offset: have - piece.start, IfMatch: piece.info.ETag})
+		if err == nil {
+			_, err = io.Copy(f, body)
+			body.Close()
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) || ctx.Err() != nil {
+			return err
+		}
+
+		// only count attempts that got nowhere, a flaky link that keeps making progress keeps going
+		now, serr := f.Seek(0, io.SeekEnd)
+		if serr != nil {
+			return serr
+		}
+		if now > have {
+			retries = 0
+			continue
+		}
+		retries++
+		if retries > DefaultDownloadRetries {
+			return err
+		}
+		select {
+		case <-time.After(time.Duration(retries) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package syncer
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DryRunFile is a file a dry run found to upload.
+type DryRunFile struct {
+	Path         string
+	Size         int64
+	StorageClass types.StorageClass
+	// Pieces is how many objects the file is split into, or parts it is sent in with NativeMultipart, 0 when
+	// it goes up in one PUT.
+	Pieces int
+}
+
+// DryRunSkip is a file a dry run found the sync leaves out, and why.
+type DryRunSkip struct {
+	Path   string
+	Size   int64
+	Reason string
+}
+
+// DryRunReport is what UploadDiffs would upload, see DryRun.
+type DryRunReport struct {
+	Files []DryRunFile
+	// Bytes is the size of all of Files.
+	Bytes int64
+	// Skipped are the files the last WalkAndHash left out for SkipLargerThan or Skip, and the quarantined ones.
+	Skipped []DryRunSkip
+	// Purged are the deleted files whose objects Purge would delete after the upload, tombstoned longer than
+	// Retention.
+	Purged []string
+}
+
+// DryRunReport works out what UploadDiffs would upload of diffs, in the order it would, in which storage class
+// and how the files over the PUT limit of their storage class would be split, with what the sync would skip and
+// purge. Nothing is sent to the bucket or written to the manifest.
+func (app *Syncer) DryRunReport(diffs []string, deep bool) (*DryRunReport, error) {
+	report := &DryRunReport{Skipped: append([]DryRunSkip{}, app.skips...)}
+	for _, p := range app.sortDiffs(app.startAfter(diffs)) {
+		f := DryRunFile{Path: p, Size: app.sizeOf(p), StorageClass: app.storageClassFor(p, deep)}
+		if limit := app.putLimit(f.StorageClass); f.Size > limit {
+			piece, err := app.pieceSize(f.Size, limit)
+			if err != nil {
+				return report, fmt.Errorf("%s: %w", p, err)
+			}
+			f.Pieces = int((f.Size + piece - 1) / piece)
+		}
+		report.Files = append(report.Files, f)
+		report.Bytes += f.Size
+	}
+	quarantined, err := app.Quarantined()
+	if err != nil {
+		return report, err
+	}
+	for _, q := range quarantined {
+		report.Skipped = append(report.Skipped, DryRunSkip{Path: q.Path, Size: -1, Reason: fmt.Sprintf("quarantined after %d failures", q.Failures)})
+	}
+	purgeable, err := app.purgeable()
+	if err != nil {
+		return report, err
+	}
+	for _, ts := range purgeable {
+		report.Purged = append(report.Purged, ts.Path)
+	}
+	return report, nil
+}
+
+// printDryRun lists the files of report, and what they add up to.
+func (app *Syncer) printDryRun(report *DryRunReport) {
+	_, native := app.multipart()
+	for _, f := range report.Files {
+		switch {
+		case f.Pieces > 0 && native:
+			app.term().info().Printfln("Would upload %s (%s) to %s in %d parts", f.Path, formatBytes(f.Size), f.StorageClass, f.Pieces)
+		case f.Pieces > 0:
+			app.term().info().Printfln("Would upload %s (%s) to %s, split into %d pieces", f.Path, formatBytes(f.Size), f.StorageClass, f.Pieces)
+		default:
+			app.term().info().Printfln("Would upload %s (%s) to %s", f.Path, formatBytes(f.Size), f.StorageClass)
+		}
+	}
+	for _, f := range report.Skipped {
+		if f.Size >= 0 {
+			app.term().info().Printfln("Would skip %s (%s), %s", f.Path, formatBytes(f.Size), f.Reason)
+		} else {
+			app.term().info().Printfln("Would skip %s, %s", f.Path, f.Reason)
+		}
+	}
+	for _, p := range report.Purged {
+		app.term().info().Printfln("Would purge %s", p)
+	}
+	app.term().success().Printfln("Dry run: %d files, %s would be uploaded, %d skipped and %d purged.", len(report.Files), formatBytes(report.Bytes), len(report.Skipped), len(report.Purged))
+}
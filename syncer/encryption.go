@@ -0,0 +1,55 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ValidateEncryption checks the server-side encryption, KMS key and encryption context are accepted, by writing
+// and deleting an encrypted preflight object, so a bucket or key policy that turns them down fails the run before
+// any upload does. Without ServerSideEncryption, KMSKeyID or KMSEncryptionContext there is nothing to check.
+func (app *Syncer) ValidateEncryption(ctx context.Context) error {
+	kms := app.KMSKeyID != "" || len(app.KMSEncryptionContext) > 0
+	switch app.ServerSideEncryption {
+	case "", types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+	case types.ServerSideEncryptionAes256:
+		if kms {
+			return fmt.Errorf("a KMS key or encryption context needs %s or %s encryption, not %s", types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse, app.ServerSideEncryption)
+		}
+	default:
+		return fmt.Errorf("unknown server-side encryption %q, use %s, %s or %s", app.ServerSideEncryption, types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse)
+	}
+	if !kms {
+		if app.ServerSideEncryption == "" {
+			return nil
+		}
+		_, err := app.store().Put(ctx, preflightKey, bytes.NewReader(nil), PutOptions{StorageClass: string(app.StorageClass)})
+		if err != nil {
+			return fmt.Errorf("bucket %s turned down an object with %s encryption: %w", app.Bucket, app.ServerSideEncryption, err)
+		}
+		return app.store().Delete(ctx, preflightKey)
+	}
+	for k, v := range app.KMSEncryptionContext {
+		if k == "" || v == "" {
+			return fmt.Errorf("encryption context %q=%q: keys and values can't be empty", k, v)
+		}
+	}
+	key := app.KMSKeyID
+	if key == "" {
+		key = "aws/s3"
+	}
+	_, err := app.store().Put(ctx, preflightKey, bytes.NewReader(nil), PutOptions{StorageClass: string(app.StorageClass)})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			return fmt.Errorf("bucket %s turned down an object encrypted with KMS key %s and context %v: %s: %s", app.Bucket, key, app.KMSEncryptionContext, apiErr.ErrorCode(), apiErr.ErrorMessage())
+		}
+		return fmt.Errorf("could not check KMS key %s on bucket %s: %w", key, app.Bucket, err)
+	}
+	return app.store().Delete(ctx, preflightKey)
+}
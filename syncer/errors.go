@@ -0,0 +1,111 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+// The failure categories of an UploadError, to test for with errors.Is. ErrNotFound, ErrTooLarge and ErrConflict
+// are categories as well.
+var (
+	// ErrPermission is a local file that can't be read, or credentials the store turned down.
+	ErrPermission = errors.New("permission denied")
+	// ErrThrottled is the store still asking to slow down after every retry.
+	ErrThrottled = errors.New("throttled by the object store")
+	// ErrFileChanged is a file that was written to while it was uploading, it is left pending for the next sync.
+	ErrFileChanged = errors.New("file changed while it was uploading")
+	// ErrSplitFailed is a file too big for a single PUT that could not be split into pieces.
+	ErrSplitFailed = errors.New("splitting the file failed")
+	// ErrStalled is an upload that moved no bytes for StallTimeout, every time it was started over.
+	ErrStalled = errors.New("upload stalled")
+	// ErrKeyTooLong is a file whose object key is over the MaxKeyLength S3 allows, see Syncer.ShortenKeys.
+	ErrKeyTooLong = errors.New("object key is too long for S3")
+	// ErrBadDigest is an upload S3 turned down because it didn't match its Content-MD5, see Syncer.ContentMD5.
+	ErrBadDigest = errors.New("upload was corrupted on the way to the bucket")
+	// ErrCorrupt is a downloaded piece of a split file that doesn't match the sum it was recorded with.
+	ErrCorrupt = errors.New("downloaded piece doesn't match its recorded sum")
+)
+
+// UploadError is what UploadDiffs returns when a file stops it. Kind is the category of the failure, nil when
+// it fits none of them, and both Kind and Err can be tested for with errors.Is.
+type UploadError struct {
+	Path string
+	Kind error
+	Err  error
+}
+
+func (e *UploadError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *UploadError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// UploadErrors is what UploadDiffs returns with KeepGoing when files failed, after trying every one of them.
+// errors.Is finds the categories of any of the failures.
+type UploadErrors struct {
+	// Uploaded is how many files went up.
+	Uploaded int
+	Failed   []*UploadError
+}
+
+func (e *UploadErrors) Error() string {
+	return fmt.Sprintf("%d files failed to upload, %d went up, the first: %v", len(e.Failed), e.Uploaded, e.Failed[0])
+}
+
+func (e *UploadErrors) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f
+	}
+	return errs
+}
+
+// classify returns the category of err, nil if it has none.
+func classify(err error) error {
+	for _, kind := range []error{ErrNotFound, ErrTooLarge, ErrConflict, ErrFileChanged, ErrSplitFailed, ErrPermission, ErrThrottled, ErrStalled, ErrKeyTooLong, ErrBadDigest} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return ErrPermission
+	case errors.Is(err, os.ErrNotExist):
+		return ErrNotFound
+	case isThrottle(err):
+		return ErrThrottled
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "AllBucketsDisabled":
+			return ErrPermission
+		case "NoSuchBucket", "NoSuchKey", "NotFound":
+			return ErrNotFound
+		case "KeyTooLongError":
+			return ErrKeyTooLong
+		case "BadDigest":
+			return ErrBadDigest
+		}
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusForbidden, http.StatusUnauthorized:
+			return ErrPermission
+		case http.StatusNotFound:
+			return ErrNotFound
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package syncer
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// RestorePrice is what S3 charges to restore archived objects at one tier and how long it typically takes.
+type RestorePrice struct {
+	// PerGB is the retrieval charge in US dollars per GB restored, PerThousand per thousand restore requests.
+	PerGB       float64
+	PerThousand float64
+	// MinTime and MaxTime are the usual window for a restored copy to be readable, MinTime 0 for "within".
+	MinTime time.Duration
+	MaxTime time.Duration
+}
+
+// RestorePrices are the us-east-1 list prices of the archive tiers when this was written. Other regions and
+// later price changes differ a little, so treat estimates as a guide or set the prices of your region.
+var RestorePrices = map[types.StorageClass]map[types.Tier]RestorePrice{
+	types.StorageClassGlacier: {
+		types.TierExpedited: {PerGB: 0.03, PerThousand: 10, MinTime: time.Minute, MaxTime: 5 * time.Minute},
+		types.TierStandard:  {PerGB: 0.01, PerThousand: 0.05, MinTime: 3 * time.Hour, MaxTime: 5 * time.Hour},
+		types.TierBulk:      {PerGB: 0, PerThousand: 0.025, MinTime: 5 * time.Hour, MaxTime: 12 * time.Hour},
+	},
+	types.StorageClassDeepArchive: {
+		types.TierStandard: {PerGB: 0.02, PerThousand: 0.10, MaxTime: 12 * time.Hour},
+		types.TierBulk:     {PerGB: 0.0025, PerThousand: 0.025, MaxTime: 48 * time.Hour},
+	},
+}
+
+// RestoreEstimate is roughly what restoring a set of objects at one tier costs and how long it takes.
+type RestoreEstimate struct {
+	Tier types.Tier
+	// Objects and Bytes are the archived objects the restore brings back.
+	Objects int
+	Bytes   int64
+	// Cost is the retrieval charge in US dollars at RestorePrices, without the storage of the restored copies.
+	Cost float64
+	// MinTime and MaxTime are the window the slowest of the objects is typically readable in.
+	MinTime time.Duration
+	MaxTime time.Duration
+	// Unsupported are the keys that can't be restored at Tier, Deep Archive has no Expedited.
+	Unsupported []string
+	// Ready keys need no restore. Unknown keys have no size or storage class in the manifest, often because
+	// they were uploaded by an older version, and are left out of the estimate.
+	Ready   []string
+	Unknown []string
+}
+
+// EstimateRestore works out what restoring keys at tier would cost and take, from the sizes and storage classes
+// recorded in the manifest. Nothing is sent to S3. The key of a split file stands for all of its pieces, and no
+// keys estimates every object recorded under prefix.
+func (app *Syncer) EstimateRestore(keys []string, prefix string, tier types.Tier) (*RestoreEstimate, error) {
+	if err := app.needSQLite("EstimateRestore"); err != nil {
+		return nil, err
+	}
+	var err error
+	if keys == nil {
+		keys, err = app.queryPaths(SELECTETAGKEYS, prefix, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	est := &RestoreEstimate{Tier: tier}
+	for _, key := range keys {
+		objects, err := app.queryPaths(SELECTPARTKEYSBYKEY, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) == 0 {
+			objects = []string{key}
+		}
+		for _, obj := range objects {
+			var size int64
+			var class string
+			err = app.db.QueryRow(SELECTOBJECTSIZE, obj, obj, obj).Scan(&size, &class)
+			if err != nil {
+				return nil, err
+			}
+			if class != "" && !archived(types.StorageClass(class)) {
+				est.Ready = append(est.Ready, obj)
+				continue
+			}
+			if size < 0 || class == "" {
+				est.Unknown = append(est.Unknown, obj)
+				continue
+			}
+			price, ok := RestorePrices[types.StorageClass(class)][tier]
+			if !ok {
+				est.Unsupported = append(est.Unsupported, obj)
+				continue
+			}
+			est.Objects++
+			est.Bytes += size
+			est.Cost += price.PerGB*float64(size)/(1<<30) + price.PerThousand/1000
+			est.MinTime = max(est.MinTime, price.MinTime)
+			est.MaxTime = max(est.MaxTime, price.MaxTime)
+		}
+	}
+	return est, nil
+}
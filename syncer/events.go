@@ -0,0 +1,183 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// UploadEvent describes a file that just went up, for systems downstream of the bucket to react to.
+type UploadEvent struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Parts are the keys of the pieces of a split file, Key then is the name they are stored under.
+	Parts        []string  `json:"parts,omitempty"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	StorageClass string    `json:"storage_class"`
+	Time         time.Time `json:"time"`
+}
+
+// EventPublisher sends an UploadEvent somewhere, see Syncer.Events. Publishing is best effort, an error only
+// gets a warning and the upload still counts.
+type EventPublisher interface {
+	Publish(ctx context.Context, ev UploadEvent) error
+}
+
+// Publishers publishes every event to each of them in turn, all are tried even when one fails.
+type Publishers []EventPublisher
+
+func (ps Publishers) Publish(ctx context.Context, ev UploadEvent) error {
+	var errs []error
+	for _, p := range ps {
+		errs = append(errs, p.Publish(ctx, ev))
+	}
+	return errors.Join(errs...)
+}
+
+// publishUpload sends the UploadEvent of the file p to Events, if it is set.
+func (app *Syncer) publishUpload(ctx context.Context, p string, class string) {
+	if app.Events == nil {
+		return
+	}
+	err := app.publish(ctx, p, class)
+	if err != nil && !app.NoSpinners {
+		app.term().warning().Printfln("Could not publish the upload of %s: %v", p, err)
+	}
+}
+
+func (app *Syncer) publish(ctx context.Context, p string, class string) error {
+	key, err := app.keyFor(p)
+	if err != nil {
+		return err
+	}
+	parts, err := app.partKeys(p)
+	if err != nil {
+		return err
+	}
+	size, hash, _, err := app.recordedContent(p)
+	if err != nil {
+		return err
+	}
+	ev := UploadEvent{Bucket: app.Bucket, Key: key, Parts: parts, Path: p, Size: size, SHA256: hash, StorageClass: class, Time: time.Now().UTC()}
+	return app.Events.Publish(ctx, ev)
+}
+
+// WebhookPublisher posts every UploadEvent as JSON to URL, any 2xx answer counts as delivered.
+type WebhookPublisher struct {
+	URL string
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+func (w *WebhookPublisher) Publish(ctx context.Context, ev UploadEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return send(w.Client, req)
+}
+
+// SNSPublisher publishes every UploadEvent as JSON to an SNS topic, which can fan it out to SQS queues. The
+// request is signed with the credentials of the S3 client, so they need sns:Publish on the topic.
+type SNSPublisher struct {
+	TopicARN    string
+	Credentials aws.CredentialsProvider
+	// Endpoint is where to send the requests, the SNS endpoint of the topic's region when empty.
+	Endpoint string
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// region is the region of the topic, the fourth field of its ARN.
+func (s *SNSPublisher) region() (string, error) {
+	fields := strings.Split(s.TopicARN, ":")
+	if len(fields) < 6 || fields[2] != "sns" {
+		return "", fmt.Errorf("%q is not an SNS topic ARN", s.TopicARN)
+	}
+	return fields[3], nil
+}
+
+func (s *SNSPublisher) Publish(ctx context.Context, ev UploadEvent) error {
+	region, err := s.region()
+	if err != nil {
+		return err
+	}
+	message, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {s.TopicARN},
+		"Message":  {string(message)},
+	}
+	body := form.Encode()
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://sns.%s.amazonaws.com/", region)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if s.Credentials == nil {
+		return errors.New("no credentials to sign the SNS request with")
+	}
+	creds, err := s.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(body))
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "sns", region, time.Now())
+	if err != nil {
+		return err
+	}
+	return send(s.Client, req)
+}
+
+// send runs req and turns an answer outside 2xx into an error, with the SNS error message if there is one.
+func send(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var snsErr struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}
+	if xml.Unmarshal(data, &snsErr) == nil && snsErr.Code != "" {
+		return fmt.Errorf("%s: %s: %s", req.URL.Host, snsErr.Code, snsErr.Message)
+	}
+	return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+}
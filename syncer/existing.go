@@ -0,0 +1,117 @@
+package syncer
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// existingObjects are the objects SkipExisting found in the bucket, listed a prefix at a time.
+type existingObjects struct {
+	listed []string
+	objs   map[string]ObjectInfo
+}
+
+// listExisting lists the bucket under the longest prefix the keys of page share, unless an earlier listing
+// covered it already, so SkipExisting costs a listing per run instead of a HEAD per file.
+func (app *Syncer) listExisting(ctx context.Context, page []string) error {
+	if !app.SkipExisting {
+		return nil
+	}
+	if app.existing == nil {
+		app.existing = &existingObjects{objs: map[string]ObjectInfo{}}
+	}
+	var prefix string
+	for i, p := range page {
+		key, err := app.keyFor(p)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			prefix = key
+		}
+		for !strings.HasPrefix(key, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	for _, listed := range app.existing.listed {
+		if strings.HasPrefix(prefix, listed) {
+			return nil
+		}
+	}
+	infos, err := app.store().List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		app.existing.objs[info.Key] = info
+	}
+	app.existing.listed = append(app.existing.listed, prefix)
+	return nil
+}
+
+// skipExisting records the file p as uploaded when the object key already holds it, see inBucket, and reports
+// whether it did. Files too big for a single PUT go up as pieces and are always uploaded.
+func (app *Syncer) skipExisting(ctx context.Context, p string, key string, class types.StorageClass) (bool, error) {
+	info, err := os.Stat(p)
+	if err != nil || info.Size() > app.putLimit(class) {
+		return false, err
+	}
+	obj, ok, err := app.inBucket(ctx, p, key, info.Size())
+	if err != nil || !ok {
+		return false, err
+	}
+	err = app.recordETag(key, obj.ETag, types.StorageClass(obj.StorageClass))
+	if err == nil {
+		err = app.completeUpload(p)
+	}
+	return err == nil, err
+}
+
+// inBucket reports whether the listed object key holds the file p, returning the object. It must be the same
+// size, with an ETag that is the MD5 of p. Objects whose ETag is no MD5, like multipart uploads, are only
+// taken when a HEAD shows s3sync uploaded them from this very path.
+func (app *Syncer) inBucket(ctx context.Context, p string, key string, size int64) (ObjectInfo, bool, error) {
+	obj, ok := app.existing.objs[key]
+	if !ok || obj.Size != size {
+		return obj, false, nil
+	}
+	etag := strings.Trim(obj.ETag, `"`)
+	if len(etag) == 32 && !strings.Contains(etag, "-") {
+		sum, err := md5File(p)
+		return obj, err == nil && sum == etag, err
+	}
+	head, err := app.store().Head(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return obj, false, nil
+	}
+	if err != nil {
+		return obj, false, err
+	}
+	return obj, head.Metadata[MetaSrcPath] == app.srcPath(p), nil
+}
+
+// md5File returns the hex MD5 of the file at p, what S3 makes the ETag of a single PUT.
+func md5File(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
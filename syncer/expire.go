@@ -0,0 +1,86 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy picks the snapshots to keep: the last KeepLast of them and every one taken at or after
+// KeepSince. The newest snapshot is always kept, it holds the files as they are now.
+type RetentionPolicy struct {
+	KeepLast  int
+	KeepSince time.Time
+}
+
+// ExpiryPlan is what ComputeExpired found could go: the snapshots the policy lets go of, the objects only they
+// hold and the bytes deleting those would reclaim.
+type ExpiryPlan struct {
+	Snapshots []string
+	Keys      []string
+	Bytes     int64
+}
+
+// ComputeExpired works out which objects can be deleted under policy without deleting anything. Only objects
+// under the prefix of an expired snapshot are candidates, and one still holding a file of a kept snapshot stays,
+// with everything stored alongside it like its pieces and sidecars. A snapshot whose name isn't a time in
+// SnapshotLayout is always kept, its age is unknown.
+func (app *Syncer) ComputeExpired(ctx context.Context, policy RetentionPolicy) (*ExpiryPlan, error) {
+	if policy.KeepLast <= 0 && policy.KeepSince.IsZero() {
+		return nil, errors.New("a retention policy needs KeepLast or KeepSince, this one would expire every snapshot")
+	}
+	snaps, err := app.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	plan := &ExpiryPlan{}
+	kept := map[string]bool{}
+	for i, s := range snaps {
+		taken, err := time.Parse(SnapshotLayout, s.Name)
+		keep := err != nil || i == len(snaps)-1 || i >= len(snaps)-policy.KeepLast ||
+			(!policy.KeepSince.IsZero() && !taken.Before(policy.KeepSince))
+		if !keep {
+			plan.Snapshots = append(plan.Snapshots, s.Name)
+			continue
+		}
+		keys, err := app.queryPaths(SELECTSNAPSHOTOBJECTS, s.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			kept[k] = true
+		}
+	}
+
+	for _, name := range plan.Snapshots {
+		objs, err := app.store().List(ctx, app.prefixKey(name+"/"))
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if referenced(kept, obj.Key) {
+				continue
+			}
+			plan.Keys = append(plan.Keys, obj.Key)
+			plan.Bytes += obj.Size
+		}
+	}
+	sort.Strings(plan.Keys)
+	return plan, nil
+}
+
+// referenced reports whether key is in kept or is stored alongside a key that is, its pieces, delta objects and
+// xattr sidecar are the key with a dotted suffix.
+func referenced(kept map[string]bool, key string) bool {
+	if kept[key] {
+		return true
+	}
+	for i := strings.LastIndex(key, "."); i > 0; i = strings.LastIndex(key[:i], ".") {
+		if kept[key[:i]] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestFormat is the version of the JSON ExportManifest writes. ImportManifest takes this one and older.
+const ManifestFormat = 1
+
+// ManifestObject is the key, under KeyPrefix, of the manifest PushManifest shares through the bucket.
+const ManifestObject = ".s3sync-manifest.json"
+
+// ErrNewerManifest is an exported manifest made by a newer s3sync than this one, with a format or schema it
+// doesn't know.
+var ErrNewerManifest = errors.New("the manifest was exported by a newer s3sync")
+
+// sharedTables are the tables of the manifest that describe the bucket and the files in it, the ones exported.
+// The walk checkpoint, multipart uploads in flight, plans and the run history belong to the machine that made
+// them and stay behind.
+var sharedTables = []string{"videos", "parts", "etags", "blocks", "snapshot_keys", "snapshot_files", "encrypted", "compressed", "checksum"}
+
+// pathColumns are the columns of sharedTables holding local paths, rewritten on import to another folder.
+var pathColumns = map[string][]string{
+	"videos":         {"filepath", "link_of"},
+	"parts":          {"filepath"},
+	"snapshot_keys":  {"filepath"},
+	"snapshot_files": {"filepath"},
+	"encrypted":      {"filepath"},
+	"compressed":     {"filepath"},
+}
+
+// exportedManifest is the JSON of ExportManifest.
+type exportedManifest struct {
+	Format int `json:"format"`
+	// Schema is how many migrations the manifest had, see migrations.
+	Schema   int       `json:"schema"`
+	Exported time.Time `json:"exported"`
+	// Folder is the FolderPath the paths in Tables are under.
+	Folder string                      `json:"folder"`
+	Tables map[string][]map[string]any `json:"tables"`
+}
+
+// ExportManifest writes the manifest to w as versioned JSON, for ImportManifest on another machine or as a
+// backup. Only what describes the bucket goes out, see sharedTables.
+func (app *Syncer) ExportManifest(w io.Writer) error {
+	if err := app.needSQLite("ExportManifest"); err != nil {
+		return err
+	}
+	exp := exportedManifest{Format: ManifestFormat, Schema: len(migrations), Exported: time.Now().UTC(), Folder: app.FolderPath, Tables: map[string][]map[string]any{}}
+	for _, table := range sharedTables {
+		rows, err := app.exportTable(table)
+		if err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		exp.Tables[table] = rows
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(exp)
+}
+
+// exportTable reads every row of table as a map from column to value.
+func (app *Syncer) exportTable(table string) ([]map[string]any, error) {
+	rows, err := app.manifest().Query("select * from " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	res := []map[string]any{}
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]any, len(cols))
+		for i, c := range cols {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[c] = values[i]
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+}
+
+// ImportManifest replaces what the manifest knows of the bucket with the export read from r, in one transaction.
+// Paths under the folder it was exported from are moved under FolderPath, so a machine with the files somewhere
+// else can take over from the one that uploaded them. Use it on a manifest no sync is running with.
+func (app *Syncer) ImportManifest(r io.Reader) error {
+	if err := app.needSQLite("ImportManifest"); err != nil {
+		return err
+	}
+	var exp exportedManifest
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	err := dec.Decode(&exp)
+	if err != nil {
+		return fmt.Errorf("reading the manifest: %w", err)
+	}
+	if exp.Format > ManifestFormat || exp.Schema > len(migrations) {
+		return fmt.Errorf("format %d, schema %d: %w", exp.Format, exp.Schema, ErrNewerManifest)
+	}
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range sharedTables {
+		_, err = tx.Exec("delete from " + table)
+		if err != nil {
+			return err
+		}
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		for _, row := range exp.Tables[table] {
+			err = app.importRow(tx, table, columns, row, exp.Folder)
+			if err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// the imported manifest may record another checksum
+	app.Checksum = Checksum{}
+	return app.initChecksum()
+}
+
+// tableColumns returns the columns table has in the manifest.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("select name from pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[string]bool{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		res[name] = true
+	}
+	return res, rows.Err()
+}
+
+// importRow inserts the exported row into table, its paths moved from the folder it was exported from. The
+// export may come from the bucket, so a column table doesn't have is turned down rather than put in the query.
+func (app *Syncer) importRow(tx *sql.Tx, table string, columns map[string]bool, row map[string]any, folder string) error {
+	cols := make([]string, 0, len(row))
+	args := make([]any, 0, len(row))
+	for c, v := range row {
+		if !columns[c] {
+			return fmt.Errorf("unknown column %q", c)
+		}
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else {
+				v, _ = n.Float64()
+			}
+		}
+		if s, ok := v.(string); ok && folder != "" && app.FolderPath != "" {
+			for _, pc := range pathColumns[table] {
+				if pc == c {
+					v = movePath(s, folder, app.FolderPath)
+				}
+			}
+		}
+		cols = append(cols, c)
+		args = append(args, v)
+	}
+	query := fmt.Sprintf("insert into %s (%s) values (%s)", table, strings.Join(cols, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", "))
+	_, err := tx.Exec(query, args...)
+	return err
+}
+
+// movePath is p with the folder from replaced by to, p itself when it isn't under from. Paths exported on
+// another OS get the separators of this one.
+func movePath(p string, from string, to string) string {
+	slashed, fromSlashed := strings.ReplaceAll(p, `\`, "/"), strings.TrimSuffix(strings.ReplaceAll(from, `\`, "/"), "/")
+	if slashed != fromSlashed && !strings.HasPrefix(slashed, fromSlashed+"/") {
+		return p
+	}
+	return filepath.Join(to, filepath.FromSlash(strings.TrimPrefix(slashed, fromSlashed)))
+}
+
+// manifestKey is the key of the shared manifest, see PushManifest.
+func (app *Syncer) manifestKey() string {
+	return app.KeyPrefix + ManifestObject
+}
+
+// PushManifest uploads the export of the manifest to ManifestObject in the bucket, for PullManifest on another
+// machine. It only replaces the object this manifest last pushed or pulled, so two machines pushing in turn
+// don't undo each other: if another one pushed since, it fails with ErrConflict and the manifest has to be
+// pulled first.
+func (app *Syncer) PushManifest(ctx context.Context) error {
+	if err := app.needSQLite("PushManifest"); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err := app.ExportManifest(&buf)
+	if err != nil {
+		return err
+	}
+	var last string
+	err = app.manifest().QueryRow(SELECTSHAREDETAG).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if last == "" {
+		// nobody shared a manifest yet, or it must not be overwritten blindly
+		info, err := app.store().Head(ctx, app.manifestKey())
+		if err == nil {
+			return fmt.Errorf("%s was pushed by another machine, pull it first: %w", info.Key, ErrConflict)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	etag, err := app.store().Put(ctx, app.manifestKey(), &buf, PutOptions{IfMatch: last, Headers: Headers{ContentType: "application/json"}})
+	if err != nil {
+		return err
+	}
+	_, err = app.manifest().Exec(SETSHAREDETAG, etag)
+	return err
+}
+
+// PullManifest replaces the manifest with the one PushManifest shared in the bucket, see ImportManifest. It
+// returns false, leaving the manifest alone, when none was pushed or it is the one this manifest already has.
+func (app *Syncer) PullManifest(ctx context.Context) (bool, error) {
+	if err := app.needSQLite("PullManifest"); err != nil {
+		return false, err
+	}
+	info, err := app.store().Head(ctx, app.manifestKey())
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var last string
+	err = app.manifest().QueryRow(SELECTSHAREDETAG).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if last == info.ETag {
+		return false, nil
+	}
+	body, err := app.store().GetRange(ctx, info.Key, GetOptions{IfMatch: info.ETag})
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	err = app.ImportManifest(body)
+	if err != nil {
+		return false, err
+	}
+	_, err = app.manifest().Exec(SETSHAREDETAG, info.ETag)
+	return true, err
+}
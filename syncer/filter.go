@@ -0,0 +1,112 @@
+package syncer
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Filters pick the files a walk syncs. A plain filter like .jpg matches the names ending in it, as it always has.
+// One with *, ? or [ in it is a glob, see path.Match, and one between slashes like /^raw/.*\.CR2$/ is a regular
+// expression. Filters with a slash in them match the path relative to the source folder, with forward slashes,
+// the others only the name, and a path filter that matches a folder matches everything under it. A filter
+// starting with ! leaves out what it matches, even files another filter lets in, so raw/ without its thumbnails
+// is raw/ and !raw/thumbs/.
+
+// fileFilter is one parsed filter.
+type fileFilter struct {
+	exclude bool
+	byPath  bool
+	suffix  string
+	glob    string
+	re      *regexp.Regexp
+}
+
+// parseFilters parses filters, failing on a bad glob or expression. Empty filters match nothing.
+func parseFilters(filters []string) ([]fileFilter, error) {
+	res := make([]fileFilter, 0, len(filters))
+	for _, raw := range filters {
+		f := fileFilter{}
+		s := raw
+		if strings.HasPrefix(s, "!") {
+			f.exclude, s = true, s[1:]
+		}
+		switch {
+		case len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"):
+			re, err := regexp.Compile(s[1 : len(s)-1])
+			if err != nil {
+				return nil, fmt.Errorf("filter %q: %w", raw, err)
+			}
+			f.re = re
+			f.byPath = strings.Contains(re.String(), "/")
+		case strings.ContainsAny(s, "*?["):
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("filter %q: %w", raw, err)
+			}
+			f.glob = strings.TrimPrefix(s, "/")
+			f.byPath = strings.Contains(f.glob, "/")
+		case strings.Contains(s, "/"):
+			// a folder or file, names never have a slash to end in
+			f.glob = strings.Trim(s, "/")
+			f.byPath = true
+		default:
+			f.suffix = s
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// match reports whether f matches the file at rel, its slash separated path relative to the source folder.
+func (f fileFilter) match(rel string) bool {
+	name := path.Base(rel)
+	switch {
+	case f.re != nil && f.byPath:
+		return f.re.MatchString(rel)
+	case f.re != nil:
+		return f.re.MatchString(name)
+	case f.glob != "" && f.byPath:
+		for dir := rel; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(f.glob, dir); ok {
+				return true
+			}
+		}
+		return false
+	case f.glob != "":
+		ok, _ := path.Match(f.glob, name)
+		return ok
+	}
+	return strings.HasSuffix(name, f.suffix)
+}
+
+// inFilters reports whether the file at rel passes filters: an include filter matches it, or there are only
+// excludes, and no exclude does.
+func inFilters(rel string, filters []fileFilter) bool {
+	included, includes := false, false
+	for _, f := range filters {
+		if f.exclude {
+			if f.match(rel) {
+				return false
+			}
+			continue
+		}
+		includes = true
+		included = included || f.match(rel)
+	}
+	return included || !includes && len(filters) > 0
+}
+
+// filterPath returns the path filters match p by, relative to its source folder with forward slashes.
+func (app *Syncer) filterPath(p string) string {
+	src, ok := app.sourceFor(p)
+	if !ok {
+		return filepath.Base(p)
+	}
+	rel, err := filepath.Rel(src.FolderPath, p)
+	if err != nil {
+		return filepath.Base(p)
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package syncer
+
+// freeSpace is unknown where statfs isn't available, so Doctor only checks the temp dir is writable there.
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
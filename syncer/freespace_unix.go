@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package syncer
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes free to an unprivileged user on the filesystem holding dir, false if it is unknown.
+func freeSpace(dir string) (int64, bool) {
+	var st unix.Statfs_t
+	if unix.Statfs(dir, &st) != nil {
+		return 0, false
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), true
+}
@@ -0,0 +1,88 @@
+package syncer
+
+import (
+	"context"
+)
+
+// FsckReport is the result of checking the manifest against the local tree, see Fsck.
+type FsckReport struct {
+	// Checked is how many manifest records were compared.
+	Checked int
+	// Missing files are in the manifest but no longer on disk.
+	Missing []string
+	// Modified files have a newer or older modification time than the manifest, a change the last sync missed.
+	Modified []string
+	// Corrupt files kept their modification time but no longer match the hash taken at upload, likely bit-rot.
+	Corrupt []string
+	// Untracked files are on disk but not in the manifest.
+	Untracked []string
+	// Unhashed records were uploaded before hashes were kept, so only their modification time was checked.
+	Unhashed []string
+}
+
+// Clean reports whether the manifest matched the local tree exactly.
+func (r *FsckReport) Clean() bool {
+	return len(r.Missing)+len(r.Modified)+len(r.Corrupt)+len(r.Untracked) == 0
+}
+
+// Fsck re-walks the local tree with filters, re-hashes every uploaded file and compares it with the manifest.
+// It only reads, nothing in the manifest or the bucket is changed.
+func (app *Syncer) Fsck(ctx context.Context, filters []string) (*FsckReport, error) {
+	if err := app.needSQLite("Fsck"); err != nil {
+		return nil, err
+	}
+	local, err := app.WalkAndHash(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := app.db.Query(SELECTFSCK)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &FsckReport{}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var p, hash string
+		var mod int64
+		var uploaded bool
+		err = rows.Scan(&p, &mod, &uploaded, &hash)
+		if err != nil {
+			return nil, err
+		}
+		if !app.inScope(p) {
+			continue
+		}
+		report.Checked++
+		seen[p] = true
+		localMod, ok := local[p]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, p)
+		case localMod != mod:
+			report.Modified = append(report.Modified, p)
+		case !uploaded:
+			// nothing to compare against until it is uploaded
+		case hash == "":
+			report.Unhashed = append(report.Unhashed, p)
+		default:
+			sum, _, err := app.sumFile(p)
+			if err != nil {
+				return nil, err
+			}
+			if sum != hash {
+				report.Corrupt = append(report.Corrupt, p)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for p := range local {
+		if !seen[p] {
+			report.Untracked = append(report.Untracked, p)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,49 @@
+package syncer
+
+import (
+	"os"
+)
+
+// fileID is the device and inode of a file, which every hardlink to it shares.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// noteHardlink remembers p as a link to the first path the walk found for the same inode, see Syncer.Hardlinks.
+func (app *Syncer) noteHardlink(p string, info os.FileInfo) {
+	id, ok := hardlinkID(info)
+	if !ok {
+		return
+	}
+	if first, seen := app.inodes[id]; seen {
+		app.links[p] = first
+		return
+	}
+	app.inodes[id] = p
+}
+
+// linkTarget returns the path the manifest has p as a hardlink of, empty if p is synced on its own.
+func (app *Syncer) linkTarget(p string) (string, error) {
+	rec, _, err := app.records().Get(p)
+	return rec.LinkOf, err
+}
+
+// recordLink sets p to be a hardlink of target, or a file of its own when target is empty. A changed link
+// puts p back in the upload list, a file that stops being a link needs its own copy in the bucket.
+func (app *Syncer) recordLink(p string, target string) error {
+	current, err := app.linkTarget(p)
+	if err != nil || current == target {
+		return err
+	}
+	return app.records().SetLink(p, target)
+}
+
+// contentPath returns the path whose objects hold the content of p, its link target for a hardlink.
+func (app *Syncer) contentPath(p string) (string, error) {
+	target, err := app.linkTarget(p)
+	if err != nil || target == "" {
+		return p, err
+	}
+	return target, nil
+}
@@ -0,0 +1,111 @@
+package syncer
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Headers are the HTTP headers an object is served with, for files handed out through presigned URLs or a CDN.
+// Empty fields are not sent.
+type Headers struct {
+	// ContentType is the media type, S3 serves objects without one as binary/octet-stream. HeaderRules leave
+	// it to DetectContentType, or to a HeaderFunc of its own.
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+	// ContentLanguage is the language of the content, like de or en-GB, for sites serving one bucket per locale.
+	ContentLanguage string
+	Expires         time.Time
+}
+
+// HeaderFunc picks the Headers for the local file p, see HeaderRules.
+type HeaderFunc func(p string) Headers
+
+// HeaderRule sets one header on the files whose name matches Pattern, a filepath.Match pattern like *.css.
+// Patterns with slashes are matched against as many trailing folders of the path, like assets/*.js.
+type HeaderRule struct {
+	Pattern string
+	Name    string
+	Value   string
+	// ExpiresIn is the Expires header as a time from the upload, when Name is Expires and Value a duration.
+	ExpiresIn time.Duration
+}
+
+// ParseHeaderRule reads a rule written as pattern:Name=value, e.g. *.css:Cache-Control=max-age=86400.
+// Name is one of Cache-Control, Content-Disposition, Content-Language or Expires, the latter taking a date
+// (RFC 1123) or a duration from the upload like 720h. A pattern of * sets the header on every file of the run.
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	pattern, header, ok := strings.Cut(s, ":")
+	if !ok || pattern == "" {
+		return HeaderRule{}, fmt.Errorf("header rule %q: want pattern:Name=value", s)
+	}
+	name, value, ok := strings.Cut(header, "=")
+	if !ok {
+		return HeaderRule{}, fmt.Errorf("header rule %q: want pattern:Name=value", s)
+	}
+	rule := HeaderRule{Pattern: pattern, Name: http.CanonicalHeaderKey(strings.TrimSpace(name)), Value: value}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return HeaderRule{}, fmt.Errorf("header rule %q: %w", s, err)
+	}
+	switch rule.Name {
+	case "Cache-Control", "Content-Disposition", "Content-Language":
+	case "Expires":
+		if d, err := time.ParseDuration(value); err == nil {
+			rule.ExpiresIn = d
+		} else if _, err := time.Parse(http.TimeFormat, value); err != nil {
+			return HeaderRule{}, fmt.Errorf("header rule %q: Expires wants a date like %s or a duration", s, http.TimeFormat)
+		}
+	default:
+		return HeaderRule{}, fmt.Errorf("header rule %q: only Cache-Control, Content-Disposition, Content-Language and Expires can be set", s)
+	}
+	return rule, nil
+}
+
+// HeaderRules returns a HeaderFunc applying rules in order, a later rule for the same header wins.
+func HeaderRules(rules []HeaderRule) HeaderFunc {
+	return func(p string) Headers {
+		var h Headers
+		parts := strings.Split(filepath.ToSlash(p), "/")
+		for _, r := range rules {
+			n := strings.Count(r.Pattern, "/") + 1
+			if n > len(parts) {
+				continue
+			}
+			if ok, _ := path.Match(r.Pattern, strings.Join(parts[len(parts)-n:], "/")); !ok {
+				continue
+			}
+			switch r.Name {
+			case "Cache-Control":
+				h.CacheControl = r.Value
+			case "Content-Disposition":
+				h.ContentDisposition = r.Value
+			case "Content-Language":
+				h.ContentLanguage = r.Value
+			case "Expires":
+				if r.ExpiresIn > 0 {
+					h.Expires = time.Now().Add(r.ExpiresIn)
+				} else {
+					h.Expires, _ = time.Parse(http.TimeFormat, r.Value)
+				}
+			}
+		}
+		return h
+	}
+}
+
+// headersFor returns the Headers the file p is uploaded with, none unless Headers or DetectContentType is set.
+func (app *Syncer) headersFor(p string) Headers {
+	var h Headers
+	if app.Headers != nil {
+		h = app.Headers(p)
+	}
+	if h.ContentType == "" && app.DetectContentType {
+		h.ContentType = mime.TypeByExtension(filepath.Ext(p))
+	}
+	return h
+}
@@ -0,0 +1,149 @@
+package syncer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the file at the top of a source folder that lists what WalkAndHash leaves out, one gitignore
+// style pattern per line. A pattern without a slash matches a name at any depth, one with a slash the path from
+// the source folder, ** matches any number of folders, a trailing / only matches folders and ! takes a file back
+// in. Lines starting with # are comments. Ignored folders are not walked into at all, and the ignore rules win
+// over the filters.
+const IgnoreFile = ".s3syncignore"
+
+// ignoreRule is one line of an IgnoreFile.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules are the lines of an IgnoreFile in order, the last one that matches decides.
+type ignoreRules []ignoreRule
+
+// loadIgnore reads the IgnoreFile of the source folder root, none if it has no such file.
+func loadIgnore(root string) (ignoreRules, error) {
+	f, err := os.Open(filepath.Join(root, IgnoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := parseIgnore(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return rules, nil
+}
+
+// parseIgnore parses the patterns of an IgnoreFile.
+func parseIgnore(r io.Reader) (ignoreRules, error) {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		}
+		// \# and \! start patterns that really begin with them
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		expr := "^(.*/)?" + ignoreRegexp(line) + "$"
+		if strings.Contains(line, "/") {
+			// anchored to the source folder
+			expr = "^" + ignoreRegexp(strings.TrimPrefix(line, "/")) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ignoreRegexp turns the glob of an ignore pattern into a regular expression for slash separated paths.
+func ignoreRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[' && strings.IndexByte(glob[i:], ']') > 1:
+			end := i + strings.IndexByte(glob[i:], ']')
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// match reports whether the last rule matching rel, a slash separated path from the source folder, ignores it.
+func (rules ignoreRules) match(rel string, dir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !dir {
+			continue
+		}
+		if rule.re.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// ignores reports whether rel or one of the folders it is in is ignored, a file can't be taken back in from
+// an ignored folder.
+func (rules ignoreRules) ignores(rel string, dir bool) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	for parent := path.Dir(rel); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if rules.match(parent, true) {
+			return true
+		}
+	}
+	return rules.match(rel, dir)
+}
+
+// ignored reports whether the IgnoreFile of the source of p leaves it out, as read by the last walk.
+func (app *Syncer) ignored(p string, dir bool) bool {
+	src, ok := app.sourceFor(p)
+	if !ok || p == src.FolderPath {
+		return false
+	}
+	return app.ignores[src.FolderPath].ignores(app.filterPath(p), dir)
+}
@@ -0,0 +1,128 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrCorruptManifest is a manifest sqlite found damage in. Syncing against it could upload too much or too
+// little, so it has to be repaired first, see RestoreManifest and RebuildManifest.
+var ErrCorruptManifest = errors.New("the manifest is corrupt")
+
+// CheckManifest runs sqlite's integrity_check on the manifest at dbpath, or the faster quick_check, and returns
+// what it found wrong, nothing for a sound manifest. The manifest is opened as it is, without migrating it.
+func CheckManifest(dbpath string, quick bool) ([]string, error) {
+	if _, err := os.Stat(dbpath); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(sqliteDriver, dbpath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	pragma := "pragma integrity_check"
+	if quick {
+		pragma = "pragma quick_check"
+	}
+	rows, err := db.Query(pragma)
+	if corrupt(err) {
+		return []string{err.Error()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		if err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err = rows.Err(); corrupt(err) {
+		return append(problems, err.Error()), nil
+	}
+	return problems, err
+}
+
+// corrupt reports whether err is sqlite saying the file is damaged, as opposed to busy or missing.
+func corrupt(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "malformed") || strings.Contains(err.Error(), "not a database"))
+}
+
+// SoundManifest returns ErrCorruptManifest if quick_check finds damage in the manifest at dbpath. A manifest that
+// doesn't exist yet is sound.
+func SoundManifest(dbpath string) error {
+	problems, err := CheckManifest(dbpath, true)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %w: %s", dbpath, ErrCorruptManifest, problems[0])
+	}
+	return nil
+}
+
+// RestoreManifest replaces the manifest at dbpath with a sound copy of the one at from, like an older copy kept
+// for DiffManifests. The damaged manifest is set aside rather than deleted, its new path is returned.
+func RestoreManifest(dbpath string, from string) (string, error) {
+	problems, err := CheckManifest(from, false)
+	if err != nil {
+		return "", err
+	}
+	if len(problems) > 0 {
+		return "", fmt.Errorf("%s: %w: %s", from, ErrCorruptManifest, problems[0])
+	}
+	aside, err := setAside(dbpath)
+	if err != nil {
+		return "", err
+	}
+	db, err := sql.Open(sqliteDriver, from)
+	if err != nil {
+		return aside, err
+	}
+	defer db.Close()
+	// vacuum into writes a consistent copy, with whatever is still in the copy's WAL
+	_, err = db.Exec("vacuum into ?", dbpath)
+	return aside, err
+}
+
+// RebuildManifest sets the manifest at dbpath aside and builds a new one from the bucket with
+// BuildManifestFromBucket. The Syncer is left with the new manifest open.
+func (app *Syncer) RebuildManifest(ctx context.Context, dbpath string) (string, *AdoptReport, error) {
+	aside, err := setAside(dbpath)
+	if err != nil {
+		return "", nil, err
+	}
+	err = app.InitDb(dbpath)
+	if err != nil {
+		return aside, nil, err
+	}
+	report, err := app.BuildManifestFromBucket(ctx)
+	return aside, report, err
+}
+
+// setAside renames the manifest at dbpath, with its -wal and -shm files, to dbpath.corrupt-<time> and returns the
+// new path.
+func setAside(dbpath string) (string, error) {
+	aside := dbpath + ".corrupt-" + time.Now().UTC().Format("20060102T150405Z")
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(dbpath+suffix, aside+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return aside, nil
+}
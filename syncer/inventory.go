@@ -0,0 +1,59 @@
+package syncer
+
+import (
+	"fmt"
+	"time"
+)
+
+// inventoryInterval is how often the inventory spinner shows how far the walk got. It is also how long a walk
+// runs before the spinner shows at all, so a quick one doesn't flicker.
+const inventoryInterval = 250 * time.Millisecond
+
+// inventory is the terminal output of WalkAndHash: a spinner counting the files found and naming the folder the
+// walk is in, for big trees that would otherwise look hung for minutes.
+type inventory struct {
+	term    terminal
+	off     bool
+	shown   time.Time
+	spinner *spinner
+}
+
+func (app *Syncer) startInventory() *inventory {
+	return &inventory{term: app.term(), off: app.NoSpinners, shown: time.Now()}
+}
+
+// update reports the walk is in dir with files found so far, at most every inventoryInterval.
+func (in *inventory) update(dir string, files int) {
+	if in.off || time.Since(in.shown) < inventoryInterval {
+		return
+	}
+	in.shown = time.Now()
+	text := fmt.Sprintf("Taking inventory of local files: %d so far, in %s", files, dir)
+	if in.spinner == nil {
+		in.spinner, _ = in.term.spinner(text)
+		return
+	}
+	in.spinner.UpdateText(text)
+}
+
+// success ends the inventory with text.
+func (in *inventory) success(text string) {
+	switch {
+	case in.off:
+	case in.spinner != nil:
+		in.spinner.Success(text)
+	default:
+		in.term.success().Println(text)
+	}
+}
+
+// fail ends the inventory with err.
+func (in *inventory) fail(err error) {
+	switch {
+	case in.off:
+	case in.spinner != nil:
+		in.spinner.Fail(err)
+	default:
+		in.term.failure().Println(err)
+	}
+}
@@ -0,0 +1,202 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// objectKey returns the S3 key for the local file p. KeyFunc has the final say if it is set, under the
+// Snapshot prefix when there is one and KeyPrefix. Otherwise SanitizeKeys cleans up the key, see sanitizeKey. Either way
+// ShortenKeys cuts down keys that are too long for S3, see shortenKey.
+func (app *Syncer) objectKey(p string) string {
+	key := app.keyOf(p)
+	if app.ShortenKeys {
+		key = shortenKey(key, MaxKeyLength-keyReserve)
+	}
+	return key
+}
+
+// keyOf is objectKey before ShortenKeys.
+func (app *Syncer) keyOf(p string) string {
+	if app.KeyFunc != nil {
+		return app.prefixKey(app.snapshotKey(app.KeyFunc(p)))
+	}
+	key := app.localize(p)
+	if src, ok := app.sourceFor(p); ok {
+		if prefix, relative := app.sourcePrefix(src); relative {
+			rel, err := filepath.Rel(src.FolderPath, p)
+			if err == nil {
+				key = prefix + filepath.ToSlash(rel)
+			}
+		}
+	}
+	if app.SanitizeKeys {
+		key = sanitizeKey(key)
+	}
+	return app.prefixKey(app.snapshotKey(key))
+}
+
+// sourcePrefix is what the keys of the files under src start with when they are keyed by their path relative to
+// it, false when they are keyed by their full local path. With RelativeKeys and several sources, the ones without
+// a KeyPrefix of their own go under the name of their folder, so they don't key their files the same.
+func (app *Syncer) sourcePrefix(src Source) (string, bool) {
+	switch {
+	case src.KeyPrefix != "":
+		return src.KeyPrefix, true
+	case !app.RelativeKeys:
+		return "", false
+	case len(app.Sources) > 1:
+		return filepath.Base(src.FolderPath) + "/", true
+	}
+	return "", true
+}
+
+// prefixKey puts key under KeyPrefix. A prefix ending in a slash doesn't get another one from a key that is an
+// absolute path.
+func (app *Syncer) prefixKey(key string) string {
+	if app.KeyPrefix == "" {
+		return key
+	}
+	if strings.HasSuffix(app.KeyPrefix, "/") {
+		key = strings.TrimLeft(key, "/")
+	}
+	return app.KeyPrefix + key
+}
+
+// keyProblem describes what makes key awkward to work with, "" if nothing does. S3 takes these keys, but
+// consoles, the CLI and tools that turn keys back into paths trip over them.
+func keyProblem(key string) string {
+	for i, seg := range strings.Split(key, "/") {
+		switch {
+		case seg == "." || seg == "..":
+			return fmt.Sprintf("a %q segment", seg)
+		case seg == "" && i > 0 && i < strings.Count(key, "/"):
+			return "an empty segment"
+		case strings.TrimSpace(seg) != seg:
+			return fmt.Sprintf("leading or trailing space in %q", seg)
+		}
+	}
+	for _, c := range key {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Sprintf("the control character %U", c)
+		}
+	}
+	return ""
+}
+
+// shortenKey cuts key down to limit bytes by replacing its tail with a hash of the whole key, keeping the
+// extension: a/very/long/name.mkv becomes a/very/lo~<16 hex digits>.mkv. The original path stays in the
+// srcpath metadata and the manifest.
+func shortenKey(key string, limit int) string {
+	if len(key) <= limit {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	tail := "~" + hex.EncodeToString(sum[:8])
+	if ext := path.Ext(key); len(ext) <= 16 {
+		tail += ext
+	}
+	keep := limit - len(tail)
+	for keep > 0 && !utf8.RuneStart(key[keep]) {
+		keep--
+	}
+	return key[:keep] + tail
+}
+
+// sanitizeKey fixes what keyProblem finds: control characters, spaces at the ends of a segment and "." and ".."
+// segments are percent encoded, and empty segments are dropped. The original path is in the srcpath metadata.
+func sanitizeKey(key string) string {
+	segs := strings.Split(key, "/")
+	res := segs[:0]
+	for i, seg := range segs {
+		if seg == "" && i > 0 && i < len(segs)-1 {
+			continue
+		}
+		if seg == "." || seg == ".." {
+			res = append(res, strings.ReplaceAll(seg, ".", "%2E"))
+			continue
+		}
+		var b strings.Builder
+		for j, c := range seg {
+			edge := j == 0 || j == len(seg)-1
+			if c < 0x20 || c == 0x7f || c == ' ' && edge {
+				fmt.Fprintf(&b, "%%%02X", c)
+				continue
+			}
+			b.WriteRune(c)
+		}
+		res = append(res, b.String())
+	}
+	return strings.Join(res, "/")
+}
+
+// keyFor returns the key recorded in the manifest for p, so uploads use the same mapping that download/reconcile will.
+// Falls back to objectKey for records that predate the key column.
+func (app *Syncer) keyFor(p string) (string, error) {
+	key, err := app.recordedKey(p)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return app.objectKey(p), nil
+	}
+	if app.ShortenKeys && len(key) > MaxKeyLength {
+		// recorded before ShortenKeys was on, a key this long never went up
+		key = shortenKey(key, MaxKeyLength-keyReserve)
+		return key, app.setKey(p, key)
+	}
+	return key, nil
+}
+
+// partKey returns the S3 key for piece index of a split file stored under key.
+func partKey(key string, index int) string {
+	return fmt.Sprintf("%s.part%d", key, index)
+}
+
+// partPlaceholder matches {key}, {index}, {number} and {total} in a PartKeyTemplate, with an optional zero padded width.
+var partPlaceholder = regexp.MustCompile(`\{(key|index|number|total)(?::(\d+))?\}`)
+
+// ValidatePartTemplate checks that template gives every piece its own key.
+func ValidatePartTemplate(template string) error {
+	for _, m := range partPlaceholder.FindAllStringSubmatch(template, -1) {
+		if m[1] == "index" || m[1] == "number" {
+			return nil
+		}
+	}
+	return fmt.Errorf("part key template %q needs {index} or {number}, or every part gets the same key", template)
+}
+
+// partKeyFor returns the S3 key for piece index of total pieces of a split file stored under key, laid out by
+// PartKeyTemplate. {index} counts from 0 and {number} from 1, so "parts/{key}.p{number:4}of{total:4}" gives
+// parts/movie.mkv.p0001of0003. Without a template it is partKey.
+func (app *Syncer) partKeyFor(key string, index int, total int) string {
+	if app.PartKeyTemplate == "" {
+		return partKey(key, index)
+	}
+	return partPlaceholder.ReplaceAllStringFunc(app.PartKeyTemplate, func(s string) string {
+		m := partPlaceholder.FindStringSubmatch(s)
+		var n int
+		switch m[1] {
+		case "key":
+			return key
+		case "index":
+			n = index
+		case "number":
+			n = index + 1
+		case "total":
+			n = total
+		}
+		if m[2] == "" {
+			return strconv.Itoa(n)
+		}
+		width, _ := strconv.Atoi(m[2])
+		return fmt.Sprintf("%0*d", width, n)
+	})
+}
@@ -0,0 +1,156 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// LifecycleOptions describes the bucket side settings that should match how the syncer uploads.
+type LifecycleOptions struct {
+	// Prefix limits the rule to keys under it, empty for the whole bucket.
+	Prefix string
+	// TransitionDays moves objects to TransitionClass after this many days, 0 for no transition.
+	TransitionDays  int32
+	TransitionClass types.TransitionStorageClass
+	// ExpireDays deletes objects after this many days, 0 to keep them forever.
+	ExpireDays int32
+	// NoncurrentExpireDays deletes the older versions of objects in a versioned bucket this many days after they
+	// were overwritten or deleted, 0 to keep them forever.
+	NoncurrentExpireDays int32
+	// AbortIncompleteDays cleans up multipart uploads that were never completed, 0 to leave them.
+	AbortIncompleteDays int32
+}
+
+// LifecyclePolicy is a bucket lifecycle configuration in the JSON shape the aws cli takes
+// for put-bucket-lifecycle-configuration.
+type LifecyclePolicy struct {
+	Rules []LifecyclePolicyRule `json:"Rules"`
+}
+
+type LifecyclePolicyRule struct {
+	ID                             string                 `json:"ID"`
+	Status                         string                 `json:"Status"`
+	Filter                         LifecycleFilter        `json:"Filter"`
+	Transitions                    []LifecycleTransition  `json:"Transitions,omitempty"`
+	Expiration                     *LifecycleExpiration   `json:"Expiration,omitempty"`
+	NoncurrentVersionExpiration    *LifecycleNoncurrent   `json:"NoncurrentVersionExpiration,omitempty"`
+	AbortIncompleteMultipartUpload *LifecycleAbortUploads `json:"AbortIncompleteMultipartUpload,omitempty"`
+}
+
+type LifecycleFilter struct {
+	Prefix string `json:"Prefix"`
+}
+
+type LifecycleTransition struct {
+	Days         int32  `json:"Days"`
+	StorageClass string `json:"StorageClass"`
+}
+
+type LifecycleExpiration struct {
+	Days int32 `json:"Days"`
+}
+
+type LifecycleNoncurrent struct {
+	NoncurrentDays int32 `json:"NoncurrentDays"`
+}
+
+type LifecycleAbortUploads struct {
+	DaysAfterInitiation int32 `json:"DaysAfterInitiation"`
+}
+
+// GenerateLifecycle builds the lifecycle policy for opts.
+func GenerateLifecycle(opts LifecycleOptions) LifecyclePolicy {
+	rule := LifecyclePolicyRule{
+		ID:     "s3sync",
+		Status: string(types.ExpirationStatusEnabled),
+		Filter: LifecycleFilter{Prefix: opts.Prefix},
+	}
+	if opts.TransitionDays > 0 {
+		class := opts.TransitionClass
+		if class == "" {
+			class = types.TransitionStorageClassDeepArchive
+		}
+		rule.Transitions = append(rule.Transitions, LifecycleTransition{Days: opts.TransitionDays, StorageClass: string(class)})
+	}
+	if opts.ExpireDays > 0 {
+		rule.Expiration = &LifecycleExpiration{Days: opts.ExpireDays}
+	}
+	if opts.NoncurrentExpireDays > 0 {
+		rule.NoncurrentVersionExpiration = &LifecycleNoncurrent{NoncurrentDays: opts.NoncurrentExpireDays}
+	}
+	if opts.AbortIncompleteDays > 0 {
+		rule.AbortIncompleteMultipartUpload = &LifecycleAbortUploads{DaysAfterInitiation: opts.AbortIncompleteDays}
+	}
+	return LifecyclePolicy{Rules: []LifecyclePolicyRule{rule}}
+}
+
+// ApplyLifecycle puts the rules of policy on the bucket. A rule already there with the ID of one of them is
+// replaced, the rules of the bucket with other IDs are kept.
+func (app *Syncer) ApplyLifecycle(ctx context.Context, policy LifecyclePolicy) error {
+	cfg := policy.configuration()
+	ours := make(map[string]bool, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		ours[aws.ToString(r.ID)] = true
+	}
+	out, err := app.S3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket:              aws.String(app.Bucket),
+		ExpectedBucketOwner: app.bucketOwner(),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration":
+		// nothing to keep
+	case err != nil:
+		return err
+	default:
+		var kept []types.LifecycleRule
+		for _, r := range out.Rules {
+			if !ours[aws.ToString(r.ID)] {
+				kept = append(kept, r)
+			}
+		}
+		cfg.Rules = append(kept, cfg.Rules...)
+	}
+	_, err = app.S3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(app.Bucket),
+		LifecycleConfiguration: cfg,
+		ExpectedBucketOwner:    app.bucketOwner(),
+	})
+	return err
+}
+
+// configuration converts the policy into the sdk type.
+func (policy LifecyclePolicy) configuration() *types.BucketLifecycleConfiguration {
+	var rules []types.LifecycleRule
+	for _, r := range policy.Rules {
+		rule := types.LifecycleRule{
+			ID:     aws.String(r.ID),
+			Status: types.ExpirationStatus(r.Status),
+			Filter: &types.LifecycleRuleFilter{Prefix: aws.String(r.Filter.Prefix)},
+		}
+		for _, t := range r.Transitions {
+			rule.Transitions = append(rule.Transitions, types.Transition{
+				Days:         aws.Int32(t.Days),
+				StorageClass: types.TransitionStorageClass(t.StorageClass),
+			})
+		}
+		if r.Expiration != nil {
+			rule.Expiration = &types.LifecycleExpiration{Days: aws.Int32(r.Expiration.Days)}
+		}
+		if r.NoncurrentVersionExpiration != nil {
+			rule.NoncurrentVersionExpiration = &types.NoncurrentVersionExpiration{NoncurrentDays: aws.Int32(r.NoncurrentVersionExpiration.NoncurrentDays)}
+		}
+		if r.AbortIncompleteMultipartUpload != nil {
+			rule.AbortIncompleteMultipartUpload = &types.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int32(r.AbortIncompleteMultipartUpload.DaysAfterInitiation),
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return &types.BucketLifecycleConfiguration{Rules: rules}
+}
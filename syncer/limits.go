@@ -0,0 +1,93 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"s3sync/splitter"
+)
+
+// MaxPutSize is the largest object S3 accepts in a single PutObject, 5GiB.
+const MaxPutSize int64 = 5 * 1024 * 1024 * 1024
+
+// MaxObjectSize is the largest logical object S3 can hold, 5TiB.
+const MaxObjectSize int64 = 5 * 1024 * 1024 * 1024 * 1024
+
+// MaxParts is the most parts S3 allows for one object.
+const MaxParts = 10000
+
+// MinPartSize is the smallest part S3 allows in a multipart upload, except for the last one.
+const MinPartSize int64 = 5 * 1024 * 1024
+
+// MaxKeyLength is the longest object key S3 allows, in bytes of UTF-8.
+const MaxKeyLength = 1024
+
+// keyReserve is what ShortenKeys leaves free under MaxKeyLength, for the .partN and sidecar suffixes that
+// other objects add to a key.
+const keyReserve = 32
+
+// DefaultTargetParts is the part count sync --adaptive-parts aims for.
+const DefaultTargetParts = 1000
+
+// ErrTooLarge is returned for files over the single PUT limit when Syncer.NoSplit is set.
+var ErrTooLarge = errors.New("file is too large for a single PUT and splitting is off")
+
+// putLimits is the largest single PUT for each storage class. Every AWS class takes the same 5GiB today,
+// the table is here so stores with other limits can be described through Syncer.PutLimits.
+var putLimits = map[types.StorageClass]int64{
+	types.StorageClassStandard:           MaxPutSize,
+	types.StorageClassReducedRedundancy:  MaxPutSize,
+	types.StorageClassStandardIa:         MaxPutSize,
+	types.StorageClassOnezoneIa:          MaxPutSize,
+	types.StorageClassIntelligentTiering: MaxPutSize,
+	types.StorageClassGlacier:            MaxPutSize,
+	types.StorageClassGlacierIr:          MaxPutSize,
+	types.StorageClassDeepArchive:        MaxPutSize,
+}
+
+// putLimit returns the largest file that can go up as one object in class, anything bigger gets split.
+// Syncer.PutLimits wins over the built in table.
+func (app *Syncer) putLimit(class types.StorageClass) int64 {
+	if limit, ok := app.PutLimits[class]; ok && limit > 0 {
+		return limit
+	}
+	if limit, ok := putLimits[class]; ok {
+		return limit
+	}
+	return MaxPutSize
+}
+
+// pieceSize returns the size to split a file of size bytes into, each piece at most limit. It starts from
+// PartSize, or the biggest piece the splitter writes, and grows it when the file would need more than MaxParts.
+// With TargetParts it is worked out from size instead, see adaptivePieceSize.
+// Files that can't fit at all fail here, before anything is split or uploaded.
+func (app *Syncer) pieceSize(size int64, limit int64) (int64, error) {
+	if size > MaxObjectSize {
+		return 0, fmt.Errorf("file is %d bytes, more than the %d S3 can store as one object", size, MaxObjectSize)
+	}
+	piece := app.PartSize
+	if piece <= 0 {
+		piece = splitter.MaxPieceSize
+	}
+	if app.TargetParts > 0 {
+		piece = adaptivePieceSize(size, app.TargetParts)
+	}
+	piece = min(piece, limit)
+	if need := (size + MaxParts - 1) / MaxParts; piece < need {
+		piece = need
+	}
+	if piece > limit {
+		return 0, fmt.Errorf("file is %d bytes, it needs parts of %d bytes to stay within %d parts but the limit is %d", size, piece, MaxParts, limit)
+	}
+	return piece, nil
+}
+
+// adaptivePieceSize splits size into at most target parts of at least MinPartSize, grown so they come out even
+// rather than leaving a sliver at the end.
+func adaptivePieceSize(size int64, target int) int64 {
+	piece := max((size+int64(target)-1)/int64(target), MinPartSize)
+	parts := max(size/piece, 1)
+	return (size + parts - 1) / parts
+}
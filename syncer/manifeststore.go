@@ -0,0 +1,596 @@
+package syncer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNeedsSQLite is a feature used with a Syncer.Manifest other than the SQLite one, whose tables only it has.
+var ErrNeedsSQLite = errors.New("needs the SQLite manifest, see Syncer.InitDb")
+
+// ManifestStore is what the manifest of the synced files and their parts is kept in. The walk, the upload list
+// and the uploads only go through this, so the syncer can be embedded with another store by implementing it and
+// setting Syncer.Manifest. InitDb keeps it in SQLite, which also holds the run history, ETags, delta signatures,
+// snapshots, plans and the rest, the features built on those fail with ErrNeedsSQLite without it.
+type ManifestStore interface {
+	// Get returns the record of the file p, false if there is none.
+	Get(p string) (FileRecord, bool, error)
+	// List returns the records of every file, tombstoned ones included, in path order.
+	List() ([]FileRecord, error)
+	// ListPending returns the files that aren't complete or deleted, leaving out the ones that failed maxFailures
+	// times or more unless it is 0.
+	ListPending(maxFailures int) ([]string, error)
+	// UpdateRecord adds p, or puts it back in the upload list, as modified at mod and uploaded as key. It is
+	// pending and not multipart again with no failures, what was recorded of its content stays.
+	UpdateRecord(p string, mod int64, key string) error
+	// SetModified records mod as the modification time of p and leaves the rest as it is.
+	SetModified(p string, mod int64) error
+	// SetKey records key as the object key of p.
+	SetKey(p string, key string) error
+	// RenameKey records key as the object key of p and puts it back in the upload list, as a whole file.
+	RenameKey(p string, key string) error
+	// SetLink records p as a hardlink of target, or a file of its own when target is empty, to be uploaded.
+	SetLink(p string, target string) error
+	// SetDeleted tombstones p as deleted at the unix time at, if it isn't already, or brings it back when at is 0.
+	SetDeleted(p string, at int64) error
+	// SetStatus moves the file p to status.
+	SetStatus(p string, status string) error
+	// UpdateUploadStatus completes p, unless it is multipart: a split file completes with the last of its parts.
+	UpdateUploadStatus(p string) error
+	// CompleteUpload records what p was uploaded with, sum and size, clears its failures and completes it like
+	// UpdateUploadStatus, all in one change.
+	CompleteUpload(p string, sum string, size int64) error
+	// RecordFailure counts another failed upload of p.
+	RecordFailure(p string) error
+	// ResetFailures clears the failure count of every file.
+	ResetFailures() error
+	// RecordParts marks p multipart and replaces its parts with parts, in order.
+	RecordParts(p string, parts []PartRecord) error
+	// Parts returns the recorded parts of the file p in order, none if it was never split.
+	Parts(p string) ([]Part, error)
+	// SetPartStatus moves the part recorded as part to status. The file fails with any of its parts and
+	// completes once all of them are.
+	SetPartStatus(part string, status string) error
+	// Batch runs fn as one change: if it returns an error, nothing fn recorded is kept.
+	Batch(fn func() error) error
+}
+
+// FileRecord is what a ManifestStore keeps of one synced file. Size is -1 and SHA256 empty until it was
+// uploaded, Deleted is the unix time it was tombstoned, 0 while it is there.
+type FileRecord struct {
+	Path      string
+	Modified  int64
+	Key       string
+	Status    string
+	Uploaded  bool
+	Multipart bool
+	Size      int64
+	SHA256    string
+	Failures  int
+	Deleted   int64
+	LinkOf    string
+}
+
+// PartRecord is a piece of a split file for RecordParts. Offset and Size are -1 and SHA256 empty when the piece
+// wasn't on disk to be measured, see recordParts.
+type PartRecord struct {
+	Path   string
+	Key    string
+	Offset int64
+	Size   int64
+	SHA256 string
+}
+
+// records returns the ManifestStore the files are kept in, Manifest or the SQLite manifest of InitDb.
+func (app *Syncer) records() ManifestStore {
+	if app.Manifest != nil {
+		return app.Manifest
+	}
+	return sqliteManifest{app}
+}
+
+// needSQLite fails feature with ErrNeedsSQLite when the files are kept in a Manifest other than SQLite.
+func (app *Syncer) needSQLite(feature string) error {
+	if app.db == nil && app.Manifest != nil {
+		return fmt.Errorf("%s: %w", feature, ErrNeedsSQLite)
+	}
+	return nil
+}
+
+// sqliteOnly returns the first option set that keeps its state in SQLite tables of its own, empty if none is.
+func (app *Syncer) sqliteOnly() string {
+	switch {
+	case app.DeltaMode:
+		return "DeltaMode"
+	case app.Snapshot != "":
+		return "Snapshot"
+	case app.CheckpointWalk:
+		return "CheckpointWalk"
+	case app.EncryptionKey != nil:
+		return "EncryptionKey"
+	case app.Compression != "":
+		return "Compression"
+	case app.DetectDrift:
+		return "DetectDrift"
+	case app.NativeMultipart:
+		return "NativeMultipart"
+	}
+	return ""
+}
+
+// sqliteManifest is the ManifestStore of InitDb, the videos and parts tables. It goes through manifest, so
+// what UpdateManifest records is part of its transaction.
+type sqliteManifest struct {
+	app *Syncer
+}
+
+func (m sqliteManifest) Get(p string) (FileRecord, bool, error) {
+	rec, err := scanRecord(m.app.manifest().QueryRow(SELECTFILERECORD, p))
+	if err == sql.ErrNoRows {
+		return FileRecord{}, false, nil
+	}
+	if err != nil {
+		return FileRecord{}, false, err
+	}
+	return rec, true, nil
+}
+
+func (m sqliteManifest) List() ([]FileRecord, error) {
+	rows, err := m.app.manifest().Query(SELECTFILERECORDS)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []FileRecord
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, rows.Err()
+}
+
+// scanRecord reads a FileRecord from a row of SELECTFILERECORD.
+func scanRecord(row interface{ Scan(...any) error }) (FileRecord, error) {
+	var rec FileRecord
+	err := row.Scan(&rec.Path, &rec.Modified, &rec.Key, &rec.Status, &rec.Uploaded, &rec.Multipart, &rec.Size, &rec.SHA256, &rec.Failures, &rec.Deleted, &rec.LinkOf)
+	return rec, err
+}
+
+func (m sqliteManifest) ListPending(maxFailures int) ([]string, error) {
+	return m.app.queryPaths(SELECTUPLOADLIST, maxFailures)
+}
+
+func (m sqliteManifest) UpdateRecord(p string, mod int64, key string) error {
+	_, err := m.app.manifest().Exec(UPSERTRECORD, p, mod, key)
+	return err
+}
+
+func (m sqliteManifest) SetModified(p string, mod int64) error {
+	_, err := m.app.manifest().Exec(UPDATEMODIFIED, mod, p)
+	return err
+}
+
+func (m sqliteManifest) SetKey(p string, key string) error {
+	_, err := m.app.manifest().Exec(UPDATEKEY, key, p)
+	return err
+}
+
+func (m sqliteManifest) RenameKey(p string, key string) error {
+	_, err := m.app.manifest().Exec(RENAMEKEY, key, p)
+	return err
+}
+
+func (m sqliteManifest) SetLink(p string, target string) error {
+	_, err := m.app.manifest().Exec(SETLINK, target, p)
+	return err
+}
+
+func (m sqliteManifest) SetDeleted(p string, at int64) error {
+	var err error
+	if at == 0 {
+		_, err = m.app.manifest().Exec(CLEARTOMBSTONE, p)
+	} else {
+		_, err = m.app.manifest().Exec(SETTOMBSTONE, at, p)
+	}
+	return err
+}
+
+func (m sqliteManifest) SetStatus(p string, status string) error {
+	_, err := m.app.manifest().Exec(UPDATESTATUS, status, p)
+	return err
+}
+
+func (m sqliteManifest) UpdateUploadStatus(p string) error {
+	_, err := m.app.manifest().Exec(UPDATEUPLOADSTATUS, p)
+	return err
+}
+
+func (m sqliteManifest) CompleteUpload(p string, sum string, size int64) error {
+	tx, err := m.app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(RESETFAILURES, p)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(UPDATEHASH, sum, size, p)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(UPDATEUPLOADSTATUS, p)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m sqliteManifest) RecordFailure(p string) error {
+	_, err := m.app.manifest().Exec(INCREMENTFAILURES, p)
+	return err
+}
+
+func (m sqliteManifest) ResetFailures() error {
+	_, err := m.app.manifest().Exec(RESETALLFAILURES)
+	return err
+}
+
+func (m sqliteManifest) RecordParts(p string, parts []PartRecord) error {
+	id, err := m.app.setMultipart(p)
+	if err != nil {
+		return err
+	}
+	return m.app.insertParts(id, parts)
+}
+
+func (m sqliteManifest) Parts(p string) ([]Part, error) {
+	rows, err := m.app.manifest().Query(SELECTPARTS, p)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Part
+	for rows.Next() {
+		var part Part
+		err = rows.Scan(&part.Path, &part.Index, &part.Offset, &part.Size, &part.SHA256, &part.Key, &part.Status)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, part)
+	}
+	return res, rows.Err()
+}
+
+// SetPartStatus leaves the roll up to the parts_complete and parts_failed triggers.
+func (m sqliteManifest) SetPartStatus(part string, status string) error {
+	if status == StatusComplete {
+		_, err := m.app.manifest().Exec(UPDATEUPLOADSTATUSPART, part)
+		return err
+	}
+	_, err := m.app.manifest().Exec(UPDATEPARTSTATUS, status, part)
+	return err
+}
+
+// Batch runs fn in the transaction manifest hands out, so the other tables fn writes commit with the files.
+func (m sqliteManifest) Batch(fn func() error) error {
+	if m.app.manifestTx != nil {
+		return fn()
+	}
+	tx, err := m.app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	m.app.manifestTx = tx
+	defer func() { m.app.manifestTx = nil }()
+	err = fn()
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// JSONFormat is the version of the file a JSONManifest writes.
+const JSONFormat = 1
+
+// JSONManifest is a ManifestStore kept in a JSON file, for embedding the syncer without SQLite and the cgo it
+// takes. It holds the whole manifest in memory and writes the file again after every change outside a Batch, so
+// it suits trees of thousands of files rather than millions. The file is replaced by a rename, a crash leaves
+// either the old manifest or the new one.
+type JSONManifest struct {
+	path string
+	// mu guards files, uploads record their progress from several goroutines
+	mu    sync.Mutex
+	files map[string]*jsonFile
+	// partOf is the file each recorded part belongs to
+	partOf map[string]string
+	// saved is the manifest as the running Batch found it, nil outside one
+	saved map[string]*jsonFile
+}
+
+// jsonFile is a file of a JSONManifest with its parts.
+type jsonFile struct {
+	FileRecord
+	Parts []Part `json:",omitempty"`
+}
+
+// jsonManifestFile is the JSON of a JSONManifest.
+type jsonManifestFile struct {
+	Format int         `json:"format"`
+	Files  []*jsonFile `json:"files"`
+}
+
+// OpenJSONManifest reads the JSONManifest in the file at path, an empty one if there is no file yet.
+func OpenJSONManifest(path string) (*JSONManifest, error) {
+	m := &JSONManifest{path: path, files: map[string]*jsonFile{}, partOf: map[string]string{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved jsonManifestFile
+	err = json.Unmarshal(b, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if saved.Format > JSONFormat {
+		return nil, fmt.Errorf("%s: %w", path, ErrNewerManifest)
+	}
+	for _, f := range saved.Files {
+		m.files[f.Path] = f
+		for _, part := range f.Parts {
+			m.partOf[part.Path] = f.Path
+		}
+	}
+	return m, nil
+}
+
+// save writes the manifest to its file, unless a Batch is running. It is called with mu held.
+func (m *JSONManifest) save() error {
+	if m.saved != nil {
+		return nil
+	}
+	saved := jsonManifestFile{Format: JSONFormat, Files: make([]*jsonFile, 0, len(m.files))}
+	for _, f := range m.files {
+		saved.Files = append(saved.Files, f)
+	}
+	sort.Slice(saved.Files, func(i, j int) bool { return saved.Files[i].Path < saved.Files[j].Path })
+	b, err := json.MarshalIndent(saved, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// update runs fn on the record of p and saves the manifest, p not being recorded changes nothing.
+func (m *JSONManifest) update(p string, fn func(f *jsonFile)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[p]
+	if !ok {
+		return nil
+	}
+	fn(f)
+	return m.save()
+}
+
+func (m *JSONManifest) Get(p string) (FileRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[p]
+	if !ok {
+		return FileRecord{}, false, nil
+	}
+	return f.FileRecord, true, nil
+}
+
+func (m *JSONManifest) List() ([]FileRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]FileRecord, 0, len(m.files))
+	for _, f := range m.files {
+		res = append(res, f.FileRecord)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res, nil
+}
+
+func (m *JSONManifest) ListPending(maxFailures int) ([]string, error) {
+	recs, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, rec := range recs {
+		if rec.Status != StatusComplete && rec.Deleted == 0 && (maxFailures == 0 || rec.Failures < maxFailures) {
+			res = append(res, rec.Path)
+		}
+	}
+	return res, nil
+}
+
+func (m *JSONManifest) UpdateRecord(p string, mod int64, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[p]
+	if !ok {
+		f = &jsonFile{FileRecord: FileRecord{Path: p, Size: -1}}
+		m.files[p] = f
+	}
+	f.Modified, f.Key, f.Uploaded, f.Multipart, f.Status, f.Failures = mod, key, false, false, StatusPending, 0
+	return m.save()
+}
+
+func (m *JSONManifest) SetModified(p string, mod int64) error {
+	return m.update(p, func(f *jsonFile) { f.Modified = mod })
+}
+
+func (m *JSONManifest) SetKey(p string, key string) error {
+	return m.update(p, func(f *jsonFile) { f.Key = key })
+}
+
+func (m *JSONManifest) RenameKey(p string, key string) error {
+	return m.update(p, func(f *jsonFile) { f.Key, f.Uploaded, f.Multipart, f.Status = key, false, false, StatusPending })
+}
+
+func (m *JSONManifest) SetLink(p string, target string) error {
+	return m.update(p, func(f *jsonFile) { f.LinkOf, f.Uploaded, f.Status = target, false, StatusPending })
+}
+
+func (m *JSONManifest) SetDeleted(p string, at int64) error {
+	return m.update(p, func(f *jsonFile) {
+		if at == 0 || f.Deleted == 0 {
+			f.Deleted = at
+		}
+	})
+}
+
+func (m *JSONManifest) SetStatus(p string, status string) error {
+	return m.update(p, func(f *jsonFile) { f.Status = status })
+}
+
+func (m *JSONManifest) UpdateUploadStatus(p string) error {
+	return m.update(p, func(f *jsonFile) {
+		if !f.Multipart {
+			f.Uploaded, f.Status = true, StatusComplete
+		}
+	})
+}
+
+func (m *JSONManifest) CompleteUpload(p string, sum string, size int64) error {
+	return m.update(p, func(f *jsonFile) {
+		f.Failures, f.SHA256, f.Size = 0, sum, size
+		if !f.Multipart {
+			f.Uploaded, f.Status = true, StatusComplete
+		}
+	})
+}
+
+func (m *JSONManifest) RecordFailure(p string) error {
+	return m.update(p, func(f *jsonFile) { f.Failures++ })
+}
+
+func (m *JSONManifest) ResetFailures() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.files {
+		f.Failures = 0
+	}
+	return m.save()
+}
+
+func (m *JSONManifest) RecordParts(p string, parts []PartRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[p]
+	if !ok {
+		return nil
+	}
+	for _, part := range f.Parts {
+		delete(m.partOf, part.Path)
+	}
+	f.Multipart = true
+	f.Parts = make([]Part, len(parts))
+	for i, part := range parts {
+		f.Parts[i] = Part{Path: part.Path, Index: i, Offset: part.Offset, Size: part.Size, SHA256: part.SHA256, Key: part.Key, Status: StatusPending}
+		m.partOf[part.Path] = p
+	}
+	return m.save()
+}
+
+func (m *JSONManifest) Parts(p string) ([]Part, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[p]
+	if !ok {
+		return nil, nil
+	}
+	return append([]Part(nil), f.Parts...), nil
+}
+
+// SetPartStatus rolls the status up to the file the way the parts triggers of the SQLite manifest do.
+func (m *JSONManifest) SetPartStatus(part string, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[m.partOf[part]]
+	if !ok {
+		return nil
+	}
+	complete := true
+	for i := range f.Parts {
+		if f.Parts[i].Path == part {
+			f.Parts[i].Status = status
+		}
+		complete = complete && f.Parts[i].Status == StatusComplete
+	}
+	switch {
+	case status == StatusComplete && complete:
+		f.Uploaded, f.Status = true, StatusComplete
+	case status == StatusFailed:
+		f.Uploaded, f.Status = false, StatusFailed
+	}
+	return m.save()
+}
+
+// Batch keeps what fn records in memory and saves it once fn returns, or goes back to the manifest as it was.
+func (m *JSONManifest) Batch(fn func() error) error {
+	m.mu.Lock()
+	if m.saved != nil {
+		m.mu.Unlock()
+		return fn()
+	}
+	m.saved = make(map[string]*jsonFile, len(m.files))
+	for p, f := range m.files {
+		kept := *f
+		kept.Parts = append([]Part(nil), f.Parts...)
+		m.saved[p] = &kept
+	}
+	m.mu.Unlock()
+
+	err := fn()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.files = m.saved
+		m.partOf = map[string]string{}
+		for p, f := range m.files {
+			for _, part := range f.Parts {
+				m.partOf[part.Path] = p
+			}
+		}
+		m.saved = nil
+		return err
+	}
+	m.saved = nil
+	return m.save()
+}
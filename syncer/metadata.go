@@ -0,0 +1,127 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Object metadata keys, stored as x-amz-meta-<key>.
+const (
+	MetaMode = "mode"
+	MetaUid  = "uid"
+	MetaGid  = "gid"
+	// MetaMtime is the modification time of the file, RFC 3339 with nanoseconds.
+	MetaMtime = "mtime"
+	// MetaRunLabel is the RunLabel of the run that uploaded the object.
+	MetaRunLabel = "run-label"
+	// MetaSrcPath is the path of the file relative to its source folder, so the key mapping can be rebuilt
+	// from the objects alone if the manifest is lost.
+	MetaSrcPath = "srcpath"
+)
+
+// MaxMetadataSize is the most user metadata S3 takes on an object, counting the keys and values of ours too.
+const MaxMetadataSize = 2048
+
+// reservedMetadata are the keys s3sync keeps for itself, custom metadata can't use them.
+var reservedMetadata = []string{MetaMode, MetaUid, MetaGid, MetaMtime, MetaSymlink, MetaRunLabel, MetaSrcPath, MetaSparse, MetaXattrs, MetaXattrSidecar, MetaCipher, MetaKeyID, MetaNonce, MetaCompression}
+
+// ValidateMetadata checks meta can be stored as custom object metadata. S3 sends it as x-amz-meta-<key> headers
+// and lowercases the keys, so keys are lowercase letters, digits, '-', '_' and '.', and values printable ascii.
+func ValidateMetadata(meta map[string]string) error {
+	for k, v := range meta {
+		if k == "" {
+			return errors.New("metadata key is empty")
+		}
+		for _, c := range k {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				return fmt.Errorf("metadata key %q: only lowercase letters, digits, '-', '_' and '.' are allowed", k)
+			}
+		}
+		if slices.Contains(reservedMetadata, k) {
+			return fmt.Errorf("metadata key %q is used by s3sync", k)
+		}
+		for _, c := range v {
+			if c < 0x20 || c > 0x7e {
+				return fmt.Errorf("metadata %s: the value has to be printable ascii", k)
+			}
+		}
+	}
+	return nil
+}
+
+// addUserMetadata adds Metadata and what MetadataFunc picks for p to meta, failing on keys that don't validate
+// and when the metadata of p comes to more than MaxMetadataSize.
+func (app *Syncer) addUserMetadata(p string, meta map[string]string) error {
+	var custom map[string]string
+	if app.MetadataFunc != nil {
+		custom = app.MetadataFunc(p)
+	}
+	for _, m := range []map[string]string{app.Metadata, custom} {
+		err := ValidateMetadata(m)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		for k, v := range m {
+			meta[k] = v
+		}
+	}
+	size := 0
+	for k, v := range meta {
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		return fmt.Errorf("%s: its metadata is %d bytes, S3 takes %d: %w", p, size, MaxMetadataSize, ErrTooLarge)
+	}
+	return nil
+}
+
+// fileMetadata builds the object metadata stored alongside the file p described by info.
+func (app *Syncer) fileMetadata(p string, info os.FileInfo) map[string]string {
+	meta := map[string]string{MetaSrcPath: app.srcPath(p)}
+	if app.RunLabel != "" {
+		meta[MetaRunLabel] = app.RunLabel
+	}
+	if app.PreservePermissions {
+		for k, v := range posixMetadata(info) {
+			meta[k] = v
+		}
+		meta[MetaMtime] = info.ModTime().UTC().Format(time.RFC3339Nano)
+	}
+	return meta
+}
+
+// restoreModTime sets the modification time in meta on p, if it has one.
+func restoreModTime(p string, meta map[string]string) error {
+	v, ok := meta[MetaMtime]
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", MetaMtime, err)
+	}
+	return os.Chtimes(p, t, t)
+}
+
+// srcPath returns p relative to the folder it was found in, with forward slashes. Metadata travels as an HTTP
+// header so anything outside printable ascii is percent encoded.
+func (app *Syncer) srcPath(p string) string {
+	rel := p
+	if src, ok := app.sourceFor(p); ok {
+		if r, err := filepath.Rel(src.FolderPath, p); err == nil {
+			rel = r
+		}
+	}
+	rel = filepath.ToSlash(rel)
+	for _, c := range rel {
+		if c < 0x20 || c > 0x7e {
+			return url.PathEscape(rel)
+		}
+	}
+	return rel
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+
+package syncer
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// posixMetadata returns st_mode, uid and gid of the file described by info.
+func posixMetadata(info os.FileInfo) map[string]string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return map[string]string{MetaMode: strconv.FormatUint(uint64(info.Mode().Perm()), 8)}
+	}
+	return map[string]string{
+		MetaMode: strconv.FormatUint(uint64(st.Mode), 8),
+		MetaUid:  strconv.FormatUint(uint64(st.Uid), 10),
+		MetaGid:  strconv.FormatUint(uint64(st.Gid), 10),
+	}
+}
+
+// restorePosixMetadata reapplies the mode and ownership in meta to the file p.
+// Changing ownership usually needs root, so a permission error there is not treated as a failure.
+func restorePosixMetadata(p string, meta map[string]string) error {
+	if m, ok := meta[MetaMode]; ok {
+		mode, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			return err
+		}
+		err = syscall.Chmod(p, uint32(mode&07777))
+		if err != nil {
+			return err
+		}
+	}
+	uid, uidErr := strconv.Atoi(meta[MetaUid])
+	gid, gidErr := strconv.Atoi(meta[MetaGid])
+	if uidErr != nil || gidErr != nil {
+		return nil
+	}
+	err := os.Lchown(p, uid, gid)
+	if err != nil && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	return nil
+}
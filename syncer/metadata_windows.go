@@ -0,0 +1,15 @@
+//go:build windows
+
+package syncer
+
+import "os"
+
+// posixMetadata is a no-op on windows, there are no mode bits or owners worth keeping.
+func posixMetadata(info os.FileInfo) map[string]string {
+	return nil
+}
+
+// restorePosixMetadata is a no-op on windows.
+func restorePosixMetadata(p string, meta map[string]string) error {
+	return nil
+}
@@ -0,0 +1,76 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// multipart returns the store to upload files over the PUT limit to as one object, if NativeMultipart is set
+// and the store can.
+func (app *Syncer) multipart() (MultipartStore, bool) {
+	if !app.NativeMultipart {
+		return nil, false
+	}
+	store, ok := app.store().(MultipartStore)
+	return store, ok
+}
+
+// putMultipart uploads src for obj as the single object key with the multipart API, each part read straight
+// from the file so nothing is split to disk. The parts are pieceSize big. A file split on an earlier upload
+// forgets its pieces, it is one object now. With a ResumableStore an upload a run didn't finish is carried on, see
+// putResumable, unless the content was made for this upload alone, like by a Transform.
+func (app *Syncer) putMultipart(ctx context.Context, store MultipartStore, obj string, src string, key string, info fs.FileInfo, class types.StorageClass, opts PutOptions) error {
+	partSize, err := app.pieceSize(info.Size(), app.putLimit(class))
+	if err != nil {
+		return fmt.Errorf("%s: %w", obj, err)
+	}
+	err = app.clearParts(obj)
+	if err != nil {
+		return err
+	}
+	opts.StorageClass = string(class)
+	if resumable, ok := store.(ResumableStore); ok && src == obj {
+		etag, err := app.putResumable(ctx, resumable, obj, key, info, partSize, opts)
+		if err != nil {
+			return err
+		}
+		return app.recordETag(key, etag, class)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var body io.ReaderAt = f
+	if app.reportsBytes(info.Size()) {
+		body = &progressReaderAt{file: f, size: info.Size(), report: func(read int64) {
+			app.emit(ProgressEvent{Type: BytesProgress, Path: obj, Bytes: read, Size: info.Size()})
+		}}
+	}
+	etag, err := store.PutParts(ctx, key, app.limitedAt(ctx, body), info.Size(), partSize, opts)
+	if err != nil {
+		return err
+	}
+	return app.recordETag(key, etag, class)
+}
+
+// clearParts turns p back into a file stored as one object.
+func (app *Syncer) clearParts(p string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{DELETEPARTSBYPATH, CLEARMULTIPART} {
+		_, err = tx.Exec(q, p)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
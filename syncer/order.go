@@ -0,0 +1,76 @@
+package syncer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Order is the order UploadDiffs uploads files in.
+type Order int
+
+const (
+	// OrderAsGiven keeps the order of the diffs slice.
+	OrderAsGiven Order = iota
+	// OrderLargestFirst gets the big risky files done early.
+	OrderLargestFirst
+	// OrderSmallestFirst gets the most files done early.
+	OrderSmallestFirst
+	// OrderPath is stable path order.
+	OrderPath
+)
+
+// ParseOrder reads an order from its name: given, largest, smallest or path.
+func ParseOrder(s string) (Order, error) {
+	switch s {
+	case "", "given":
+		return OrderAsGiven, nil
+	case "largest":
+		return OrderLargestFirst, nil
+	case "smallest":
+		return OrderSmallestFirst, nil
+	case "path":
+		return OrderPath, nil
+	}
+	return OrderAsGiven, fmt.Errorf("unknown upload order %q, want given, largest, smallest or path", s)
+}
+
+// sortDiffs returns a copy of diffs in UploadOrder. Sizes come from the walk, see sizeOf, files that can't be
+// read sort as empty and fail when they are uploaded. Ties keep path order so runs are repeatable.
+func (app *Syncer) sortDiffs(diffs []string) []string {
+	if app.UploadOrder == OrderAsGiven {
+		return diffs
+	}
+	sorted := append([]string(nil), diffs...)
+	sort.Strings(sorted)
+	if app.UploadOrder == OrderPath {
+		return sorted
+	}
+	sizes := make(map[string]int64, len(sorted))
+	for _, p := range sorted {
+		sizes[p] = app.sizeOf(p)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if app.UploadOrder == OrderLargestFirst {
+			return sizes[sorted[i]] > sizes[sorted[j]]
+		}
+		return sizes[sorted[i]] < sizes[sorted[j]]
+	})
+	return sorted
+}
+
+// PendingBytes returns the total size of the files in diffs, for progress percentages and ETAs.
+func (app *Syncer) PendingBytes(diffs []string) int64 {
+	var total int64
+	for _, p := range diffs {
+		total += app.sizeOf(p)
+	}
+	return total
+}
+
+// sizeOf returns the size of p as seen by the last walk, only falling back to a stat for files it did not see.
+func (app *Syncer) sizeOf(p string) int64 {
+	if size, ok := app.sizes[p]; ok {
+		return size
+	}
+	return fileSize(p)
+}
@@ -0,0 +1,132 @@
+package syncer
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+// terminal hands out the pterm printers of a Syncer, writing to its Output and ErrOutput.
+type terminal struct {
+	out    io.Writer
+	err    io.Writer
+	report Reporter
+}
+
+// term returns the printers for app. A nil writer is pterm's default, stdout, so nothing changes unless Output
+// is set. Warnings and errors go to ErrOutput, or to Output as well when that is not set. With a Reporter the
+// messages go to it instead and spinners and bars to nowhere.
+func (app *Syncer) term() terminal {
+	t := terminal{out: app.Output, err: app.ErrOutput, report: app.Reporter}
+	if t.err == nil {
+		t.err = t.out
+	}
+	return t
+}
+
+func (t terminal) info() *pterm.PrefixPrinter    { return t.printer(pterm.Info, t.out, Notice) }
+func (t terminal) success() *pterm.PrefixPrinter { return t.printer(pterm.Success, t.out, Notice) }
+func (t terminal) warning() *pterm.PrefixPrinter { return t.printer(pterm.Warning, t.err, Warning) }
+func (t terminal) failure() *pterm.PrefixPrinter { return t.printer(pterm.Error, t.err, Failure) }
+
+// printer is p writing to w, or a plain printer handing its messages to the Reporter as kind events.
+func (t terminal) printer(p pterm.PrefixPrinter, w io.Writer, kind EventType) *pterm.PrefixPrinter {
+	if t.report == nil {
+		return p.WithWriter(w)
+	}
+	return &pterm.PrefixPrinter{Writer: reportWriter{to: t.report, kind: kind}, MessageStyle: pterm.NewStyle()}
+}
+
+// spinner starts a spinner showing text.
+func (t terminal) spinner(text string) (*spinner, error) {
+	sp := &spinner{style: pterm.DefaultSpinner, Text: text, started: time.Now(), done: make(chan struct{})}
+	sp.style.Writer = t.animated()
+	if pterm.RawOutput {
+		pterm.Fprintln(sp.style.Writer, text)
+	}
+	go sp.animate()
+	return sp, nil
+}
+
+// spinner draws pterm's DefaultSpinner with every frame and update under mu. pterm's own SpinnerPrinter reads
+// its text and state from the goroutine animating it without a lock, which races with the upload workers
+// updating it.
+type spinner struct {
+	mu      sync.Mutex
+	style   pterm.SpinnerPrinter
+	Text    string
+	frame   string
+	started time.Time
+	stopped bool
+	done    chan struct{}
+}
+
+// animate draws the next frame every Delay until the spinner stops.
+func (sp *spinner) animate() {
+	ticker := time.NewTicker(sp.style.Delay)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		sp.mu.Lock()
+		if !sp.stopped && !pterm.RawOutput {
+			sp.frame = sp.style.Sequence[i%len(sp.style.Sequence)]
+			timer := " (" + time.Since(sp.started).Round(sp.style.TimerRoundingFactor).String() + ")"
+			pterm.Fprinto(sp.style.Writer, sp.style.Style.Sprint(sp.frame)+" "+sp.style.MessageStyle.Sprint(sp.Text)+sp.style.TimerStyle.Sprint(timer))
+		}
+		sp.mu.Unlock()
+		select {
+		case <-sp.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// UpdateText replaces the text of the spinner.
+func (sp *spinner) UpdateText(text string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.Text = text
+	if pterm.RawOutput {
+		pterm.Fprintln(sp.style.Writer, text)
+		return
+	}
+	pterm.Fprinto(sp.style.Writer, sp.style.Style.Sprint(sp.frame)+" "+sp.style.MessageStyle.Sprint(sp.Text))
+}
+
+func (sp *spinner) Info(message ...any)    { sp.end(sp.style.InfoPrinter, message) }
+func (sp *spinner) Success(message ...any) { sp.end(sp.style.SuccessPrinter, message) }
+func (sp *spinner) Warning(message ...any) { sp.end(sp.style.WarningPrinter, message) }
+func (sp *spinner) Fail(message ...any)    { sp.end(sp.style.FailPrinter, message) }
+
+// end replaces the spinner with message, its text without one, printed by p, and stops it.
+func (sp *spinner) end(p pterm.TextPrinter, message []any) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if len(message) == 0 {
+		message = []any{sp.Text}
+	}
+	pterm.Fprinto(sp.style.Writer, strings.Repeat(" ", pterm.GetTerminalWidth()))
+	pterm.Fprinto(sp.style.Writer, p.Sprint(message...))
+	if sp.stopped {
+		return
+	}
+	sp.stopped = true
+	close(sp.done)
+	pterm.Fprintln(sp.style.Writer)
+}
+
+// bar is a progress bar up to total, to be started by the caller.
+func (t terminal) bar(total int) *pterm.ProgressbarPrinter {
+	return pterm.DefaultProgressbar.WithWriter(t.animated()).WithTotal(total)
+}
+
+// animated is where spinners and bars are drawn.
+func (t terminal) animated() io.Writer {
+	if t.report != nil {
+		return io.Discard
+	}
+	return t.out
+}
@@ -0,0 +1,86 @@
+package syncer
+
+import (
+	"context"
+)
+
+// DefaultPageSize is how many pending files UploadPending reads from the manifest at a time when given 0.
+const DefaultPageSize = 10000
+
+// UploadPending uploads the files GetUploadList would return, like UploadDiffs, but reads them from the manifest
+// pageSize at a time in path order, so the whole list is never held in memory. UploadOrder sorts each page.
+// StartAfter is where the first page starts. With DryRun the files are only listed, see UploadDiffs.
+func (app *Syncer) UploadPending(ctx context.Context, pageSize int, deep bool) (err error) {
+	if err := app.needSQLite("UploadPending"); err != nil {
+		return err
+	}
+	if app.DryRun {
+		uploads, err := app.GetUploadList()
+		if err != nil {
+			return err
+		}
+		return app.UploadDiffs(ctx, uploads, deep)
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	run, err := app.startRun()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		finishErr := app.finishRun(run, err)
+		if err == nil {
+			err = finishErr
+		}
+	}()
+
+	count, total, err := app.pendingTotals()
+	if err != nil {
+		return err
+	}
+	after := app.StartAfter
+	next := func() ([]string, error) {
+		for {
+			page, err := app.queryPaths(SELECTUPLOADPAGE, app.MaxFailures, after, pageSize)
+			if err != nil || len(page) == 0 {
+				return nil, err
+			}
+			after = page[len(page)-1]
+			var res []string
+			for _, p := range page {
+				if app.inScope(p) {
+					res = append(res, p)
+				}
+			}
+			// a page can be all out of scope, keep reading so it doesn't end the run early
+			if len(res) > 0 {
+				return app.sortDiffs(res), nil
+			}
+		}
+	}
+	return app.uploadPages(ctx, run, count, total, next, deep)
+}
+
+// pendingTotals counts the files and bytes UploadPending will upload without keeping their paths.
+func (app *Syncer) pendingTotals() (int, int64, error) {
+	rows, err := app.db.Query(SELECTUPLOADLIST, app.MaxFailures)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	count := 0
+	var total int64
+	for rows.Next() {
+		var p string
+		err = rows.Scan(&p)
+		if err != nil {
+			return 0, 0, err
+		}
+		if app.inScope(p) && p > app.StartAfter {
+			count++
+			total += app.sizeOf(p)
+		}
+	}
+	return count, total, rows.Err()
+}
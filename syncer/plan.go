@@ -0,0 +1,157 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Actions a plan records for each of its files.
+const (
+	PlanUpload  = "upload"
+	PlanReplace = "replace"
+)
+
+// PlannedFile is one file an UploadPlan will upload, as it was when the plan was made.
+type PlannedFile struct {
+	Path     string
+	Modified int64
+	Size     int64
+	// Action is PlanUpload for a file that was never uploaded, PlanReplace for one whose object it overwrites.
+	Action string
+}
+
+// UploadPlan is a set of uploads recorded in the manifest to be reviewed before Apply runs them.
+type UploadPlan struct {
+	ID    int64
+	Deep  bool
+	Files []PlannedFile
+}
+
+// Bytes is the total size of the files in the plan.
+func (p *UploadPlan) Bytes() int64 {
+	var res int64
+	for _, f := range p.Files {
+		res += f.Size
+	}
+	return res
+}
+
+// Plan records the uploads a sync would make now as a plan in the manifest, without uploading anything.
+// Run it after UpdateManifest, the plan holds what GetUploadList returns.
+func (app *Syncer) Plan(deep bool) (*UploadPlan, error) {
+	if err := app.needSQLite("Plan"); err != nil {
+		return nil, err
+	}
+	paths, err := app.GetUploadList()
+	if err != nil {
+		return nil, err
+	}
+	plan := &UploadPlan{Deep: deep}
+	for _, p := range app.sortDiffs(app.startAfter(paths)) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		action := PlanUpload
+		_, hash, _, err := app.recordedContent(p)
+		if err != nil {
+			return nil, err
+		}
+		if hash != "" {
+			action = PlanReplace
+		}
+		plan.Files = append(plan.Files, PlannedFile{Path: p, Modified: info.ModTime().Unix(), Size: info.Size(), Action: action})
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(INSERTPLAN, time.Now().Unix(), deep)
+	if err != nil {
+		return nil, err
+	}
+	plan.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range plan.Files {
+		_, err = tx.Exec(INSERTPLANFILE, plan.ID, f.Path, f.Modified, f.Size, f.Action)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, tx.Commit()
+}
+
+// LoadPlan reads back the plan id from the manifest.
+func (app *Syncer) LoadPlan(id int64) (*UploadPlan, error) {
+	if err := app.needSQLite("LoadPlan"); err != nil {
+		return nil, err
+	}
+	var applied int64
+	plan := &UploadPlan{ID: id}
+	err := app.db.QueryRow(SELECTPLAN, id).Scan(&applied, &plan.Deep)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("plan %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if applied != 0 {
+		return nil, fmt.Errorf("plan %d was already applied on %s: %w", id, time.Unix(applied, 0).Format(time.DateTime), ErrConflict)
+	}
+	rows, err := app.db.Query(SELECTPLANFILES, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f PlannedFile
+		err = rows.Scan(&f.Path, &f.Modified, &f.Size, &f.Action)
+		if err != nil {
+			return nil, err
+		}
+		plan.Files = append(plan.Files, f)
+	}
+	return plan, rows.Err()
+}
+
+// Apply uploads the files of plan id and marks it applied once they are all up, so a failed apply can be run
+// again but a finished one can't. Files that changed or went away since the plan was made are left out and
+// returned as stale, make a new plan to pick them up. Files uploaded in the meantime are skipped.
+func (app *Syncer) Apply(ctx context.Context, id int64) (stale []string, err error) {
+	if err := app.needSQLite("Apply"); err != nil {
+		return nil, err
+	}
+	plan, err := app.LoadPlan(id)
+	if err != nil {
+		return nil, err
+	}
+	var uploads []string
+	for _, f := range plan.Files {
+		info, err := os.Stat(f.Path)
+		if err != nil || info.ModTime().Unix() != f.Modified || info.Size() != f.Size {
+			stale = append(stale, f.Path)
+			continue
+		}
+		status, err := app.getStatus(f.Path)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if status == StatusComplete || err == sql.ErrNoRows {
+			continue
+		}
+		uploads = append(uploads, f.Path)
+	}
+	err = app.UploadDiffs(ctx, uploads, plan.Deep)
+	if err != nil {
+		return stale, err
+	}
+	_, err = app.db.Exec(APPLYPLAN, time.Now().Unix(), id)
+	return stale, err
+}
@@ -0,0 +1,219 @@
+package syncer
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"s3sync/splitter"
+)
+
+// presplit is a file the presplitter split ahead of its upload.
+type presplit struct {
+	pieces  []string
+	keys    []string
+	size    int64
+	modTime time.Time
+	err     error
+}
+
+// presplitter splits the files of a page that are too big for one PUT while the files before them upload,
+// several at once, keeping the pieces on disk within SplitBudget. Files are reserved in page order, the order
+// they upload in, so the file the upload is waiting for always gets the budget first.
+type presplitter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	budget int64
+	used   int64
+	closed bool
+	splits map[string]chan presplit
+	sizes  map[string]int64
+}
+
+func newPresplitter(budget int64) *presplitter {
+	s := &presplitter{budget: budget, splits: map[string]chan presplit{}, sizes: map[string]int64{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// reserve waits until size more bytes fit in the budget. A file bigger than the whole budget goes once nothing
+// else is on disk.
+func (s *presplitter) reserve(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.closed || s.used > 0 && s.used+size > s.budget {
+		if s.closed {
+			return context.Canceled
+		}
+		s.cond.Wait()
+	}
+	s.used += size
+	return nil
+}
+
+// presplitPage starts splitting the files of page that putContent would split, see splittable.
+func (app *Syncer) presplitPage(ctx context.Context, page []string, deep bool) {
+	if app.SplitBudget <= 0 {
+		return
+	}
+	if app.presplits == nil {
+		app.presplits = newPresplitter(app.SplitBudget)
+	}
+	s := app.presplits
+	type job struct {
+		path string
+		size int64
+		done chan presplit
+	}
+	var todo []job
+	s.mu.Lock()
+	for _, p := range page {
+		if info, ok := app.splittable(p, deep); ok {
+			j := job{path: p, size: info.Size(), done: make(chan presplit, 1)}
+			s.splits[p] = j.done
+			s.sizes[p] = j.size
+			todo = append(todo, j)
+		}
+	}
+	s.mu.Unlock()
+	go func() {
+		for _, j := range todo {
+			if err := s.reserve(j.size); err != nil {
+				j.done <- presplit{err: err}
+				continue
+			}
+			go func(j job) {
+				j.done <- app.splitAhead(ctx, j.path, deep)
+			}(j)
+		}
+	}()
+}
+
+// splittable reports whether putObject would split p as it is, returning its info if so. Files that may take
+// another path, like transformed, encrypted, compressed, sparse and delta uploads, are left to putObject.
+func (app *Syncer) splittable(p string, deep bool) (os.FileInfo, bool) {
+	if app.Transform != nil || app.EncryptionKey != nil || app.compresses(p) || app.Sparse || app.DeltaMode || app.NoSplit {
+		return nil, false
+	}
+	if _, ok := app.multipart(); ok {
+		return nil, false
+	}
+	if target, err := app.linkTarget(p); err != nil || target != "" {
+		return nil, false
+	}
+	if pieces, err := app.resumePieces(p); !app.ForceRestart && (err != nil || partlyUploaded(pieces)) {
+		// putContent resumes what an earlier run left
+		return nil, false
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.Size() <= app.putLimit(app.storageClassFor(p, deep)) {
+		return nil, false
+	}
+	return info, true
+}
+
+// splitAhead splits p without progress events, those are sent once its upload takes the pieces.
+func (app *Syncer) splitAhead(ctx context.Context, p string, deep bool) presplit {
+	info, err := os.Stat(p)
+	if err != nil {
+		return presplit{err: err}
+	}
+	key, err := app.keyFor(p)
+	if err != nil {
+		return presplit{err: err}
+	}
+	pieces, keys, err := app.splitPieces(ctx, p, p, key, info, app.putLimit(app.storageClassFor(p, deep)), func(ProgressEvent) {})
+	return presplit{pieces: pieces, keys: keys, size: info.Size(), modTime: info.ModTime(), err: err}
+}
+
+// takePresplit returns the pieces split ahead for obj, waiting for them if they are still being split. Pieces of
+// a file that changed since are thrown away, as is a failed split, and false sends putContent to split afresh.
+func (app *Syncer) takePresplit(obj string, info os.FileInfo) ([]string, []string, bool) {
+	if app.presplits == nil {
+		return nil, nil, false
+	}
+	s := app.presplits
+	s.mu.Lock()
+	ch, ok := s.splits[obj]
+	delete(s.splits, obj)
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+	res := <-ch
+	if res.err != nil || res.size != info.Size() || !res.modTime.Equal(info.ModTime()) {
+		if len(res.pieces) > 0 {
+			splitter.CleanUp(res.pieces)
+		}
+		app.releasePresplit(obj)
+		return nil, nil, false
+	}
+	app.emit(ProgressEvent{Type: SplitStarted, Path: obj, Size: res.size, PartSize: pieceLen(res.pieces), Total: len(res.pieces)})
+	app.emit(ProgressEvent{Type: SplitCompleted, Path: obj, Total: len(res.pieces)})
+	return res.pieces, res.keys, true
+}
+
+// releasePresplit gives the budget of obj back once its pieces are off the disk.
+func (app *Syncer) releasePresplit(obj string) {
+	s := app.presplits
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= s.sizes[obj]
+	delete(s.sizes, obj)
+	s.cond.Broadcast()
+}
+
+// dropPresplit throws away the pieces split ahead for p if its upload didn't take them, e.g. because it failed
+// before getting that far.
+func (app *Syncer) dropPresplit(p string) {
+	if app.presplits == nil {
+		return
+	}
+	s := app.presplits
+	s.mu.Lock()
+	ch, ok := s.splits[p]
+	delete(s.splits, p)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	res := <-ch
+	app.releasePresplit(p)
+	if len(res.pieces) > 0 {
+		splitter.CleanUp(res.pieces)
+	}
+}
+
+// stopPresplits ends the splitting ahead when the upload of the pages is over, and throws away whatever it split
+// that is left.
+func (app *Syncer) stopPresplits() {
+	s := app.presplits
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	var left []string
+	for p := range s.splits {
+		left = append(left, p)
+	}
+	s.mu.Unlock()
+	for _, p := range left {
+		app.dropPresplit(p)
+	}
+	app.presplits = nil
+}
+
+// pieceLen is the size of the first of pieces, the size all but the last one have.
+func pieceLen(pieces []string) int64 {
+	info, err := os.Stat(pieces[0])
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
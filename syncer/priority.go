@@ -0,0 +1,38 @@
+package syncer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// lowered makes sure LowPriority is applied once, the priority belongs to the process and not to a Syncer.
+var lowered sync.Once
+
+// background applies LowPriority, a failure only costs politeness so it is a warning.
+func (app *Syncer) background() {
+	if !app.LowPriority {
+		return
+	}
+	lowered.Do(func() {
+		err := lowerPriority()
+		if err != nil && !app.NoSpinners {
+			app.term().warning().Printfln("Could not lower the priority: %s", err)
+		}
+	})
+}
+
+// pause waits FilePause between two files, or until ctx is done.
+func (app *Syncer) pause(ctx context.Context) error {
+	if app.FilePause <= 0 {
+		return nil
+	}
+	t := time.NewTimer(app.FilePause)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
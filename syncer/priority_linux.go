@@ -0,0 +1,40 @@
+//go:build linux
+
+package syncer
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ioprio_set arguments for the idle IO class, which only gets the disk when nothing else wants it.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerPriority moves every thread of the process to the idle IO class and nice 19, like ionice -c3 and nice.
+// Both are per thread on Linux, threads started later inherit them.
+func lowerPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			return errno
+		}
+		err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package syncer
+
+import "syscall"
+
+// lowerPriority renices the process to 19. There is no portable IO priority, most systems give less IO to
+// processes that get less CPU.
+func lowerPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, 19)
+}
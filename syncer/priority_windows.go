@@ -0,0 +1,21 @@
+//go:build windows
+
+package syncer
+
+import "syscall"
+
+// processModeBackgroundBegin is the SetPriorityClass mode that lowers both the CPU and the IO priority.
+const processModeBackgroundBegin = 0x00100000
+
+// lowerPriority puts the process in background mode.
+func lowerPriority() error {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	ok, _, err := syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass").Call(uintptr(h), processModeBackgroundBegin)
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
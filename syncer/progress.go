@@ -0,0 +1,567 @@
+package syncer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pterm/pterm"
+)
+
+// EventType identifies what a ProgressEvent is reporting.
+type EventType int
+
+const (
+	FileStarted EventType = iota
+	BytesProgress
+	FileCompleted
+	FileFailed
+	SplitStarted
+	PieceCreated
+	SplitCompleted
+	PartStarted
+	// Notice, Warning and Failure are the messages of a run for a Reporter, in Message.
+	Notice
+	Warning
+	Failure
+)
+
+// ProgressEvent describes one step of an upload. Index and Total refer to the file within the run,
+// or to the piece within the file for SplitStarted, PieceCreated, SplitCompleted and PartStarted.
+type ProgressEvent struct {
+	Type  EventType
+	Path  string
+	Index int
+	Total int
+	// Bytes sent so far and the full Size of the file, for BytesProgress. Size is also set for FileStarted and FileCompleted.
+	Bytes int64
+	Size  int64
+	// TotalBytes is the size of all the files in the run, for FileStarted.
+	TotalBytes int64
+	// PartSize is the size of the pieces of the file, for SplitStarted, with Total the number of pieces.
+	PartSize int64
+	// Err is why the file failed, for FileFailed.
+	Err error
+	// Message is the text of a Notice, Warning or Failure.
+	Message string
+}
+
+// reporter renders progress events on the terminal.
+type reporter interface {
+	handle(ev ProgressEvent)
+}
+
+// progressMu guards the terminal reporter and the transformed scales, files upload from several goroutines.
+var progressMu sync.Mutex
+
+// emit hands ev to the terminal reporter and to the Progress channel if there is one.
+func (app *Syncer) emit(ev ProgressEvent) {
+	progressMu.Lock()
+	if scale, ok := app.transformed[ev.Path]; ok && ev.Type == BytesProgress {
+		ev = scale.scale(ev)
+	}
+	if r := app.terminalReporter(); r != nil {
+		r.handle(ev)
+	}
+	progressMu.Unlock()
+	if app.Progress != nil {
+		app.Progress <- ev
+	}
+}
+
+// terminalReporter returns the reporter for the chosen terminal output, Reporter when it is set and nil with
+// NoSpinners.
+func (app *Syncer) terminalReporter() reporter {
+	if app.Reporter != nil {
+		return forwardReporter{to: app.Reporter}
+	}
+	if app.NoSpinners {
+		return nil
+	}
+	if app.reporter == nil {
+		switch {
+		case app.GroupByDir:
+			app.reporter = &dirReporter{term: app.term(), dirOf: app.dirOf, dirs: map[string]*dirProgress{}}
+		case app.Compact:
+			app.reporter = &barReporter{term: app.term()}
+		case app.LargeFile > 0:
+			app.reporter = &sizeReporter{term: app.term(), threshold: app.LargeFile}
+		default:
+			app.reporter = &spinnerReporter{term: app.term()}
+		}
+	}
+	return app.reporter
+}
+
+// spinnerRefresh is how often the spinner text follows the bytes sent, so a fast upload doesn't flood the terminal.
+const spinnerRefresh = 250 * time.Millisecond
+
+// spinnerReporter renders progress events as pterm spinners, the default terminal output. With several files
+// going up at once the spinner names the latest and counts the others, each finished file gets its own line.
+// The latest file shows how much of it went up and how fast, across all its pieces for a split file.
+type spinnerReporter struct {
+	term      terminal
+	file      *spinner
+	split     *spinner
+	splitting int
+	// active are the files going up, in the order they started, with their index in the run
+	active []ProgressEvent
+	// sent is the last BytesProgress of each active file, started when it started
+	sent    map[string]ProgressEvent
+	started map[string]time.Time
+	shown   time.Time
+}
+
+func (r *spinnerReporter) handle(ev ProgressEvent) {
+	switch ev.Type {
+	case FileStarted:
+		r.active = append(r.active, ev)
+		if r.started == nil {
+			r.sent, r.started = map[string]ProgressEvent{}, map[string]time.Time{}
+		}
+		r.started[ev.Path] = time.Now()
+		if r.file == nil {
+			r.file, _ = r.term.spinner(r.uploading())
+		} else {
+			r.file.UpdateText(r.uploading())
+		}
+	case SplitStarted:
+		r.file.Warning(fmt.Sprintf("%s too big for S3, Splitting into multiple files.", ev.Path))
+		r.splitting++
+		if r.split == nil {
+			r.split, _ = r.term.spinner(fmt.Sprintf("Splitting %s into %d pieces of %s", ev.Path, ev.Total, formatBytes(ev.PartSize)))
+		}
+	case PieceCreated:
+		if r.split != nil {
+			r.split.UpdateText(fmt.Sprintf("Piece: %s created successfully, now creating piece %d", ev.Path, ev.Index))
+		}
+	case SplitCompleted:
+		r.splitting--
+		if r.split != nil && r.splitting == 0 {
+			r.split.Success(fmt.Sprintf("Done splitting. Split %s into %d files", filepath.Base(ev.Path), ev.Total))
+			r.split = nil
+		}
+	case BytesProgress:
+		if _, ok := r.started[ev.Path]; !ok {
+			return
+		}
+		r.sent[ev.Path] = ev
+		if r.file != nil && time.Since(r.shown) >= spinnerRefresh {
+			r.shown = time.Now()
+			r.file.UpdateText(r.uploading())
+		}
+	case PartStarted:
+		r.file.UpdateText(fmt.Sprintf("Uploading %s part %d/%d", ev.Path, ev.Index, ev.Total))
+	case FileCompleted:
+		r.finish(ev.Path)
+		r.file.Success(fmt.Sprintf("Successfully uploaded file: %s. %d/%d", ev.Path, ev.Index, ev.Total))
+		r.restart()
+	case FileFailed:
+		r.finish(ev.Path)
+		if r.split != nil {
+			r.split.Fail(ev.Err)
+			r.split = nil
+			r.splitting = 0
+		}
+		if r.file != nil {
+			r.file.Fail(ev.Err)
+		}
+		r.restart()
+	}
+}
+
+// uploading is the text of the spinner for the files going up.
+func (r *spinnerReporter) uploading() string {
+	last := r.active[len(r.active)-1]
+	text := fmt.Sprintf("Uploading file: %s. %d/%d", last.Path, last.Index, last.Total)
+	if sent, ok := r.sent[last.Path]; ok && sent.Size > 0 {
+		rate := float64(sent.Bytes) / time.Since(r.started[last.Path]).Seconds()
+		text += fmt.Sprintf(", %d%% at %s/s", sent.Bytes*100/sent.Size, formatBytes(int64(rate)))
+	}
+	if len(r.active) > 1 {
+		text += fmt.Sprintf(" and %d more", len(r.active)-1)
+	}
+	return text
+}
+
+// finish drops p from the files going up.
+func (r *spinnerReporter) finish(p string) {
+	delete(r.sent, p)
+	delete(r.started, p)
+	for i, ev := range r.active {
+		if ev.Path == p {
+			r.active = append(r.active[:i], r.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// restart puts up a new spinner for the files still going up once the last one printed its outcome.
+func (r *spinnerReporter) restart() {
+	r.file = nil
+	if len(r.active) > 0 {
+		r.file, _ = r.term.spinner(r.uploading())
+	}
+}
+
+// barReporter renders a whole run as a single progress bar, printing only failures and a closing summary.
+type barReporter struct {
+	term       terminal
+	bar        *pterm.ProgressbarPrinter
+	started    time.Time
+	done       int
+	bytes      int64
+	totalBytes int64
+}
+
+func (r *barReporter) handle(ev ProgressEvent) {
+	switch ev.Type {
+	case FileStarted:
+		if r.bar == nil {
+			r.started = time.Now()
+			r.totalBytes = ev.TotalBytes
+			r.bar, _ = r.term.bar(ev.Total).WithShowCount(true).Start("Uploading")
+		}
+	case FileCompleted:
+		r.done++
+		r.bytes += ev.Size
+		if r.bar == nil {
+			// finished after another file failed
+			return
+		}
+		r.bar.UpdateTitle(r.title(ev.Total))
+		r.bar.Increment()
+		if ev.Index == ev.Total {
+			r.finish(ev.Total)
+		}
+	case FileFailed:
+		r.term.failure().Printfln("%s: %v", ev.Path, ev.Err)
+		r.finish(ev.Total)
+	}
+}
+
+// title is the bytes, rate and ETA shown next to the bar. The ETA goes by bytes when the run total is known,
+// by file count otherwise.
+func (r *barReporter) title(total int) string {
+	elapsed := time.Since(r.started)
+	rate := float64(r.bytes) / elapsed.Seconds()
+	if r.totalBytes > 0 && r.bytes > 0 {
+		eta := time.Duration(float64(elapsed) / float64(r.bytes) * float64(r.totalBytes-r.bytes))
+		return fmt.Sprintf("%s of %s (%d%%), %s/s, ETA %s", formatBytes(r.bytes), formatBytes(r.totalBytes),
+			r.bytes*100/r.totalBytes, formatBytes(int64(rate)), eta.Round(time.Second))
+	}
+	eta := time.Duration(float64(elapsed) / float64(r.done) * float64(total-r.done))
+	return fmt.Sprintf("%s, %s/s, ETA %s", formatBytes(r.bytes), formatBytes(int64(rate)), eta.Round(time.Second))
+}
+
+// finish stops the bar and prints the run summary.
+func (r *barReporter) finish(total int) {
+	if r.bar == nil {
+		return
+	}
+	r.bar.Stop()
+	r.bar = nil
+	summary := fmt.Sprintf("Uploaded %d/%d files, %s in %s.", r.done, total, formatBytes(r.bytes), time.Since(r.started).Round(time.Second))
+	if r.done < total {
+		r.term.warning().Println(summary)
+		return
+	}
+	r.term.success().Println(summary)
+}
+
+// sizeReporter batches the files under threshold into one progress bar counting files, and gives every bigger
+// file a byte progress bar of its own, so thousands of small files don't flicker past a long large upload.
+type sizeReporter struct {
+	term      terminal
+	threshold int64
+	batch     *pterm.ProgressbarPrinter
+	large     *pterm.ProgressbarPrinter
+	// largePath is the file the large bar is for, others over threshold going up at the same time only get a line
+	largePath string
+	small     int
+	sent      int64
+}
+
+func (r *sizeReporter) handle(ev ProgressEvent) {
+	switch ev.Type {
+	case FileStarted:
+		if ev.Size >= r.threshold {
+			if r.large != nil {
+				return
+			}
+			r.stopBatch()
+			r.sent = 0
+			r.largePath = ev.Path
+			r.large, _ = r.term.bar(int(ev.Size)).WithShowCount(false).
+				Start(fmt.Sprintf("Uploading %s (%s) %d/%d", filepath.Base(ev.Path), formatBytes(ev.Size), ev.Index, ev.Total))
+			return
+		}
+		if r.batch == nil {
+			r.batch, _ = r.term.bar(ev.Total).WithShowCount(true).Start(r.batchTitle())
+			r.batch.Add(ev.Index - 1)
+		}
+	case BytesProgress:
+		if r.large != nil && ev.Path == r.largePath && ev.Bytes > r.sent {
+			r.large.Add(int(ev.Bytes - r.sent))
+			r.sent = ev.Bytes
+		}
+	case FileCompleted:
+		if r.large != nil && ev.Path == r.largePath {
+			r.large.Add(int(ev.Size - r.sent))
+			r.large.Stop()
+			r.large = nil
+		}
+		if ev.Size >= r.threshold {
+			r.term.success().Printfln("Successfully uploaded file: %s. %d/%d", ev.Path, ev.Index, ev.Total)
+			return
+		}
+		r.small++
+		if r.batch == nil {
+			return
+		}
+		r.batch.UpdateTitle(r.batchTitle())
+		r.batch.Increment()
+		if ev.Index == ev.Total {
+			r.stopBatch()
+		}
+	case FileFailed:
+		if r.large != nil {
+			r.large.Stop()
+			r.large = nil
+		}
+		r.stopBatch()
+		r.term.failure().Printfln("%s: %v", ev.Path, ev.Err)
+	}
+}
+
+func (r *sizeReporter) batchTitle() string {
+	return fmt.Sprintf("Uploading small files, %d done", r.small)
+}
+
+// stopBatch takes the small file bar off the screen, a new one picks up the count with the next small file.
+func (r *sizeReporter) stopBatch() {
+	if r.batch != nil {
+		r.batch.Stop()
+		r.batch = nil
+	}
+}
+
+// dirProgress is how far the uploads of one directory are.
+type dirProgress struct {
+	files int
+	done  int
+	bytes int64
+	sent  int64
+}
+
+// dirReporter shows a spinner per directory counting its files and bytes up as they complete, instead of one
+// per file, so a large tree reads as the folders it is made of. The totals come from the pages of the run, see
+// queueDirs.
+type dirReporter struct {
+	term    terminal
+	dirOf   func(p string) string
+	dirs    map[string]*dirProgress
+	current string
+	spinner *spinner
+}
+
+// add counts a file of size bytes at p into its directory.
+func (r *dirReporter) add(p string, size int64) {
+	dir := r.dirOf(p)
+	if r.dirs[dir] == nil {
+		r.dirs[dir] = &dirProgress{}
+	}
+	r.dirs[dir].files++
+	r.dirs[dir].bytes += size
+}
+
+func (r *dirReporter) handle(ev ProgressEvent) {
+	dir := r.dirOf(ev.Path)
+	d := r.dirs[dir]
+	if d == nil && (ev.Type == FileStarted || ev.Type == FileCompleted) {
+		r.add(ev.Path, ev.Size)
+		d = r.dirs[dir]
+	}
+	switch ev.Type {
+	case FileStarted:
+		if dir != r.current {
+			r.stop()
+			r.current = dir
+			r.spinner, _ = r.term.spinner(r.text(dir, d))
+		}
+	case FileCompleted:
+		d.done++
+		d.sent += ev.Size
+		if dir != r.current {
+			// a directory left behind while files of it were still going up
+			if d.done >= d.files {
+				r.term.success().Println(r.text(dir, d))
+			}
+			return
+		}
+		if r.spinner == nil {
+			return
+		}
+		if d.done >= d.files {
+			r.spinner.Success(r.text(dir, d))
+			r.spinner = nil
+			r.current = ""
+			return
+		}
+		r.spinner.UpdateText(r.text(dir, d))
+	case FileFailed:
+		if r.spinner != nil {
+			r.spinner.Fail(fmt.Sprintf("%s: %v", ev.Path, ev.Err))
+			r.spinner = nil
+			r.current = ""
+		}
+	}
+}
+
+func (r *dirReporter) text(dir string, d *dirProgress) string {
+	return fmt.Sprintf("%s: %d/%d files, %s of %s", dir, d.done, d.files, formatBytes(d.sent), formatBytes(d.bytes))
+}
+
+// stop leaves the directory in progress where it got to, the upload order moved on to another one.
+func (r *dirReporter) stop() {
+	if r.spinner != nil {
+		r.spinner.Info(r.text(r.current, r.dirs[r.current]))
+		r.spinner = nil
+	}
+}
+
+// queueDirs counts the files of a page into the directories GroupByDir shows, before they upload.
+func (app *Syncer) queueDirs(page []string) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	r, ok := app.terminalReporter().(*dirReporter)
+	if !ok {
+		return
+	}
+	for _, p := range page {
+		r.add(p, app.sizeOf(p))
+	}
+}
+
+// dirOf is the directory of the local file p relative to its source folder, with forward slashes, "." for the
+// files right in it.
+func (app *Syncer) dirOf(p string) string {
+	dir := filepath.Dir(p)
+	if src, ok := app.sourceFor(p); ok {
+		if rel, err := filepath.Rel(src.FolderPath, dir); err == nil {
+			dir = rel
+		}
+	}
+	return filepath.ToSlash(dir)
+}
+
+// progressScale turns the bytes sent of a transformed copy into bytes of the file it came from. The run totals
+// and FileStarted count the files as they are on disk, the transformed size is only known once it is written.
+type progressScale struct {
+	input  int64
+	output int64
+}
+
+func (s *progressScale) scale(ev ProgressEvent) ProgressEvent {
+	if s.output > 0 {
+		ev.Bytes = int64(float64(ev.Bytes) / float64(s.output) * float64(s.input))
+	}
+	ev.Size = s.input
+	return ev
+}
+
+// progressStep is how many bytes a progressReader reads between BytesProgress events.
+const progressStep = 1 << 20
+
+// progressReader hands the bytes read so far of a file, or piece, of size bytes being uploaded to report, every
+// progressStep and once it is all read. Seeking, like the SDK does to rewind a retried request, moves the count with it.
+type progressReader struct {
+	file     io.ReadSeeker
+	size     int64
+	report   func(read int64)
+	read     int64
+	reported int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	r.read += int64(n)
+	if r.read-r.reported >= progressStep || (r.read == r.size && r.reported != r.size) {
+		r.reported = r.read
+		r.report(r.read)
+	}
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.file.Seek(offset, whence)
+	if err == nil {
+		r.read = pos
+		r.reported = min(r.reported, pos)
+	}
+	return pos, err
+}
+
+// progressReaderAt is progressReader for a file read at offsets, like the parts of a multipart upload. The count
+// is how far into the file it was read, so a part sent again doesn't add up twice.
+type progressReaderAt struct {
+	file     io.ReaderAt
+	size     int64
+	report   func(read int64)
+	mu       sync.Mutex
+	read     int64
+	reported int64
+}
+
+func (r *progressReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.file.ReadAt(p, off)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.read = max(r.read, off+int64(n))
+	if r.read-r.reported >= progressStep || (r.read == r.size && r.reported != r.size) {
+		r.reported = r.read
+		r.report(r.read)
+	}
+	return n, err
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseSize reads a size like 750M, 4GiB or 1.5 TB as formatBytes writes them. Units are binary, so G, GB and GiB
+// are all 1024^3, and a bare number is bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	num := strings.TrimRightFunc(s, unicode.IsLetter)
+	unit := strings.ToUpper(strings.TrimSpace(s[len(num):]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	mult := int64(1)
+	if unit != "" {
+		exp := strings.Index("KMGTPE", unit)
+		if exp < 0 || len(unit) != 1 {
+			return 0, fmt.Errorf("invalid size %q, unknown unit", s)
+		}
+		mult = 1 << (10 * (exp + 1))
+	}
+	return int64(n * float64(mult)), nil
+}
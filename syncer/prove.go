@@ -0,0 +1,273 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrUnproven is a file whose objects could not be shown to hold its content, see Prove.
+var ErrUnproven = errors.New("the bucket copy could not be proven")
+
+// ProveDepth is how hard Prove checks that a file can be got back.
+type ProveDepth int
+
+const (
+	// ProveHead checks every object of the file exists with the ETag recorded at upload. Cheap, but only says
+	// the upload went through.
+	ProveHead ProveDepth = iota
+	// ProveSample also reads the first SampleSize bytes of every object and compares them with the local file.
+	ProveSample
+	// ProveFull reads the objects back in full and compares their SHA-256 with the local file's.
+	ProveFull
+)
+
+// ParseProveDepth reads a depth from its name: head, sample or full.
+func ParseProveDepth(s string) (ProveDepth, error) {
+	switch s {
+	case "", "head":
+		return ProveHead, nil
+	case "sample":
+		return ProveSample, nil
+	case "full":
+		return ProveFull, nil
+	}
+	return ProveHead, fmt.Errorf("unknown prove depth %q, want head, sample or full", s)
+}
+
+// ProveOptions tune Prove.
+type ProveOptions struct {
+	Depth ProveDepth
+	// SampleSize is how much of each object ProveSample reads, 64KiB by default.
+	SampleSize int64
+	// PollInterval is how often an archived object is checked for its restored copy, 15 minutes by default.
+	PollInterval time.Duration
+	// RestoreDays is how long a restored copy stays readable, 1 day by default.
+	RestoreDays int32
+}
+
+// Prove checks that the uploaded file p can be got back from the bucket, to be sure of it before the local copy
+// goes. Past ProveHead, objects in Glacier or Deep Archive are restored first and Prove waits for them, which
+// takes hours, so give it a ctx without a short deadline. It returns ErrUnproven when the bucket copy is wrong.
+func (app *Syncer) Prove(ctx context.Context, p string, opts ProveOptions) error {
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = 64 * 1024
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 15 * time.Minute
+	}
+	if opts.RestoreDays <= 0 {
+		opts.RestoreDays = 1
+	}
+	src, err := app.contentPath(p)
+	if err != nil {
+		return err
+	}
+	keys, err := app.partKeys(src)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		key, err := app.keyFor(src)
+		if err != nil {
+			return err
+		}
+		keys = []string{key}
+	}
+
+	infos := make([]ObjectInfo, len(keys))
+	for i, k := range keys {
+		infos[i], err = app.store().Head(ctx, k)
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%s: %s is missing: %w", p, k, ErrUnproven)
+		}
+		if err != nil {
+			return err
+		}
+		etag, err := app.recordedETag(k)
+		if err != nil {
+			return err
+		}
+		if etag != "" && infos[i].ETag != etag {
+			return fmt.Errorf("%s: %s changed since it was uploaded: %w", p, k, ErrUnproven)
+		}
+	}
+	_, gen, _, err := app.deltaState(src)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	var patches []ObjectInfo
+	for g := 1; g <= gen; g++ {
+		// DeltaMode patched the last full upload since
+		base, err := app.keyFor(src)
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{deltaKey(base, g), deltaKey(base, g) + ".json"} {
+			info, err := app.store().Head(ctx, k)
+			if errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("%s: %s is missing: %w", p, k, ErrUnproven)
+			}
+			if err != nil {
+				return err
+			}
+			patches = append(patches, info)
+		}
+	}
+	if opts.Depth == ProveHead {
+		return nil
+	}
+	if app.Transform != nil || infos[0].Metadata[MetaSparse] != "" || infos[0].Metadata[MetaCipher] != "" || infos[0].Metadata[MetaCompression] != "" {
+		return fmt.Errorf("%s: the objects don't hold the content as is, only head can be proven", p)
+	}
+	for i := range infos {
+		err = app.waitRestored(ctx, &infos[i], opts)
+		if err != nil {
+			return err
+		}
+	}
+	if len(patches) > 0 {
+		for i := range patches {
+			err = app.waitRestored(ctx, &patches[i], opts)
+			if err != nil {
+				return err
+			}
+		}
+		// the objects hold the file only once the patches are applied
+		return app.provePatched(ctx, p)
+	}
+	if opts.Depth == ProveSample {
+		return app.proveSample(ctx, p, infos, opts.SampleSize)
+	}
+	return app.proveFull(ctx, p, infos)
+}
+
+// provePatched downloads the file p DeltaMode uploaded patches of, rebuilding it like Download does, and compares
+// the sum of the result with the local file's.
+func (app *Syncer) provePatched(ctx context.Context, p string) error {
+	dir, err := os.MkdirTemp("", "s3sync-prove")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	restored := app.restored
+	app.restored = nil
+	err = app.Download(ctx, p, filepath.Join(dir, "file"))
+	app.restored = restored
+	if err != nil {
+		return err
+	}
+	remote, _, err := app.sumFile(filepath.Join(dir, "file"))
+	if err != nil {
+		return err
+	}
+	local, _, err := app.sumFile(p)
+	if err != nil {
+		return err
+	}
+	if remote != local {
+		return fmt.Errorf("%s: the bucket copy differs from the local file: %w", p, ErrUnproven)
+	}
+	return nil
+}
+
+// waitRestored restores the archived object info, if it isn't already, and waits for the copy to be readable.
+func (app *Syncer) waitRestored(ctx context.Context, info *ObjectInfo, opts ProveOptions) error {
+	if !archived(types.StorageClass(info.StorageClass)) || info.Restored {
+		return nil
+	}
+	err := app.store().Restore(ctx, info.Key, opts.RestoreDays)
+	if err != nil {
+		return err
+	}
+	for {
+		latest, err := app.store().Head(ctx, info.Key)
+		if err != nil {
+			return err
+		}
+		if latest.Restored {
+			*info = latest
+			return nil
+		}
+		if !app.NoSpinners {
+			app.term().info().Printfln("Waiting for %s to be restored...", info.Key)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+// proveSample compares the first size bytes of every object with the same stretch of the local file p.
+func (app *Syncer) proveSample(ctx context.Context, p string, infos []ObjectInfo, size int64) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var offset int64
+	for _, info := range infos {
+		n := min(size, info.Size)
+		remote, err := app.store().GetRange(ctx, info.Key, GetOptions{IfMatch: info.ETag})
+		if err != nil {
+			return err
+		}
+		got := make([]byte, n)
+		_, err = io.ReadFull(remote, got)
+		remote.Close()
+		if err != nil {
+			return fmt.Errorf("%s: reading %s: %w", p, info.Key, err)
+		}
+		want := make([]byte, n)
+		_, err = f.ReadAt(want, offset)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("%s: %s does not hold the local content: %w", p, info.Key, ErrUnproven)
+		}
+		offset += info.Size
+	}
+	return nil
+}
+
+// proveFull reads every object back and compares the SHA-256 of the whole with the local file p.
+func (app *Syncer) proveFull(ctx context.Context, p string, infos []ObjectInfo) error {
+	remote := sha256.New()
+	for _, info := range infos {
+		body, err := app.store().GetRange(ctx, info.Key, GetOptions{IfMatch: info.ETag})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(remote, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("%s: reading %s: %w", p, info.Key, err)
+		}
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	local := sha256.New()
+	_, err = io.Copy(local, f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(remote.Sum(nil), local.Sum(nil)) {
+		return fmt.Errorf("%s: the bucket copy differs from the local file: %w", p, ErrUnproven)
+	}
+	return nil
+}
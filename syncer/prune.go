@@ -0,0 +1,133 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// PruneReport is the result of PruneDeleted and PruneRemote.
+type PruneReport struct {
+	// Files are the synced files that are gone locally.
+	Files []string
+	// Keys are the objects of Files still in the bucket and Bytes their size. Objects a snapshot keeps are
+	// left out, they stay.
+	Keys  []string
+	Bytes int64
+	// Deleted is set when the objects were deleted and the files forgotten, not only reported.
+	Deleted bool
+}
+
+// PruneDeleted finds the synced files that are gone locally, tombstoned by a walk or missing from the disk now,
+// and lists the bucket for their objects. Unless confirm is set that is all it does. With confirm the objects are
+// deleted and the files are removed from the manifest with their parts, so they don't come back. Unlike Purge
+// it doesn't wait for Retention. A source folder that isn't there fails it, rather than pruning everything in
+// it because a disk isn't mounted.
+func (app *Syncer) PruneDeleted(ctx context.Context, confirm bool) (*PruneReport, error) {
+	if err := app.needSQLite("PruneDeleted"); err != nil {
+		return nil, err
+	}
+	for _, src := range app.sources() {
+		if _, err := os.Stat(src.FolderPath); err != nil {
+			return nil, fmt.Errorf("%s isn't there, nothing was pruned: %w", src.FolderPath, err)
+		}
+	}
+	gone, err := app.goneFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{Deleted: confirm}
+	fileKeys := map[string][]string{}
+	all := map[string]bool{}
+	for _, p := range gone {
+		// a hardlink that is still there is restored from these objects
+		var links int
+		err = app.manifest().QueryRow(COUNTLINKSTO, p).Scan(&links)
+		if err != nil {
+			return nil, err
+		}
+		if links > 0 {
+			continue
+		}
+		keys, err := app.remoteKeys(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			kept, err := app.snapshotted(k)
+			if err != nil {
+				return nil, err
+			}
+			if !kept {
+				fileKeys[p] = append(fileKeys[p], k)
+				all[k] = true
+			}
+		}
+		report.Files = append(report.Files, p)
+	}
+	if len(report.Files) == 0 {
+		return report, nil
+	}
+
+	objs, err := app.store().List(ctx, commonFolder(all))
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objs {
+		if all[o.Key] {
+			report.Keys = append(report.Keys, o.Key)
+			report.Bytes += o.Size
+		}
+	}
+	sort.Strings(report.Keys)
+	if !confirm {
+		return report, nil
+	}
+
+	for _, p := range report.Files {
+		for _, k := range fileKeys[p] {
+			err = app.store().Delete(ctx, k)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return report, err
+			}
+		}
+		err = app.forget(p, fileKeys[p])
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// PruneRemote is PruneDeleted with a dry run flag instead of a confirmation: with dryRun it only reports what
+// would go, without it the objects are deleted and the files forgotten.
+func (app *Syncer) PruneRemote(ctx context.Context, dryRun bool) (*PruneReport, error) {
+	return app.PruneDeleted(ctx, !dryRun)
+}
+
+// goneFiles returns the files of the manifest that are tombstoned, and the live ones in scope that are no longer
+// on disk, in order.
+func (app *Syncer) goneFiles() ([]string, error) {
+	tombstones, err := app.Tombstones()
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, ts := range tombstones {
+		res = append(res, ts.Path)
+	}
+	live, err := app.queryPaths(SELECTLIVEPATHS)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range live {
+		if _, err := os.Lstat(p); errors.Is(err, os.ErrNotExist) && app.inScope(p) {
+			res = append(res, p)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
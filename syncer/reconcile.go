@@ -0,0 +1,121 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrReconcile is a bucket that does not hold exactly the objects the local files should have, see Reconcile.
+var ErrReconcile = errors.New("the bucket does not match the local files")
+
+// ReconcileReport is the result of Reconcile.
+type ReconcileReport struct {
+	// Prefix is what the bucket was listed under, the common folder of the expected keys.
+	Prefix string
+	// Expected is how many objects the local files should have, counting every piece of a split file.
+	Expected int
+	// Found is how many of them are in the bucket.
+	Found int
+	// Missing are the expected keys that are not in the bucket.
+	Missing []string
+	// Unexpected are the keys under Prefix that no local file accounts for and the manifest never uploaded.
+	Unexpected []string
+}
+
+// Err returns ErrReconcile, with the counts, when the bucket and the local files disagree.
+func (r *ReconcileReport) Err() error {
+	if len(r.Missing) == 0 && len(r.Unexpected) == 0 {
+		return nil
+	}
+	return fmt.Errorf("expected %d objects under %q, found %d with %d missing and %d unexpected: %w", r.Expected, r.Prefix, r.Found, len(r.Missing), len(r.Unexpected), ErrReconcile)
+}
+
+// Reconcile lists the bucket once and checks that the files of the last walk, as returned by WalkAndHash, all
+// have their objects there. Hardlinks count once and files quarantined by MaxFailures are left out.
+func (app *Syncer) Reconcile(ctx context.Context, files map[string]int64) (*ReconcileReport, error) {
+	quarantined, err := app.Quarantined()
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for _, q := range quarantined {
+		skip[q.Path] = true
+	}
+	expected := map[string]bool{}
+	for p := range files {
+		if skip[p] || !app.inScope(p) {
+			continue
+		}
+		target, err := app.linkTarget(p)
+		if err != nil {
+			return nil, err
+		}
+		if target != "" {
+			continue
+		}
+		keys, err := app.partKeys(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			key, err := app.keyFor(p)
+			if err != nil {
+				return nil, err
+			}
+			keys = []string{key}
+		}
+		for _, k := range keys {
+			expected[k] = true
+		}
+	}
+
+	report := &ReconcileReport{Prefix: commonFolder(expected), Expected: len(expected)}
+	objs, err := app.store().List(ctx, report.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	listed := map[string]bool{}
+	for _, o := range objs {
+		listed[o.Key] = true
+		if expected[o.Key] {
+			report.Found++
+			continue
+		}
+		// delta patches and objects of deleted files waiting for Purge are known to the manifest
+		etag, err := app.recordedETag(o.Key)
+		if err != nil {
+			return nil, err
+		}
+		if etag == "" {
+			report.Unexpected = append(report.Unexpected, o.Key)
+		}
+	}
+	for k := range expected {
+		if !listed[k] {
+			report.Missing = append(report.Missing, k)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Unexpected)
+	return report, nil
+}
+
+// commonFolder returns the longest folder prefix, ending in a slash, that all keys share. Empty for none.
+func commonFolder(keys map[string]bool) string {
+	prefix := ""
+	first := true
+	for k := range keys {
+		dir := k[:strings.LastIndex(k, "/")+1]
+		if first {
+			prefix, first = dir, false
+			continue
+		}
+		for !strings.HasPrefix(dir, prefix) {
+			prefix = prefix[:strings.LastIndex(prefix[:len(prefix)-1], "/")+1]
+		}
+	}
+	return prefix
+}
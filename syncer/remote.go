@@ -0,0 +1,178 @@
+package syncer
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DiffAgainstRemote walks the source folders like WalkAndHash and works out what to upload from one listing of
+// the bucket instead of the manifest, for a manifest that was lost or a bucket filled by another tool. A file
+// differs when it has no object, when its objects add up to another size, or when it was modified after they
+// were and, for a single object with an MD5 ETag, its content no longer matches. Files that were encrypted,
+// compressed or transformed on the way up are compared by modification time only. The files that match are
+// recorded as uploaded like BuildManifestFromBucket does, the walk is recorded like UpdateManifest does, and the
+// ones that differ are left pending and returned, sorted, for UploadDiffs.
+func (app *Syncer) DiffAgainstRemote(ctx context.Context, filters []string) ([]string, error) {
+	files, err := app.WalkAndHash(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := app.store().List(ctx, app.KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]ObjectInfo, len(objs))
+	for _, o := range objs {
+		listed[o.Key] = o
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var diffs []string
+	report := &AdoptReport{}
+	for _, p := range paths {
+		if app.links[p] != "" {
+			// goes up with the file it is a link of
+			continue
+		}
+		remote, err := app.remoteObjects(p, listed)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := app.remoteChanged(p, remote)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			diffs = append(diffs, p)
+			continue
+		}
+		if !app.DryRun {
+			err = app.adoptFile(p, remote, report)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = app.UpdateManifest(files)
+	if err != nil {
+		return nil, err
+	}
+	if app.DryRun {
+		app.dryRuns = append([]string{}, diffs...)
+		return diffs, nil
+	}
+	for _, p := range diffs {
+		// a file the manifest has as uploaded but the bucket doesn't agree with
+		err = app.setStatus(p, StatusPending)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
+
+// remoteObjects returns the objects of listed that hold p: its own object, or the pieces it was split into in
+// order, none when it isn't in the bucket.
+func (app *Syncer) remoteObjects(p string, listed map[string]ObjectInfo) ([]ObjectInfo, error) {
+	key, err := app.keyFor(p)
+	if err != nil {
+		return nil, err
+	}
+	if o, ok := listed[key]; ok {
+		return []ObjectInfo{o}, nil
+	}
+	if o, ok := listed[key+"/"]; ok {
+		// an empty directory, see KeepEmptyDirs
+		return []ObjectInfo{o}, nil
+	}
+	// a template with {total} names every piece after how many there are
+	total := 0
+	if strings.Contains(app.PartKeyTemplate, "{total") {
+		for n := 1; n <= MaxParts && total == 0; n++ {
+			if _, ok := listed[app.partKeyFor(key, 0, n)]; ok {
+				total = n
+			}
+		}
+		if total == 0 {
+			return nil, nil
+		}
+	}
+	var res []ObjectInfo
+	for i := 0; total == 0 || i < total; i++ {
+		o, ok := listed[app.partKeyFor(key, i, total)]
+		if !ok {
+			break
+		}
+		res = append(res, o)
+	}
+	if total > 0 && len(res) != total {
+		// some pieces are missing, it has to go up again
+		return nil, nil
+	}
+	return res, nil
+}
+
+// remoteChanged reports whether the local file p differs from the objects remote holds it in.
+func (app *Syncer) remoteChanged(p string, remote []ObjectInfo) (bool, error) {
+	if len(remote) == 0 {
+		return true, nil
+	}
+	info, err := app.localStat(p)
+	if err != nil {
+		return false, err
+	}
+	content, marker, err := app.markerContent(p)
+	if err != nil {
+		return false, err
+	}
+	localSize := info.Size()
+	if marker {
+		localSize = int64(len(content))
+	}
+	var size int64
+	newest := remote[0].LastModified
+	for _, o := range remote {
+		size += o.Size
+		if o.LastModified.After(newest) {
+			newest = o.LastModified
+		}
+	}
+	// what went up isn't the file as it is on disk, only the modification time tells
+	transformed := !marker && (app.EncryptionKey != nil || app.Transform != nil || app.Sparse || app.compresses(p))
+	if !info.ModTime().After(newest) {
+		return !transformed && size != localSize, nil
+	}
+	if transformed || size != localSize || len(remote) > 1 {
+		return true, nil
+	}
+	// modified since the upload, or only touched
+	etag := strings.Trim(remote[0].ETag, `"`)
+	if len(etag) != md5.Size*2 || strings.Contains(etag, "-") {
+		return true, nil
+	}
+	h := md5.New()
+	if marker {
+		io.WriteString(h, content)
+	} else {
+		f, err := os.Open(p)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return false, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)) != etag, nil
+}
@@ -0,0 +1,175 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+// Reporter is told about a run in place of the terminal, for cron jobs, CI and other programs with no one
+// watching spinners. Report gets the ProgressEvents of the uploads, and the messages that would be printed as
+// Notice, Warning and Failure events. Spinners and progress bars are left out. Calls come one at a time, from
+// whichever goroutine the event happened on. See LogReporter, SlogReporter and JSONReporter.
+type Reporter interface {
+	Report(ev ProgressEvent)
+}
+
+// eventNames are what JSONReporter calls the event types.
+var eventNames = map[EventType]string{
+	FileStarted:    "file_started",
+	BytesProgress:  "bytes_progress",
+	FileCompleted:  "file_completed",
+	FileFailed:     "file_failed",
+	SplitStarted:   "split_started",
+	PieceCreated:   "piece_created",
+	SplitCompleted: "split_completed",
+	PartStarted:    "part_started",
+	Notice:         "notice",
+	Warning:        "warning",
+	Failure:        "failure",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+// forwardReporter hands the progress events of the terminal output to Reporter.
+type forwardReporter struct {
+	to Reporter
+}
+
+func (r forwardReporter) handle(ev ProgressEvent) {
+	r.to.Report(ev)
+}
+
+// reportWriter turns what a pterm printer writes into events of kind for Reporter, without the colors and
+// the indent of the lines after the first.
+type reportWriter struct {
+	to   Reporter
+	kind EventType
+}
+
+func (w reportWriter) Write(p []byte) (int, error) {
+	lines := strings.Split(strings.TrimSpace(pterm.RemoveColorFromString(string(p))), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	progressMu.Lock()
+	w.to.Report(ProgressEvent{Type: w.kind, Message: strings.Join(lines, "\n")})
+	progressMu.Unlock()
+	return len(p), nil
+}
+
+// LogReporter writes a line per file, split and message to Logger, or the standard logger when it is nil.
+// BytesProgress and PieceCreated are left out, they would be most of the log.
+type LogReporter struct {
+	Logger *log.Logger
+}
+
+func (r LogReporter) Report(ev ProgressEvent) {
+	logf := log.Printf
+	if r.Logger != nil {
+		logf = r.Logger.Printf
+	}
+	switch ev.Type {
+	case FileStarted:
+		logf("uploading %s (%d/%d, %s)", ev.Path, ev.Index, ev.Total, formatBytes(ev.Size))
+	case FileCompleted:
+		logf("uploaded %s", ev.Path)
+	case FileFailed:
+		logf("failed %s: %v", ev.Path, ev.Err)
+	case SplitStarted:
+		logf("splitting %s into %d pieces", ev.Path, ev.Total)
+	case SplitCompleted:
+		logf("split %s", ev.Path)
+	case PartStarted:
+		logf("uploading %s (piece %d/%d)", ev.Path, ev.Index, ev.Total)
+	case Notice:
+		logf("%s", ev.Message)
+	case Warning:
+		logf("warning: %s", ev.Message)
+	case Failure:
+		logf("error: %s", ev.Message)
+	}
+}
+
+// SlogReporter logs every event to Logger as a structured record, or to slog.Default when it is nil, with the
+// path, counts, sizes and error as attributes. BytesProgress and PieceCreated are logged at debug level, failures
+// at error and warnings at warn.
+type SlogReporter struct {
+	Logger *slog.Logger
+}
+
+func (r SlogReporter) Report(ev ProgressEvent) {
+	logger := r.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	level := slog.LevelInfo
+	switch ev.Type {
+	case BytesProgress, PieceCreated:
+		level = slog.LevelDebug
+	case Warning:
+		level = slog.LevelWarn
+	case FileFailed, Failure:
+		level = slog.LevelError
+	}
+	msg := ev.Message
+	if msg == "" {
+		msg = strings.ReplaceAll(ev.Type.String(), "_", " ")
+	}
+	attrs := []slog.Attr{slog.String("event", ev.Type.String())}
+	if ev.Path != "" {
+		attrs = append(attrs, slog.String("path", ev.Path))
+	}
+	if ev.Total > 0 {
+		attrs = append(attrs, slog.Int("index", ev.Index), slog.Int("total", ev.Total))
+	}
+	if ev.Size > 0 {
+		attrs = append(attrs, slog.Int64("size", ev.Size))
+	}
+	if ev.Bytes > 0 {
+		attrs = append(attrs, slog.Int64("bytes", ev.Bytes))
+	}
+	if ev.TotalBytes > 0 {
+		attrs = append(attrs, slog.Int64("total_bytes", ev.TotalBytes))
+	}
+	if ev.Err != nil {
+		attrs = append(attrs, slog.String("error", ev.Err.Error()))
+	}
+	logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// JSONReporter writes every event to W as a line of JSON, named as in eventNames, with the time it happened.
+type JSONReporter struct {
+	W io.Writer
+}
+
+// jsonEvent is a line of JSONReporter.
+type jsonEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Path       string    `json:"path,omitempty"`
+	Index      int       `json:"index,omitempty"`
+	Total      int       `json:"total,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	TotalBytes int64     `json:"total_bytes,omitempty"`
+	PartSize   int64     `json:"part_size,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+func (r JSONReporter) Report(ev ProgressEvent) {
+	line := jsonEvent{Time: time.Now().UTC(), Type: ev.Type.String(), Path: ev.Path, Index: ev.Index, Total: ev.Total, Bytes: ev.Bytes, Size: ev.Size, TotalBytes: ev.TotalBytes, PartSize: ev.PartSize, Message: ev.Message}
+	if ev.Err != nil {
+		line.Error = ev.Err.Error()
+	}
+	json.NewEncoder(r.W).Encode(line)
+}
@@ -0,0 +1,338 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DefaultRestoreDays is how long the copy of an archived object that RestoreFolder asks for stays readable,
+// long enough to come back for it on another day.
+const DefaultRestoreDays = 7
+
+// restorePollInterval is how often WaitForRestore checks on the objects it waits for.
+var restorePollInterval = 15 * time.Minute
+
+// RestoreReport is the result of RestoreFolder.
+type RestoreReport struct {
+	// Restored files were downloaded from the bucket.
+	Restored []string
+	// Unchanged files were there already with the content recorded at upload.
+	Unchanged []string
+	// Pending files have objects in Glacier or Deep Archive that were asked to be restored, run again once
+	// the copies are readable, hours later and up to 12 for Deep Archive, see WaitForRestore.
+	Pending []string
+}
+
+// RestoreFolder downloads every uploaded file in the manifest back to where it was synced from, or under dest
+// when it is set, with the same path relative to its source folder. Split files are joined back together and
+// get the modification time they were uploaded with. Files with objects in an archive storage class that have
+// no readable copy yet are asked to be restored for RestoreDays and reported pending instead of failing.
+func (app *Syncer) RestoreFolder(ctx context.Context, dest string) (*RestoreReport, error) {
+	if err := app.needSQLite("RestoreFolder"); err != nil {
+		return nil, err
+	}
+	paths, err := app.queryPaths(SELECTVERIFY)
+	if err != nil {
+		return nil, err
+	}
+	return app.restorePaths(ctx, paths, dest)
+}
+
+// Restore is RestoreFolder for the files with keys under prefix, put back where they were synced from.
+func (app *Syncer) Restore(ctx context.Context, prefix string) (*RestoreReport, error) {
+	if err := app.needSQLite("Restore"); err != nil {
+		return nil, err
+	}
+	paths, err := app.queryPaths(SELECTPATHSBYPREFIX, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return app.restorePaths(ctx, paths, "")
+}
+
+// DownloadDiffs is RestoreFolder for the files held by the objects in keys, put back where they were synced
+// from. A key can be the object of a whole file or a piece of a split one, either way the file is downloaded
+// whole. A key no uploaded file in the manifest has fails with ErrNotFound before anything is downloaded.
+func (app *Syncer) DownloadDiffs(ctx context.Context, keys []string) (*RestoreReport, error) {
+	if err := app.needSQLite("DownloadDiffs"); err != nil {
+		return nil, err
+	}
+	var paths []string
+	seen := map[string]bool{}
+	for _, k := range keys {
+		found, err := app.queryPaths(SELECTPATHSBYKEY, k, k)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("%s: %w", k, ErrNotFound)
+		}
+		for _, p := range found {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return app.restorePaths(ctx, paths, "")
+}
+
+// restorePaths restores the synced files in paths, to dest if it is set, see restoreTarget.
+func (app *Syncer) restorePaths(ctx context.Context, paths []string, dest string) (*RestoreReport, error) {
+	report := &RestoreReport{}
+	var spinner *spinner
+	if !app.NoSpinners {
+		spinner, _ = app.term().spinner("Restoring files")
+	}
+	for i, p := range paths {
+		if !app.inScope(p) {
+			continue
+		}
+		target := app.restoreTarget(p, dest)
+		if spinner != nil {
+			spinner.UpdateText(fmt.Sprintf("Restoring %s. %d/%d", target, i+1, len(paths)))
+		}
+		restored, pending, err := app.restoreFile(ctx, p, target)
+		if err != nil {
+			if spinner != nil {
+				spinner.Fail(fmt.Sprintf("%s: %v", p, err))
+			}
+			return report, fmt.Errorf("%s: %w", p, err)
+		}
+		switch {
+		case restored:
+			report.Restored = append(report.Restored, target)
+		case pending:
+			report.Pending = append(report.Pending, target)
+		default:
+			report.Unchanged = append(report.Unchanged, target)
+		}
+	}
+	if spinner != nil {
+		spinner.Success(fmt.Sprintf("Restored %d files, %d were already there, %d are waiting on a restore from the archive", len(report.Restored), len(report.Unchanged), len(report.Pending)))
+	}
+	return report, nil
+}
+
+// RequestRestore asks for readable copies of the archived objects in keys for days, DefaultRestoreDays when it
+// is 0, at tier, Standard when it is empty. The key of a split file stands for all of its pieces, and objects
+// that are readable already are left alone. Deep Archive can't be restored at Expedited, see RestorePrices.
+func (app *Syncer) RequestRestore(ctx context.Context, keys []string, tier string, days int) error {
+	if err := app.needSQLite("RequestRestore"); err != nil {
+		return err
+	}
+	t := types.TierStandard
+	if tier != "" {
+		t = types.Tier(tier)
+	}
+	if !slices.Contains(t.Values(), t) {
+		return fmt.Errorf("unknown tier %q, expected one of %v", tier, t.Values())
+	}
+	if days <= 0 {
+		days = DefaultRestoreDays
+	}
+	restorer, tiered := app.store().(TierRestorer)
+	if !tiered && t != types.TierStandard {
+		return fmt.Errorf("the object store can't restore at tier %s", t)
+	}
+	objects, err := app.restoreObjects(keys)
+	if err != nil {
+		return err
+	}
+	for _, k := range objects {
+		info, err := app.store().Head(ctx, k)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		class := types.StorageClass(info.StorageClass)
+		if !archived(class) || info.Restored {
+			continue
+		}
+		if _, ok := RestorePrices[class][t]; !ok {
+			return fmt.Errorf("%s: %s can't be restored at tier %s", k, class, t)
+		}
+		if tiered {
+			err = restorer.RestoreTier(ctx, k, int32(days), t)
+		} else {
+			err = app.store().Restore(ctx, k, int32(days))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// WaitForRestore checks on the archived objects in keys every restorePollInterval until all of them have a
+// readable copy, and the files they hold can be downloaded. It waits for hours, so give it a ctx without a short
+// deadline. An archived object no restore was asked for fails right away, see RequestRestore.
+func (app *Syncer) WaitForRestore(ctx context.Context, keys []string) error {
+	if err := app.needSQLite("WaitForRestore"); err != nil {
+		return err
+	}
+	waiting, err := app.restoreObjects(keys)
+	if err != nil {
+		return err
+	}
+	for {
+		var still []string
+		for _, k := range waiting {
+			info, err := app.store().Head(ctx, k)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			if !archived(types.StorageClass(info.StorageClass)) || info.Restored {
+				continue
+			}
+			if !info.Restoring {
+				return fmt.Errorf("%s is archived and wasn't asked to be restored", k)
+			}
+			still = append(still, k)
+		}
+		if len(still) == 0 {
+			return nil
+		}
+		waiting = still
+		if !app.NoSpinners {
+			app.term().info().Printfln("Waiting for %d objects to be restored...", len(waiting))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(restorePollInterval):
+		}
+	}
+}
+
+// restoreObjects is keys with the key of a split file replaced by the keys of its pieces.
+func (app *Syncer) restoreObjects(keys []string) ([]string, error) {
+	var objects []string
+	for _, k := range keys {
+		parts, err := app.queryPaths(SELECTPARTKEYSBYKEY, k)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 0 {
+			parts = []string{k}
+		}
+		objects = append(objects, parts...)
+	}
+	return objects, nil
+}
+
+// restoreTarget is where RestoreFolder writes the synced file p, p itself without dest.
+func (app *Syncer) restoreTarget(p string, dest string) string {
+	if dest == "" {
+		return p
+	}
+	src, ok := app.sourceFor(p)
+	if !ok {
+		return filepath.Join(dest, filepath.Base(p))
+	}
+	rel, _ := filepath.Rel(src.FolderPath, p)
+	if len(app.Sources) > 1 {
+		// the folders could have paths in common, keep them apart
+		rel = filepath.Join(filepath.Base(src.FolderPath), rel)
+	}
+	return filepath.Join(dest, rel)
+}
+
+// restoreFile downloads the synced file p to target unless it holds the recorded content already, or the content
+// it had in FromSnapshot when that is set. It is pending when an archived object of p has to be restored first.
+func (app *Syncer) restoreFile(ctx context.Context, p string, target string) (restored bool, pending bool, err error) {
+	size, hash, mod, keys, err := app.restoreContent(p)
+	if err != nil {
+		return false, false, err
+	}
+	if info, err := app.localStat(target); err == nil && info.Size() == size && hash != "" {
+		sum, _, err := app.sumFile(target)
+		if err != nil {
+			return false, false, err
+		}
+		if sum == hash {
+			return false, false, nil
+		}
+	}
+
+	waiting := false
+	for _, k := range keys {
+		info, err := app.store().Head(ctx, k)
+		if err != nil {
+			return false, false, err
+		}
+		if !archived(types.StorageClass(info.StorageClass)) || info.Restored {
+			continue
+		}
+		days := app.RestoreDays
+		if days <= 0 {
+			days = DefaultRestoreDays
+		}
+		err = app.store().Restore(ctx, k, days)
+		if err != nil {
+			return false, false, err
+		}
+		waiting = true
+	}
+	if waiting {
+		return false, true, nil
+	}
+
+	err = app.Download(ctx, p, target)
+	if err != nil {
+		return false, false, err
+	}
+	info, err := os.Lstat(target)
+	if err != nil {
+		return false, false, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 || mod == 0 || info.ModTime().Unix() == mod {
+		// a link has no times of its own to set, and a time from the object metadata is the more precise one
+		return true, false, nil
+	}
+	t := time.Unix(mod, 0)
+	return true, false, os.Chtimes(target, t, t)
+}
+
+// restoreContent returns the size, sum and modification time restoreFile restores p with, and the objects that
+// hold it: the ones recorded for it now, or in FromSnapshot. There is no modification time for a snapshot
+// recorded before they were.
+func (app *Syncer) restoreContent(p string) (size int64, hash string, mod int64, keys []string, err error) {
+	if app.FromSnapshot != "" {
+		size, hash, mod, err = app.snapshotContent(app.FromSnapshot, p)
+		if err != nil {
+			return 0, "", 0, nil, err
+		}
+		keys, err = app.snapshotKeys(app.FromSnapshot, p)
+		return size, hash, mod, keys, err
+	}
+	size, hash, _, err = app.recordedContent(p)
+	if err != nil {
+		return 0, "", 0, nil, err
+	}
+	err = app.manifest().QueryRow(SELECTMODIFIED, p).Scan(&mod)
+	if err != nil {
+		return 0, "", 0, nil, err
+	}
+	src, err := app.contentPath(p)
+	if err != nil {
+		return 0, "", 0, nil, err
+	}
+	keys, err = app.partKeys(src)
+	if err != nil {
+		return 0, "", 0, nil, err
+	}
+	if len(keys) == 0 {
+		key, err := app.keyFor(src)
+		if err != nil {
+			return 0, "", 0, nil, err
+		}
+		keys = []string{key}
+	}
+	return size, hash, mod, keys, nil
+}
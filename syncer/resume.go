@@ -0,0 +1,367 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// resumePiece is a piece recorded by the split of an earlier run, with where it sits in the original file.
+type resumePiece struct {
+	path   string
+	key    string
+	offset int64
+	size   int64
+	sum    string
+	done   bool
+}
+
+// resumeSplit finishes the upload of obj that an earlier run split but didn't get all the pieces of up. The
+// pieces that went up are kept and the rest are read straight from obj, so nothing is split again. It reports
+// false when there is nothing to resume: obj wasn't split, changed since, or its recorded pieces no longer fit.
+func (app *Syncer) resumeSplit(ctx context.Context, obj string, key string, info fs.FileInfo, class types.StorageClass, opts PutOptions) (bool, error) {
+	pieces, err := app.resumePieces(obj)
+	if err != nil || len(pieces) == 0 {
+		return false, err
+	}
+	f, err := os.Open(obj)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var next int64
+	var todo []resumePiece
+	for i, piece := range pieces {
+		if piece.offset != next || piece.size < 0 || piece.key != app.partKeyFor(key, i, len(pieces)) {
+			return false, nil
+		}
+		next += piece.size
+		if piece.done {
+			continue
+		}
+		if piece.sum == "" || piece.size > app.putLimit(class) {
+			return false, nil
+		}
+		// the file kept its modification time, make sure it kept the content of the piece too
+		h := app.checksum().New()
+		_, err = io.Copy(h, io.NewSectionReader(f, piece.offset, piece.size))
+		if err != nil {
+			return false, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != piece.sum {
+			return false, nil
+		}
+		todo = append(todo, piece)
+	}
+	if next != info.Size() {
+		return false, nil
+	}
+
+	paths := make([]string, len(todo))
+	sizes := make([]int64, len(todo))
+	for i, piece := range todo {
+		paths[i] = piece.path
+		sizes[i] = piece.size
+	}
+	return true, app.putPieces(ctx, obj, paths, sizes, func(i int, report func(read int64)) error {
+		piece := todo[i]
+		return app.trackPart(piece.path, func() error {
+			body := &progressReader{file: io.NewSectionReader(f, piece.offset, piece.size), size: piece.size, report: report}
+			return app.putBody(ctx, piece.key, body, class, opts)
+		})
+	})
+}
+
+// resumePieces returns the recorded pieces of obj in order, none unless obj was split and hasn't changed since.
+func (app *Syncer) resumePieces(obj string) ([]resumePiece, error) {
+	rec, _, err := app.records().Get(obj)
+	if err != nil || !rec.Multipart {
+		return nil, err
+	}
+	parts, err := app.records().Parts(obj)
+	if err != nil {
+		return nil, err
+	}
+	var res []resumePiece
+	for _, part := range parts {
+		res = append(res, resumePiece{path: part.Path, key: part.Key, offset: part.Offset, size: part.Size, sum: part.SHA256, done: part.Status == StatusComplete})
+	}
+	return res, nil
+}
+
+// partlyUploaded reports whether some of pieces went up and some didn't.
+func partlyUploaded(pieces []resumePiece) bool {
+	done := 0
+	for _, piece := range pieces {
+		if piece.done {
+			done++
+		}
+	}
+	return done > 0 && done < len(pieces)
+}
+
+// inFlight is a multipart upload of a synced file recorded in the manifest, see putResumable.
+type inFlight struct {
+	path     string
+	key      string
+	id       string
+	partSize int64
+	size     int64
+	modified int64
+	class    string
+}
+
+// putResumable uploads the synced file obj as key in parts of partSize like PutParts, with the upload and each
+// part that lands recorded in the manifest, so an upload a run didn't finish is carried on from the parts it has
+// by the next one. A failed upload is kept for that instead of aborted. A recorded upload of another key, part
+// size, storage class or version of obj is aborted and started over, as it is with ForceRestart.
+func (app *Syncer) putResumable(ctx context.Context, store ResumableStore, obj string, key string, info fs.FileInfo, partSize int64, opts PutOptions) (string, error) {
+	up, err := app.recordedUpload(obj)
+	if err != nil {
+		return "", err
+	}
+	want := inFlight{path: obj, key: key, partSize: partSize, size: info.Size(), modified: info.ModTime().Unix(), class: opts.StorageClass}
+	if up != nil {
+		want.id = up.id
+		if app.ForceRestart || *up != want {
+			err = app.dropUpload(ctx, store, *up)
+			if err != nil {
+				return "", err
+			}
+			up = nil
+		}
+	}
+	if up == nil {
+		want.id, err = store.CreateUpload(ctx, key, opts)
+		if err != nil {
+			return "", err
+		}
+		_, err = app.db.Exec(INSERTUPLOAD, obj, key, want.id, partSize, want.size, want.modified, want.class)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	parts := max(1, int((want.size+partSize-1)/partSize))
+	etags := make([]string, parts)
+	rows, err := app.db.Query(SELECTUPLOADPARTS, want.id)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var n int
+		var etag string
+		err = rows.Scan(&n, &etag)
+		if err != nil {
+			rows.Close()
+			return "", err
+		}
+		if n >= 1 && n <= parts {
+			etags[n-1] = etag
+		}
+	}
+	rows.Close()
+	f, err := os.Open(obj)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// the parts that landed on an earlier run count as sent
+	var sent int64
+	for i := range etags {
+		if etags[i] != "" {
+			sent += min(partSize, want.size-int64(i)*partSize)
+		}
+	}
+	for i := range etags {
+		if etags[i] != "" {
+			continue
+		}
+		start := int64(i) * partSize
+		n := min(partSize, want.size-start)
+		var body io.Reader = io.NewSectionReader(f, start, n)
+		if app.reportsBytes(want.size) {
+			done := sent
+			body = &progressReader{file: io.NewSectionReader(f, start, n), size: n, report: func(read int64) {
+				app.emit(ProgressEvent{Type: BytesProgress, Path: obj, Bytes: done + read, Size: want.size})
+			}}
+		}
+		etags[i], err = store.UploadPart(ctx, key, want.id, int32(i+1), app.limited(ctx, body), n)
+		if err != nil {
+			return "", fmt.Errorf("%s: multipart upload: part %d: %w", key, i+1, err)
+		}
+		sent += n
+		_, err = app.db.Exec(INSERTUPLOADPART, want.id, i+1, etags[i])
+		if err != nil {
+			return "", err
+		}
+	}
+	etag, err := store.CompleteUpload(ctx, key, want.id, etags)
+	if err != nil {
+		return "", fmt.Errorf("%s: multipart upload: %w", key, err)
+	}
+	return etag, app.forgetUpload(want.id)
+}
+
+// recordedUpload returns the upload of p recorded by putResumable, nil when there is none.
+func (app *Syncer) recordedUpload(p string) (*inFlight, error) {
+	up := &inFlight{}
+	err := app.db.QueryRow(SELECTUPLOAD, p).Scan(&up.path, &up.key, &up.id, &up.partSize, &up.size, &up.modified, &up.class)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+// dropUpload aborts up in the bucket and forgets it.
+func (app *Syncer) dropUpload(ctx context.Context, store ResumableStore, up inFlight) error {
+	err := store.AbortUpload(ctx, up.key, up.id)
+	if err != nil {
+		return fmt.Errorf("%s: aborting upload %s: %w", up.key, up.id, err)
+	}
+	return app.forgetUpload(up.id)
+}
+
+// forgetUpload removes the record of the upload id and its parts.
+func (app *Syncer) forgetUpload(id string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{DELETEUPLOADPARTS, DELETEUPLOAD} {
+		_, err = tx.Exec(q, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DefaultStaleUploadAge is the StaleUploadAge when Syncer.StaleUploadAge is 0, a week like the abort rule of
+// GenerateLifecycle is usually set to.
+const DefaultStaleUploadAge = 7 * 24 * time.Hour
+
+// ResumeReport is the result of ResumePending.
+type ResumeReport struct {
+	// Resumed are the files whose unfinished uploads were carried on and completed.
+	Resumed []string
+	// Aborted are the keys of the unfinished uploads that were dropped from the bucket.
+	Aborted []string
+}
+
+// ResumePending carries on the multipart uploads an earlier run didn't finish, from the last part that landed,
+// see putResumable. Uploads of files that changed, are gone or were uploaded since are aborted, and so are
+// unfinished uploads in the bucket the manifest has no record of for keys it does hold, left by a run that died
+// in the middle of PutParts, so their parts aren't billed forever. Those are only aborted once they were started
+// StaleUploadAge ago, a younger one may belong to another machine syncing with the same manifest. Uploads of any
+// other keys are left alone. It needs NativeMultipart and a ResumableStore, like the uploads it resumes.
+func (app *Syncer) ResumePending(ctx context.Context) (*ResumeReport, error) {
+	if err := app.needSQLite("ResumePending"); err != nil {
+		return nil, err
+	}
+	multipart, ok := app.multipart()
+	store, resumable := multipart.(ResumableStore)
+	if !ok || !resumable {
+		return nil, fmt.Errorf("resuming uploads needs NativeMultipart and an object store that can resume them")
+	}
+	rows, err := app.db.Query(SELECTUPLOADS)
+	if err != nil {
+		return nil, err
+	}
+	var recorded []inFlight
+	for rows.Next() {
+		var up inFlight
+		err = rows.Scan(&up.path, &up.key, &up.id, &up.partSize, &up.size, &up.modified, &up.class)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		recorded = append(recorded, up)
+	}
+	rows.Close()
+
+	uploads, err := store.ListUploads(ctx, app.KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	listed := map[string]bool{}
+	for _, u := range uploads {
+		listed[u.ID] = true
+	}
+
+	report := &ResumeReport{}
+	known := map[string]bool{}
+	resume := map[bool][]string{}
+	for _, up := range recorded {
+		known[up.id] = true
+		_, _, status, err := app.recordedContent(up.path)
+		if err != nil {
+			return report, err
+		}
+		info, err := os.Stat(up.path)
+		if err == nil && info.Size() == up.size && info.ModTime().Unix() == up.modified && status != StatusComplete && status != "" {
+			if !listed[up.id] {
+				// expired by a lifecycle rule or aborted by hand, the file starts over
+				err = app.forgetUpload(up.id)
+				if err != nil {
+					return report, err
+				}
+			}
+			deep := types.StorageClass(up.class) == types.StorageClassDeepArchive
+			resume[deep] = append(resume[deep], up.path)
+			continue
+		}
+		err = app.dropUpload(ctx, store, up)
+		if err != nil {
+			return report, err
+		}
+		report.Aborted = append(report.Aborted, up.key)
+	}
+
+	staleAge := app.StaleUploadAge
+	if staleAge == 0 {
+		staleAge = DefaultStaleUploadAge
+	}
+	for _, u := range uploads {
+		if known[u.ID] || time.Since(u.Initiated) < staleAge {
+			continue
+		}
+		var n int
+		err = app.db.QueryRow(COUNTKEY, u.Key).Scan(&n)
+		if err != nil {
+			return report, err
+		}
+		if n == 0 {
+			continue
+		}
+		err = store.AbortUpload(ctx, u.Key, u.ID)
+		if err != nil {
+			return report, fmt.Errorf("%s: aborting upload %s: %w", u.Key, u.ID, err)
+		}
+		report.Aborted = append(report.Aborted, u.Key)
+	}
+
+	for _, deep := range []bool{false, true} {
+		if len(resume[deep]) == 0 {
+			continue
+		}
+		err = app.UploadDiffs(ctx, resume[deep], deep)
+		if err != nil {
+			return report, err
+		}
+		report.Resumed = append(report.Resumed, resume[deep]...)
+	}
+	return report, nil
+}
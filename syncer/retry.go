@@ -0,0 +1,84 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+// DefaultMaxRetries is how many times a PUT that failed on a transient error is retried when MaxRetries is not set.
+const DefaultMaxRetries = 3
+
+// retryBase and retryCap bound the backoff between retries, it doubles from retryBase up to retryCap and is
+// jittered over the whole range, so uploads that failed together don't come back together.
+var (
+	retryBase = time.Second
+	retryCap  = time.Minute
+)
+
+// isTransient reports whether err is a failure that may well go away when the PUT is sent again: a dropped or
+// timed out connection, or S3 failing on its side. Throttling is left to uploadThrottled, which also backs off the
+// concurrency, and anything S3 turned the request down for, like AccessDenied or NoSuchBucket, fails right away.
+func isTransient(err error) bool {
+	if err == nil || isThrottle(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "InternalError", "RequestTimeout", "ServiceUnavailable":
+			return true
+		}
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode() >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.As(err, &netErr)
+}
+
+// putRetried is putWatched, sent again from where body started after a transient error, up to MaxRetries times
+// with exponential backoff. A body that can't seek back only gets the one try.
+func (app *Syncer) putRetried(ctx context.Context, key string, body io.Reader, opts PutOptions) (string, error) {
+	retries := app.MaxRetries
+	if retries == 0 {
+		retries = DefaultMaxRetries
+	}
+	seeker, _ := body.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			seeker = nil
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		etag, err := app.putWatched(ctx, key, body, opts)
+		if !isTransient(err) || attempt >= retries || seeker == nil {
+			return etag, err
+		}
+		_, seekErr := seeker.Seek(start, io.SeekStart)
+		if seekErr != nil {
+			return "", err
+		}
+		wait := time.Duration(rand.Int63n(int64(min(retryBase<<attempt, retryCap)) + 1))
+		if !app.NoSpinners {
+			app.term().warning().Printfln("%s failed (%v), trying again in %s.", key, err, wait.Round(time.Millisecond))
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
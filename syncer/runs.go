@@ -0,0 +1,163 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// Run outcomes recorded in the runs table.
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	// RunStopped is a run that ran into MaxDuration, MaxFilesPerRun or MaxBytesPerRun, what it didn't get to is
+	// still pending.
+	RunStopped = "stopped"
+	// RunCancelled is a run stopped by its context, like on Ctrl-C. The file in flight went back to pending, so
+	// the next run picks it up again along with the rest.
+	RunCancelled = "cancelled"
+)
+
+// Run is the audit record of one UploadDiffs call.
+type Run struct {
+	ID        int64
+	Started   time.Time
+	Ended     time.Time
+	Attempted int
+	Succeeded int
+	Failed    int
+	Bytes     int64
+	Outcome   string
+	// Label is the RunLabel the run was made with, if any.
+	Label string
+}
+
+// RunFile is the result for one file within a run.
+type RunFile struct {
+	Path    string
+	Outcome string
+	Bytes   int64
+	Error   string
+}
+
+// startRun records the start of a run and returns its id. Only the SQLite manifest keeps the run history, the
+// runs of another have id 0 and aren't recorded.
+func (app *Syncer) startRun() (int64, error) {
+	if app.db == nil {
+		return 0, nil
+	}
+	res, err := app.db.Exec(INSERTRUN, time.Now().Unix(), app.RunLabel)
+	if err != nil {
+		return 0, err
+	}
+	run, err := res.LastInsertId()
+	app.countSummary(func(s *RunSummary) { s.Run = run })
+	return run, err
+}
+
+// finishRun stamps the end time and outcome of run from the error UploadDiffs is returning.
+func (app *Syncer) finishRun(run int64, runErr error) error {
+	outcome := RunSucceeded
+	switch {
+	case errors.Is(runErr, context.Canceled):
+		outcome = RunCancelled
+	case runErr != nil:
+		outcome = RunFailed
+	case app.remaining > 0:
+		outcome = RunStopped
+	}
+	if app.db == nil {
+		return nil
+	}
+	_, err := app.db.Exec(FINISHRUN, time.Now().Unix(), outcome, run)
+	return err
+}
+
+// recordRunFile links the result of uploading p to run and rolls it into the run totals. A file stopped by a
+// cancelled run is recorded as RunCancelled and counts as neither succeeded nor failed.
+// This is bookkeeping, so failing to write it never fails the upload itself.
+func (app *Syncer) recordRunFile(run int64, p string, uploadErr error) {
+	outcome, succeeded, failed := RunSucceeded, 1, 0
+	var bytes int64
+	var msg *string
+	switch {
+	case errors.Is(uploadErr, context.Canceled):
+		outcome, succeeded = RunCancelled, 0
+	case uploadErr != nil:
+		outcome, succeeded, failed = RunFailed, 0, 1
+		s := uploadErr.Error()
+		msg = &s
+	default:
+		bytes = fileSize(p)
+	}
+	app.countSummary(func(s *RunSummary) {
+		s.Uploaded += succeeded
+		s.Failed += failed
+		s.Bytes += bytes
+	})
+	if app.db == nil {
+		return
+	}
+	app.db.Exec(INSERTRUNFILE, run, p, outcome, bytes, msg)
+	app.db.Exec(UPDATERUNCOUNTS, succeeded, failed, bytes, run)
+}
+
+// RunHistory returns the last n runs, newest first.
+func (app *Syncer) RunHistory(n int) ([]Run, error) {
+	if err := app.needSQLite("RunHistory"); err != nil {
+		return nil, err
+	}
+	rows, err := app.db.Query(SELECTRUNS, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Run
+	for rows.Next() {
+		var r Run
+		var started, ended int64
+		err = rows.Scan(&r.ID, &started, &ended, &r.Attempted, &r.Succeeded, &r.Failed, &r.Bytes, &r.Outcome, &r.Label)
+		if err != nil {
+			return nil, err
+		}
+		r.Started = time.Unix(started, 0)
+		if ended > 0 {
+			r.Ended = time.Unix(ended, 0)
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// RunFiles returns the per file results of the run with id run.
+func (app *Syncer) RunFiles(run int64) ([]RunFile, error) {
+	if err := app.needSQLite("RunFiles"); err != nil {
+		return nil, err
+	}
+	rows, err := app.db.Query(SELECTRUNFILES, run)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []RunFile
+	for rows.Next() {
+		var f RunFile
+		err = rows.Scan(&f.Path, &f.Outcome, &f.Bytes, &f.Error)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, f)
+	}
+	return res, rows.Err()
+}
+
+// fileSize is the size of the file at p, 0 if it can't be read.
+func fileSize(p string) int64 {
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,153 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// selfTestSplitLimit is the put limit used by TestRoundTrip, small so the big fixture gets split.
+const selfTestSplitLimit = 1024 * 1024 // 1MB
+
+// TestRoundTrip is an end to end smoke test against bucket. It syncs a generated fixture tree, including one
+// file over the split limit, under a throwaway prefix with its own manifest, downloads every object back to
+// check the checksums, then deletes everything it uploaded. A nil error means the credentials and bucket work.
+func TestRoundTrip(ctx context.Context, client *s3.Client, bucket string) error {
+	dir, err := os.MkdirTemp("", "s3sync-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tree := filepath.Join(dir, "tree")
+	fixtures := map[string]int{
+		"small.txt":       16,
+		"nested/data.bin": 64 * 1024,
+		"big.bin":         3*selfTestSplitLimit + 100,
+	}
+	for name, size := range fixtures {
+		err = writeFixture(filepath.Join(tree, name), size)
+		if err != nil {
+			return err
+		}
+	}
+
+	prefix := fmt.Sprintf("s3sync-selftest-%d/", time.Now().Unix())
+	app := &Syncer{
+		FolderPath: tree,
+		Bucket:     bucket,
+		S3Client:   client,
+		KeyFunc: func(p string) string {
+			rel, _ := filepath.Rel(tree, p)
+			return prefix + filepath.ToSlash(rel)
+		},
+		PutLimits: map[types.StorageClass]int64{types.StorageClassStandard: selfTestSplitLimit},
+	}
+	err = app.InitDb(filepath.Join(dir, "manifest.db"))
+	if err != nil {
+		return err
+	}
+	defer app.Close()
+
+	fileMap, err := app.WalkAndHash(ctx, []string{""})
+	if err != nil {
+		return err
+	}
+	err = app.UpdateManifest(fileMap)
+	if err != nil {
+		return err
+	}
+	uploads, err := app.GetUploadList()
+	if err != nil {
+		return err
+	}
+	defer app.deleteUploaded(ctx, uploads)
+	err = app.UploadDiffs(ctx, uploads, false)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range uploads {
+		err = app.checkRoundTrip(ctx, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUploaded removes the objects and parts recorded for every file in files, ignoring errors.
+func (app *Syncer) deleteUploaded(ctx context.Context, files []string) {
+	for _, p := range files {
+		keys, _ := app.remoteKeys(p)
+		for _, k := range keys {
+			app.store().Delete(ctx, k)
+		}
+	}
+}
+
+// checkRoundTrip downloads the object (or all the parts) for p and compares the checksum with the local file.
+func (app *Syncer) checkRoundTrip(ctx context.Context, p string) error {
+	key, err := app.keyFor(p)
+	if err != nil {
+		return err
+	}
+	keys, err := app.partKeys(p)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		keys = []string{key}
+	}
+
+	remote := sha256.New()
+	for _, k := range keys {
+		body, err := app.store().Get(ctx, k)
+		if err != nil {
+			return fmt.Errorf("%s did not land in the bucket: %w", k, err)
+		}
+		_, err = io.Copy(remote, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	local := sha256.New()
+	_, err = io.Copy(local, f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(local.Sum(nil), remote.Sum(nil)) {
+		return fmt.Errorf("checksum mismatch for %s", p)
+	}
+	return nil
+}
+
+// writeFixture writes size random bytes to p, creating the folders it needs.
+func writeFixture(p string, size int) error {
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	_, err = rand.Read(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
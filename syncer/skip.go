@@ -0,0 +1,82 @@
+package syncer
+
+import (
+	"io"
+	"math"
+	"os"
+)
+
+// SkipFunc decides per file whether the walk leaves it out, with a reason that is shown to the user.
+// It runs after the extension filters, for files only.
+type SkipFunc func(p string, info os.FileInfo) (skip bool, reason string)
+
+// entropySample is how much of a file SkipIncompressible reads.
+const entropySample = 64 * 1024
+
+// incompressibleEntropy is the bits per byte above which a sample is taken to be encrypted or compressed.
+const incompressibleEntropy = 7.95
+
+// SkipEmpty skips empty files and files that are nothing but a sparse hole.
+func SkipEmpty(p string, info os.FileInfo) (bool, string) {
+	if info.Size() == 0 {
+		return true, "empty"
+	}
+	if blocks, ok := allocated(info); ok && blocks == 0 {
+		return true, "sparse, no data on disk"
+	}
+	return false, ""
+}
+
+// SkipIncompressible skips files whose first block looks like random data, meaning it is already encrypted
+// or compressed and compressing it again would only cost time.
+func SkipIncompressible(p string, info os.FileInfo) (bool, string) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, ""
+	}
+	defer f.Close()
+	buf := make([]byte, entropySample)
+	n, _ := io.ReadFull(f, buf)
+	// too little to tell
+	if n < 4096 {
+		return false, ""
+	}
+	if entropy(buf[:n]) >= incompressibleEntropy {
+		return true, "already encrypted or compressed"
+	}
+	return false, ""
+}
+
+// SkipAny combines skip funcs, the first one that skips wins.
+func SkipAny(funcs ...SkipFunc) SkipFunc {
+	return func(p string, info os.FileInfo) (bool, string) {
+		for _, f := range funcs {
+			if skip, reason := f(p, info); skip {
+				return true, reason
+			}
+		}
+		return false, ""
+	}
+}
+
+// entropy is the Shannon entropy of data in bits per byte, 0 for a single repeated byte up to 8 for random data.
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var res float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		f := float64(c) / float64(len(data))
+		res -= f * math.Log2(f)
+	}
+	return res
+}
+
+// Oversize returns the files the last WalkAndHash left out because they were over SkipLargerThan.
+func (app *Syncer) Oversize() []string {
+	return app.oversize
+}
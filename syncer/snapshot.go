@@ -0,0 +1,170 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// SnapshotLayout is the time layout of the snapshot names picked for sync --snapshot, e.g. 2024-06-01T03:00:00Z.
+const SnapshotLayout = "2006-01-02T15:04:05Z"
+
+// snapshotIndex is the name of the object under each snapshot listing its files, so a snapshot can be restored
+// from the bucket alone.
+const snapshotIndex = ".s3sync-snapshot.json"
+
+// SnapshotInfo is one snapshot recorded in the manifest.
+type SnapshotInfo struct {
+	Name  string
+	Files int
+}
+
+// snapshotKey puts key under the Snapshot prefix, if there is one.
+func (app *Syncer) snapshotKey(key string) string {
+	if app.Snapshot == "" {
+		return key
+	}
+	return app.Snapshot + "/" + key
+}
+
+// RecordSnapshot records every uploaded file in the manifest as part of Snapshot, with the objects that hold it.
+// Files that did not change since an earlier snapshot point at that snapshot's objects, so they are stored once.
+// An index of the snapshot is uploaded as well, and Purge leaves the objects of every snapshot alone.
+func (app *Syncer) RecordSnapshot(ctx context.Context) (int, error) {
+	if err := app.needSQLite("RecordSnapshot"); err != nil {
+		return 0, err
+	}
+	if app.Snapshot == "" {
+		return 0, fmt.Errorf("no snapshot name set")
+	}
+	paths, err := app.queryPaths(SELECTVERIFY)
+	if err != nil {
+		return 0, err
+	}
+	index := make(map[string][]string, len(paths))
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, p := range paths {
+		// a hardlink is stored as the file it links to
+		src, err := app.contentPath(p)
+		if err != nil {
+			return 0, err
+		}
+		keys, err := app.partKeys(src)
+		if err != nil {
+			return 0, err
+		}
+		if len(keys) == 0 {
+			key, err := app.keyFor(src)
+			if err != nil {
+				return 0, err
+			}
+			keys = []string{key}
+		}
+		for i, k := range keys {
+			_, err = tx.Exec(INSERTSNAPSHOTKEY, app.Snapshot, p, i, k)
+			if err != nil {
+				return 0, err
+			}
+		}
+		_, err = tx.Exec(INSERTSNAPSHOTFILE, app.Snapshot, p)
+		if err != nil {
+			return 0, err
+		}
+		index[p] = keys
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return 0, err
+	}
+	err = app.putBody(ctx, app.prefixKey(app.snapshotKey(snapshotIndex)), bytes.NewReader(data), types.StorageClassStandard, PutOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return len(paths), nil
+}
+
+// Snapshots returns the snapshots recorded in the manifest, oldest first.
+func (app *Syncer) Snapshots() ([]SnapshotInfo, error) {
+	if err := app.needSQLite("Snapshots"); err != nil {
+		return nil, err
+	}
+	rows, err := app.db.Query(SELECTSNAPSHOTS)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []SnapshotInfo
+	for rows.Next() {
+		var s SnapshotInfo
+		err = rows.Scan(&s.Name, &s.Files)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// snapshotKeys returns the objects that hold the file p in snapshot.
+func (app *Syncer) snapshotKeys(snapshot string, p string) ([]string, error) {
+	keys, err := app.queryPaths(SELECTSNAPSHOTKEYS, snapshot, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s is not in snapshot %s: %w", p, snapshot, ErrNotFound)
+	}
+	return keys, nil
+}
+
+// snapshotContent returns the size, sum and modification time the file p had in snapshot, a size of -1 and no
+// sum for a snapshot recorded before they were.
+func (app *Syncer) snapshotContent(snapshot string, p string) (int64, string, int64, error) {
+	var size, mod int64
+	var hash string
+	err := app.manifest().QueryRow(SELECTSNAPSHOTFILE, snapshot, p).Scan(&size, &hash, &mod)
+	if err == sql.ErrNoRows {
+		return -1, "", 0, nil
+	}
+	return size, hash, mod, err
+}
+
+// RestoreSnapshot is RestoreFolder for the files as they were in snapshot: every file the snapshot recorded is
+// downloaded from the objects it pointed at then, with the modification time it had, even when the file changed
+// or was deleted since. Each snapshot keeps its objects under its own prefix, so this works without versioning
+// on the bucket. Files that came after the snapshot are left alone.
+func (app *Syncer) RestoreSnapshot(ctx context.Context, snapshot string, dest string) (*RestoreReport, error) {
+	if err := app.needSQLite("RestoreSnapshot"); err != nil {
+		return nil, err
+	}
+	paths, err := app.queryPaths(SELECTSNAPSHOTPATHS, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("snapshot %s: %w", snapshot, ErrNotFound)
+	}
+	prev := app.FromSnapshot
+	app.FromSnapshot = snapshot
+	defer func() { app.FromSnapshot = prev }()
+	return app.restorePaths(ctx, paths, dest)
+}
+
+// snapshotted reports whether key holds a file of any snapshot.
+func (app *Syncer) snapshotted(key string) (bool, error) {
+	var n int
+	err := app.db.QueryRow(SELECTSNAPSHOTTED, key).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,140 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Source is one local folder to sync. Files under it are keyed as KeyPrefix plus their path relative to
+// FolderPath when KeyPrefix is set, and uploaded in StorageClass when that is set.
+type Source struct {
+	FolderPath   string
+	KeyPrefix    string
+	StorageClass types.StorageClass
+}
+
+// sources returns the folders to sync, FolderPath on its own when Sources is empty.
+func (app *Syncer) sources() []Source {
+	if len(app.Sources) > 0 {
+		return app.Sources
+	}
+	return []Source{{FolderPath: app.FolderPath}}
+}
+
+// sourceFor returns the source the local file p was found in, the one with the longest matching folder wins.
+func (app *Syncer) sourceFor(p string) (Source, bool) {
+	var best Source
+	found := false
+	for _, src := range app.sources() {
+		rel, err := filepath.Rel(src.FolderPath, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if !found || len(src.FolderPath) > len(best.FolderPath) {
+			best = src
+			found = true
+		}
+	}
+	return best, found
+}
+
+// storageClassFor returns the storage class for the file p, its source's class if it has one, otherwise
+// the first of ClassRules that matches, Deep Archive when deep is set, then Syncer.StorageClass and finally
+// Standard.
+func (app *Syncer) storageClassFor(p string, deep bool) types.StorageClass {
+	if src, ok := app.sourceFor(p); ok && src.StorageClass != "" {
+		return src.StorageClass
+	}
+	if class, ok := app.ruleClass(p); ok {
+		return class
+	}
+	if deep {
+		return types.StorageClassDeepArchive
+	}
+	if app.StorageClass != "" {
+		return app.StorageClass
+	}
+	return types.StorageClassStandard
+}
+
+// walkRoots returns the folders WalkAndHash walks, every source narrowed down to Subpath when it is set.
+// Sources without that subfolder are left out, it is an error if none of them have it.
+func (app *Syncer) walkRoots() ([]string, error) {
+	var roots []string
+	for _, src := range app.sources() {
+		roots = append(roots, src.FolderPath)
+	}
+	if app.Subpath == "" {
+		return roots, nil
+	}
+	sub := filepath.Clean(filepath.FromSlash(app.Subpath))
+	if filepath.IsAbs(sub) || sub == ".." || strings.HasPrefix(sub, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("subpath %s must be relative to the folder being synced", app.Subpath)
+	}
+	var res []string
+	for _, root := range roots {
+		p := filepath.Join(root, sub)
+		_, err := os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("subpath %s does not exist in any folder being synced", app.Subpath)
+	}
+	return res, nil
+}
+
+// inScope reports whether the local file p is part of this run, inside Subpath and IncludeDirs when they are set
+// and matching the filters of the last walk, not left out by its IgnoreFile. Changing the filters or the
+// IgnoreFile between runs only uploads the files that newly match, and the ones that stopped matching are left
+// as they are in the manifest and the bucket, neither uploaded nor tombstoned, until a walk matches them again.
+func (app *Syncer) inScope(p string) bool {
+	if app.filters != nil && !inFilters(app.filterPath(p), app.filters) || app.ignored(p, false) {
+		return false
+	}
+	if app.Subpath == "" && len(app.IncludeDirs) == 0 {
+		return true
+	}
+	src, ok := app.sourceFor(p)
+	if !ok {
+		return false
+	}
+	if app.Subpath != "" && !within(filepath.Join(src.FolderPath, filepath.FromSlash(app.Subpath)), p) {
+		return false
+	}
+	return app.included(src.FolderPath, p, false)
+}
+
+// included reports whether p under the source folder root is inside one of the IncludeDirs. Directories
+// that lead down to an include dir are included too, so the walk can get there.
+func (app *Syncer) included(root string, p string, dir bool) bool {
+	if len(app.IncludeDirs) == 0 {
+		return true
+	}
+	if p == root {
+		return true
+	}
+	for _, inc := range app.IncludeDirs {
+		incPath := filepath.Join(root, filepath.FromSlash(inc))
+		if within(incPath, p) || (dir && within(p, incPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether p is dir or anything below it.
+func within(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
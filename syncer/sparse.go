@@ -0,0 +1,178 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MetaSparse is the object metadata key holding the layout of a file uploaded by Sparse, see encodeSparse.
+const MetaSparse = "sparse"
+
+// sparseMapBudget caps the encoded layout, S3 allows 2KB of metadata per object in total.
+const sparseMapBudget = 1024
+
+// extent is a stretch of a file that holds data, the rest of a sparse file reads as zeros.
+type extent struct {
+	off, len int64
+}
+
+// sparseExtents returns the data extents of the file p when it has holes, none for a file that is all data
+// or when the platform can't tell. Holes too small to be worth a place in the layout are read as data.
+func sparseExtents(p string, info os.FileInfo) ([]extent, error) {
+	blocks, ok := allocated(info)
+	if !ok || blocks*512 >= info.Size() {
+		return nil, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	extents, err := dataExtents(f, info.Size())
+	if err != nil || extents == nil {
+		return nil, err
+	}
+	if len(extents) == 1 && extents[0] == (extent{0, info.Size()}) {
+		// fewer blocks than bytes without holes, like on a compressing file system
+		return nil, nil
+	}
+	// merge across ever bigger holes until the layout fits in the object metadata
+	for gap := int64(4096); len(encodeSparse(info.Size(), extents)) > sparseMapBudget; gap *= 2 {
+		extents = mergeExtents(extents, gap)
+	}
+	return extents, nil
+}
+
+// mergeExtents joins the extents separated by holes smaller than gap.
+func mergeExtents(extents []extent, gap int64) []extent {
+	var res []extent
+	for _, e := range extents {
+		if n := len(res); n > 0 && e.off-(res[n-1].off+res[n-1].len) < gap {
+			res[n-1].len = e.off + e.len - res[n-1].off
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// encodeSparse writes a layout as the file size and its extents, like 1048576:0+4096,65536+8192.
+func encodeSparse(size int64, extents []extent) string {
+	parts := make([]string, len(extents))
+	for i, e := range extents {
+		parts[i] = strconv.FormatInt(e.off, 10) + "+" + strconv.FormatInt(e.len, 10)
+	}
+	return strconv.FormatInt(size, 10) + ":" + strings.Join(parts, ",")
+}
+
+// decodeSparse reads a layout written by encodeSparse.
+func decodeSparse(s string) (int64, []extent, error) {
+	sizeStr, list, ok := strings.Cut(s, ":")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if !ok || err != nil {
+		return 0, nil, fmt.Errorf("bad sparse layout %q", s)
+	}
+	var extents []extent
+	for _, part := range strings.Split(list, ",") {
+		if part == "" {
+			continue
+		}
+		offStr, lenStr, _ := strings.Cut(part, "+")
+		off, offErr := strconv.ParseInt(offStr, 10, 64)
+		n, lenErr := strconv.ParseInt(lenStr, 10, 64)
+		if offErr != nil || lenErr != nil {
+			return 0, nil, fmt.Errorf("bad sparse layout %q", s)
+		}
+		extents = append(extents, extent{off, n})
+	}
+	return size, extents, nil
+}
+
+// putSparse uploads only the data extents of obj packed back to back, with the layout in the object metadata so
+// Download can put the holes back. Like putTransformed it spools the packed content to a temp file first.
+func (app *Syncer) putSparse(ctx context.Context, obj string, key string, info os.FileInfo, extents []extent, class types.StorageClass, opts PutOptions) error {
+	f, err := os.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dir, err := os.MkdirTemp("", "s3sync")
+	if err != nil {
+		return err
+	}
+	app.trackTemp(dir)
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, filepath.Base(obj))
+	out, err := os.Create(spool)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		_, err = io.Copy(out, io.NewSectionReader(f, e.off, e.len))
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	packed, err := os.Stat(spool)
+	if err != nil {
+		return err
+	}
+	if app.NoSplit && packed.Size() > app.putLimit(class) {
+		return fmt.Errorf("%s holds %d bytes of data, the limit for %s is %d: %w", obj, packed.Size(), class, app.putLimit(class), ErrTooLarge)
+	}
+
+	meta := map[string]string{MetaSparse: encodeSparse(info.Size(), extents)}
+	for k, v := range opts.Metadata {
+		meta[k] = v
+	}
+	opts.Metadata = meta
+	return app.putContent(ctx, obj, spool, key, packed, class, opts)
+}
+
+// expandSparse turns the packed content downloaded to dest back into the sparse file described by layout.
+func expandSparse(dest string, layout string) error {
+	size, extents, err := decodeSparse(layout)
+	if err != nil {
+		return err
+	}
+	packed, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer packed.Close()
+	tmp := dest + ".s3sync-sparse"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		_, err = io.Copy(io.NewOffsetWriter(out, e.off), io.LimitReader(packed, e.len))
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	// the holes past the last extent come from the size alone
+	err = out.Truncate(size)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package syncer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// whence values of lseek for finding the data in a sparse file.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataExtents walks f with SEEK_DATA and SEEK_HOLE and returns where its data is.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	extents := []extent{}
+	var off int64
+	for off < size {
+		start, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// only a hole is left
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, extent{start, end - start})
+		off = end
+	}
+	return extents, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package syncer
+
+import "os"
+
+// dataExtents can't find the holes without SEEK_DATA, so Sparse uploads every file in full here.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	return nil, nil
+}
@@ -3,24 +3,241 @@ package syncer
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 const CREATEVIDEOSTABLE = "create table videos (id integer primary key not null, filepath text unique, modified integer default (0), uploaded integer default (0), multipart integer default (0))"
 const CREATEPARTSTABLE = "create table parts (id INTEGER PRIMARY KEY NOT NULL UNIQUE, video_id INTEGER NOT NULL, filepath TEXT UNIQUE, uploaded INTEGER DEFAULT (0))"
 
-const UPSERTRECORD = "insert into videos (filepath, modified) values(?, ?) on conflict(filepath) do update set (modified, uploaded, multipart) = (?,?,?)"
-const SELECTRECORD = "select filepath from videos where filepath = ? and modified = ?"
+const UPSERTRECORD = "insert into videos (filepath, modified, key) values(?, ?, ?) on conflict(filepath) do update set modified = excluded.modified, key = excluded.key, uploaded = 0, multipart = 0, status = 'pending', failures = 0"
+const SELECTMODIFIED = "select modified from videos where filepath = ?"
 const SELECTVIDEOIDBBYPATH = "select id from videos where filepath = ?"
-const UPDATEUPLOADSTATUS = "update videos set uploaded = 1 where filepath = ?"
-const UPDATEUPLOADSTATUSPART = "update PARTS set uploaded = 1 where filepath = ?"
-const SELECTUPLOADLIST = "select filepath from videos where uploaded = false"
+
+// UPDATEUPLOADSTATUS only completes whole files, multipart files are completed by the parts_complete trigger.
+const UPDATEUPLOADSTATUS = "update videos set uploaded = 1, status = 'complete' where filepath = ? and multipart = 0"
+const UPDATEUPLOADSTATUSPART = "update PARTS set uploaded = 1, status = 'complete' where filepath = ?"
+const UPDATESTATUS = "update videos set status = ? where filepath = ?"
+const UPDATEPARTSTATUS = "update parts set status = ? where filepath = ?"
+
+// SELECTFILERECORD and SELECTFILERECORDS read the FileRecords of sqliteManifest.
+const SELECTFILERECORD = "select filepath, modified, coalesce(key, ''), coalesce(status, 'pending'), uploaded, multipart, coalesce(size, -1), coalesce(sha256, ''), failures, deleted, coalesce(link_of, '') from videos where filepath = ?"
+const SELECTFILERECORDS = "select filepath, modified, coalesce(key, ''), coalesce(status, 'pending'), uploaded, multipart, coalesce(size, -1), coalesce(sha256, ''), failures, deleted, coalesce(link_of, '') from videos order by filepath"
+
+// SELECTUPLOADLIST skips quarantined files, the ones that failed at least the max failures given (0 for no limit).
+const SELECTUPLOADLIST = "select filepath from videos where status != 'complete' and deleted = 0 and (?1 = 0 or failures < ?1)"
+const SELECTUPLOADPAGE = "select filepath from videos where status != 'complete' and deleted = 0 and (?1 = 0 or failures < ?1) and filepath > ?2 order by filepath limit ?3"
+const INCREMENTFAILURES = "update videos set failures = failures + 1 where filepath = ?"
+const RESETFAILURES = "update videos set failures = 0 where filepath = ?"
+const RESETALLFAILURES = "update videos set failures = 0"
+const DELETEPARTS = "delete from parts where video_id = ?"
+const INSERTRUN = "insert into runs (started, label) values(?, nullif(?, ''))"
+const FINISHRUN = "update runs set ended = ?, outcome = ? where id = ?"
+const INSERTRUNFILE = "insert into run_files (run_id, filepath, outcome, bytes, error) values(?, ?, ?, ?, ?)"
+const UPDATERUNCOUNTS = "update runs set attempted = attempted + 1, succeeded = succeeded + ?, failed = failed + ?, bytes = bytes + ? where id = ?"
+const SELECTRUNS = "select id, started, ended, attempted, succeeded, failed, bytes, outcome, coalesce(label, '') from runs order by id desc limit ?"
+const SELECTRUNFILES = "select filepath, outcome, bytes, coalesce(error, '') from run_files where run_id = ? order by id"
+const SELECTETAG = "select etag from etags where key = ?"
+const UPSERTETAG = "insert into etags (key, etag, storage_class) values(?, ?, ?) on conflict(key) do update set etag = excluded.etag, storage_class = excluded.storage_class"
+const UPDATEKEY = "update videos set key = ? where filepath = ?"
+
+// RENAMEKEY moves a file to a new key and uploads it again there, see caseCollisions.
+const RENAMEKEY = "update videos set key = ?, uploaded = 0, multipart = 0, status = 'pending' where filepath = ?"
+
+// SELECTOBJECTSIZE is the recorded size and storage class of an object key, the key passed three times.
+const SELECTOBJECTSIZE = "select coalesce((select size from parts where key = ?), (select size from videos where key = ? and multipart = 0), -1), coalesce((select storage_class from etags where key = ?), '')"
+const SELECTPARTKEYSBYKEY = "select key from parts where video_id = (select id from videos where key = ? and multipart = 1) and key is not null order by id"
+const SELECTETAGKEYS = "select key from etags where substr(key, 1, length(?)) = ? order by key"
+const COUNTLINKSTO = "select count(*) from videos where link_of = ? and deleted = 0"
+const SETLINK = "update videos set link_of = nullif(?, ''), uploaded = 0, status = 'pending' where filepath = ?"
+const SELECTSTORAGECLASS = "select coalesce(storage_class, '') from etags where key = ?"
+const UPDATEHASH = "update videos set sha256 = ?, size = ? where filepath = ?"
+const SELECTMANIFESTFILES = "select filepath, modified, coalesce(size, -1), coalesce(sha256, '') from videos where deleted = 0 order by filepath"
+const SELECTHASHBYPATH = "select coalesce(sha256, '') from videos where filepath = ?"
+
+// The sha256 columns hold the sums of the Checksum the checksum table names, sha256 unless another was chosen.
+const SELECTCHECKSUM = "select algorithm from checksum where id = 1"
+const SETCHECKSUM = "insert into checksum (id, algorithm) values (1, ?) on conflict(id) do update set algorithm = excluded.algorithm"
+const COUNTSUMS = "select (select count(*) from videos where sha256 is not null) + (select count(*) from parts where sha256 is not null)"
+const SELECTVERIFY = "select filepath from videos where status = 'complete' and deleted = 0 order by filepath"
+
+// SELECTKNOWNKEYS are the keys of every object an upload recorded, see Verify.
+const SELECTKNOWNKEYS = `select key from videos where key is not null union select key from parts where key is not null
+	union select key from etags union select key from snapshot_keys`
+
+// SELECTPATHSBYKEY finds the uploaded file an object holds, by its own key or the key of one of its pieces.
+const SELECTPATHSBYKEY = `select filepath from videos where key = ? and status = 'complete' and deleted = 0
+	union select v.filepath from parts p join videos v on v.id = p.video_id where p.key = ? and v.status = 'complete' and v.deleted = 0`
+const SELECTPATHSBYPREFIX = "select filepath from videos where status = 'complete' and deleted = 0 and substr(key, 1, length(?1)) = ?1 order by filepath"
+const SELECTWALKSIGNATURE = "select signature from walk_state where id = 1"
+const SETWALKSIGNATURE = "insert into walk_state (id, signature) values(1, ?) on conflict(id) do update set signature = excluded.signature"
+const SELECTWALKDIRS = "select filepath from walk_dirs"
+const SELECTWALKFILES = "select filepath, modified, size from walk_files"
+const INSERTWALKFILE = "insert or replace into walk_files (filepath, modified, size) values(?, ?, ?)"
+const INSERTWALKDIR = "insert or ignore into walk_dirs (filepath) values(?)"
+const DELETEWALKFILES = "delete from walk_files"
+const DELETEWALKDIRS = "delete from walk_dirs"
+const DELETEWALKSIGNATURE = "delete from walk_state"
+const UPDATEMODIFIED = "update videos set modified = ? where filepath = ?"
+const SELECTFSCK = "select filepath, modified, status = 'complete', coalesce(sha256, '') from videos order by filepath"
+const SELECTLIVEPATHS = "select filepath from videos where deleted = 0"
+const SETTOMBSTONE = "update videos set deleted = ? where filepath = ? and deleted = 0"
+const CLEARTOMBSTONE = "update videos set deleted = 0 where filepath = ?"
+const DELETEBLOCKSBYPATH = "delete from blocks where video_id = (select id from videos where filepath = ?)"
+const DELETEPARTSBYPATH = "delete from parts where video_id = (select id from videos where filepath = ?)"
+const DELETERECORD = "delete from videos where filepath = ?"
+const DELETEETAG = "delete from etags where key = ?"
+const INSERTSNAPSHOTKEY = "insert or replace into snapshot_keys (snapshot, filepath, idx, key) values(?, ?, ?, ?)"
+const SELECTSNAPSHOTKEYS = "select key from snapshot_keys where snapshot = ? and filepath = ? order by idx"
+const SELECTSNAPSHOTTED = "select count(*) from snapshot_keys where key = ?"
+const SELECTSNAPSHOTS = "select snapshot, count(distinct filepath) from snapshot_keys group by snapshot order by snapshot"
+const SELECTSNAPSHOTOBJECTS = "select distinct key from snapshot_keys where snapshot = ?"
+const INSERTSNAPSHOTFILE = "insert or replace into snapshot_files (snapshot, filepath, size, sha256, modified) select ?, filepath, size, sha256, modified from videos where filepath = ?"
+const SELECTSNAPSHOTFILE = "select coalesce(size, -1), coalesce(sha256, ''), modified from snapshot_files where snapshot = ? and filepath = ?"
+const SELECTSNAPSHOTPATHS = "select distinct filepath from snapshot_keys where snapshot = ? order by filepath"
+const SELECTPARTS = "select coalesce(filepath, ''), coalesce(idx, -1), coalesce(byte_offset, -1), coalesce(size, -1), coalesce(sha256, ''), coalesce(key, ''), status from parts where video_id = (select id from videos where filepath = ?) order by id"
+const SELECTDELTASTATE = "select id, delta_gen, delta_block from videos where filepath = ?"
+const UPDATEDELTASTATE = "update videos set delta_gen = ?, delta_block = ? where id = ?"
+const SELECTBLOCKS = "select idx, weak, strong from blocks where video_id = ? order by idx"
+const DELETEBLOCKS = "delete from blocks where video_id = ?"
+const INSERTBLOCK = "insert into blocks (video_id, idx, weak, strong) values(?, ?, ?, ?)"
 const SETMULTIPART = "update videos set multipart = 1 where filepath = ?"
-const INSERTPART = "insert into parts (video_id, filepath) values(?, ?)"
+const CLEARMULTIPART = "update videos set multipart = 0 where filepath = ?"
+const INSERTPART = "insert into parts (video_id, filepath, key, idx, byte_offset, size, sha256) values(?, ?, ?, ?, ?, ?, ?)"
+const INSERTADOPTED = "insert into videos (filepath, modified, key, uploaded, multipart, status, size) values(?, ?, ?, ?, ?, ?, ?) on conflict(filepath) do nothing"
+const INSERTADOPTEDPART = "insert into parts (video_id, filepath, key, idx, byte_offset, size, uploaded, status) values(?, ?, ?, ?, ?, ?, 1, 'complete')"
+const INSERTPLAN = "insert into plans (created, deep) values(?, ?)"
+const INSERTPLANFILE = "insert into plan_files (plan_id, filepath, modified, size, action) values(?, ?, ?, ?, ?)"
+const SELECTPLAN = "select applied, deep from plans where id = ?"
+const SELECTPLANFILES = "select filepath, modified, size, action from plan_files where plan_id = ? order by filepath"
+const APPLYPLAN = "update plans set applied = ? where id = ?"
+
+// SETENCRYPTED records how the last upload of a file was encrypted, see putEncrypted.
+const SETENCRYPTED = `insert into encrypted (filepath, cipher, key_id, nonce) values (?, ?, ?, ?)
+	on conflict (filepath) do update set cipher = excluded.cipher, key_id = excluded.key_id, nonce = excluded.nonce`
+
+// SETCOMPRESSED and CLEARCOMPRESSED record whether the last upload of a file was compressed, see markCompressed.
+const SETCOMPRESSED = "insert into compressed (filepath, algorithm) values (?, ?) on conflict (filepath) do update set algorithm = excluded.algorithm"
+const CLEARCOMPRESSED = "delete from compressed where filepath = ?"
+
+// SELECTBATCH, SETBATCH and CLEARBATCH keep where the last upload stopped, see BatchCursor.
+const SELECTBATCH = "select cursor from batch where id = 1"
+const SETBATCH = "insert into batch (id, cursor) values (1, ?) on conflict (id) do update set cursor = excluded.cursor"
+const CLEARBATCH = "delete from batch"
+
+// SELECTSHAREDETAG and SETSHAREDETAG keep the ETag of the shared manifest last pushed or pulled, see PushManifest.
+const SELECTSHAREDETAG = "select etag from shared_manifest where id = 1"
+const SETSHAREDETAG = "insert into shared_manifest (id, etag) values (1, ?) on conflict (id) do update set etag = excluded.etag"
+
+// uploads are the multipart uploads of synced files in progress, and upload_parts the parts that landed in them
+const INSERTUPLOAD = "insert into uploads (filepath, key, upload_id, part_size, size, modified, storage_class) values(?, ?, ?, ?, ?, ?, ?)"
+const SELECTUPLOAD = "select filepath, key, upload_id, part_size, size, modified, storage_class from uploads where filepath = ?"
+const SELECTUPLOADS = "select filepath, key, upload_id, part_size, size, modified, storage_class from uploads order by filepath"
+const DELETEUPLOAD = "delete from uploads where upload_id = ?"
+const INSERTUPLOADPART = "insert or replace into upload_parts (upload_id, part_number, etag) values(?, ?, ?)"
+const SELECTUPLOADPARTS = "select part_number, etag from upload_parts where upload_id = ?"
+const DELETEUPLOADPARTS = "delete from upload_parts where upload_id = ?"
+const COUNTKEY = "select count(*) from videos where key = ?"
+
+// migrations bring an existing manifest up to the current schema, user_version records how many have been applied.
+var migrations = []string{
+	"alter table videos add column key text",
+	"alter table parts add column key text",
+	"alter table videos add column status text default ('pending')",
+	"alter table parts add column status text default ('pending')",
+	"update videos set status = 'complete' where uploaded = 1",
+	"update parts set status = 'complete' where uploaded = 1",
+	// a split file is complete only once every one of its parts is
+	`create trigger parts_complete after update of status on parts
+	when new.status = 'complete' and not exists (select 1 from parts where video_id = new.video_id and status != 'complete')
+	begin update videos set uploaded = 1, status = 'complete' where id = new.video_id; end`,
+	// and a single failed part fails the whole file
+	`create trigger parts_failed after update of status on parts
+	when new.status = 'failed'
+	begin update videos set uploaded = 0, status = 'failed' where id = new.video_id; end`,
+	"create table blocks (video_id integer not null, idx integer not null, weak integer not null, strong text not null, primary key (video_id, idx))",
+	"alter table videos add column delta_gen integer default (0)",
+	"alter table videos add column delta_block integer default (0)",
+	"alter table videos add column failures integer default (0)",
+	"create table runs (id integer primary key not null, started integer not null, ended integer default (0), attempted integer default (0), succeeded integer default (0), failed integer default (0), bytes integer default (0), outcome text default ('running'))",
+	"create table run_files (id integer primary key not null, run_id integer not null, filepath text not null, outcome text not null, bytes integer default (0), error text)",
+	"create table etags (key text primary key not null, etag text not null)",
+	"alter table videos add column sha256 text",
+	"alter table videos add column deleted integer default (0)",
+	"alter table videos add column size integer",
+	"create table walk_files (filepath text primary key not null, modified integer not null, size integer not null)",
+	"create table walk_dirs (filepath text primary key not null)",
+	"create table walk_state (id integer primary key check (id = 1), signature text not null)",
+	"alter table etags add column storage_class text",
+	"alter table videos add column link_of text",
+	"create table snapshot_keys (snapshot text not null, filepath text not null, idx integer not null, key text not null, primary key (snapshot, filepath, idx))",
+	"create index snapshot_keys_key on snapshot_keys (key)",
+	"alter table runs add column label text",
+	// where each part sits in the original file, so a split file can be checked end to end
+	"alter table parts add column idx integer",
+	"alter table parts add column byte_offset integer",
+	"alter table parts add column size integer",
+	"alter table parts add column sha256 text",
+	"create table plans (id integer primary key not null, created integer not null, applied integer default (0), deep integer default (0))",
+	"create table plan_files (plan_id integer not null, filepath text not null, modified integer not null, size integer not null, action text not null, primary key (plan_id, filepath))",
+	"create table checksum (id integer primary key check (id = 1), algorithm text not null)",
+	"insert into checksum (id, algorithm) values (1, 'sha256')",
+	"create table uploads (filepath text primary key not null, key text not null, upload_id text not null, part_size integer not null, size integer not null, modified integer not null, storage_class text not null)",
+	"create table upload_parts (upload_id text not null, part_number integer not null, etag text not null, primary key (upload_id, part_number))",
+	"create table encrypted (filepath text primary key not null, cipher text not null, key_id text not null, nonce text not null)",
+	"create table shared_manifest (id integer primary key check (id = 1), etag text not null)",
+	"create table compressed (filepath text primary key not null, algorithm text not null)",
+	"create table batch (id integer primary key check (id = 1), cursor text not null)",
+	// the content of each file as it was in a snapshot, for RestoreSnapshot
+	"create table snapshot_files (snapshot text not null, filepath text not null, size integer, sha256 text, modified integer, primary key (snapshot, filepath))",
+}
+
+// Upload states tracked in the status column for both videos and parts.
+const (
+	StatusPending    = "pending"
+	StatusInProgress = "in_progress"
+	StatusComplete   = "complete"
+	StatusFailed     = "failed"
+)
+
+// Defaults for DBOptions, chosen so concurrent uploads can update the manifest without "database is locked".
+const (
+	DefaultBusyTimeout = 5 * time.Second
+	DefaultJournalMode = "WAL"
+	DefaultSynchronous = "NORMAL"
+)
+
+// DBOptions are the sqlite pragmas the manifest is opened with. Zero values use the defaults above.
+type DBOptions struct {
+	// BusyTimeout is how long a write waits for another connection's lock before failing.
+	BusyTimeout time.Duration
+	// JournalMode is any sqlite journal_mode, e.g. WAL or DELETE.
+	JournalMode string
+	// Synchronous is any sqlite synchronous level, e.g. NORMAL or FULL.
+	Synchronous string
+}
+
+// dsn adds the pragmas in opts to dbpath. They go in the DSN rather than an exec so every pooled connection gets them.
+func (opts DBOptions) dsn(dbpath string) string {
+	if opts.BusyTimeout == 0 {
+		opts.BusyTimeout = DefaultBusyTimeout
+	}
+	if opts.JournalMode == "" {
+		opts.JournalMode = DefaultJournalMode
+	}
+	if opts.Synchronous == "" {
+		opts.Synchronous = DefaultSynchronous
+	}
+	return driverDSN(dbpath, opts)
+}
 
 // InitDb gets the db if it already exists, if not it creates and preps a new one.
 func (app *Syncer) InitDb(dbpath string) error {
-	db, err := sql.Open("sqlite3", dbpath)
+	db, err := sql.Open(sqliteDriver, app.DBOptions.dsn(dbpath))
 
 	if err != nil {
 		return err
@@ -39,21 +256,82 @@ func (app *Syncer) InitDb(dbpath string) error {
 		}
 	}
 	// db exists, just set it
+	err = app.migrate()
+	if err != nil {
+		return err
+	}
+	return app.initChecksum()
+}
+
+// Close releases the manifest and removes split pieces left behind by failed uploads. The WAL is checkpointed
+// first so the manifest is a single file again. Close is safe to call more than once.
+func (app *Syncer) Close() error {
+	tempMu.Lock()
+	for dir := range app.tempDirs {
+		os.RemoveAll(dir)
+		delete(app.tempDirs, dir)
+	}
+	tempMu.Unlock()
+	if app.db == nil {
+		return nil
+	}
+	_, err := app.db.Exec("pragma wal_checkpoint(TRUNCATE)")
+	closeErr := app.db.Close()
+	app.db = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// tempMu guards tempDirs, files split ahead of their upload are tracked from several goroutines.
+var tempMu sync.Mutex
+
+// trackTemp has Close remove dir in case the upload that made it doesn't get to.
+func (app *Syncer) trackTemp(dir string) {
+	tempMu.Lock()
+	defer tempMu.Unlock()
+	if app.tempDirs == nil {
+		app.tempDirs = make(map[string]bool)
+	}
+	app.tempDirs[dir] = true
+}
+
+// migrate applies any migrations the manifest has not seen yet.
+func (app *Syncer) migrate() error {
+	var version int
+	err := app.db.QueryRow("pragma user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		_, err = app.db.Exec(migrations[i])
+		if err != nil {
+			return err
+		}
+		_, err = app.db.Exec(fmt.Sprintf("pragma user_version = %d", i+1))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// GetUploadList queries the db and returns a slice of files that need updated.
+// GetUploadList queries the db and returns a slice of files that need updated, leaving out quarantined files
+// and files outside Subpath or IncludeDirs. With DryRun they are the ones the last UpdateManifest found.
 func (app *Syncer) GetUploadList() ([]string, error) {
-	rows, err := app.db.Query(SELECTUPLOADLIST)
+	if app.DryRun && app.dryRuns != nil {
+		return app.dryRuns, nil
+	}
+	pending, err := app.records().ListPending(app.MaxFailures)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 	var res []string
-	for rows.Next() {
-		var p string
-		rows.Scan(&p)
-		res = append(res, p)
+	for _, p := range pending {
+		if app.inScope(p) {
+			res = append(res, p)
+		}
 	}
 
 	return res, nil
@@ -61,103 +339,158 @@ func (app *Syncer) GetUploadList() ([]string, error) {
 
 // updateRecord updates or inserts an individual record with the p path and the last mod date specified by mod
 // checks to see if the record needs updating first, only will update if the modified date has changed
+// and the content did too, see sameContent
 func (app *Syncer) updateRecord(p string, mod int64) error {
-	tx, err := app.db.Begin()
-	if err != nil {
-		return err
+	if app.OnlyNew {
+		// any record at all means it was seen before, leave it as it is
+		_, seen, err := app.records().Get(p)
+		if err != nil || seen {
+			return err
+		}
 	}
-
-	query, err := tx.Prepare(UPSERTRECORD)
+	skewed, err := app.skewedModTime(p, mod)
 	if err != nil {
 		return err
 	}
-	defer query.Close()
-
+	if skewed {
+		app.skewed = append(app.skewed, p)
+	}
 	exists, err := app.recordExists(p, mod)
 	if err != nil {
 		return err
 	}
-	if exists {
+	if exists && !app.contentOnly() && !(skewed && app.HashSkewed) {
 		return nil
 	}
-	_, err = query.Exec(p, mod, mod, 0, 0)
+	if exists {
+		// still waiting to go up, keep its failure count
+		_, _, status, err := app.recordedContent(p)
+		if err != nil || status != StatusComplete {
+			return err
+		}
+	}
+	same, err := app.sameContent(p)
 	if err != nil {
 		return err
 	}
-	tx.Commit()
-	return nil
+	if same {
+		// only touched, keep it uploaded
+		return app.records().SetModified(p, mod)
+	}
+	return app.records().UpdateRecord(p, mod, app.objectKey(p))
 }
 
 // updateUploadStatuspart updates the status for the file specified with p.
 func (app *Syncer) updateUploadStatusPart(p string) error {
-	tx, err := app.db.Begin()
+	return app.records().SetPartStatus(p, StatusComplete)
+}
+
+// updateUploadStatus updates the status for the file specified with p.
+func (app *Syncer) updateUploadStatus(p string) error {
+	return app.records().UpdateUploadStatus(p)
+}
+
+// setStatus moves the file p to status.
+func (app *Syncer) setStatus(p string, status string) error {
+	return app.records().SetStatus(p, status)
+}
+
+// setPartStatus moves the part p to status, the manifest rolls the result up to the parent file.
+func (app *Syncer) setPartStatus(p string, status string) error {
+	return app.records().SetPartStatus(p, status)
+}
+
+// getStatus returns the upload status of the file p, sql.ErrNoRows if it isn't recorded.
+func (app *Syncer) getStatus(p string) (string, error) {
+	rec, ok, err := app.records().Get(p)
 	if err != nil {
-		return err
+		return "", err
 	}
-	stmt, err := tx.Prepare(UPDATEUPLOADSTATUSPART)
-	if err != nil {
-		return err
+	if !ok {
+		return "", sql.ErrNoRows
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(p)
+	return rec.Status, nil
+}
+
+// recordParts inserts the split videos parts into the parts table, keys holds the S3 key for each part.
+// Every part is recorded with its index, its offset in the original file, its size and its sum. A part that
+// isn't on disk only gets its index, and the parts after it no offset.
+func (app Syncer) recordParts(videoid int, parts []string, keys []string) error {
+	records, err := app.partRecords(parts, keys, nil)
 	if err != nil {
 		return err
 	}
-	err = tx.Commit()
+	return app.insertParts(videoid, records)
+}
+
+// recordPieces records the pieces obj was split into as its parts, keys holds the S3 key and known the sum the
+// splitter took of each piece.
+func (app *Syncer) recordPieces(obj string, pieces []string, keys []string, known []string) error {
+	parts, err := app.partRecords(pieces, keys, known)
 	if err != nil {
 		return err
 	}
+	return app.records().RecordParts(obj, parts)
+}
 
-	return nil
+// partRecords measures the pieces in parts for recordParts, taking the sums in known of the pieces the splitter
+// summed already.
+func (app Syncer) partRecords(parts []string, keys []string, known []string) ([]PartRecord, error) {
+	res := make([]PartRecord, len(parts))
+	var offset int64
+	for i, part := range parts {
+		res[i] = PartRecord{Path: part, Key: keys[i], Offset: offset, Size: -1}
+		if i < len(known) && known[i] != "" {
+			info, err := os.Stat(part)
+			if err == nil {
+				res[i].SHA256, res[i].Size = known[i], info.Size()
+			}
+		}
+		if res[i].Size < 0 {
+			sum, size, err := app.sumFile(part)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			if err == nil {
+				res[i].SHA256, res[i].Size = sum, size
+			}
+		}
+		if offset >= 0 && res[i].Size >= 0 {
+			offset += res[i].Size
+		} else {
+			offset = -1
+		}
+	}
+	return res, nil
 }
 
-// updateUploadStatus updates the status for the file specified with p.
-func (app *Syncer) updateUploadStatus(p string) error {
+// insertParts replaces the parts of the video id in the parts table with parts.
+func (app Syncer) insertParts(videoid int, parts []PartRecord) error {
 	tx, err := app.db.Begin()
 	if err != nil {
 		return err
 	}
-	stmt, err := tx.Prepare(UPDATEUPLOADSTATUS)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(p)
-	if err != nil {
-		return err
-	}
-	err = tx.Commit()
+	defer tx.Rollback()
+	// a re-split replaces whatever parts were recorded before
+	_, err = tx.Exec(DELETEPARTS, videoid)
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-// recordParts inserts the split videos parts into the parts table
-func (app Syncer) recordParts(videoid int, parts []string) error {
-	tx, err := app.db.Begin()
+	stmt, err := tx.Prepare(INSERTPART)
 	if err != nil {
 		return err
 	}
-	for _, part := range parts {
-		stmt, err := tx.Prepare(INSERTPART)
-		if err != nil {
-			return err
-		}
-		defer stmt.Close()
-		_, err = stmt.Exec(videoid, part)
+	defer stmt.Close()
+	for i, part := range parts {
+		offset := sql.NullInt64{Int64: part.Offset, Valid: part.Offset >= 0}
+		size := sql.NullInt64{Int64: part.Size, Valid: part.Size >= 0}
+		sum := sql.NullString{String: part.SHA256, Valid: part.Size >= 0}
+		_, err = stmt.Exec(videoid, part.Path, part.Key, i, offset, size, sum)
 		if err != nil {
 			return err
 		}
-		stmt.Close()
-	}
-	err = tx.Commit()
-	if err != nil {
-		return err
 	}
-
-	return nil
+	return tx.Commit()
 }
 
 // SetMultipart sets the multipart flag in the vidoes table
@@ -193,13 +526,198 @@ func (app Syncer) setMultipart(fp string) (int, error) {
 
 // recordExists checks to see if there is a matching record for the provided p (file path) and modified time modtime.
 func (app *Syncer) recordExists(p string, modtime int64) (bool, error) {
+	rec, ok, err := app.records().Get(p)
+	return ok && rec.Modified == modtime, err
+}
+
+// recordedKey returns the S3 key stored in the manifest for the file p, empty if there is none.
+func (app *Syncer) recordedKey(p string) (string, error) {
+	rec, _, err := app.records().Get(p)
+	return rec.Key, err
+}
+
+// setKey records key as the object key of the file p.
+func (app *Syncer) setKey(p string, key string) error {
+	return app.records().SetKey(p, key)
+}
+
+// recordedETag returns the ETag the object key had when this manifest last uploaded it, empty if never.
+func (app *Syncer) recordedETag(key string) (string, error) {
+	if app.db == nil {
+		return "", nil
+	}
 	var res string
-	err := app.db.QueryRow(SELECTRECORD, p, modtime).Scan(&res)
+	err := app.db.QueryRow(SELECTETAG, key).Scan(&res)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, nil
+			return "", nil
+		}
+		return "", err
+	}
+	return res, nil
+}
+
+// recordETag stores the ETag and storage class of the object just uploaded as key, the SQLite manifest only has
+// a table for them.
+func (app *Syncer) recordETag(key string, etag string, class types.StorageClass) error {
+	if etag == "" || app.db == nil {
+		return nil
+	}
+	_, err := app.db.Exec(UPSERTETAG, key, etag, string(class))
+	return err
+}
+
+// recordedClass returns the storage class key was last uploaded or transitioned to, empty if it is unknown.
+func (app *Syncer) recordedClass(key string) (types.StorageClass, error) {
+	if app.db == nil {
+		return "", nil
+	}
+	var res string
+	err := app.db.QueryRow(SELECTSTORAGECLASS, key).Scan(&res)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return types.StorageClass(res), nil
+}
+
+// deltaState returns the id, delta generation and signature block size recorded for the file p.
+func (app *Syncer) deltaState(p string) (int, int, int, error) {
+	var id, gen, block int
+	err := app.db.QueryRow(SELECTDELTASTATE, p).Scan(&id, &gen, &block)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return id, gen, block, nil
+}
+
+// getBlocks returns the block signatures stored for the video id.
+func (app *Syncer) getBlocks(id int) ([]blockSig, error) {
+	rows, err := app.db.Query(SELECTBLOCKS, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []blockSig
+	for rows.Next() {
+		var sig blockSig
+		err = rows.Scan(&sig.Index, &sig.Weak, &sig.Strong)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, sig)
+	}
+	return res, rows.Err()
+}
+
+// setBlocks replaces the block signatures of video id and records the generation and block size they belong to.
+func (app *Syncer) setBlocks(id int, gen int, blockSize int, sigs []blockSig) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(DELETEBLOCKS, id)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(INSERTBLOCK)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, sig := range sigs {
+		_, err = stmt.Exec(id, sig.Index, sig.Weak, sig.Strong)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(UPDATEDELTASTATE, gen, blockSize, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryPaths runs query and returns the file paths it selects.
+func (app *Syncer) queryPaths(query string, args ...any) ([]string, error) {
+	rows, err := app.manifest().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var p string
+		err = rows.Scan(&p)
+		if err != nil {
+			return nil, err
 		}
-		return false, err
+		res = append(res, p)
 	}
-	return true, nil
+	return res, rows.Err()
+}
+
+// partKeys returns the S3 keys of the recorded parts of the file p in order, none if it was never split.
+func (app *Syncer) partKeys(p string) ([]string, error) {
+	parts, err := app.Parts(p)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, part := range parts {
+		res = append(res, part.Key)
+	}
+	return res, nil
+}
+
+// Part is one recorded piece of a split file. Index, Offset and Size are -1 when they weren't recorded, as for
+// parts recorded by older versions, and adopted parts have no SHA256.
+type Part struct {
+	// Path is the piece the part was split to.
+	Path   string
+	Index  int
+	Offset int64
+	Size   int64
+	SHA256 string
+	Key    string
+	Status string
+}
+
+// Parts returns the recorded parts of the file p in order, none if it was never split.
+func (app *Syncer) Parts(p string) ([]Part, error) {
+	return app.records().Parts(p)
+}
+
+// QuarantinedFile is a file that kept failing and is skipped until its failures are reset.
+type QuarantinedFile struct {
+	Path     string
+	Failures int
+}
+
+// Quarantined returns the files that failed MaxFailures times or more, none if MaxFailures is 0.
+func (app *Syncer) Quarantined() ([]QuarantinedFile, error) {
+	if app.MaxFailures == 0 {
+		return nil, nil
+	}
+	recs, err := app.records().List()
+	if err != nil {
+		return nil, err
+	}
+	var res []QuarantinedFile
+	for _, rec := range recs {
+		if rec.Status != StatusComplete && rec.Failures >= app.MaxFailures {
+			res = append(res, QuarantinedFile{Path: rec.Path, Failures: rec.Failures})
+		}
+	}
+	return res, nil
+}
+
+// ResetQuarantine clears the failure count of every file so they are all tried again.
+func (app *Syncer) ResetQuarantine() error {
+	return app.records().ResetFailures()
+}
+
+// recordFailure counts another failed upload of p.
+func (app *Syncer) recordFailure(p string) error {
+	return app.records().RecordFailure(p)
 }
@@ -0,0 +1,17 @@
+//go:build cgo && !purego
+
+package syncer
+
+import (
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the cgo sqlite driver, the default whenever cgo is available.
+const sqliteDriver = "sqlite3"
+
+// driverDSN spells the pragmas in opts the way go-sqlite3 reads them.
+func driverDSN(dbpath string, opts DBOptions) string {
+	return fmt.Sprintf("%s?_busy_timeout=%d&_journal_mode=%s&_synchronous=%s", dbpath, opts.BusyTimeout.Milliseconds(), opts.JournalMode, opts.Synchronous)
+}
@@ -0,0 +1,18 @@
+//go:build !cgo || purego
+
+package syncer
+
+import (
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDriver is the pure Go sqlite driver, used for CGO_ENABLED=0 builds or with the purego build tag.
+// It reads and writes the same manifest file as the cgo driver.
+const sqliteDriver = "sqlite"
+
+// driverDSN spells the pragmas in opts the way modernc.org/sqlite reads them.
+func driverDSN(dbpath string, opts DBOptions) string {
+	return fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(%s)&_pragma=synchronous(%s)", dbpath, opts.BusyTimeout.Milliseconds(), opts.JournalMode, opts.Synchronous)
+}
@@ -0,0 +1,96 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStallRetries is how often a stalled upload is started over when Syncer.StallRetries is not set.
+const DefaultStallRetries = 3
+
+// stallReader notes when the last bytes were read from r, which is when they went out on the connection.
+type stallReader struct {
+	r    io.Reader
+	last atomic.Int64
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Seek lets the SDK work out the length of r, which it needs for a PUT without a trailing checksum.
+func (s *stallReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := s.r.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("body can't seek")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+// putWatched is ObjectStore.Put with StallTimeout and MaxBytesPerSecond applied. A stalled PUT is cancelled and sent again from the
+// start of body, up to StallRetries times.
+func (app *Syncer) putWatched(ctx context.Context, key string, body io.Reader, opts PutOptions) (string, error) {
+	body = app.limited(ctx, body)
+	if app.StallTimeout <= 0 {
+		return app.store().Put(ctx, key, body, opts)
+	}
+	retries := app.StallRetries
+	if retries == 0 {
+		retries = DefaultStallRetries
+	}
+	for attempt := 0; ; attempt++ {
+		etag, err := app.putOnce(ctx, key, body, opts)
+		if !errors.Is(err, ErrStalled) || attempt >= retries {
+			return etag, err
+		}
+		seeker, ok := body.(io.Seeker)
+		if !ok {
+			return "", err
+		}
+		_, seekErr := seeker.Seek(0, io.SeekStart)
+		if seekErr != nil {
+			return "", err
+		}
+		if !app.NoSpinners {
+			app.term().warning().Printfln("%s stalled, starting it over.", key)
+		}
+	}
+}
+
+// putOnce runs one Put and cancels it when no bytes move for StallTimeout.
+func (app *Syncer) putOnce(ctx context.Context, key string, body io.Reader, opts PutOptions) (string, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	watched := &stallReader{r: body}
+	watched.last.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(app.StallTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, watched.last.Load())) > app.StallTimeout {
+					cancel(ErrStalled)
+					return
+				}
+			}
+		}
+	}()
+	etag, err := app.store().Put(ctx, key, watched, opts)
+	if err != nil && errors.Is(context.Cause(ctx), ErrStalled) {
+		return "", fmt.Errorf("%s: no bytes moved for %s: %w", key, app.StallTimeout, ErrStalled)
+	}
+	return etag, err
+}
@@ -0,0 +1,47 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// preflightKey is the object ValidateStorageClass and ValidateEncryption write and remove to prove a class or
+// KMS key is accepted.
+const preflightKey = ".s3sync-preflight"
+
+// ValidateStorageClass checks that class is a storage class S3 knows and that the bucket accepts it, by
+// writing and deleting a tiny preflight object. This turns a region or bucket that doesn't support a class
+// into a clear error up front instead of a cryptic failure on the first real upload.
+func (app *Syncer) ValidateStorageClass(ctx context.Context, class types.StorageClass) error {
+	if !slices.Contains(class.Values(), class) {
+		return fmt.Errorf("unknown storage class %q, expected one of %v", class, class.Values())
+	}
+	region := "unknown"
+	if app.S3Client != nil {
+		loc, err := app.S3Client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(app.Bucket), ExpectedBucketOwner: app.bucketOwner()})
+		if err == nil {
+			region = string(loc.LocationConstraint)
+			if region == "" {
+				region = "us-east-1"
+			}
+		}
+	}
+
+	_, err := app.store().Put(ctx, preflightKey, bytes.NewReader(nil), PutOptions{StorageClass: string(class)})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "InvalidStorageClass" || apiErr.ErrorCode() == "InvalidArgument") {
+			return fmt.Errorf("storage class %s is not supported by bucket %s in region %s: %s", class, app.Bucket, region, apiErr.ErrorMessage())
+		}
+		return fmt.Errorf("could not check storage class %s on bucket %s: %w", class, app.Bucket, err)
+	}
+	return app.store().Delete(ctx, preflightKey)
+}
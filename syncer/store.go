@@ -0,0 +1,661 @@
+package syncer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrNotFound is returned by an ObjectStore when the key does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// TagRunLabel is the object tag holding Syncer.RunLabel.
+const TagRunLabel = "s3sync-run"
+
+// ErrConflict is returned by an ObjectStore when PutOptions.IfMatch no longer matches the stored object.
+var ErrConflict = errors.New("remote object changed since it was last synced")
+
+// ObjectStore is the storage the sync engine talks to. The walk, diff, split and manifest logic only go through
+// this, so another cloud can be plugged in by implementing it and setting Syncer.Store.
+type ObjectStore interface {
+	// Put stores body as key and returns the ETag of the new object.
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (string, error)
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange reads key from opts.Offset to the end.
+	GetRange(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// SetStorageClass rewrites key in place in class, keeping its data and metadata, and returns the new ETag.
+	SetStorageClass(ctx context.Context, key string, class string) (string, error)
+	// Restore asks for a readable copy of the archived object key for days. Head reports when it is ready.
+	Restore(ctx context.Context, key string, days int32) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// MultipartStore is an ObjectStore that can put one object together from parts uploaded one by one, for content
+// over the single PUT limit. Syncer.NativeMultipart uploads through it.
+type MultipartStore interface {
+	// PutParts stores the size bytes of body as key in parts of partSize and returns the ETag of the object. A
+	// failed upload is aborted, so no parts are left behind to be billed.
+	PutParts(ctx context.Context, key string, body io.ReaderAt, size int64, partSize int64, opts PutOptions) (string, error)
+}
+
+// ResumableStore is a MultipartStore whose uploads can be carried on part by part by a later run, see
+// Syncer.ResumePending.
+type ResumableStore interface {
+	MultipartStore
+	// CreateUpload starts a multipart upload of key and returns its ID.
+	CreateUpload(ctx context.Context, key string, opts PutOptions) (string, error)
+	// UploadPart stores the size bytes of body as part n of upload and returns the ETag of the part.
+	UploadPart(ctx context.Context, key string, upload string, n int32, body io.Reader, size int64) (string, error)
+	// CompleteUpload puts the parts with etags together as key, part 1 first, and returns the ETag of the object.
+	CompleteUpload(ctx context.Context, key string, upload string, etags []string) (string, error)
+	// AbortUpload drops upload and the parts it holds.
+	AbortUpload(ctx context.Context, key string, upload string) error
+	// ListUploads returns the uploads of keys under prefix that were neither completed nor aborted.
+	ListUploads(ctx context.Context, prefix string) ([]Upload, error)
+}
+
+// Upload is a multipart upload in the bucket that wasn't completed or aborted.
+type Upload struct {
+	Key       string
+	ID        string
+	Initiated time.Time
+}
+
+// TierRestorer is an ObjectStore that can restore archived objects at a chosen retrieval tier. A store without
+// it restores at whatever tier Restore uses, see Syncer.RequestRestore.
+type TierRestorer interface {
+	RestoreTier(ctx context.Context, key string, days int32, tier types.Tier) error
+}
+
+// PutOptions are the per object settings for ObjectStore.Put.
+type PutOptions struct {
+	StorageClass string
+	Metadata     map[string]string
+	Headers      Headers
+	// Tags are set on the object as S3 object tags.
+	Tags map[string]string
+	// IfMatch only overwrites the object if its ETag still is this one.
+	IfMatch string
+	// ContentMD5 is the base64 MD5 of the body, the put fails with ErrBadDigest if what arrives doesn't match.
+	ContentMD5 string
+}
+
+// GetOptions are the per request settings for ObjectStore.GetRange.
+type GetOptions struct {
+	Offset int64
+	// IfMatch fails the read with ErrConflict if the object's ETag is no longer this one.
+	IfMatch string
+}
+
+// ObjectInfo describes a stored object. Metadata is only filled in by Head.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	StorageClass string
+	LastModified time.Time
+	Metadata     map[string]string
+	// Restored is set by Head for archived objects that have a readable restored copy.
+	Restored bool
+	// Restoring is set by Head for archived objects with a restore asked for that isn't done yet.
+	Restoring bool
+}
+
+// store returns the configured ObjectStore, the S3 bucket wrapped around S3Client by default.
+func (app *Syncer) store() ObjectStore {
+	if app.Store != nil {
+		return app.Store
+	}
+	return &S3Store{Client: app.S3Client, Bucket: app.Bucket, RequesterPays: app.RequesterPays, ExpectedBucketOwner: app.ExpectedBucketOwner, ServerSideEncryption: app.ServerSideEncryption, KMSKeyID: app.KMSKeyID, KMSEncryptionContext: app.KMSEncryptionContext}
+}
+
+// bucketOwner is the ExpectedBucketOwner for bucket requests made outside the store, nil unless it is set.
+func (app *Syncer) bucketOwner() *string {
+	return (&S3Store{ExpectedBucketOwner: app.ExpectedBucketOwner}).owner()
+}
+
+// S3Store is the ObjectStore for an S3 bucket.
+type S3Store struct {
+	Client *s3.Client
+	Bucket string
+	// RequesterPays sends RequestPayer=requester with every request, for buckets that bill the caller.
+	RequesterPays bool
+	// ExpectedBucketOwner is the account ID sent as x-amz-expected-bucket-owner with every request, so S3 turns
+	// them down if the bucket belongs to anyone else.
+	ExpectedBucketOwner string
+	// CopyLimit is the biggest object SetStorageClass copies with a single CopyObject, MaxPutSize when 0. Bigger
+	// ones are copied with a multipart copy in parts of this size.
+	CopyLimit int64
+	// ServerSideEncryption is the kind of server-side encryption asked for on every object written: AES256 for
+	// SSE-S3, aws:kms or aws:kms:dsse. KMSKeyID or KMSEncryptionContext on their own mean aws:kms.
+	ServerSideEncryption types.ServerSideEncryption
+	// KMSKeyID encrypts every object written with SSE-KMS under this key, the AWS managed key of S3 when only
+	// KMSEncryptionContext is set. None of them leaves the encryption to the bucket default.
+	KMSKeyID string
+	// KMSEncryptionContext is sent with every write as x-amz-server-side-encryption-context, for key policies
+	// that grant access on a context. Reads need no context, S3 keeps it with the object.
+	KMSEncryptionContext map[string]string
+}
+
+// sse returns the server-side encryption settings of a write, all empty unless ServerSideEncryption, KMSKeyID or
+// KMSEncryptionContext is set. The context goes out as base64 JSON, as S3 expects it.
+func (st *S3Store) sse() (types.ServerSideEncryption, *string, *string) {
+	if st.KMSKeyID == "" && len(st.KMSEncryptionContext) == 0 {
+		return st.ServerSideEncryption, nil, nil
+	}
+	var key, context *string
+	if st.KMSKeyID != "" {
+		key = aws.String(st.KMSKeyID)
+	}
+	if len(st.KMSEncryptionContext) > 0 {
+		// a map of strings always marshals, with its keys sorted
+		data, _ := json.Marshal(st.KMSEncryptionContext)
+		context = aws.String(base64.StdEncoding.EncodeToString(data))
+	}
+	if st.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse {
+		return st.ServerSideEncryption, key, context
+	}
+	return types.ServerSideEncryptionAwsKms, key, context
+}
+
+// owner returns the ExpectedBucketOwner to send, nil unless it is set.
+func (st *S3Store) owner() *string {
+	if st.ExpectedBucketOwner == "" {
+		return nil
+	}
+	return aws.String(st.ExpectedBucketOwner)
+}
+
+// payer returns the RequestPayer to send, empty unless RequesterPays is set.
+func (st *S3Store) payer() types.RequestPayer {
+	if st.RequesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+func (st *S3Store) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:              aws.String(st.Bucket),
+		Key:                 aws.String(key),
+		StorageClass:        types.StorageClass(opts.StorageClass),
+		Body:                body,
+		Metadata:            opts.Metadata,
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId, input.SSEKMSEncryptionContext = st.sse()
+	if opts.IfMatch != "" {
+		input.IfMatch = aws.String(opts.IfMatch)
+	}
+	if opts.ContentMD5 != "" {
+		input.ContentMD5 = aws.String(opts.ContentMD5)
+	}
+	input.Tagging = tagging(opts.Tags)
+	input.ContentType, input.CacheControl, input.ContentDisposition, input.ContentLanguage, input.Expires = opts.Headers.input()
+	out, err := st.Client.PutObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		// a deleted object fails If-Match with NoSuchKey, which is drift just the same
+		if opts.IfMatch != "" && errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "NoSuchKey") {
+			return "", fmt.Errorf("%s: %w", key, ErrConflict)
+		}
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "BadDigest" {
+			return "", fmt.Errorf("%s: %w: %s", key, ErrBadDigest, apiErr.ErrorMessage())
+		}
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// tagging is tags as the query string S3 takes them in, nil when there are none.
+func tagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return aws.String(values.Encode())
+}
+
+// input returns the headers as the fields of a write, nil when not set.
+func (h Headers) input() (contentType, cacheControl, contentDisposition, contentLanguage *string, expires *time.Time) {
+	if h.ContentType != "" {
+		contentType = aws.String(h.ContentType)
+	}
+	if h.CacheControl != "" {
+		cacheControl = aws.String(h.CacheControl)
+	}
+	if h.ContentDisposition != "" {
+		contentDisposition = aws.String(h.ContentDisposition)
+	}
+	if h.ContentLanguage != "" {
+		contentLanguage = aws.String(h.ContentLanguage)
+	}
+	if !h.Expires.IsZero() {
+		expires = aws.Time(h.Expires)
+	}
+	return
+}
+
+// PutParts uploads body with CreateMultipartUpload, one UploadPart per partSize read straight from body, and
+// CompleteMultipartUpload. The upload is aborted on any failure, cancellation included.
+func (st *S3Store) PutParts(ctx context.Context, key string, body io.ReaderAt, size int64, partSize int64, opts PutOptions) (string, error) {
+	upload, err := st.CreateUpload(ctx, key, opts)
+	if err != nil {
+		return "", err
+	}
+	etag, err := st.putParts(ctx, key, upload, body, size, partSize)
+	if err != nil {
+		st.AbortUpload(context.WithoutCancel(ctx), key, upload)
+		return "", fmt.Errorf("%s: multipart upload: %w", key, err)
+	}
+	return etag, nil
+}
+
+// putParts uploads the parts of body into upload and completes it.
+func (st *S3Store) putParts(ctx context.Context, key string, upload string, body io.ReaderAt, size int64, partSize int64) (string, error) {
+	var etags []string
+	for start := int64(0); start < size || len(etags) == 0; start += partSize {
+		n := min(partSize, size-start)
+		number := int32(len(etags) + 1)
+		etag, err := st.UploadPart(ctx, key, upload, number, io.NewSectionReader(body, start, n), n)
+		if err != nil {
+			return "", fmt.Errorf("part %d: %w", number, err)
+		}
+		etags = append(etags, etag)
+	}
+	return st.CompleteUpload(ctx, key, upload, etags)
+}
+
+func (st *S3Store) CreateUpload(ctx context.Context, key string, opts PutOptions) (string, error) {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:              aws.String(st.Bucket),
+		Key:                 aws.String(key),
+		StorageClass:        types.StorageClass(opts.StorageClass),
+		Metadata:            opts.Metadata,
+		Tagging:             tagging(opts.Tags),
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	}
+	create.ServerSideEncryption, create.SSEKMSKeyId, create.SSEKMSEncryptionContext = st.sse()
+	create.ContentType, create.CacheControl, create.ContentDisposition, create.ContentLanguage, create.Expires = opts.Headers.input()
+	upload, err := st.Client.CreateMultipartUpload(ctx, create)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(upload.UploadId), nil
+}
+
+func (st *S3Store) UploadPart(ctx context.Context, key string, upload string, n int32, body io.Reader, size int64) (string, error) {
+	out, err := st.Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:              aws.String(st.Bucket),
+		Key:                 aws.String(key),
+		UploadId:            aws.String(upload),
+		PartNumber:          aws.Int32(n),
+		Body:                body,
+		ContentLength:       aws.Int64(size),
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (st *S3Store) CompleteUpload(ctx context.Context, key string, upload string, etags []string) (string, error) {
+	parts := make([]types.CompletedPart, len(etags))
+	for i, etag := range etags {
+		parts[i] = types.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int32(int32(i + 1))}
+	}
+	out, err := st.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:              aws.String(st.Bucket),
+		Key:                 aws.String(key),
+		UploadId:            aws.String(upload),
+		MultipartUpload:     &types.CompletedMultipartUpload{Parts: parts},
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (st *S3Store) AbortUpload(ctx context.Context, key string, upload string) error {
+	_, err := st.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), UploadId: aws.String(upload), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	var noUpload *types.NoSuchUpload
+	if errors.As(err, &noUpload) {
+		// gone already, aborted or expired by a lifecycle rule
+		return nil
+	}
+	return err
+}
+
+func (st *S3Store) ListUploads(ctx context.Context, prefix string) ([]Upload, error) {
+	var res []Upload
+	uploads := s3.NewListMultipartUploadsPaginator(st.Client, &s3.ListMultipartUploadsInput{Bucket: aws.String(st.Bucket), Prefix: aws.String(prefix), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	for uploads.HasMorePages() {
+		page, err := uploads.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range page.Uploads {
+			res = append(res, Upload{Key: aws.ToString(u.Key), ID: aws.ToString(u.UploadId), Initiated: aws.ToTime(u.Initiated)})
+		}
+	}
+	return res, nil
+}
+
+func (st *S3Store) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := st.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ETag:         aws.ToString(out.ETag),
+		StorageClass: string(out.StorageClass),
+		LastModified: aws.ToTime(out.LastModified),
+		Metadata:     out.Metadata,
+		Restored:     strings.Contains(aws.ToString(out.Restore), `ongoing-request="false"`),
+		Restoring:    strings.Contains(aws.ToString(out.Restore), `ongoing-request="true"`),
+	}, nil
+}
+
+func (st *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := st.Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (st *S3Store) GetRange(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:              aws.String(st.Bucket),
+		Key:                 aws.String(key),
+		Range:               aws.String(fmt.Sprintf("bytes=%d-", opts.Offset)),
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	}
+	if opts.IfMatch != "" {
+		input.IfMatch = aws.String(opts.IfMatch)
+	}
+	out, err := st.Client.GetObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "NoSuchKey":
+				return nil, ErrNotFound
+			case "PreconditionFailed":
+				return nil, fmt.Errorf("%s: %w", key, ErrConflict)
+			}
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (st *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := st.Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	return err
+}
+
+func (st *S3Store) SetStorageClass(ctx context.Context, key string, class string) (string, error) {
+	head, err := st.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	if err != nil {
+		return "", err
+	}
+	if aws.ToInt64(head.ContentLength) > st.copyLimit() {
+		return st.copyInParts(ctx, key, class, head)
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:                    aws.String(st.Bucket),
+		Key:                       aws.String(key),
+		CopySource:                st.copySource(key),
+		ExpectedSourceBucketOwner: st.owner(),
+		StorageClass:              types.StorageClass(class),
+		RequestPayer:              st.payer(),
+		ExpectedBucketOwner:       st.owner(),
+	}
+	// a copy is encrypted as it says, not as its source was
+	input.ServerSideEncryption, input.SSEKMSKeyId, input.SSEKMSEncryptionContext = st.sse()
+	out, err := st.Client.CopyObject(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	if out.CopyObjectResult == nil {
+		return "", nil
+	}
+	return aws.ToString(out.CopyObjectResult.ETag), nil
+}
+
+// copyLimit returns CopyLimit, or the 5GiB S3 allows for a single CopyObject.
+func (st *S3Store) copyLimit() int64 {
+	if st.CopyLimit > 0 {
+		return st.CopyLimit
+	}
+	return MaxPutSize
+}
+
+// copySource is the CopySource of key in this bucket.
+func (st *S3Store) copySource(key string) *string {
+	return aws.String((&url.URL{Path: st.Bucket + "/" + key}).EscapedPath())
+}
+
+// copyInParts rewrites key in class with UploadPartCopy, for objects too big for CopyObject. A multipart upload
+// starts out bare, so the headers, metadata and tags of head are carried over by hand. An upload of key to class
+// a run left unfinished is resumed instead, keeping the parts it already copied. The upload is aborted on failure
+// so no parts are left to pay for, unless the run was cancelled and the next one can pick it up again.
+func (st *S3Store) copyInParts(ctx context.Context, key string, class string, head *s3.HeadObjectOutput) (string, error) {
+	upload, landed, err := st.pendingUpload(ctx, key, class)
+	if err != nil {
+		return "", err
+	}
+	if upload == nil {
+		upload, err = st.createCopyUpload(ctx, key, class, head)
+		if err != nil {
+			return "", err
+		}
+	}
+	etag, err := st.copyParts(ctx, key, upload, aws.ToInt64(head.ContentLength), landed)
+	if err != nil {
+		if ctx.Err() == nil {
+			st.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), UploadId: upload, RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+		}
+		return "", fmt.Errorf("%s: multipart copy: %w", key, err)
+	}
+	return etag, nil
+}
+
+// createCopyUpload starts the multipart upload copyInParts copies key into.
+func (st *S3Store) createCopyUpload(ctx context.Context, key string, class string, head *s3.HeadObjectOutput) (*string, error) {
+	tags, err := st.Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	if err != nil {
+		return nil, err
+	}
+	tagging := url.Values{}
+	for _, t := range tags.TagSet {
+		tagging.Set(aws.ToString(t.Key), aws.ToString(t.Value))
+	}
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:              aws.String(st.Bucket),
+		Key:                 aws.String(key),
+		StorageClass:        types.StorageClass(class),
+		Metadata:            head.Metadata,
+		CacheControl:        head.CacheControl,
+		ContentDisposition:  head.ContentDisposition,
+		ContentEncoding:     head.ContentEncoding,
+		ContentLanguage:     head.ContentLanguage,
+		ContentType:         head.ContentType,
+		Expires:             head.Expires,
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	}
+	create.ServerSideEncryption, create.SSEKMSKeyId, create.SSEKMSEncryptionContext = st.sse()
+	if len(tagging) > 0 {
+		create.Tagging = aws.String(tagging.Encode())
+	}
+	upload, err := st.Client.CreateMultipartUpload(ctx, create)
+	if err != nil {
+		return nil, err
+	}
+	return upload.UploadId, nil
+}
+
+// pendingUpload finds the latest unfinished multipart upload of key to class with ListMultipartUploads, and the
+// parts that already landed in it with ListParts. The upload is nil when there is none to resume.
+func (st *S3Store) pendingUpload(ctx context.Context, key string, class string) (*string, map[int32]types.Part, error) {
+	var found *types.MultipartUpload
+	uploads := s3.NewListMultipartUploadsPaginator(st.Client, &s3.ListMultipartUploadsInput{Bucket: aws.String(st.Bucket), Prefix: aws.String(key), RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	for uploads.HasMorePages() {
+		page, err := uploads.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, u := range page.Uploads {
+			if aws.ToString(u.Key) != key || string(u.StorageClass) != class {
+				continue
+			}
+			if found == nil || aws.ToTime(u.Initiated).After(aws.ToTime(found.Initiated)) {
+				found = &page.Uploads[i]
+			}
+		}
+	}
+	if found == nil {
+		return nil, nil, nil
+	}
+	landed := map[int32]types.Part{}
+	parts := s3.NewListPartsPaginator(st.Client, &s3.ListPartsInput{Bucket: aws.String(st.Bucket), Key: aws.String(key), UploadId: found.UploadId, RequestPayer: st.payer(), ExpectedBucketOwner: st.owner()})
+	for parts.HasMorePages() {
+		page, err := parts.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, part := range page.Parts {
+			landed[aws.ToInt32(part.PartNumber)] = part
+		}
+	}
+	return found.UploadId, landed, nil
+}
+
+// copyParts copies the size bytes of key into upload part by part and completes it. Parts in landed that
+// already hold the right range are kept as they are.
+func (st *S3Store) copyParts(ctx context.Context, key string, upload *string, size int64, landed map[int32]types.Part) (string, error) {
+	partSize := max(st.copyLimit(), (size+MaxParts-1)/MaxParts)
+	var parts []types.CompletedPart
+	for start := int64(0); start < size; start += partSize {
+		end := min(start+partSize, size) - 1
+		number := aws.Int32(int32(len(parts) + 1))
+		if part, ok := landed[*number]; ok && aws.ToInt64(part.Size) == end-start+1 && part.ETag != nil {
+			parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: number})
+			continue
+		}
+		out, err := st.Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:                    aws.String(st.Bucket),
+			Key:                       aws.String(key),
+			UploadId:                  upload,
+			PartNumber:                number,
+			CopySource:                st.copySource(key),
+			ExpectedSourceBucketOwner: st.owner(),
+			CopySourceRange:           aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			RequestPayer:              st.payer(),
+			ExpectedBucketOwner:       st.owner(),
+		})
+		if err != nil {
+			return "", err
+		}
+		if out.CopyPartResult == nil {
+			return "", fmt.Errorf("no ETag for part %d", *number)
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: number})
+	}
+	out, err := st.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:              aws.String(st.Bucket),
+		Key:                 aws.String(key),
+		UploadId:            upload,
+		MultipartUpload:     &types.CompletedMultipartUpload{Parts: parts},
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (st *S3Store) Restore(ctx context.Context, key string, days int32) error {
+	return st.RestoreTier(ctx, key, days, types.TierStandard)
+}
+
+func (st *S3Store) RestoreTier(ctx context.Context, key string, days int32, tier types.Tier) error {
+	_, err := st.Client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(st.Bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: tier},
+		},
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	})
+	var apiErr smithy.APIError
+	// a second request for the same copy is fine, it's on its way
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
+
+func (st *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var res []ObjectInfo
+	pages := s3.NewListObjectsV2Paginator(st.Client, &s3.ListObjectsV2Input{
+		Bucket:              aws.String(st.Bucket),
+		Prefix:              aws.String(prefix),
+		RequestPayer:        st.payer(),
+		ExpectedBucketOwner: st.owner(),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			res = append(res, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         aws.ToString(obj.ETag),
+				StorageClass: string(obj.StorageClass),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,4666 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// memStore is an in memory ObjectStore for tests.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+	// failPut makes Put fail for keys it returns an error for.
+	failPut func(key string) error
+	// dropAfter makes every GetRange fail after sending this many bytes, when set.
+	dropAfter int
+	ranges    []int64
+	restores  int
+	// stallPuts makes that many Puts hang without reading the body until they are cancelled.
+	stallPuts int
+	// skew is added to the LastModified of new objects, like a server whose clock is off.
+	skew time.Duration
+	// flip corrupts the first byte of every Put body on the way, like a bad network.
+	flip bool
+	// parts and aborts count the parts uploaded and the multipart uploads aborted by PutParts.
+	parts  int
+	aborts int
+}
+
+type memObject struct {
+	data    []byte
+	info    ObjectInfo
+	headers Headers
+	tags    map[string]string
+	md5     string
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: map[string]memObject{}}
+}
+
+func (m *memStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (string, error) {
+	if m.failPut != nil {
+		if err := m.failPut(key); err != nil {
+			return "", err
+		}
+	}
+	m.mu.Lock()
+	stall := m.stallPuts > 0
+	if stall {
+		m.stallPuts--
+	}
+	m.mu.Unlock()
+	if stall {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.flip && len(data) > 0 {
+		data[0] ^= 0xff
+	}
+	if sum := md5.Sum(data); opts.ContentMD5 != "" && opts.ContentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return "", ErrBadDigest
+	}
+	if opts.IfMatch != "" && m.objects[key].info.ETag != opts.IfMatch {
+		return "", ErrConflict
+	}
+	etag := fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(data)))
+	m.objects[key] = memObject{data: data, info: ObjectInfo{
+		Key:          key,
+		Size:         int64(len(data)),
+		ETag:         etag,
+		StorageClass: opts.StorageClass,
+		LastModified: time.Now().Add(m.skew),
+		Metadata:     opts.Metadata,
+	}, headers: opts.Headers, tags: opts.Tags, md5: opts.ContentMD5}
+	return etag, nil
+}
+
+// PutParts stores the parts read from body as one object, after failPut passed each of them as key#partN.
+func (m *memStore) PutParts(ctx context.Context, key string, body io.ReaderAt, size int64, partSize int64, opts PutOptions) (string, error) {
+	var data []byte
+	for n, start := 0, int64(0); start < size; n, start = n+1, start+partSize {
+		if m.failPut != nil {
+			if err := m.failPut(fmt.Sprintf("%s#part%d", key, n)); err != nil {
+				m.mu.Lock()
+				m.aborts++
+				m.mu.Unlock()
+				return "", fmt.Errorf("%s: multipart upload: %w", key, err)
+			}
+		}
+		part, err := io.ReadAll(io.NewSectionReader(body, start, min(partSize, size-start)))
+		if err != nil {
+			return "", err
+		}
+		data = append(data, part...)
+		m.mu.Lock()
+		m.parts++
+		m.mu.Unlock()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	etag := fmt.Sprintf("%q", fmt.Sprintf("%x-%d", md5.Sum(data), (size+partSize-1)/partSize))
+	m.objects[key] = memObject{data: data, info: ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ETag:         etag,
+		StorageClass: opts.StorageClass,
+		LastModified: time.Now().Add(m.skew),
+		Metadata:     opts.Metadata,
+	}, headers: opts.Headers, tags: opts.Tags}
+	return etag, nil
+}
+
+func (m *memStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return obj.info, nil
+}
+
+func (m *memStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (m *memStore) GetRange(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if opts.IfMatch != "" && obj.info.ETag != opts.IfMatch {
+		return nil, ErrConflict
+	}
+	m.ranges = append(m.ranges, opts.Offset)
+	data := obj.data[opts.Offset:]
+	if m.dropAfter > 0 && len(data) > m.dropAfter {
+		return io.NopCloser(io.MultiReader(bytes.NewReader(data[:m.dropAfter]), errReader{})), nil
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// errReader is a connection that dropped.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+
+func (m *memStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// Restore makes the copy ready right away.
+func (m *memStore) Restore(ctx context.Context, key string, days int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return ErrNotFound
+	}
+	m.restores++
+	obj.info.Restored = true
+	m.objects[key] = obj
+	return nil
+}
+
+func (m *memStore) SetStorageClass(ctx context.Context, key string, class string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	obj.info.StorageClass = class
+	m.objects[key] = obj
+	return obj.info.ETag, nil
+}
+
+func (m *memStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []ObjectInfo
+	for k, obj := range m.objects {
+		if strings.HasPrefix(k, prefix) {
+			info := obj.info
+			info.Metadata = nil
+			res = append(res, info)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res, nil
+}
+
+func (m *memStore) keys() []string {
+	list, _ := m.List(context.Background(), "")
+	var res []string
+	for _, obj := range list {
+		res = append(res, obj.Key)
+	}
+	return res
+}
+
+// newStoreSyncer returns a test Syncer uploading to a memStore, with a quiet terminal.
+func newStoreSyncer(t *testing.T) (*Syncer, *memStore) {
+	t.Helper()
+	s := newTestSyncer(t)
+	store := newMemStore()
+	s.Store = store
+	s.NoSpinners = true
+	// one file at a time, so the tests can count on the order of the uploads
+	s.MaxConcurrency = 1
+	s.FolderPath = filepath.Join(s.FolderPath, "src")
+	s.KeyFunc = func(p string) string {
+		rel, _ := filepath.Rel(s.FolderPath, p)
+		return filepath.ToSlash(rel)
+	}
+	return s, store
+}
+
+// syncOnce runs the same steps as the sync command.
+func syncOnce(t *testing.T, s *Syncer) {
+	t.Helper()
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UpdateManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := s.GetUploadList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UploadDiffs(context.Background(), uploads, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadDiffsSplitsLargeFiles(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1024}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+
+	syncOnce(t, s)
+
+	got := strings.Join(store.keys(), ",")
+	if got != "big.bin.part0,big.bin.part1,big.bin.part2,small.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+	for _, p := range []string{"small.txt", "big.bin"} {
+		err := s.checkRoundTrip(context.Background(), filepath.Join(s.FolderPath, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, _ := s.GetUploadList()
+	if len(list) != 0 {
+		t.Fatalf("still pending after sync: %v", list)
+	}
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "s3sync*", "big.bin.part*"))
+	if len(matches) != 0 {
+		t.Fatalf("split pieces left behind: %v", matches)
+	}
+}
+
+func TestRunHistory(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 20)
+	syncOnce(t, s)
+
+	// second run fails on b.txt
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 30)
+	os.Chtimes(filepath.Join(s.FolderPath, "b.txt"), time.Now(), time.Now().Add(time.Hour))
+	store.failPut = func(key string) error {
+		return errors.New("disk on fire")
+	}
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	if err := s.UploadDiffs(context.Background(), uploads, false); err == nil {
+		t.Fatal("expected the second run to fail")
+	}
+
+	runs, err := s.RunHistory(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("runs = %+v", runs)
+	}
+	if runs[1].Outcome != RunSucceeded || runs[1].Succeeded != 2 || runs[1].Bytes != 30 {
+		t.Fatalf("first run = %+v", runs[1])
+	}
+	if runs[0].Outcome != RunFailed || runs[0].Failed != 1 {
+		t.Fatalf("second run = %+v", runs[0])
+	}
+	results, _ := s.RunFiles(runs[0].ID)
+	if len(results) != 1 || results[0].Error != "disk on fire" {
+		t.Fatalf("second run files = %+v", results)
+	}
+}
+
+func TestCancelledRun(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	p := filepath.Join(s.FolderPath, "a.txt")
+	writeFixture(p, 100)
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+
+	// Ctrl-C while the file is going up
+	store.stallPuts = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := s.UploadDiffs(ctx, uploads, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled upload = %v", err)
+	}
+	if status, _ := s.getStatus(p); status != StatusPending {
+		t.Fatalf("status after a cancelled upload = %q", status)
+	}
+	runs, _ := s.RunHistory(1)
+	if len(runs) != 1 || runs[0].Outcome != RunCancelled || runs[0].Failed != 0 || runs[0].Succeeded != 0 {
+		t.Fatalf("runs = %+v", runs)
+	}
+	results, _ := s.RunFiles(runs[0].ID)
+	if len(results) != 1 || results[0].Outcome != RunCancelled {
+		t.Fatalf("run files = %+v", results)
+	}
+	if sum := s.Summary(err); sum.Outcome != RunCancelled || sum.Failed != 0 {
+		t.Fatalf("summary = %+v", sum)
+	}
+	checkConsistent(t, s)
+
+	// the next run picks it up
+	syncOnce(t, s)
+	if !bytes.Equal(store.objects["a.txt"].data, mustRead(t, p)) {
+		t.Fatal("the next run didn't upload the file")
+	}
+}
+
+func TestUnchangedSplitFileIsSkipped(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	big := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(big, 2500)
+	syncOnce(t, s)
+	if got := len(store.keys()); got != 3 {
+		t.Fatalf("first sync stored %v", store.keys())
+	}
+
+	// the parent row is only complete through its parts
+	status, err := s.getStatus(big)
+	if err != nil || status != StatusComplete {
+		t.Fatalf("status = %q, %v", status, err)
+	}
+
+	store.failPut = func(key string) error {
+		t.Errorf("unchanged file uploaded again as %s", key)
+		return nil
+	}
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, err := s.GetUploadList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 0 {
+		t.Fatalf("upload list = %v", uploads)
+	}
+	keys, _ := s.partKeys(big)
+	if len(keys) != 3 {
+		t.Fatalf("part records = %v", keys)
+	}
+
+	parts, err := s.Parts(big)
+	if err != nil || len(parts) != 3 {
+		t.Fatalf("parts = %+v, %v", parts, err)
+	}
+	var offset int64
+	for i, part := range parts {
+		if part.Index != i || part.Offset != offset || part.Status != StatusComplete {
+			t.Fatalf("part %d = %+v", i, part)
+		}
+		obj := store.objects[part.Key]
+		sum := sha256.Sum256(obj.data)
+		if part.Size != int64(len(obj.data)) || part.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("part %d = %+v doesn't match the stored object", i, part)
+		}
+		offset += part.Size
+	}
+	if offset != 2500 {
+		t.Fatalf("parts add up to %d bytes", offset)
+	}
+}
+
+func TestSplitConcurrencyDownloadChecksSums(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.SplitConcurrency = 3
+	big := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(big, 4500)
+	syncOnce(t, s)
+	if got := len(store.keys()); got != 5 {
+		t.Fatalf("sync stored %v", store.keys())
+	}
+
+	ctx := context.Background()
+	dest := filepath.Join(t.TempDir(), "big.bin")
+	err := s.Download(ctx, big, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(big)
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, want) {
+		t.Fatal("downloaded file doesn't match")
+	}
+
+	// a piece gone bad in the bucket, with the size and ETag it was listed with
+	parts, _ := s.Parts(big)
+	store.mu.Lock()
+	obj := store.objects[parts[2].Key]
+	obj.data = append([]byte(nil), obj.data...)
+	obj.data[10] ^= 0xff
+	store.objects[parts[2].Key] = obj
+	store.mu.Unlock()
+	// download it again rather than link to the first copy
+	s.restored = nil
+	dest = filepath.Join(t.TempDir(), "big.bin")
+	err = s.Download(ctx, big, dest)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("download of a corrupt piece = %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("corrupt download left %s behind: %v", dest, err)
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.DetectDrift = true
+	p := filepath.Join(s.FolderPath, "shared.txt")
+	writeFixture(p, 10)
+	syncOnce(t, s)
+
+	// our own changes go through, conditional on the ETag from the last sync
+	touch := func() {
+		writeFixture(p, 20)
+		later := time.Now().Add(time.Hour)
+		os.Chtimes(p, later, later)
+	}
+	touch()
+	syncOnce(t, s)
+
+	// someone else overwrites the object
+	store.Put(context.Background(), "shared.txt", strings.NewReader("theirs"), PutOptions{})
+	writeFixture(p, 30)
+	later := time.Now().Add(2 * time.Hour)
+	os.Chtimes(p, later, later)
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("err = %v, want ErrConflict", err)
+	}
+	body, _ := store.Get(context.Background(), "shared.txt")
+	data, _ := io.ReadAll(body)
+	if string(data) != "theirs" {
+		t.Fatalf("remote overwritten with %d bytes", len(data))
+	}
+}
+
+func TestFsck(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	for _, name := range []string{"ok.txt", "rot.txt", "edited.txt", "gone.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, name), 100)
+	}
+	syncOnce(t, s)
+
+	rot := filepath.Join(s.FolderPath, "rot.txt")
+	info, _ := os.Stat(rot)
+	writeFixture(rot, 100)
+	os.Chtimes(rot, info.ModTime(), info.ModTime())
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(s.FolderPath, "edited.txt"), later, later)
+	os.Remove(filepath.Join(s.FolderPath, "gone.txt"))
+	writeFixture(filepath.Join(s.FolderPath, "new.txt"), 10)
+
+	report, err := s.Fsck(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, got []string, name string) {
+		t.Helper()
+		if len(got) != 1 || filepath.Base(got[0]) != name {
+			t.Fatalf("%s = %v, want %s", what, got, name)
+		}
+	}
+	check("Corrupt", report.Corrupt, "rot.txt")
+	check("Modified", report.Modified, "edited.txt")
+	check("Missing", report.Missing, "gone.txt")
+	check("Untracked", report.Untracked, "new.txt")
+	if report.Checked != 4 || report.Clean() {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	big := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(big, 2500)
+	syncOnce(t, s)
+
+	store.dropAfter = 300
+	dest := filepath.Join(t.TempDir(), "restored", "big.bin")
+	err := s.Download(context.Background(), big, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(big)
+	got, _ := os.ReadFile(dest)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("restored %d bytes, want %d", len(got), len(want))
+	}
+	// each 1000 byte part takes four 300 byte ranges, the 500 byte tail two
+	wantRanges := []int64{0, 300, 600, 900, 0, 300, 600, 900, 0, 300}
+	if fmt.Sprint(store.ranges) != fmt.Sprint(wantRanges) {
+		t.Fatalf("ranges = %v, want %v", store.ranges, wantRanges)
+	}
+	leftovers, _ := filepath.Glob(dest + ".s3sync-*")
+	if len(leftovers) != 0 {
+		t.Fatalf("partial files left behind: %v", leftovers)
+	}
+}
+
+func TestSubpath(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	writeFixture(filepath.Join(s.FolderPath, "a", "one.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "projects", "x", "two.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "projects", "y", "three.txt"), 10)
+
+	s.Subpath = "projects/x"
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "projects/x/two.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+
+	s.Subpath = "../elsewhere"
+	if _, err := s.WalkAndHash(context.Background(), []string{""}); err == nil {
+		t.Fatal("expected a subpath outside the folder to be rejected")
+	}
+	s.Subpath = ""
+	syncOnce(t, s)
+	if len(store.keys()) != 3 {
+		t.Fatalf("keys = %v", store.keys())
+	}
+}
+
+func TestTombstonePurge(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	keep := filepath.Join(s.FolderPath, "keep.txt")
+	gone := filepath.Join(s.FolderPath, "gone.bin")
+	writeFixture(keep, 10)
+	writeFixture(gone, 1500)
+	syncOnce(t, s)
+
+	os.Remove(gone)
+	syncOnce(t, s)
+	tombstones, err := s.Tombstones()
+	if err != nil || len(tombstones) != 1 || tombstones[0].Path != gone {
+		t.Fatalf("tombstones = %v, %v", tombstones, err)
+	}
+	if len(store.keys()) != 3 {
+		t.Fatalf("objects removed before the retention ran out: %v", store.keys())
+	}
+
+	s.Retention = 24 * time.Hour
+	purged, _ := s.Purge(context.Background())
+	if len(purged) != 0 {
+		t.Fatalf("purged %v inside the retention window", purged)
+	}
+	s.db.Exec("update videos set deleted = ? where filepath = ?", time.Now().Add(-48*time.Hour).Unix(), gone)
+	purged, err = s.Purge(context.Background())
+	if err != nil || len(purged) != 1 {
+		t.Fatalf("purged %v, %v", purged, err)
+	}
+	if got := strings.Join(store.keys(), ","); got != "keep.txt" {
+		t.Fatalf("keys after purge = %s", got)
+	}
+	if keys, _ := s.partKeys(gone); len(keys) != 0 {
+		t.Fatalf("parts still recorded: %v", keys)
+	}
+
+	// a file that comes back is live again
+	os.Remove(keep)
+	syncOnce(t, s)
+	writeFixture(keep, 10)
+	syncOnce(t, s)
+	if tombstones, _ = s.Tombstones(); len(tombstones) != 0 {
+		t.Fatalf("tombstones = %v", tombstones)
+	}
+}
+
+func TestTouchedFileIsNotReuploaded(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	touched := filepath.Join(s.FolderPath, "touched.txt")
+	edited := filepath.Join(s.FolderPath, "edited.txt")
+	writeFixture(touched, 100)
+	writeFixture(edited, 100)
+	syncOnce(t, s)
+
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(touched, later, later)
+	writeFixture(edited, 100)
+	os.Chtimes(edited, later, later)
+
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncOnce(t, s)
+	if strings.Join(puts, ",") != "edited.txt" {
+		t.Fatalf("uploaded %v, want only edited.txt", puts)
+	}
+	// the new modification time is remembered, so the next run does not hash it again
+	if exists, _ := s.recordExists(touched, later.Unix()); !exists {
+		t.Fatal("touched file kept its old modification time in the manifest")
+	}
+}
+
+func TestIncludeDirs(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	for _, name := range []string{"top.jpg", "photos/a.jpg", "photos/a.txt", "music/b.mp3", "docs/2023/c.jpg", "docs/2024/d.jpg"} {
+		writeFixture(filepath.Join(s.FolderPath, filepath.FromSlash(name)), 10)
+	}
+	s.IncludeDirs = []string{"photos", "docs/2023"}
+	files, err := s.WalkAndHash(context.Background(), []string{".jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	s.UploadDiffs(context.Background(), uploads, false)
+	if got := strings.Join(store.keys(), ","); got != "docs/2023/c.jpg,photos/a.jpg" {
+		t.Fatalf("keys = %s", got)
+	}
+}
+
+func TestHeal(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	for _, name := range []string{"ok.txt", "deleted.txt", "rot.bin", "lost.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, name), 1500)
+	}
+	syncOnce(t, s)
+
+	ctx := context.Background()
+	store.Delete(ctx, "deleted.txt.part1")
+	store.Put(ctx, "rot.bin.part0", strings.NewReader("garbage"), PutOptions{})
+	store.Delete(ctx, "lost.txt.part0")
+	os.Remove(filepath.Join(s.FolderPath, "lost.txt"))
+
+	report, err := s.Heal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(paths []string) string {
+		var res []string
+		for _, p := range paths {
+			res = append(res, filepath.Base(p))
+		}
+		sort.Strings(res)
+		return strings.Join(res, ",")
+	}
+	if report.Verify.Checked != 4 || names(report.Verify.Missing) != "deleted.txt,lost.txt" || names(report.Verify.Mismatched) != "rot.bin" {
+		t.Fatalf("verify = %+v", report.Verify)
+	}
+	if names(report.Repaired) != "deleted.txt,rot.bin" || names(report.Unrecoverable) != "lost.txt" {
+		t.Fatalf("heal = %+v", report)
+	}
+	if !errors.Is(report.Verify.Err(), ErrVerify) || report.Verify.OK() != 1 {
+		t.Fatalf("verify = %+v, %v", report.Verify, report.Verify.Err())
+	}
+	verify, err := s.Verify(ctx)
+	if err != nil || names(verify.Missing) != "lost.txt" || len(verify.Mismatched) != 0 {
+		t.Fatalf("after heal = %+v, %v", verify, err)
+	}
+}
+
+func TestVerifyLocal(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	for _, name := range []string{"same.txt", "gone.txt", "touched.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, name), 100)
+	}
+	syncOnce(t, s)
+
+	ctx := context.Background()
+	store.Put(ctx, "stray.txt", strings.NewReader("nobody uploaded this"), PutOptions{})
+	os.Remove(filepath.Join(s.FolderPath, "gone.txt"))
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(s.FolderPath, "touched.txt"), later, later)
+
+	report, err := s.Verify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.Orphaned, ",") != "stray.txt" {
+		t.Fatalf("orphaned = %v", report.Orphaned)
+	}
+	if len(report.Gone) != 1 || filepath.Base(report.Gone[0]) != "gone.txt" {
+		t.Fatalf("gone = %v", report.Gone)
+	}
+	if len(report.Modified) != 1 || filepath.Base(report.Modified[0]) != "touched.txt" {
+		t.Fatalf("modified = %v", report.Modified)
+	}
+	// the bucket still holds what was uploaded
+	if report.Err() != nil || report.OK() != 3 {
+		t.Fatalf("verify = %+v, %v", report, report.Err())
+	}
+}
+
+func TestEncryptionKey(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 100000}
+	s.EncryptionKey = bytes.Repeat([]byte{7}, 32)
+	big := filepath.Join(s.FolderPath, "big.bin")
+	empty := filepath.Join(s.FolderPath, "empty.txt")
+	writeFixture(big, 3*cipherChunk+10)
+	writeFixture(empty, 0)
+	syncOnce(t, s)
+
+	// big.bin is split after encryption, the pieces hold nothing of the file as is
+	want, _ := os.ReadFile(big)
+	if len(store.keys()) != 3 {
+		t.Fatalf("keys = %v", store.keys())
+	}
+	for _, k := range store.keys() {
+		obj := store.objects[k]
+		if bytes.Contains(obj.data, want[:64]) || obj.info.Metadata[MetaKeyID] != KeyID(s.EncryptionKey) {
+			t.Fatalf("%s isn't encrypted: %v", k, obj.info.Metadata)
+		}
+	}
+	ctx := context.Background()
+	for _, p := range []string{big, empty} {
+		dest := filepath.Join(t.TempDir(), filepath.Base(p))
+		err := s.Download(ctx, p, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(dest)
+		want, _ := os.ReadFile(p)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: decrypted %d bytes, want %d", p, len(got), len(want))
+		}
+	}
+
+	key := s.EncryptionKey
+	s.EncryptionKey = bytes.Repeat([]byte{8}, 32)
+	s.restored = nil
+	if err := s.Download(ctx, empty, filepath.Join(t.TempDir(), "empty.txt")); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("download with another key = %v", err)
+	}
+	s.EncryptionKey = key
+	// a cut off object doesn't decrypt to a short file
+	obj := store.objects["empty.txt"]
+	store.Put(ctx, "empty.txt", bytes.NewReader(obj.data[:8]), PutOptions{Metadata: obj.info.Metadata})
+	if err := s.Download(ctx, empty, filepath.Join(t.TempDir(), "empty.txt")); err == nil {
+		t.Fatal("cut off object decrypted")
+	}
+}
+
+func TestUploadOrder(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	sizes := map[string]int{"b.txt": 30, "a.txt": 10, "c.txt": 20}
+	var diffs []string
+	for name, size := range sizes {
+		p := filepath.Join(s.FolderPath, name)
+		writeFixture(p, size)
+		diffs = append(diffs, p)
+	}
+	cases := map[Order]string{
+		OrderLargestFirst:  "b.txt,c.txt,a.txt",
+		OrderSmallestFirst: "a.txt,c.txt,b.txt",
+		OrderPath:          "a.txt,b.txt,c.txt",
+	}
+	for order, want := range cases {
+		var got []string
+		store.failPut = func(key string) error {
+			got = append(got, key)
+			return nil
+		}
+		s.UploadOrder = order
+		s.UploadDiffs(context.Background(), diffs, false)
+		if strings.Join(got, ",") != want {
+			t.Fatalf("order %d uploaded %v, want %s", order, got, want)
+		}
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.KeepGoing = true
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, name), 10)
+	}
+	store.failPut = func(key string) error {
+		if key == "b.txt" {
+			return fmt.Errorf("put %s: %w", key, os.ErrPermission)
+		}
+		return nil
+	}
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+	var failed *UploadErrors
+	if !errors.As(err, &failed) || failed.Uploaded != 2 || len(failed.Failed) != 1 || filepath.Base(failed.Failed[0].Path) != "b.txt" {
+		t.Fatalf("UploadDiffs = %v", err)
+	}
+	if !errors.Is(err, ErrPermission) {
+		t.Fatalf("%v isn't ErrPermission", err)
+	}
+	if got := strings.Join(store.keys(), ","); got != "a.txt,c.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+	pending, _ := s.GetUploadList()
+	if len(pending) != 1 || filepath.Base(pending[0]) != "b.txt" {
+		t.Fatalf("pending = %v", pending)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.WatchInterval = time.Hour
+	if runtime.GOOS != "linux" {
+		s.WatchInterval = 50 * time.Millisecond
+	}
+	s.WatchDebounce = 20 * time.Millisecond
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Watch(ctx, []string{""}, false) }()
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for strings.Join(store.keys(), ",") != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("keys = %v, want %s", store.keys(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("a.txt")
+	// a file in a folder made after the watch started
+	writeFixture(filepath.Join(s.FolderPath, "new", "b.txt"), 10)
+	waitFor("a.txt,new/b.txt")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImportManifest(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	syncOnce(t, s)
+	var buf bytes.Buffer
+	err := s.ExportManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another machine with the same file somewhere else
+	other, _ := newStoreSyncer(t)
+	other.Store = store
+	data, _ := os.ReadFile(filepath.Join(s.FolderPath, "a.txt"))
+	os.MkdirAll(other.FolderPath, 0755)
+	os.WriteFile(filepath.Join(other.FolderPath, "a.txt"), data, 0644)
+	err = other.ImportManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := other.WalkAndHash(context.Background(), []string{""})
+	other.UpdateManifest(files)
+	if pending, _ := other.GetUploadList(); len(pending) != 0 {
+		t.Fatalf("pending after import = %v", pending)
+	}
+
+	// sharing it through the bucket
+	err = s.PushManifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.PushManifest(context.Background()); !errors.Is(err, ErrConflict) {
+		t.Fatalf("push without pulling = %v", err)
+	}
+	if pulled, err := other.PullManifest(context.Background()); !pulled || err != nil {
+		t.Fatalf("PullManifest = %v, %v", pulled, err)
+	}
+	if pulled, err := other.PullManifest(context.Background()); pulled || err != nil {
+		t.Fatalf("PullManifest again = %v, %v", pulled, err)
+	}
+	err = other.PushManifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PushManifest(context.Background()); !errors.Is(err, ErrConflict) {
+		t.Fatalf("push over another machine's = %v", err)
+	}
+
+	// anyone who can write to the bucket writes the export, its column names don't go into the query unchecked
+	evil := `{"format": 1, "schema": 1, "tables": {"etags": [{"key": "k", "etag": "e", "etag) values ('x', 'y'); drop table videos; --": 1}]}}`
+	if err = other.ImportManifest(strings.NewReader(evil)); err == nil || !strings.Contains(err.Error(), "unknown column") {
+		t.Fatalf("import with an unknown column = %v", err)
+	}
+	if _, err = other.db.Exec("select count(*) from videos"); err != nil {
+		t.Fatalf("the manifest lost a table: %v", err)
+	}
+}
+
+func TestSkipFunc(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	writeFixture(filepath.Join(s.FolderPath, "random.bin"), 64*1024)
+	writeFixture(filepath.Join(s.FolderPath, "empty.txt"), 0)
+	os.WriteFile(filepath.Join(s.FolderPath, "text.txt"), bytes.Repeat([]byte("hello world "), 1000), 0644)
+	if runtime.GOOS != "windows" {
+		sparse, _ := os.Create(filepath.Join(s.FolderPath, "sparse.img"))
+		sparse.Truncate(1 << 20)
+		sparse.Close()
+	}
+
+	s.Skip = SkipAny(SkipEmpty, SkipIncompressible)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "text.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+}
+
+func TestPendingBytes(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 100)
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 250)
+	events := make(chan ProgressEvent, 100)
+	s.Progress = events
+	syncOnce(t, s)
+	close(events)
+	started := 0
+	for ev := range events {
+		if ev.Type == FileStarted {
+			started++
+			if ev.TotalBytes != 350 {
+				t.Fatalf("TotalBytes = %d, want 350", ev.TotalBytes)
+			}
+		}
+	}
+	if started != 2 {
+		t.Fatalf("%d files started", started)
+	}
+}
+
+func TestPartKeyTemplate(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.PartKeyTemplate = "parts/{key}.p{number:4}of{total:4}"
+	big := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(big, 2500)
+	syncOnce(t, s)
+	want := "parts/big.bin.p0001of0003,parts/big.bin.p0002of0003,parts/big.bin.p0003of0003"
+	if got := strings.Join(store.keys(), ","); got != want {
+		t.Fatalf("keys = %s", got)
+	}
+
+	// a restore finds the parts through the manifest, whatever the template is now
+	s.PartKeyTemplate = ""
+	dest := filepath.Join(t.TempDir(), "big.bin")
+	err := s.Download(context.Background(), big, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileSize(dest) != 2500 {
+		t.Fatalf("restored %d bytes", fileSize(dest))
+	}
+
+	if ValidatePartTemplate("{key}.part") == nil {
+		t.Fatal("expected a template without an index to be rejected")
+	}
+}
+
+func TestCheckpointWalk(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	s.CheckpointWalk = true
+	for _, name := range []string{"a/1.txt", "a/2.txt", "b/3.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, filepath.FromSlash(name)), 10)
+	}
+	_, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend the walk crashed partway through b.
+	b := filepath.Join(s.FolderPath, "b")
+	s.db.Exec("delete from walk_dirs where filepath in (?, ?)", s.FolderPath, b)
+	s.db.Exec("delete from walk_files where filepath like ?", b+"%")
+	writeFixture(filepath.Join(s.FolderPath, "a", "late.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "b", "4.txt"), 10)
+
+	names := func(files map[string]int64) string {
+		var res []string
+		for p := range files {
+			rel, _ := filepath.Rel(s.FolderPath, p)
+			res = append(res, filepath.ToSlash(rel))
+		}
+		sort.Strings(res)
+		return strings.Join(res, ",")
+	}
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(files); got != "a/1.txt,a/2.txt,b/3.txt,b/4.txt" {
+		t.Fatalf("resumed walk = %s", got)
+	}
+	err = s.UpdateManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err = s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(files); got != "a/1.txt,a/2.txt,a/late.txt,b/3.txt,b/4.txt" {
+		t.Fatalf("walk after manifest update = %s", got)
+	}
+}
+
+func TestCloseRemovesLeftoverPieces(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	p := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(p, 1500)
+	info, _ := os.Stat(p)
+	pieces, _, err := s.splitObject(context.Background(), p, "big.bin", info, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(pieces[0])
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("split folder %s survived Close", dir)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestNoSplit(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.NoSplit = true
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	big := filepath.Join(s.FolderPath, "big.bin")
+	small := filepath.Join(s.FolderPath, "small.bin")
+	writeFixture(big, 1500)
+	writeFixture(small, 500)
+
+	err := s.putObject(context.Background(), big, "big.bin", types.StorageClassStandard)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("err = %v, want ErrTooLarge", err)
+	}
+	err = s.putObject(context.Background(), small, "small.bin", types.StorageClassStandard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(store.keys(), ","); got != "small.bin" {
+		t.Fatalf("keys = %s", got)
+	}
+}
+
+func TestSkipLargerThan(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.SkipLargerThan = 1000
+	writeFixture(filepath.Join(s.FolderPath, "small.bin"), 1000)
+	writeFixture(filepath.Join(s.FolderPath, "vm.img"), 1001)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "small.bin" {
+		t.Fatalf("keys = %s", got)
+	}
+	if got := s.Oversize(); len(got) != 1 || filepath.Base(got[0]) != "vm.img" {
+		t.Fatalf("oversize = %v", got)
+	}
+}
+
+func TestTransition(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	for _, name := range []string{"old/a.txt", "old/b.txt", "old/frozen.txt", "old/thawed.txt", "new/c.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, filepath.FromSlash(name)), 10)
+	}
+	syncOnce(t, s)
+	for _, key := range []string{"old/frozen.txt", "old/thawed.txt"} {
+		obj := store.objects[key]
+		obj.info.StorageClass = string(types.StorageClassGlacier)
+		obj.info.Restored = key == "old/thawed.txt"
+		store.objects[key] = obj
+	}
+	store.SetStorageClass(context.Background(), "old/b.txt", string(types.StorageClassDeepArchive))
+
+	report, err := s.Transition(context.Background(), "old/", types.StorageClassDeepArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(report.Moved, ","); got != "old/a.txt,old/thawed.txt" {
+		t.Fatalf("moved = %s", got)
+	}
+	if got := strings.Join(report.NeedsRestore, ","); got != "old/frozen.txt" {
+		t.Fatalf("needs restore = %s", got)
+	}
+	if got := strings.Join(report.Unchanged, ","); got != "old/b.txt" {
+		t.Fatalf("unchanged = %s", got)
+	}
+	if class := store.objects["new/c.txt"].info.StorageClass; class == string(types.StorageClassDeepArchive) {
+		t.Fatalf("object outside the prefix was moved")
+	}
+	class, err := s.recordedClass("old/a.txt")
+	if err != nil || class != types.StorageClassDeepArchive {
+		t.Fatalf("recorded class = %s, %v", class, err)
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hardlinks are not detected on windows")
+	}
+	s, store := newStoreSyncer(t)
+	s.Hardlinks = true
+	a := filepath.Join(s.FolderPath, "a.bin")
+	b := filepath.Join(s.FolderPath, "b.bin")
+	d := filepath.Join(s.FolderPath, "c", "d.bin")
+	writeFixture(a, 100)
+	os.MkdirAll(filepath.Dir(d), 0755)
+	os.Link(a, b)
+	os.Link(a, d)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "a.bin" {
+		t.Fatalf("keys = %s", got)
+	}
+
+	out := t.TempDir()
+	for _, p := range []string{b, d} {
+		err := s.Download(context.Background(), p, filepath.Join(out, filepath.Base(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, _ := os.Stat(filepath.Join(out, "b.bin"))
+	second, _ := os.Stat(filepath.Join(out, "d.bin"))
+	if !os.SameFile(first, second) || first.Size() != 100 {
+		t.Fatalf("downloaded hardlinks were not linked again")
+	}
+
+	// once a.bin is gone b.bin is the first path and needs its own object
+	os.Remove(a)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "a.bin,b.bin" {
+		t.Fatalf("keys after removing a.bin = %s", got)
+	}
+}
+
+func TestUploadErrorKind(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	p := filepath.Join(s.FolderPath, "a.txt")
+	writeFixture(p, 10)
+	store.failPut = func(key string) error { return &smithy.GenericAPIError{Code: "AccessDenied"} }
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) || uploadErr.Path != p || !errors.Is(err, ErrPermission) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	upper := func(p string, r io.Reader) (io.Reader, string, error) {
+		data, err := io.ReadAll(r)
+		return bytes.NewReader(bytes.ToUpper(data)), "", err
+	}
+	rename := func(p string, r io.Reader) (io.Reader, string, error) {
+		return r, "clean/" + filepath.Base(p), nil
+	}
+	s.Transform = ChainTransforms(upper, rename)
+	small := filepath.Join(s.FolderPath, "small.txt")
+	big := filepath.Join(s.FolderPath, "big.txt")
+	os.MkdirAll(s.FolderPath, 0755)
+	os.WriteFile(small, []byte("hello"), 0644)
+	os.WriteFile(big, bytes.Repeat([]byte("abc"), 500), 0644)
+	syncOnce(t, s)
+
+	if got := strings.Join(store.keys(), ","); got != "clean/big.txt.part0,clean/big.txt.part1,clean/small.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+	if got := string(store.objects["clean/small.txt"].data); got != "HELLO" {
+		t.Fatalf("small.txt went up as %q", got)
+	}
+	dest := filepath.Join(t.TempDir(), "big.txt")
+	err := s.Download(context.Background(), big, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(dest)
+	if !bytes.Equal(got, bytes.Repeat([]byte("ABC"), 500)) {
+		t.Fatalf("big.txt came back as %d bytes", len(got))
+	}
+	report, err := s.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing)+len(report.Mismatched) != 0 || report.Err() != nil || report.OK() != report.Checked {
+		t.Fatalf("verify = %+v", report)
+	}
+}
+
+func TestLargeFileProgress(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	s.LargeFile = 2000
+	small := filepath.Join(s.FolderPath, "small.bin")
+	big := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(small, 100)
+	writeFixture(big, 3000)
+	events := make(chan ProgressEvent, 100)
+	s.Progress = events
+	syncOnce(t, s)
+	close(events)
+	var sent int64
+	for ev := range events {
+		switch {
+		case ev.Type == FileStarted && ev.Path == big && ev.Size != 3000:
+			t.Fatalf("FileStarted size = %d", ev.Size)
+		case ev.Type == BytesProgress && ev.Path == small:
+			t.Fatalf("small file reported byte progress")
+		case ev.Type == BytesProgress && ev.Path == big:
+			sent = ev.Bytes
+		}
+	}
+	if sent != 3000 {
+		t.Fatalf("bytes reported for big.bin = %d", sent)
+	}
+}
+
+func TestMultipartProgress(t *testing.T) {
+	for _, resumable := range []bool{false, true} {
+		s, mem := newStoreSyncer(t)
+		if resumable {
+			s.Store = &resumableStore{memStore: mem, uploads: map[string]*memUpload{}}
+		}
+		s.NativeMultipart = true
+		s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+		big := filepath.Join(s.FolderPath, "big.bin")
+		writeFixture(big, 2500)
+		events := make(chan ProgressEvent, 100)
+		s.Progress = events
+		syncOnce(t, s)
+		close(events)
+		var sent []int64
+		for ev := range events {
+			if ev.Type == BytesProgress && ev.Path == big {
+				if ev.Size != 2500 {
+					t.Fatalf("resumable %v: BytesProgress size = %d", resumable, ev.Size)
+				}
+				sent = append(sent, ev.Bytes)
+			}
+		}
+		if len(sent) == 0 || sent[len(sent)-1] != 2500 || !slices.IsSorted(sent) {
+			t.Fatalf("resumable %v: bytes reported for big.bin = %v", resumable, sent)
+		}
+	}
+}
+
+func TestTransformProgress(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.LargeFile = 1
+	// shrink.bin halves like a compressed file, grow.bin doubles and only needs splitting once transformed
+	s.Transform = func(p string, r io.Reader) (io.Reader, string, error) {
+		data, err := io.ReadAll(r)
+		if filepath.Base(p) == "grow.bin" {
+			return bytes.NewReader(append(data, data...)), "", err
+		}
+		return bytes.NewReader(data[:len(data)/2]), "", err
+	}
+	shrink := filepath.Join(s.FolderPath, "shrink.bin")
+	grow := filepath.Join(s.FolderPath, "grow.bin")
+	writeFixture(shrink, 1500)
+	writeFixture(grow, 600)
+	events := make(chan ProgressEvent, 100)
+	s.Progress = events
+	syncOnce(t, s)
+	close(events)
+
+	if got := strings.Join(store.keys(), ","); got != "grow.bin.part0,grow.bin.part1,shrink.bin" {
+		t.Fatalf("keys = %s", got)
+	}
+	sent := map[string]ProgressEvent{}
+	for ev := range events {
+		if ev.Type == BytesProgress {
+			sent[ev.Path] = ev
+		}
+	}
+	for p, size := range map[string]int64{shrink: 1500, grow: 600} {
+		if ev := sent[p]; ev.Bytes != size || ev.Size != size {
+			t.Fatalf("%s reported %d of %d bytes", filepath.Base(p), ev.Bytes, ev.Size)
+		}
+	}
+}
+
+func TestContentOnly(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.ContentOnly = true
+	touched := filepath.Join(s.FolderPath, "touched.txt")
+	sneaky := filepath.Join(s.FolderPath, "sneaky.txt")
+	writeFixture(touched, 100)
+	writeFixture(sneaky, 100)
+	syncOnce(t, s)
+
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(touched, later, later)
+	// edited in place with the old modification time put back, only the hash can tell
+	info, _ := os.Stat(sneaky)
+	writeFixture(sneaky, 100)
+	os.Chtimes(sneaky, info.ModTime(), info.ModTime())
+
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncOnce(t, s)
+	if strings.Join(puts, ",") != "sneaky.txt" {
+		t.Fatalf("uploaded %v, want only sneaky.txt", puts)
+	}
+}
+
+func TestHashMode(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	dbpath := filepath.Join(filepath.Dir(s.FolderPath), "manifest.db")
+	s.Close()
+	s.Checksum = Checksum{}
+	s.HashMode = HashETag
+	err := s.InitDb(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sneaky := filepath.Join(s.FolderPath, "sneaky.txt")
+	writeFixture(sneaky, 100)
+	writeFixture(filepath.Join(s.FolderPath, "same.txt"), 100)
+	syncOnce(t, s)
+	if s.checksum().Name != "etag" {
+		t.Fatalf("hashed with %s", s.checksum().Name)
+	}
+	info, _ := os.Stat(sneaky)
+	writeFixture(sneaky, 100)
+	os.Chtimes(sneaky, info.ModTime(), info.ModTime())
+
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncOnce(t, s)
+	if strings.Join(puts, ",") != "sneaky.txt" {
+		t.Fatalf("uploaded %v, want only sneaky.txt", puts)
+	}
+
+	s.Checksum = SHA512
+	if err := s.initHashMode(); err == nil {
+		t.Fatal("etag hash mode was taken with a sha512 checksum")
+	}
+	if _, err := ParseHashMode("ctime"); err == nil {
+		t.Fatal("an unknown hash mode was taken")
+	}
+}
+
+func TestETagChecksum(t *testing.T) {
+	data := bytes.Repeat([]byte("s3sync"), 10)
+	one := md5.Sum(data)
+	h := newETagHash(16)
+	h.Write(data)
+	first, second := md5.Sum(data[:16]), md5.Sum(data[16:32])
+	third, last := md5.Sum(data[32:48]), md5.Sum(data[48:])
+	want := md5.Sum(bytes.Join([][]byte{first[:], second[:], third[:], last[:]}, nil))
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("the multipart sum isn't the MD5 of the part MD5s")
+	}
+	// written in odd sizes it comes out the same, and a single part is the plain MD5
+	h.Reset()
+	for i := 0; i < len(data); i += 7 {
+		h.Write(data[i:min(i+7, len(data))])
+	}
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("the sum depends on how the content was written")
+	}
+	h = newETagHash(1 << 20)
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), one[:]) {
+		t.Fatal("a single part isn't summed as its MD5")
+	}
+}
+
+func TestSkewedModTime(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	future := filepath.Join(s.FolderPath, "future.txt")
+	past := filepath.Join(s.FolderPath, "past.txt")
+	writeFixture(future, 100)
+	writeFixture(past, 100)
+	ahead := time.Now().Add(48 * time.Hour)
+	os.Chtimes(future, ahead, ahead)
+	syncOnce(t, s)
+	if strings.Join(s.Skewed(), ",") != future {
+		t.Fatalf("first sync flagged %v", s.Skewed())
+	}
+
+	// the clock went back: past.txt is touched to before its recorded time, future.txt is rewritten
+	// by a copy that keeps its time
+	behind := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(past, behind, behind)
+	writeFixture(future, 100)
+	os.Chtimes(future, ahead, ahead)
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncOnce(t, s)
+	skewed := s.Skewed()
+	slices.Sort(skewed)
+	if len(puts) != 0 || strings.Join(skewed, ",") != future+","+past {
+		t.Fatalf("uploaded %v and flagged %v, want nothing uploaded and both flagged", puts, skewed)
+	}
+
+	s.HashSkewed = true
+	syncOnce(t, s)
+	if strings.Join(puts, ",") != "future.txt" {
+		t.Fatalf("with HashSkewed uploaded %v, want only future.txt", puts)
+	}
+}
+
+func TestStrictWalk(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	// a share that is not mounted
+	missing := filepath.Join(t.TempDir(), "share")
+	s.Sources = []Source{{FolderPath: s.FolderPath}, {FolderPath: missing}}
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil || len(files) != 1 {
+		t.Fatalf("lenient walk found %d files, %v", len(files), err)
+	}
+	s.StrictWalk = true
+	_, err = s.WalkAndHash(context.Background(), []string{""})
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("strict walk err = %v", err)
+	}
+}
+
+func TestUploadPending(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	for i := 0; i < 7; i++ {
+		writeFixture(filepath.Join(s.FolderPath, fmt.Sprintf("f%d.txt", i)), 10)
+	}
+	writeFixture(filepath.Join(s.FolderPath, "other", "x.txt"), 10)
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UpdateManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan ProgressEvent, 100)
+	s.Progress = events
+	err = s.UploadPending(context.Background(), 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.keys()) != 8 {
+		t.Fatalf("uploaded %v, want all 8 files", store.keys())
+	}
+	close(events)
+	last := ProgressEvent{}
+	for e := range events {
+		if e.Type == FileCompleted {
+			last = e
+		}
+	}
+	if last.Index != 8 || last.Total != 8 {
+		t.Fatalf("last file was %d of %d, want 8 of 8", last.Index, last.Total)
+	}
+	uploads, err := s.GetUploadList()
+	if err != nil || len(uploads) != 0 {
+		t.Fatalf("still pending %v, %v", uploads, err)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	var rules []HeaderRule
+	for _, v := range []string{"*:Cache-Control=no-cache", "*.css:Cache-Control=max-age=86400", "downloads/*.pdf:Content-Disposition=attachment", "*.css:Expires=24h"} {
+		r, err := ParseHeaderRule(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	s.Headers = HeaderRules(rules)
+	writeFixture(filepath.Join(s.FolderPath, "site.css"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "downloads", "manual.pdf"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "manual.pdf"), 10)
+	syncOnce(t, s)
+
+	css := store.objects["site.css"].headers
+	if css.CacheControl != "max-age=86400" || time.Until(css.Expires) < 23*time.Hour {
+		t.Fatalf("site.css headers = %+v", css)
+	}
+	if h := store.objects["downloads/manual.pdf"].headers; h.ContentDisposition != "attachment" || h.CacheControl != "no-cache" {
+		t.Fatalf("downloads/manual.pdf headers = %+v", h)
+	}
+	if h := store.objects["manual.pdf"].headers; h.ContentDisposition != "" {
+		t.Fatalf("manual.pdf outside downloads got %+v", h)
+	}
+	for _, bad := range []string{"*.css", "*.css:Content-Type=text/css", "*.css:Expires=soon", "[:Cache-Control=x"} {
+		if _, err := ParseHeaderRule(bad); err == nil {
+			t.Fatalf("ParseHeaderRule(%q) took it", bad)
+		}
+	}
+}
+
+func TestCustomMetadata(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.Metadata = map[string]string{"team": "web", "release": "2024.6"}
+	s.MetadataFunc = func(p string) map[string]string {
+		if filepath.Ext(p) == ".bin" {
+			return map[string]string{"release": "2024.7"}
+		}
+		return nil
+	}
+	r, err := ParseHeaderRule("*:Content-Language=de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Headers = HeaderRules([]HeaderRule{r})
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+
+	for _, key := range []string{"small.txt", "big.bin.part0", "big.bin.part1", "big.bin.part2"} {
+		obj, ok := store.objects[key]
+		if !ok {
+			t.Fatalf("%s wasn't uploaded, the bucket holds %v", key, store.keys())
+		}
+		release := "2024.6"
+		if strings.HasPrefix(key, "big.bin") {
+			release = "2024.7"
+		}
+		if obj.info.Metadata["team"] != "web" || obj.info.Metadata["release"] != release || obj.headers.ContentLanguage != "de" {
+			t.Fatalf("%s went up with metadata %v and headers %+v", key, obj.info.Metadata, obj.headers)
+		}
+	}
+
+	for _, bad := range []map[string]string{{"": "x"}, {"Team": "web"}, {"team name": "web"}, {MetaMode: "0644"}, {"note": "tab\there"}, {"note": "ünicode"}} {
+		if ValidateMetadata(bad) == nil {
+			t.Fatalf("ValidateMetadata(%v) took it", bad)
+		}
+	}
+	s.Metadata = map[string]string{"note": strings.Repeat("x", MaxMetadataSize)}
+	if err := s.addUserMetadata("small.txt", map[string]string{}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversize metadata gave %v", err)
+	}
+}
+
+func TestKMSEncryptionContext(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	rt := &recordingTransport{}
+	client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newStoreSyncer(t)
+	s.Store = nil
+	s.S3Client = client
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.KMSKeyID = "alias/backups"
+	s.KMSEncryptionContext = map[string]string{"project": "archive", "dept": "finance"}
+	err = s.ValidateEncryption(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+
+	want := "alias/backups " + base64.StdEncoding.EncodeToString([]byte(`{"dept":"finance","project":"archive"}`))
+	for _, key := range []string{preflightKey, "big.bin.part0", "big.bin.part1", "big.bin.part2"} {
+		if got := rt.puts["/"+key]; got != want {
+			t.Fatalf("%s went up with %q, want %q (all puts: %v)", key, got, want, rt.puts)
+		}
+	}
+
+	s.KMSEncryptionContext = map[string]string{"project": ""}
+	if s.ValidateEncryption(context.Background()) == nil {
+		t.Fatal("an empty context value was taken")
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	rt := &recordingTransport{}
+	client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newStoreSyncer(t)
+	s.Store = nil
+	s.S3Client = client
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.ServerSideEncryption = types.ServerSideEncryptionAes256
+	err = s.ValidateEncryption(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+	for _, key := range []string{preflightKey, "big.bin.part0", "big.bin.part1", "big.bin.part2"} {
+		if got := rt.sse["/"+key]; got != "AES256" || rt.puts["/"+key] != " " {
+			t.Fatalf("%s went up with %q and KMS %q", key, got, rt.puts["/"+key])
+		}
+	}
+
+	s.ServerSideEncryption, s.KMSKeyID = types.ServerSideEncryptionAwsKmsDsse, "alias/backups"
+	if mode, key, _ := s.store().(*S3Store).sse(); mode != types.ServerSideEncryptionAwsKmsDsse || key == nil || *key != "alias/backups" {
+		t.Fatalf("DSSE went out as %s with key %v", mode, key)
+	}
+	for _, bad := range []types.ServerSideEncryption{types.ServerSideEncryptionAes256, "aes"} {
+		s.ServerSideEncryption = bad
+		if s.ValidateEncryption(context.Background()) == nil {
+			t.Fatalf("%s with a KMS key was taken", bad)
+		}
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.MaxDuration = 300 * time.Millisecond
+	s.UploadOrder = OrderPath
+	writeFixture(filepath.Join(s.FolderPath, "a.bin"), 2500)
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "c.txt"), 20)
+	// the pieces of a.bin alone take longer than the window
+	store.failPut = func(key string) error {
+		time.Sleep(150 * time.Millisecond)
+		return nil
+	}
+	syncOnce(t, s)
+	if files, bytes := s.Remaining(); files != 2 || bytes != 30 {
+		t.Fatalf("left %d files of %d bytes, want 2 of 30", files, bytes)
+	}
+	if keys := strings.Join(store.keys(), ","); keys != "a.bin.part0,a.bin.part1,a.bin.part2" {
+		t.Fatalf("stopped with %s in the bucket", keys)
+	}
+	runs, err := s.RunHistory(1)
+	if err != nil || runs[0].Outcome != RunStopped {
+		t.Fatalf("run recorded as %+v, %v", runs, err)
+	}
+
+	s.MaxDuration = 0
+	syncOnce(t, s)
+	if files, _ := s.Remaining(); files != 0 || len(store.keys()) != 5 {
+		t.Fatalf("next run left %d files, the bucket holds %v", files, store.keys())
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.UploadOrder = OrderPath
+	s.MaxFilesPerRun = 2
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, name), 10)
+	}
+	syncOnce(t, s)
+	if files, bytes := s.Remaining(); files != 3 || bytes != 30 {
+		t.Fatalf("left %d files of %d bytes, want 3 of 30", files, bytes)
+	}
+	if cursor, err := s.BatchCursor(); err != nil || filepath.Base(cursor) != "b.txt" {
+		t.Fatalf("cursor = %q, %v", cursor, err)
+	}
+
+	// the next batch goes on from the files still pending, without a walk
+	s.MaxFilesPerRun, s.MaxBytesPerRun = 0, 25
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(store.keys(), ","); keys != "a.txt,b.txt,c.txt,d.txt" {
+		t.Fatalf("keys = %s", keys)
+	}
+	uploads, _ = s.GetUploadList()
+	err = s.UploadDiffs(context.Background(), uploads, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := s.Remaining(); files != 0 || len(store.keys()) != 5 {
+		t.Fatalf("last batch left %d files, the bucket holds %v", files, store.keys())
+	}
+	if cursor, _ := s.BatchCursor(); cursor != "" {
+		t.Fatalf("cursor = %q after the last batch", cursor)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1024}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncOnce(t, s)
+	ctx := context.Background()
+	report, err := s.Reconcile(ctx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Expected != 4 || report.Found != 4 || report.Err() != nil {
+		t.Fatalf("clean bucket reconciled as %+v", report)
+	}
+
+	store.Delete(ctx, "big.bin.part1")
+	store.Put(ctx, "stray.txt", strings.NewReader("x"), PutOptions{})
+	report, err = s.Reconcile(ctx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.Missing, ",") != "big.bin.part1" || strings.Join(report.Unexpected, ",") != "stray.txt" || !errors.Is(report.Err(), ErrReconcile) {
+		t.Fatalf("broken bucket reconciled as %+v", report)
+	}
+}
+
+func TestCommonFolder(t *testing.T) {
+	for _, tc := range []struct {
+		keys []string
+		want string
+	}{
+		{[]string{"host/a/x", "host/a/y/z"}, "host/a/"},
+		{[]string{"host/a/x", "host/b/y"}, "host/"},
+		{[]string{"host/a/x", "other"}, ""},
+		{nil, ""},
+	} {
+		keys := map[string]bool{}
+		for _, k := range tc.keys {
+			keys[k] = true
+		}
+		if got := commonFolder(keys); got != tc.want {
+			t.Fatalf("commonFolder(%v) = %q, want %q", tc.keys, got, tc.want)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	ctx := context.Background()
+	same := filepath.Join(s.FolderPath, "same.txt")
+	changed := filepath.Join(s.FolderPath, "changed.txt")
+	writeFixture(same, 10)
+	writeFixture(changed, 10)
+	first, _ := os.ReadFile(changed)
+	// KeyFunc bypasses objectKey, snapshots go through the default mapping
+	s.KeyFunc = nil
+	s.Snapshot = "2024-06-01T03:00:00Z"
+	syncOnce(t, s)
+	n, err := s.RecordSnapshot(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("first snapshot recorded %d files, %v", n, err)
+	}
+
+	writeFixture(changed, 20)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(changed, later, later)
+	s.Snapshot = "2024-06-02T03:00:00Z"
+	puts := 0
+	store.failPut = func(key string) error {
+		puts++
+		return nil
+	}
+	syncOnce(t, s)
+	_, err = s.RecordSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the changed file and the index, the unchanged file stays in the first snapshot
+	if puts != 2 {
+		t.Fatalf("second snapshot did %d puts, want 2", puts)
+	}
+	snaps, err := s.Snapshots()
+	if err != nil || len(snaps) != 2 || snaps[1].Files != 2 {
+		t.Fatalf("Snapshots() = %+v, %v", snaps, err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "restored.txt")
+	s.FromSnapshot = "2024-06-01T03:00:00Z"
+	err = s.Download(ctx, changed, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(dest)
+	if !bytes.Equal(got, first) {
+		t.Fatal("restored the changed file instead of the snapshot copy")
+	}
+
+	// deleting the file locally and purging keeps the objects the snapshots point at
+	objects := len(store.keys())
+	os.Remove(same)
+	s.Retention = time.Nanosecond
+	syncOnce(t, s)
+	time.Sleep(time.Millisecond)
+	_, err = s.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.keys()) != objects {
+		t.Fatalf("purge deleted snapshot objects, %d of %d left", len(store.keys()), objects)
+	}
+}
+
+func TestDeltaDownload(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	ctx := context.Background()
+	s.DeltaMode = true
+	s.DeltaBlockSize = 1024
+	p := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(p, 200*1024)
+	syncOnce(t, s)
+
+	content, _ := os.ReadFile(p)
+	for gen := 1; gen <= 2; gen++ {
+		content[1000*gen] ^= 0xff
+		os.WriteFile(p, content, 0644)
+		later := time.Now().Add(time.Duration(gen) * time.Hour)
+		os.Chtimes(p, later, later)
+		syncOnce(t, s)
+		if _, ok := store.objects[deltaKey("big.bin", gen)+".json"]; !ok {
+			t.Fatalf("generation %d was not uploaded as a patch, objects %v", gen, store.keys())
+		}
+
+		dest := filepath.Join(t.TempDir(), "big.bin")
+		s.restored = nil
+		err := s.Download(ctx, p, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(dest)
+		if !bytes.Equal(got, content) {
+			t.Fatalf("generation %d: downloaded the stale base instead of the patched file", gen)
+		}
+		if err = s.Prove(ctx, p, ProveOptions{Depth: ProveFull}); err != nil {
+			t.Fatalf("generation %d: %v", gen, err)
+		}
+	}
+
+	// a full upload starts the chain over
+	s.DeltaMode = false
+	writeFixture(p, 300*1024)
+	later := time.Now().Add(3 * time.Hour)
+	os.Chtimes(p, later, later)
+	syncOnce(t, s)
+	dest := filepath.Join(t.TempDir(), "big.bin")
+	s.restored = nil
+	err := s.Download(ctx, p, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(dest)
+	want, _ := os.ReadFile(p)
+	if !bytes.Equal(got, want) {
+		t.Fatal("a full upload after patches was downloaded with the old patches applied")
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	ctx := context.Background()
+	kept := filepath.Join(s.FolderPath, "kept.txt")
+	gone := filepath.Join(s.FolderPath, "gone.txt")
+	writeFixture(kept, 10)
+	writeFixture(gone, 10)
+	earlier := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(kept, earlier, earlier)
+	first, _ := os.ReadFile(kept)
+	s.KeyFunc = nil
+	s.Snapshot = "2024-06-01T03:00:00Z"
+	syncOnce(t, s)
+	_, err := s.RecordSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFixture(kept, 20)
+	os.Remove(gone)
+	s.Snapshot = "2024-06-02T03:00:00Z"
+	syncOnce(t, s)
+	_, err = s.RecordSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	report, err := s.RestoreSnapshot(ctx, "2024-06-01T03:00:00Z", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Restored) != 2 {
+		t.Fatalf("restored %v", report.Restored)
+	}
+	got, _ := os.ReadFile(filepath.Join(dest, "kept.txt"))
+	if !bytes.Equal(got, first) {
+		t.Fatal("restored the file as it is now instead of as it was in the snapshot")
+	}
+	if info, err := os.Stat(filepath.Join(dest, "kept.txt")); err != nil || !info.ModTime().Equal(earlier) {
+		t.Fatalf("modification time = %v, want %v", info.ModTime(), earlier)
+	}
+	if _, err = os.Stat(filepath.Join(dest, "gone.txt")); err != nil {
+		t.Fatal("the file deleted after the snapshot was not restored")
+	}
+	if s.FromSnapshot != "" {
+		t.Fatal("FromSnapshot was left set")
+	}
+	// a second restore finds the files there already
+	report, err = s.RestoreSnapshot(ctx, "2024-06-01T03:00:00Z", dest)
+	if err != nil || len(report.Unchanged) != 2 {
+		t.Fatalf("second restore = %+v, %v", report, err)
+	}
+	if _, err = s.RestoreSnapshot(ctx, "2023-01-01T00:00:00Z", dest); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unknown snapshot: %v", err)
+	}
+}
+
+func TestProve(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassDeepArchive: 1024}
+	p := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(p, 2500)
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err = s.UploadDiffs(context.Background(), uploads, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, depth := range []ProveDepth{ProveHead, ProveSample, ProveFull} {
+		err = s.Prove(ctx, p, ProveOptions{Depth: depth, SampleSize: 100})
+		if err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+	}
+	if store.restores != 3 {
+		t.Fatalf("restored %d parts, want 3", store.restores)
+	}
+
+	// the bytes changed in the bucket without the ETag moving, only reading them back can tell
+	obj := store.objects["big.bin.part2"]
+	obj.data = bytes.Repeat([]byte{'x'}, len(obj.data))
+	store.objects["big.bin.part2"] = obj
+	if err = s.Prove(ctx, p, ProveOptions{Depth: ProveHead}); err != nil {
+		t.Fatalf("head: %v", err)
+	}
+	for _, depth := range []ProveDepth{ProveSample, ProveFull} {
+		err = s.Prove(ctx, p, ProveOptions{Depth: depth})
+		if !errors.Is(err, ErrUnproven) {
+			t.Fatalf("depth %d on a corrupt part: %v", depth, err)
+		}
+	}
+	store.Delete(ctx, "big.bin.part0")
+	if err = s.Prove(ctx, p, ProveOptions{Depth: ProveHead}); !errors.Is(err, ErrUnproven) {
+		t.Fatalf("head on a missing part: %v", err)
+	}
+}
+
+func TestStartAfter(t *testing.T) {
+	for _, paged := range []bool{false, true} {
+		s, store := newStoreSyncer(t)
+		for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+			writeFixture(filepath.Join(s.FolderPath, name), 10)
+		}
+		files, err := s.WalkAndHash(context.Background(), []string{""})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.UpdateManifest(files)
+		s.StartAfter = filepath.Join(s.FolderPath, "b.txt")
+		if paged {
+			err = s.UploadPending(context.Background(), 1, false)
+		} else {
+			uploads, _ := s.GetUploadList()
+			err = s.UploadDiffs(context.Background(), uploads, false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(store.keys(), ","); got != "c.txt,d.txt" {
+			t.Fatalf("paged %v uploaded %s, want c.txt,d.txt", paged, got)
+		}
+		pending, _ := s.GetUploadList()
+		if len(pending) != 2 {
+			t.Fatalf("paged %v left %v pending, want a.txt and b.txt", paged, pending)
+		}
+	}
+}
+
+func TestSparse(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.Sparse = true
+	p := filepath.Join(s.FolderPath, "disk.img")
+	os.MkdirAll(s.FolderPath, 0755)
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(8 << 20)
+	f.WriteAt(bytes.Repeat([]byte{1}, 4096), 0)
+	f.WriteAt(bytes.Repeat([]byte{2}, 4096), 4<<20)
+	f.Close()
+	info, _ := os.Stat(p)
+	if extents, _ := sparseExtents(p, info); extents == nil {
+		t.Skip("no holes on this file system")
+	}
+	syncOnce(t, s)
+	obj := store.objects["disk.img"]
+	if len(obj.data) != 8192 || obj.info.Metadata[MetaSparse] == "" {
+		t.Fatalf("uploaded %d bytes with layout %q", len(obj.data), obj.info.Metadata[MetaSparse])
+	}
+
+	dest := filepath.Join(t.TempDir(), "disk.img")
+	err = s.Download(context.Background(), p, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(p)
+	got, _ := os.ReadFile(dest)
+	if !bytes.Equal(got, want) {
+		t.Fatal("the restored image differs")
+	}
+	restored, _ := os.Stat(dest)
+	if blocks, ok := allocated(restored); ok && blocks*512 >= restored.Size() {
+		t.Fatalf("the restored image is not sparse, %d blocks", blocks)
+	}
+}
+
+func TestSparseLayout(t *testing.T) {
+	extents := []extent{{0, 4096}, {8192, 100}, {1 << 20, 10}}
+	size, got, err := decodeSparse(encodeSparse(2<<20, extents))
+	if err != nil || size != 2<<20 || len(got) != 3 || got[1] != extents[1] {
+		t.Fatalf("round trip gave %d %v %v", size, got, err)
+	}
+	if merged := mergeExtents(extents, 8192); len(merged) != 2 || merged[0] != (extent{0, 8292}) {
+		t.Fatalf("mergeExtents = %v", merged)
+	}
+}
+
+func TestRunLabel(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.RunLabel = "weekly-2024w23"
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	syncOnce(t, s)
+	obj := store.objects["a.txt"]
+	if obj.info.Metadata[MetaRunLabel] != "weekly-2024w23" || obj.tags[TagRunLabel] != "weekly-2024w23" {
+		t.Fatalf("object went up with metadata %v and tags %v", obj.info.Metadata, obj.tags)
+	}
+	runs, err := s.RunHistory(1)
+	if err != nil || len(runs) != 1 || runs[0].Label != "weekly-2024w23" {
+		t.Fatalf("RunHistory = %+v, %v", runs, err)
+	}
+}
+
+func TestClassRules(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.StorageClass = types.StorageClassStandardIa
+	for _, v := range []string{"GLACIER:age>90d", "glacier_ir:size>1K,size<1M"} {
+		rule, err := ParseClassRule(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ClassRules = append(s.ClassRules, rule)
+	}
+	old := filepath.Join(s.FolderPath, "old.txt")
+	writeFixture(old, 10)
+	long := time.Now().Add(-100 * 24 * time.Hour)
+	os.Chtimes(old, long, long)
+	writeFixture(filepath.Join(s.FolderPath, "mid.bin"), 4096)
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	syncOnce(t, s)
+
+	for key, want := range map[string]types.StorageClass{"old.txt": types.StorageClassGlacier, "mid.bin": types.StorageClassGlacierIr, "small.txt": types.StorageClassStandardIa} {
+		if got := store.objects[key].info.StorageClass; got != string(want) {
+			t.Fatalf("%s went up in %s, want %s", key, got, want)
+		}
+	}
+	for _, bad := range []string{"GLACIER", "COLD:age>1d", "GLACIER:age>soon", "GLACIER:mtime>1d"} {
+		if _, err := ParseClassRule(bad); err == nil {
+			t.Fatalf("ParseClassRule(%q) took it", bad)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.Compression = CompressionGzip
+	text := filepath.Join(s.FolderPath, "notes.txt")
+	photo := filepath.Join(s.FolderPath, "photo.jpg")
+	os.MkdirAll(s.FolderPath, 0755)
+	os.WriteFile(text, bytes.Repeat([]byte("hello world "), 1000), 0644)
+	writeFixture(photo, 1000)
+	syncOnce(t, s)
+
+	obj := store.objects["notes.txt"]
+	if obj.info.Metadata[MetaCompression] != CompressionGzip || len(obj.data) >= 12000 {
+		t.Fatalf("notes.txt uploaded as %d bytes with %v", len(obj.data), obj.info.Metadata)
+	}
+	if _, ok := store.objects["photo.jpg"].info.Metadata[MetaCompression]; ok {
+		t.Fatal("photo.jpg was compressed")
+	}
+	for _, p := range []string{text, photo} {
+		dest := filepath.Join(t.TempDir(), filepath.Base(p))
+		err := s.Download(context.Background(), p, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(dest)
+		want, _ := os.ReadFile(p)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: downloaded %d bytes, want %d", p, len(got), len(want))
+		}
+	}
+
+	// compressed before it is encrypted
+	s.EncryptionKey = bytes.Repeat([]byte{7}, 32)
+	os.WriteFile(text, bytes.Repeat([]byte("hello again "), 1100), 0644)
+	os.Chtimes(text, time.Now(), time.Now().Add(time.Hour))
+	syncOnce(t, s)
+	obj = store.objects["notes.txt"]
+	if obj.info.Metadata[MetaCipher] == "" || len(obj.data) >= 12000 {
+		t.Fatalf("notes.txt uploaded as %d bytes with %v", len(obj.data), obj.info.Metadata)
+	}
+	s.restored = nil
+	dest := filepath.Join(t.TempDir(), "notes.txt")
+	err := s.Download(context.Background(), text, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.HasPrefix(got, []byte("hello again")) || len(got) != 13200 {
+		t.Fatalf("downloaded %d bytes", len(got))
+	}
+
+	if _, err := ParseCompression("zip"); err == nil {
+		t.Fatal("zip accepted")
+	}
+}
+
+func TestTagsAndContentType(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.RunLabel = "nightly"
+	s.Tags = map[string]string{"team": "media", "retention": "long"}
+	s.TagsFunc = func(p string) map[string]string {
+		if filepath.Ext(p) == ".html" {
+			return map[string]string{"retention": "short"}
+		}
+		return nil
+	}
+	s.DetectContentType = true
+	writeFixture(filepath.Join(s.FolderPath, "index.html"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "data.unknownext"), 10)
+	syncOnce(t, s)
+
+	html := store.objects["index.html"]
+	if html.tags["team"] != "media" || html.tags["retention"] != "short" || html.tags[TagRunLabel] != "nightly" {
+		t.Fatalf("index.html tags = %v", html.tags)
+	}
+	if !strings.HasPrefix(html.headers.ContentType, "text/html") {
+		t.Fatalf("index.html Content-Type = %q", html.headers.ContentType)
+	}
+	data := store.objects["data.unknownext"]
+	if data.tags["retention"] != "long" || data.headers.ContentType != "" {
+		t.Fatalf("data.unknownext went up with tags %v and headers %+v", data.tags, data.headers)
+	}
+	for _, bad := range []map[string]string{{"": "x"}, {"aws:owner": "x"}, {TagRunLabel: "x"}, {"k": strings.Repeat("v", 257)}} {
+		if err := ValidateTags(bad); err == nil {
+			t.Fatalf("ValidateTags(%v) took it", bad)
+		}
+	}
+}
+
+func TestBuildManifestFromBucket(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1024}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 12*1024)
+	writeFixture(filepath.Join(s.FolderPath, "edited.txt"), 10)
+	syncOnce(t, s)
+	writeFixture(filepath.Join(s.FolderPath, "edited.txt"), 20)
+	store.Put(context.Background(), "gone.txt", strings.NewReader("x"), PutOptions{Metadata: map[string]string{MetaSrcPath: "gone.txt"}})
+
+	// the manifest is lost, a fresh one is built from the bucket
+	fresh, _ := newStoreSyncer(t)
+	fresh.Store = store
+	fresh.FolderPath = s.FolderPath
+	fresh.PutLimits = s.PutLimits
+	report, err := fresh.BuildManifestFromBucket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Adopted) != 2 || len(report.Pending) != 1 || len(report.Missing) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncOnce(t, fresh)
+	if strings.Join(puts, ",") != "edited.txt" {
+		t.Fatalf("the sync after adopting uploaded %v, want only edited.txt", puts)
+	}
+	dest := filepath.Join(t.TempDir(), "big.bin")
+	err = fresh.Download(context.Background(), filepath.Join(s.FolderPath, "big.bin"), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(filepath.Join(s.FolderPath, "big.bin"))
+	got, _ := os.ReadFile(dest)
+	if !bytes.Equal(got, want) {
+		t.Fatal("the adopted split file doesn't download in order")
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	keys := []string{"a.part10", "a.part2", "a.part1", "a.part0"}
+	sort.Slice(keys, func(i, j int) bool { return naturalLess(keys[i], keys[j]) })
+	if strings.Join(keys, ",") != "a.part0,a.part1,a.part2,a.part10" {
+		t.Fatalf("sorted %v", keys)
+	}
+}
+
+func TestStallTimeout(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.StallTimeout = 40 * time.Millisecond
+	s.StallRetries = 1
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 100)
+	store.stallPuts = 1
+	syncOnce(t, s)
+	if !bytes.Equal(store.objects["a.txt"].data, mustRead(t, filepath.Join(s.FolderPath, "a.txt"))) {
+		t.Fatal("the retried upload sent the wrong bytes")
+	}
+
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 100)
+	store.stallPuts = 2
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("err = %v, want ErrStalled once the retries ran out", err)
+	}
+}
+
+func mustRead(t *testing.T, p string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWriteChecksums(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.ChecksumFile = "SHA256SUMS"
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+	n, err := s.WriteChecksums(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("wrote %d checksums, want a.txt and 3 parts", n)
+	}
+	// every line must check out against the object it names, like sha256sum -c would
+	lines := strings.Split(strings.TrimSpace(string(store.objects["SHA256SUMS"].data)), "\n")
+	if len(lines) != n {
+		t.Fatalf("checksum file = %q", store.objects["SHA256SUMS"].data)
+	}
+	for _, l := range lines {
+		sum, key, ok := strings.Cut(l, "  ")
+		obj, found := store.objects[key]
+		if !ok || !found {
+			t.Fatalf("line %q doesn't name an object", l)
+		}
+		got := sha256.Sum256(obj.data)
+		if hex.EncodeToString(got[:]) != sum {
+			t.Fatalf("line %q doesn't match %s", l, key)
+		}
+	}
+}
+
+func TestChecksumAlgorithm(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	dbpath := filepath.Join(filepath.Dir(s.FolderPath), "manifest.db")
+	s.Close()
+	s.Checksum = CRC64
+	err := s.InitDb(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ChecksumFile = "SUMS"
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+	n, err := s.WriteChecksums(context.Background())
+	if err != nil || n != 4 {
+		t.Fatalf("wrote %d checksums, %v", n, err)
+	}
+	for _, l := range strings.Split(strings.TrimSpace(string(store.objects["SUMS"].data)), "\n") {
+		var key, sum string
+		_, err := fmt.Sscanf(l, "CRC64 (%s = %s", &key, &sum)
+		key = strings.TrimSuffix(key, ")")
+		obj, found := store.objects[key]
+		if err != nil || !found {
+			t.Fatalf("line %q doesn't name an object", l)
+		}
+		h := CRC64.New()
+		h.Write(obj.data)
+		if hex.EncodeToString(h.Sum(nil)) != sum {
+			t.Fatalf("line %q doesn't match %s", l, key)
+		}
+	}
+
+	// the manifest holds crc64 sums now, another checksum can't read them and no checksum takes them
+	s.Close()
+	s.Checksum = SHA256
+	if err := s.InitDb(dbpath); err == nil {
+		t.Fatal("opened crc64 sums as sha256")
+	}
+	s.Close()
+	s.Checksum = Checksum{}
+	err = s.InitDb(dbpath)
+	if err != nil || s.checksum().Name != "crc64" {
+		t.Fatalf("reopened with %s, %v", s.checksum().Name, err)
+	}
+	report, err := s.Fsck(context.Background(), []string{""})
+	if err != nil || len(report.Corrupt) != 0 {
+		t.Fatalf("fsck found %+v, %v", report, err)
+	}
+	if _, err := ParseChecksum("md5"); err == nil {
+		t.Fatal("ParseChecksum took md5")
+	}
+}
+
+func TestFilePause(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	s.FilePause = 30 * time.Millisecond
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, name), 10)
+	}
+	start := time.Now()
+	syncOnce(t, s)
+	// a pause between each two files, none after the last
+	if took := time.Since(start); took < 2*s.FilePause {
+		t.Fatalf("sync took %s", took)
+	}
+
+	writeFixture(filepath.Join(s.FolderPath, "d.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "e.txt"), 10)
+	s.FilePause = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	if err := s.UploadDiffs(ctx, uploads, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the pause cut short", err)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PreserveXattrs = true
+	small := filepath.Join(s.FolderPath, "tagged.txt")
+	big := filepath.Join(s.FolderPath, "lightroom.dng")
+	writeFixture(small, 10)
+	writeFixture(big, 10)
+	setXattr(small, "user.color", []byte("red"))
+	setXattr(big, "user.develop", bytes.Repeat([]byte("x"), 2000))
+	if attrs, _ := listXattrs(big); len(attrs) == 0 {
+		t.Skip("no extended attributes on this filesystem")
+	}
+	syncOnce(t, s)
+	if store.objects["tagged.txt"].info.Metadata[MetaXattrs] == "" {
+		t.Fatal("small attributes should be in the metadata")
+	}
+	if _, ok := store.objects[xattrKey("lightroom.dng")]; !ok {
+		t.Fatalf("big attributes should be in a sidecar, have %v", store.keys())
+	}
+
+	for _, p := range []string{small, big} {
+		dest := filepath.Join(t.TempDir(), filepath.Base(p))
+		err := s.Download(context.Background(), p, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := listXattrs(p)
+		got, _ := listXattrs(dest)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s restored with %v, want %v", p, got, want)
+		}
+	}
+
+	keys, _ := s.remoteKeys(big)
+	if !slices.Contains(keys, xattrKey("lightroom.dng")) {
+		t.Fatalf("remote keys %v leave out the sidecar", keys)
+	}
+}
+
+func TestSplitBudget(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.SplitBudget = 5000
+	var files []string
+	for i := 0; i < 4; i++ {
+		p := filepath.Join(s.FolderPath, fmt.Sprintf("big%d.bin", i))
+		writeFixture(p, 2500+i)
+		files = append(files, p)
+	}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	syncOnce(t, s)
+	for i, p := range files {
+		want, _ := os.ReadFile(p)
+		var got []byte
+		for j := 0; j < 3; j++ {
+			got = append(got, store.objects[fmt.Sprintf("big%d.bin.part%d", i, j)].data...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s went up as %d bytes, want %d", p, len(got), len(want))
+		}
+	}
+	if s.presplits != nil {
+		t.Fatal("presplitter left running")
+	}
+
+	// pieces of a file that changed after it was split ahead are not used
+	s.presplitPage(context.Background(), files[:1], false)
+	done := s.presplits.splits[files[0]]
+	split := <-done
+	done <- split
+	touched := time.Now().Add(time.Hour)
+	os.Chtimes(files[0], touched, touched)
+	info, _ := os.Stat(files[0])
+	if _, _, ok := s.takePresplit(files[0], info); ok {
+		t.Fatal("took the pieces of a file that changed since")
+	}
+	s.stopPresplits()
+	if leftovers, _ := filepath.Glob(filepath.Join(os.TempDir(), "s3sync*", "big0.bin*")); len(leftovers) != 0 {
+		t.Fatalf("pieces left behind: %v", leftovers)
+	}
+}
+
+func TestPartConcurrency(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	s.PartConcurrency = 3
+	var mu sync.Mutex
+	var inFlight, most int
+	store.failPut = func(key string) error {
+		mu.Lock()
+		inFlight++
+		most = max(most, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	}
+	p := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(p, 5500)
+	syncOnce(t, s)
+	if most != 3 {
+		t.Fatalf("%d pieces went up at once, want 3", most)
+	}
+	var got []byte
+	for j := 0; j < 6; j++ {
+		got = append(got, store.objects[fmt.Sprintf("big.bin.part%d", j)].data...)
+	}
+	if !bytes.Equal(got, mustRead(t, p)) {
+		t.Fatalf("big.bin went up as %d bytes", len(got))
+	}
+}
+
+func TestPartConcurrencyAuto(t *testing.T) {
+	tune := func(serial bool) (int, int) {
+		s, store := newStoreSyncer(t)
+		s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 100}
+		s.PartConcurrency = 4
+		s.PartConcurrencyAuto = true
+		var mu, link sync.Mutex
+		var inFlight, most int
+		store.failPut = func(key string) error {
+			mu.Lock()
+			inFlight++
+			most = max(most, inFlight)
+			mu.Unlock()
+			// a link that carries one piece at a time gains nothing from more of them
+			if serial {
+				link.Lock()
+				defer link.Unlock()
+			}
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil
+		}
+		writeFixture(filepath.Join(s.FolderPath, "big.bin"), 4000)
+		syncOnce(t, s)
+		return s.TunedPartConcurrency(), most
+	}
+	if tuned, most := tune(false); tuned != 4 || most != 4 {
+		t.Fatalf("latency bound: tuned to %d with %d at once, want 4", tuned, most)
+	}
+	if tuned, _ := tune(true); tuned != 1 {
+		t.Fatalf("bandwidth bound: tuned to %d, want 1", tuned)
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	for _, name := range []string{"photo.jpg", "photo~1.jpg", "notes"} {
+		writeFixture(filepath.Join(s.FolderPath, name), len(name))
+	}
+	syncOnce(t, s)
+	writeFixture(filepath.Join(s.FolderPath, "Photo.JPG"), 1)
+	objs, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.caseCollisions(objs)
+	if err != nil || len(found) != 1 || len(found[0]) != 2 || found[0][0] != filepath.Join(s.FolderPath, "photo.jpg") {
+		t.Fatalf("found %v, %v", found, err)
+	}
+
+	s.RenameCollisions = true
+	syncOnce(t, s)
+	key, _ := s.recordedKey(filepath.Join(s.FolderPath, "Photo.JPG"))
+	if key != "Photo~2.JPG" || len(store.objects["Photo~2.JPG"].data) != 1 {
+		t.Fatalf("Photo.JPG is recorded as %q, keys = %v", key, store.keys())
+	}
+	if got := store.objects["photo.jpg"].data; len(got) != len("photo.jpg") {
+		t.Fatalf("the file already uploaded was moved, photo.jpg holds %d bytes", len(got))
+	}
+
+	// once renamed the files don't collide any more
+	found, err = s.caseCollisions(objs)
+	if err != nil || len(found) != 0 {
+		t.Fatalf("found %v, %v", found, err)
+	}
+}
+
+func TestValidateRestore(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	big := filepath.Join(s.FolderPath, "big.bin")
+	small := filepath.Join(s.FolderPath, "small.txt")
+	writeFixture(big, 2500)
+	writeFixture(small, 10)
+	syncOnce(t, s)
+	checks, err := s.ValidateRestore(context.Background(), []string{big, small, filepath.Join(s.FolderPath, "never.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checks[0].Restorable() || checks[0].Objects != 3 || checks[0].Size != 2500 {
+		t.Fatalf("big.bin = %+v", checks[0])
+	}
+	if !checks[1].Restorable() || checks[1].Objects != 1 || checks[1].Size != 10 {
+		t.Fatalf("small.txt = %+v", checks[1])
+	}
+	if checks[2].Restorable() {
+		t.Fatal("a file that was never synced is restorable")
+	}
+
+	store.mu.Lock()
+	delete(store.objects, "big.bin.part2")
+	obj := store.objects["big.bin.part1"]
+	obj.data = obj.data[:500]
+	obj.info.Size = 500
+	store.objects["big.bin.part1"] = obj
+	store.mu.Unlock()
+	checks, err = s.ValidateRestore(context.Background(), []string{big})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks[0].Problems) != 2 || !strings.Contains(checks[0].Problems[0], "holds 500 bytes") || !strings.Contains(checks[0].Problems[1], "part2 is missing") {
+		t.Fatalf("problems = %q", checks[0].Problems)
+	}
+
+	// pieces recorded out of line can't be put back together
+	s.db.Exec("update parts set byte_offset = 900 where idx = 1")
+	checks, _ = s.ValidateRestore(context.Background(), []string{big})
+	if !strings.Contains(strings.Join(checks[0].Problems, "; "), "piece 1 starts at byte 900, not 1000") {
+		t.Fatalf("problems = %q", checks[0].Problems)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for the spinner goroutines to write to.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestOutput(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	out, errs := &lockedBuffer{}, &lockedBuffer{}
+	s.NoSpinners = false
+	s.Output, s.ErrOutput = out, errs
+	writeFixture(filepath.Join(s.FolderPath, "ok.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, " odd.txt"), 10)
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	syncOnce(t, s)
+	os.Stdout = stdout
+	w.Close()
+	leaked, _ := io.ReadAll(r)
+	if len(leaked) != 0 {
+		t.Fatalf("wrote %q to stdout", leaked)
+	}
+	if !strings.Contains(out.String(), "Successfully uploaded file") || strings.Contains(out.String(), "hard to get back") {
+		t.Fatalf("output = %q", out.String())
+	}
+	if !strings.Contains(errs.String(), "hard to get back") {
+		t.Fatalf("errors = %q", errs.String())
+	}
+}
+
+func TestReporter(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	out := &lockedBuffer{}
+	s.NoSpinners = false
+	s.Reporter = JSONReporter{W: out}
+	writeFixture(filepath.Join(s.FolderPath, "ok.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, " odd.txt"), 10)
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	syncOnce(t, s)
+	os.Stdout = stdout
+	w.Close()
+	leaked, _ := io.ReadAll(r)
+	if len(leaked) != 0 {
+		t.Fatalf("wrote %q to stdout", leaked)
+	}
+	seen := map[string]int{}
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var ev jsonEvent
+		if err := json.Unmarshal([]byte(l), &ev); err != nil {
+			t.Fatalf("line %q: %v", l, err)
+		}
+		seen[ev.Type]++
+		if ev.Type == "warning" && (!strings.Contains(ev.Message, "hard to get back") || strings.Contains(ev.Message, "\x1b")) {
+			t.Fatalf("warning = %q", ev.Message)
+		}
+	}
+	if seen["file_started"] != 2 || seen["file_completed"] != 2 || seen["warning"] == 0 {
+		t.Fatalf("events = %v", seen)
+	}
+
+	logged := &lockedBuffer{}
+	s.Reporter = LogReporter{Logger: log.New(logged, "", 0)}
+	writeFixture(filepath.Join(s.FolderPath, "ok.txt"), 20)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(s.FolderPath, "ok.txt"), later, later)
+	syncOnce(t, s)
+	if !strings.Contains(logged.String(), "uploaded "+filepath.Join(s.FolderPath, "ok.txt")+"\n") {
+		t.Fatalf("log = %q", logged.String())
+	}
+
+	records := &lockedBuffer{}
+	s.Reporter = SlogReporter{Logger: slog.New(slog.NewJSONHandler(records, nil))}
+	writeFixture(filepath.Join(s.FolderPath, "ok.txt"), 30)
+	later = later.Add(time.Hour)
+	os.Chtimes(filepath.Join(s.FolderPath, "ok.txt"), later, later)
+	syncOnce(t, s)
+	var completed bool
+	for _, l := range strings.Split(strings.TrimSpace(records.String()), "\n") {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(l), &rec); err != nil {
+			t.Fatalf("record %q: %v", l, err)
+		}
+		completed = completed || rec["event"] == "file_completed" && rec["path"] == filepath.Join(s.FolderPath, "ok.txt")
+	}
+	if !completed {
+		t.Fatalf("records = %q", records.String())
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.KeepGoing = true
+	s.SkipLargerThan = 100
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 20)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 200)
+	store.failPut = func(key string) error {
+		if key == "b.txt" {
+			return ErrPermission
+		}
+		return nil
+	}
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+
+	var out bytes.Buffer
+	s.WriteSummary(&out, err)
+	var sum RunSummary
+	json.Unmarshal(out.Bytes(), &sum)
+	if sum.Scanned != 3 || sum.Skipped != 1 || sum.Uploaded != 1 || sum.Failed != 1 || sum.Bytes != 10 || sum.Outcome != RunFailed || sum.Run == 0 || sum.Error == "" {
+		t.Fatalf("summary = %s", out.String())
+	}
+
+	// a run with nothing to do still sums up
+	store.failPut = nil
+	syncOnce(t, s)
+	syncOnce(t, s)
+	if sum := s.Summary(nil); sum.Scanned != 3 || sum.Uploaded != 0 || sum.Bytes != 0 || sum.Outcome != RunSucceeded {
+		t.Fatalf("summary = %+v", sum)
+	}
+}
+
+func TestInventoryProgress(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	out := &lockedBuffer{}
+	s.NoSpinners = false
+	s.Output = out
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "sub", "b.txt"), 10)
+	_, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a walk this quick only prints its result, no spinner flickers by
+	if got := out.String(); !strings.Contains(got, "Found 2 local files.") || strings.Contains(got, "so far") {
+		t.Fatalf("output = %q", got)
+	}
+
+	inv := s.startInventory()
+	inv.shown = time.Now().Add(-inventoryInterval)
+	inv.update("/data/photos", 1200)
+	if inv.spinner == nil || !strings.Contains(inv.spinner.Text, "1200 so far, in /data/photos") {
+		t.Fatalf("spinner = %+v", inv.spinner)
+	}
+	// the next update waits its turn
+	inv.update("/data/videos", 1300)
+	if strings.Contains(inv.spinner.Text, "videos") {
+		t.Fatalf("updated again right away to %q", inv.spinner.Text)
+	}
+	inv.success("Found 1300 local files.")
+}
+
+func TestEstimateRestore(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	s.StorageClass = types.StorageClassDeepArchive
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassDeepArchive: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	syncOnce(t, s)
+
+	est, err := s.EstimateRestore(nil, "", types.TierBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0.0025*2510/(1<<30) + 4*0.025/1000
+	if est.Objects != 4 || est.Bytes != 2510 || math.Abs(est.Cost-want) > 1e-12 || est.MaxTime != 48*time.Hour {
+		t.Fatalf("estimate = %+v, want cost %g", est, want)
+	}
+	est, err = s.EstimateRestore([]string{"big.bin"}, "", types.TierExpedited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Objects != 0 || len(est.Unsupported) != 3 {
+		t.Fatalf("deep archive expedited = %+v", est)
+	}
+
+	s.db.Exec("update etags set storage_class = 'STANDARD' where key = 'small.txt'")
+	est, _ = s.EstimateRestore([]string{"small.txt", "elsewhere.bin"}, "", types.TierStandard)
+	if len(est.Ready) != 1 || len(est.Unknown) != 1 || est.Objects != 0 {
+		t.Fatalf("estimate = %+v", est)
+	}
+}
+
+func TestOnlyNew(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.OnlyNew = true
+	old := filepath.Join(s.FolderPath, "DCIM0001.jpg")
+	writeFixture(old, 10)
+	syncOnce(t, s)
+
+	os.WriteFile(old, []byte("rewritten by a copy"), 0644)
+	touched := time.Now().Add(time.Hour)
+	os.Chtimes(old, touched, touched)
+	writeFixture(filepath.Join(s.FolderPath, "DCIM0002.jpg"), 20)
+	syncOnce(t, s)
+	if len(store.objects["DCIM0001.jpg"].data) != 10 {
+		t.Fatal("a file already synced went up again")
+	}
+	if len(store.objects["DCIM0002.jpg"].data) != 20 {
+		t.Fatalf("the new file didn't go up, keys = %v", store.keys())
+	}
+}
+
+func TestLongKeys(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	dir := s.FolderPath
+	for i := 0; i < 6; i++ {
+		dir = filepath.Join(dir, strings.Repeat(string(rune('a'+i)), 200))
+	}
+	p := filepath.Join(dir, "clip.mov")
+	os.MkdirAll(dir, 0755)
+	writeFixture(p, 10)
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err = s.UploadDiffs(context.Background(), uploads, false)
+	if !errors.Is(err, ErrKeyTooLong) || len(store.keys()) != 0 {
+		t.Fatalf("err = %v, keys = %v", err, store.keys())
+	}
+
+	s.ShortenKeys = true
+	syncOnce(t, s)
+	keys := store.keys()
+	if len(keys) != 1 || len(keys[0]) != MaxKeyLength-keyReserve || !strings.HasSuffix(keys[0], ".mov") {
+		t.Fatalf("keys = %v", keys)
+	}
+	if store.objects[keys[0]].info.Metadata[MetaSrcPath] != strings.TrimPrefix(filepath.ToSlash(p), filepath.ToSlash(s.FolderPath)+"/") {
+		t.Fatalf("srcpath = %s", store.objects[keys[0]].info.Metadata[MetaSrcPath])
+	}
+	if got := shortenKey(strings.Repeat("é", 600), 1001); len(got) > 1001 || !utf8.ValidString(got) {
+		t.Fatalf("shortened to %d bytes, valid %v", len(got), utf8.ValidString(got))
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.SkipExisting = true
+	for name, size := range map[string]int{"same.txt": 10, "stale.txt": 10, "multi.bin": 20, "new.txt": 5} {
+		writeFixture(filepath.Join(s.FolderPath, name), size)
+	}
+	same := mustRead(t, filepath.Join(s.FolderPath, "same.txt"))
+	store.objects["same.txt"] = memObject{data: same, info: ObjectInfo{Key: "same.txt", Size: 10, ETag: fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(same)))}}
+	store.objects["stale.txt"] = memObject{data: make([]byte, 10), info: ObjectInfo{Key: "stale.txt", Size: 10, ETag: fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(make([]byte, 10))))}}
+	store.objects["multi.bin"] = memObject{data: make([]byte, 20), info: ObjectInfo{Key: "multi.bin", Size: 20, ETag: `"0f343b0931126a20f133d67c2b018a3b-2"`, Metadata: map[string]string{MetaSrcPath: "multi.bin"}}}
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncOnce(t, s)
+	sort.Strings(puts)
+	if strings.Join(puts, " ") != "new.txt stale.txt" {
+		t.Fatalf("uploaded %v", puts)
+	}
+	uploads, _ := s.GetUploadList()
+	if len(uploads) != 0 {
+		t.Fatalf("still pending: %v", uploads)
+	}
+	if etag, _ := s.recordedETag("multi.bin"); etag != store.objects["multi.bin"].info.ETag {
+		t.Fatalf("recorded ETag %s", etag)
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	walk := func() {
+		files, err := s.WalkAndHash(context.Background(), []string{""})
+		if err == nil {
+			err = s.UpdateManifest(files)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 10)
+	walk()
+	plan, err := s.Plan(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Files) != 2 || plan.Files[0].Action != PlanUpload || plan.Bytes() != 20 {
+		t.Fatalf("plan %+v", plan)
+	}
+	if len(store.keys()) != 0 {
+		t.Fatalf("planning uploaded %v", store.keys())
+	}
+
+	// b.txt changes and c.txt turns up after the plan was approved
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 15)
+	writeFixture(filepath.Join(s.FolderPath, "c.txt"), 5)
+	walk()
+	stale, err := s.Apply(context.Background(), plan.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || filepath.Base(stale[0]) != "b.txt" {
+		t.Fatalf("stale %v", stale)
+	}
+	if keys := store.keys(); len(keys) != 1 || keys[0] != "a.txt" {
+		t.Fatalf("uploaded %v", keys)
+	}
+	_, err = s.Apply(context.Background(), plan.ID)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("applied twice: %v", err)
+	}
+	_, err = s.Apply(context.Background(), plan.ID+1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unknown plan: %v", err)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 3000)
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	dbpath := filepath.Join(t.TempDir(), "manifest.db")
+
+	outcome := func(report *DoctorReport) string {
+		var res []string
+		for _, c := range report.Checks {
+			state := "pass"
+			if c.Skipped {
+				state = "skip"
+			} else if c.Err != nil {
+				state = "fail"
+			}
+			res = append(res, c.Name+"="+state)
+		}
+		return strings.Join(res, " ")
+	}
+	report := s.Doctor(context.Background(), dbpath)
+	if got := outcome(report); got != "manifest=pass credentials=skip region=skip bucket=pass write=pass clock=pass storage class=pass temp dir=pass" {
+		t.Fatalf("report = %s", got)
+	}
+	if len(store.keys()) != 0 {
+		t.Fatalf("left behind %v", store.keys())
+	}
+
+	store.skew = -20 * time.Minute
+	s.SplitBudget = math.MaxInt64
+	report = s.Doctor(context.Background(), dbpath)
+	if got := outcome(report); !strings.Contains(got, "clock=fail") || !strings.Contains(got, "temp dir=fail") || report.Failed() != 2 {
+		t.Fatalf("report = %s", got)
+	}
+}
+
+func TestContentMD5(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.ContentMD5 = true
+	s.LargeFile = 1
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 100)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "big.bin.part0,big.bin.part1,big.bin.part2,small.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+	for key, obj := range store.objects {
+		sum := md5.Sum(obj.data)
+		if obj.md5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			t.Fatalf("%s went up with Content-MD5 %q", key, obj.md5)
+		}
+	}
+
+	store.flip = true
+	writeFixture(filepath.Join(s.FolderPath, "new.txt"), 100)
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+	if !errors.Is(err, ErrBadDigest) {
+		t.Fatalf("err = %v", err)
+	}
+	if _, ok := store.objects["new.txt"]; ok {
+		t.Fatal("the corrupted body was stored")
+	}
+}
+
+func TestUploadEvents(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	s.Bucket = "photos"
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	var mu sync.Mutex
+	var hooked []UploadEvent
+	var published []url.Values
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev UploadEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		mu.Lock()
+		hooked = append(hooked, ev)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	sns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/sns/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		published = append(published, r.PostForm)
+		mu.Unlock()
+	}))
+	defer sns.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	topic := "arn:aws:sns:eu-west-1:123456789012:uploads"
+	s.Events = Publishers{
+		&WebhookPublisher{URL: broken.URL},
+		&WebhookPublisher{URL: hook.URL},
+		&SNSPublisher{TopicARN: topic, Endpoint: sns.URL, Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", "")},
+	}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 100)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 1500)
+	// the broken webhook only warns, the upload still counts
+	syncOnce(t, s)
+
+	sort.Slice(hooked, func(i, j int) bool { return hooked[i].Key < hooked[j].Key })
+	if len(hooked) != 2 || hooked[0].Key != "big.bin" || len(hooked[0].Parts) != 2 || hooked[1].Key != "small.txt" {
+		t.Fatalf("webhook got %+v", hooked)
+	}
+	sum, _, _ := s.sumFile(filepath.Join(s.FolderPath, "small.txt"))
+	if ev := hooked[1]; ev.Bucket != "photos" || ev.Size != 100 || ev.SHA256 != sum || ev.Time.IsZero() {
+		t.Fatalf("small.txt event = %+v", ev)
+	}
+	if len(published) != 2 || published[0].Get("Action") != "Publish" || published[0].Get("TopicArn") != topic {
+		t.Fatalf("sns got %v", published)
+	}
+	var ev UploadEvent
+	if err := json.Unmarshal([]byte(published[0].Get("Message")), &ev); err != nil || ev.Bucket != "photos" {
+		t.Fatalf("sns message %q", published[0].Get("Message"))
+	}
+}
+
+func TestFilterChange(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.Retention = time.Nanosecond
+	jpg := filepath.Join(s.FolderPath, "a.jpg")
+	writeFixture(jpg, 10)
+	writeFixture(filepath.Join(s.FolderPath, "b.png"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "c.txt"), 10)
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncWith := func(filters ...string) []string {
+		t.Helper()
+		puts = nil
+		files, err := s.WalkAndHash(context.Background(), filters)
+		if err == nil {
+			err = s.UpdateManifest(files)
+		}
+		var uploads []string
+		if err == nil {
+			uploads, err = s.GetUploadList()
+		}
+		if err == nil {
+			err = s.UploadDiffs(context.Background(), uploads, false)
+		}
+		if err == nil {
+			_, err = s.Purge(context.Background())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(puts)
+		return puts
+	}
+
+	if got := syncWith(".jpg"); strings.Join(got, ",") != "a.jpg" {
+		t.Fatalf("first sync uploaded %v", got)
+	}
+	// adding a filter only uploads the files it newly matches
+	if got := syncWith(".jpg", ".png"); strings.Join(got, ",") != "b.png" {
+		t.Fatalf("adding .png uploaded %v", got)
+	}
+	// removing one leaves its files in the bucket, even when they change, and flags them
+	writeFixture(jpg, 20)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(jpg, later, later)
+	if got := syncWith(".png"); len(got) != 0 {
+		t.Fatalf("removing .jpg uploaded %v", got)
+	}
+	if out := s.FilteredOut(); len(out) != 1 || out[0] != jpg {
+		t.Fatalf("filtered out %v", out)
+	}
+	if ts, _ := s.Tombstones(); len(ts) != 0 {
+		t.Fatalf("tombstoned %v", ts)
+	}
+	if _, ok := store.objects["a.jpg"]; !ok {
+		t.Fatal("a.jpg was purged from the bucket")
+	}
+	// and matching them again picks up the change
+	if got := syncWith(".jpg", ".png"); strings.Join(got, ",") != "a.jpg" {
+		t.Fatalf("adding .jpg back uploaded %v", got)
+	}
+	if len(s.FilteredOut()) != 0 {
+		t.Fatalf("still filtered out %v", s.FilteredOut())
+	}
+}
+
+// checkConsistent fails when a file or split piece is recorded as uploaded but not complete or the other way
+// round, or when a split file's completion disagrees with that of its parts.
+func checkConsistent(t *testing.T, s *Syncer) {
+	t.Helper()
+	var n int
+	err := s.db.QueryRow("select count(*) from videos where (uploaded = 1) != (status = 'complete')").Scan(&n)
+	if err == nil && n == 0 {
+		err = s.db.QueryRow("select count(*) from parts where (uploaded = 1) != (status = 'complete')").Scan(&n)
+	}
+	if err == nil && n == 0 {
+		err = s.db.QueryRow(`select count(*) from videos v where multipart = 1 and (status = 'complete') !=
+			not exists (select 1 from parts p where p.video_id = v.id and p.status != 'complete')`).Scan(&n)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("%d records are both pending and complete", n)
+	}
+}
+
+func TestManifestCrash(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	for _, name := range []string{"a.txt", "b.txt", "crash.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, name), 10)
+	}
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the disk gives out on the last record of the inventory, none of it is kept
+	_, err = s.db.Exec(`create trigger crash before insert on videos when new.filepath like '%crash%'
+		begin select raise(abort, 'disk I/O error'); end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.UpdateManifest(files); err == nil {
+		t.Fatal("UpdateManifest succeeded on a failing manifest")
+	}
+	var n int
+	s.db.QueryRow("select count(*) from videos").Scan(&n)
+	if n != 0 {
+		t.Fatalf("a failed inventory left %d records", n)
+	}
+
+	// and on completing b.txt during the uploads, a.txt stays complete and b.txt pending
+	s.db.Exec("drop trigger crash")
+	_, err = s.db.Exec(`create trigger crash before update of status on videos when new.filepath like '%b.txt'
+		and new.status = 'complete' begin select raise(abort, 'disk I/O error'); end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UploadOrder = OrderPath
+	files, err = s.WalkAndHash(context.Background(), []string{""})
+	if err == nil {
+		err = s.UpdateManifest(files)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, _ := s.GetUploadList()
+	s.UploadDiffs(context.Background(), uploads, false)
+	checkConsistent(t, s)
+	uploads, _ = s.GetUploadList()
+	sort.Strings(uploads)
+	if len(uploads) == 0 || filepath.Base(uploads[0]) != "b.txt" {
+		t.Fatalf("pending after the crash: %v", uploads)
+	}
+
+	// the next sync after the crash finishes the job
+	s.db.Exec("drop trigger crash")
+	syncOnce(t, s)
+	checkConsistent(t, s)
+	if uploads, _ = s.GetUploadList(); len(uploads) != 0 {
+		t.Fatalf("still pending: %v", uploads)
+	}
+}
+
+func TestGroupByDir(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	out := &lockedBuffer{}
+	s.NoSpinners = false
+	s.Output = out
+	s.GroupByDir = true
+	s.UploadOrder = OrderPath
+	for _, name := range []string{"photos/2023/a.jpg", "photos/2023/b.jpg", "photos/2024/c.jpg", "top.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(s.FolderPath, name)), 0755)
+		writeFixture(filepath.Join(s.FolderPath, name), 1024)
+	}
+	syncOnce(t, s)
+	for _, want := range []string{"photos/2023: 2/2 files, 2.0 KiB of 2.0 KiB", "photos/2024: 1/1 files", ".: 1/1 files"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("no %q in %q", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "Successfully uploaded file") {
+		t.Fatalf("per file lines in %q", out.String())
+	}
+}
+
+func TestComputeExpired(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	ctx := context.Background()
+	same := filepath.Join(s.FolderPath, "same.txt")
+	changed := filepath.Join(s.FolderPath, "changed.txt")
+	writeFixture(same, 10)
+	s.KeyFunc = nil
+	names := []string{"2024-06-01T03:00:00Z", "2024-06-02T03:00:00Z", "2024-06-03T03:00:00Z"}
+	for i, name := range names {
+		writeFixture(changed, 10*(i+1))
+		later := time.Now().Add(time.Duration(i) * time.Hour)
+		os.Chtimes(changed, later, later)
+		s.Snapshot = name
+		syncOnce(t, s)
+		if _, err := s.RecordSnapshot(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects := len(store.keys())
+
+	// what only the expired snapshots hold, same.txt still belongs to the last one through the first
+	expired := func(policy RetentionPolicy, snaps ...string) {
+		t.Helper()
+		plan, err := s.ComputeExpired(ctx, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		var bytes int64
+		for _, k := range store.keys() {
+			for _, snap := range snaps {
+				if strings.HasPrefix(k, snap+"/") && !strings.Contains(k, "same.txt") {
+					want = append(want, k)
+					bytes += int64(len(store.objects[k].data))
+				}
+			}
+		}
+		sort.Strings(want)
+		if strings.Join(plan.Snapshots, " ") != strings.Join(snaps, " ") || strings.Join(plan.Keys, " ") != strings.Join(want, " ") || plan.Bytes != bytes {
+			t.Fatalf("policy %+v expired %+v, want %v %v %d", policy, plan, snaps, want, bytes)
+		}
+	}
+	expired(RetentionPolicy{KeepLast: 1}, names[0], names[1])
+	since, _ := time.Parse(SnapshotLayout, names[1])
+	expired(RetentionPolicy{KeepSince: since}, names[0])
+	expired(RetentionPolicy{KeepLast: 3})
+	// the newest snapshot holds the bucket as it is now
+	expired(RetentionPolicy{KeepSince: time.Now()}, names[0], names[1])
+
+	if _, err := s.ComputeExpired(ctx, RetentionPolicy{}); err == nil {
+		t.Fatal("an empty policy expired everything")
+	}
+	if len(store.keys()) != objects {
+		t.Fatalf("planning deleted objects, %d of %d left", len(store.keys()), objects)
+	}
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.MaxConcurrency = 4
+	s.UploadOrder = OrderPath
+	out := &lockedBuffer{}
+	s.NoSpinners = false
+	s.Output = out
+	for i := 0; i < 12; i++ {
+		writeFixture(filepath.Join(s.FolderPath, fmt.Sprintf("%02d.txt", i)), 10)
+	}
+	var mu sync.Mutex
+	active, most := 0, 0
+	store.failPut = func(key string) error {
+		mu.Lock()
+		active++
+		most = max(most, active)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	}
+	events := make(chan ProgressEvent)
+	s.Progress = events
+	var completed []int
+	drained := make(chan bool)
+	go func() {
+		for ev := range events {
+			if ev.Type == FileCompleted {
+				completed = append(completed, ev.Index)
+			}
+		}
+		drained <- true
+	}()
+	start := time.Now()
+	syncOnce(t, s)
+	took := time.Since(start)
+	close(events)
+	<-drained
+	if most < 2 || most > 4 {
+		t.Fatalf("%d uploads at once, want up to 4", most)
+	}
+	if took > 12*20*time.Millisecond {
+		t.Fatalf("12 uploads took %s, as long as one at a time", took)
+	}
+	// the count shown goes up by one per file, whatever order they finish in
+	for i, n := range completed {
+		if n != i+1 {
+			t.Fatalf("completed indices %v", completed)
+		}
+	}
+	if len(store.keys()) != 12 || !strings.Contains(out.String(), "12/12") {
+		t.Fatalf("uploaded %v, output %q", store.keys(), out.String())
+	}
+	s.Progress = nil
+
+	// the first failure stops handing out files, the ones already going up finish
+	for i := 0; i < 12; i++ {
+		writeFixture(filepath.Join(s.FolderPath, fmt.Sprintf("%02d.txt", i)), 20)
+		later := time.Now().Add(time.Hour)
+		os.Chtimes(filepath.Join(s.FolderPath, fmt.Sprintf("%02d.txt", i)), later, later)
+	}
+	store.failPut = func(key string) error {
+		if key == "01.txt" {
+			return errors.New("disk on fire")
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err := s.UploadDiffs(context.Background(), uploads, false)
+	var upErr *UploadError
+	if !errors.As(err, &upErr) || filepath.Base(upErr.Path) != "01.txt" {
+		t.Fatalf("err = %v", err)
+	}
+	checkConsistent(t, s)
+	var failed []string
+	rows, _ := s.db.Query("select filepath from videos where failures > 0 or status = 'failed'")
+	for rows.Next() {
+		var p string
+		rows.Scan(&p)
+		failed = append(failed, filepath.Base(p))
+	}
+	rows.Close()
+	if strings.Join(failed, ",") != "01.txt" {
+		t.Fatalf("failed %v", failed)
+	}
+	if uploads, _ = s.GetUploadList(); len(uploads) < 12-4 {
+		t.Fatalf("kept uploading after the failure, %d left", len(uploads))
+	}
+}
+
+func TestNativeMultipart(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.NativeMultipart = true
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+
+	syncOnce(t, s)
+
+	if got := strings.Join(store.keys(), ","); got != "big.bin,small.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+	if store.parts != 3 {
+		t.Fatalf("parts = %d", store.parts)
+	}
+	want, _ := os.ReadFile(filepath.Join(s.FolderPath, "big.bin"))
+	if !bytes.Equal(store.objects["big.bin"].data, want) {
+		t.Fatal("big.bin doesn't match the file")
+	}
+	list, _ := s.GetUploadList()
+	if len(list) != 0 {
+		t.Fatalf("still pending after sync: %v", list)
+	}
+	checkConsistent(t, s)
+
+	// a failed part aborts the upload and leaves the file pending
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2600)
+	os.Chtimes(filepath.Join(s.FolderPath, "big.bin"), time.Now(), time.Now().Add(time.Hour))
+	store.failPut = func(key string) error {
+		if key == "big.bin#part1" {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	if err := s.UploadDiffs(context.Background(), uploads, false); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if store.aborts != 1 {
+		t.Fatalf("aborts = %d", store.aborts)
+	}
+	if len(store.objects["big.bin"].data) != 2500 {
+		t.Fatal("the failed upload replaced big.bin")
+	}
+	list, _ = s.GetUploadList()
+	if len(list) != 1 {
+		t.Fatalf("pending after the failure: %v", list)
+	}
+}
+
+func TestResumeSplit(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	p := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(p, 2500)
+	var mu sync.Mutex
+	var puts []string
+	failing := "big.bin.part1"
+	store.failPut = func(key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if key == failing {
+			return errors.New("connection reset")
+		}
+		puts = append(puts, key)
+		return nil
+	}
+	upload := func() error {
+		t.Helper()
+		files, _ := s.WalkAndHash(context.Background(), []string{""})
+		s.UpdateManifest(files)
+		uploads, _ := s.GetUploadList()
+		return s.UploadDiffs(context.Background(), uploads, false)
+	}
+	if err := upload(); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+
+	// only the pieces that didn't go up are sent, read from the file
+	first := puts
+	puts, failing = nil, ""
+	if err := upload(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(puts)
+	if len(first)+len(puts) != 3 || puts[0] != "big.bin.part1" {
+		t.Fatalf("sent %v, then resumed with %v", first, puts)
+	}
+	want, _ := os.ReadFile(p)
+	var got []byte
+	for i := 0; i < 3; i++ {
+		got = append(got, store.objects[fmt.Sprintf("big.bin.part%d", i)].data...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("the resumed pieces don't make up the file")
+	}
+	list, _ := s.GetUploadList()
+	if len(list) != 0 {
+		t.Fatalf("still pending after the resume: %v", list)
+	}
+	checkConsistent(t, s)
+
+	// ForceRestart splits it again and sends every piece
+	writeFixture(p, 2500)
+	os.Chtimes(p, time.Now(), time.Now().Add(time.Hour))
+	puts, failing = nil, "big.bin.part2"
+	upload()
+	s.ForceRestart = true
+	puts, failing = nil, ""
+	if err := upload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(puts) != 3 {
+		t.Fatalf("restarted with %v", puts)
+	}
+}
+
+// resumableStore is a memStore that keeps the parts of multipart uploads between runs, like S3 does.
+type resumableStore struct {
+	*memStore
+	uploads map[string]*memUpload
+	// sent counts the parts uploaded
+	sent int
+}
+
+type memUpload struct {
+	key       string
+	opts      PutOptions
+	parts     map[int32][]byte
+	initiated time.Time
+}
+
+func (st *resumableStore) CreateUpload(ctx context.Context, key string, opts PutOptions) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	id := fmt.Sprintf("u%d", len(st.uploads)+st.aborts+st.sent)
+	st.uploads[id] = &memUpload{key: key, opts: opts, parts: map[int32][]byte{}, initiated: time.Now()}
+	return id, nil
+}
+
+func (st *resumableStore) UploadPart(ctx context.Context, key string, upload string, n int32, body io.Reader, size int64) (string, error) {
+	if st.failPut != nil {
+		if err := st.failPut(fmt.Sprintf("%s#part%d", key, n-1)); err != nil {
+			return "", err
+		}
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	up, ok := st.uploads[upload]
+	if !ok || up.key != key || int64(len(data)) != size {
+		return "", fmt.Errorf("no upload %s of %s", upload, key)
+	}
+	up.parts[n] = data
+	st.sent++
+	return fmt.Sprintf("%x", md5.Sum(data)), nil
+}
+
+func (st *resumableStore) CompleteUpload(ctx context.Context, key string, upload string, etags []string) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	up, ok := st.uploads[upload]
+	if !ok {
+		return "", fmt.Errorf("no upload %s of %s", upload, key)
+	}
+	var data []byte
+	for i, etag := range etags {
+		part := up.parts[int32(i+1)]
+		if fmt.Sprintf("%x", md5.Sum(part)) != etag {
+			return "", fmt.Errorf("part %d doesn't match %s", i+1, etag)
+		}
+		data = append(data, part...)
+	}
+	delete(st.uploads, upload)
+	etag := fmt.Sprintf("%q", fmt.Sprintf("%x-%d", md5.Sum(data), len(etags)))
+	st.objects[key] = memObject{data: data, info: ObjectInfo{Key: key, Size: int64(len(data)), ETag: etag, StorageClass: up.opts.StorageClass, LastModified: time.Now(), Metadata: up.opts.Metadata}}
+	return etag, nil
+}
+
+func (st *resumableStore) AbortUpload(ctx context.Context, key string, upload string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.uploads, upload)
+	st.aborts++
+	return nil
+}
+
+func (st *resumableStore) ListUploads(ctx context.Context, prefix string) ([]Upload, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var res []Upload
+	for id, up := range st.uploads {
+		if strings.HasPrefix(up.key, prefix) {
+			res = append(res, Upload{Key: up.key, ID: id, Initiated: up.initiated})
+		}
+	}
+	return res, nil
+}
+
+func TestResumePending(t *testing.T) {
+	s, mem := newStoreSyncer(t)
+	store := &resumableStore{memStore: mem, uploads: map[string]*memUpload{}}
+	s.Store = store
+	s.NativeMultipart = true
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	big := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(big, 2500)
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	interrupted := func() {
+		t.Helper()
+		store.failPut = func(key string) error {
+			if key == "big.bin#part1" {
+				return errors.New("connection reset")
+			}
+			return nil
+		}
+		files, _ := s.WalkAndHash(context.Background(), []string{""})
+		s.UpdateManifest(files)
+		uploads, _ := s.GetUploadList()
+		if err := s.UploadDiffs(context.Background(), uploads, false); err == nil {
+			t.Fatal("expected the upload to fail")
+		}
+		store.failPut = nil
+	}
+
+	// the first part landed and is kept, with a stale stray upload of a key in the manifest, a fresh one that may
+	// be another machine's and one of another key
+	interrupted()
+	if up, _ := s.recordedUpload(big); up == nil || store.sent != 1 || len(store.uploads) != 1 {
+		t.Fatalf("recorded %+v with %d parts sent", up, store.sent)
+	}
+	stale, _ := store.CreateUpload(context.Background(), "small.txt", PutOptions{})
+	store.uploads[stale].initiated = time.Now().Add(-DefaultStaleUploadAge - time.Hour)
+	store.CreateUpload(context.Background(), "small.txt", PutOptions{})
+	store.CreateUpload(context.Background(), "elsewhere/x.bin", PutOptions{})
+	report, err := s.ResumePending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.Resumed, ",") != big || strings.Join(report.Aborted, ",") != "small.txt" {
+		t.Fatalf("report = %+v", report)
+	}
+	if store.sent != 3 {
+		t.Fatalf("sent %d parts, want 3 with the first one kept", store.sent)
+	}
+	want, _ := os.ReadFile(big)
+	if !bytes.Equal(store.objects["big.bin"].data, want) {
+		t.Fatal("big.bin doesn't match the file")
+	}
+	if up, _ := s.recordedUpload(big); up != nil || len(store.uploads) != 2 || store.uploads[stale] != nil {
+		t.Fatalf("left %+v and %d uploads", up, len(store.uploads))
+	}
+	list, _ := s.GetUploadList()
+	for _, p := range list {
+		if p == big {
+			t.Fatal("big.bin is still pending after resuming")
+		}
+	}
+	checkConsistent(t, s)
+
+	// a file that changed since can't be carried on, its upload goes
+	writeFixture(big, 2600)
+	os.Chtimes(big, time.Now(), time.Now().Add(time.Hour))
+	interrupted()
+	writeFixture(big, 2600)
+	os.Chtimes(big, time.Now(), time.Now().Add(2*time.Hour))
+	report, err = s.ResumePending(context.Background())
+	if err != nil || len(report.Resumed) != 0 || strings.Join(report.Aborted, ",") != "big.bin" {
+		t.Fatalf("report = %+v, %v", report, err)
+	}
+}
+
+func TestRestoreFolder(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	for name, size := range map[string]int{"small.txt": 10, "dir/big.bin": 2500, "cold.txt": 20} {
+		writeFixture(filepath.Join(s.FolderPath, name), size)
+	}
+	syncOnce(t, s)
+	store.SetStorageClass(context.Background(), "cold.txt", string(types.StorageClassDeepArchive))
+
+	dest := t.TempDir()
+	report, err := s.RestoreFolder(context.Background(), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Restored) != 2 || len(report.Pending) != 1 || report.Pending[0] != filepath.Join(dest, "cold.txt") {
+		t.Fatalf("first restore = %+v", report)
+	}
+	if store.restores != 1 {
+		t.Fatalf("restores = %d", store.restores)
+	}
+	for _, name := range []string{"small.txt", "dir/big.bin"} {
+		want, _ := os.ReadFile(filepath.Join(s.FolderPath, name))
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s wasn't restored as it was synced: %v", name, err)
+		}
+		local, _ := os.Stat(filepath.Join(s.FolderPath, name))
+		restored, _ := os.Stat(filepath.Join(dest, name))
+		if restored.ModTime().Unix() != local.ModTime().Unix() {
+			t.Fatalf("%s was restored with the time %s, want %s", name, restored.ModTime(), local.ModTime())
+		}
+	}
+
+	// once the archived copy is readable it comes down, the rest is left alone
+	report, err = s.RestoreFolder(context.Background(), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Restored) != 1 || len(report.Unchanged) != 2 || len(report.Pending) != 0 {
+		t.Fatalf("second restore = %+v", report)
+	}
+}
+
+func TestDownloadDiffs(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	want := map[string][]byte{}
+	for name, size := range map[string]int{"a.txt": 10, "dir/big.bin": 2500, "dir/b.txt": 20} {
+		p := filepath.Join(s.FolderPath, name)
+		writeFixture(p, size)
+		want[name], _ = os.ReadFile(p)
+	}
+	syncOnce(t, s)
+	restored := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			got, err := os.ReadFile(filepath.Join(s.FolderPath, name))
+			if err != nil || !bytes.Equal(got, want[name]) {
+				t.Fatalf("%s wasn't restored as it was synced: %v", name, err)
+			}
+		}
+	}
+
+	// a piece brings back the whole file
+	os.RemoveAll(s.FolderPath)
+	report, err := s.DownloadDiffs(context.Background(), []string{"a.txt", "dir/big.bin.part1"})
+	if err != nil || len(report.Restored) != 2 {
+		t.Fatalf("%+v, %v", report, err)
+	}
+	restored("a.txt", "dir/big.bin")
+	if _, err := os.Stat(filepath.Join(s.FolderPath, "dir", "b.txt")); !os.IsNotExist(err) {
+		t.Fatal("a file that wasn't asked for came back")
+	}
+	if _, err := s.DownloadDiffs(context.Background(), []string{"nope.txt"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("an unknown key gave %v", err)
+	}
+
+	report, err = s.Restore(context.Background(), "dir/")
+	if err != nil || len(report.Restored) != 1 || len(report.Unchanged) != 1 {
+		t.Fatalf("%+v, %v", report, err)
+	}
+	restored("dir/b.txt", "dir/big.bin")
+}
+
+// tierStore is a memStore that restores at a tier, and leaves the restore ongoing until thaw is called.
+type tierStore struct {
+	*memStore
+	tiers []types.Tier
+}
+
+func (st *tierStore) RestoreTier(ctx context.Context, key string, days int32, tier types.Tier) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	obj, ok := st.objects[key]
+	if !ok {
+		return ErrNotFound
+	}
+	st.tiers = append(st.tiers, tier)
+	obj.info.Restoring = true
+	st.objects[key] = obj
+	return nil
+}
+
+func (st *tierStore) thaw() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for k, obj := range st.objects {
+		obj.info.Restored, obj.info.Restoring = obj.info.Restoring, false
+		st.objects[k] = obj
+	}
+}
+
+func TestRequestRestore(t *testing.T) {
+	s, mem := newStoreSyncer(t)
+	store := &tierStore{memStore: mem}
+	s.Store = store
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	writeFixture(filepath.Join(s.FolderPath, "warm.txt"), 10)
+	syncOnce(t, s)
+	for _, k := range mem.keys() {
+		if k != "warm.txt" {
+			mem.SetStorageClass(context.Background(), k, string(types.StorageClassDeepArchive))
+		}
+	}
+	keys := []string{"big.bin", "warm.txt"}
+
+	if err := s.RequestRestore(context.Background(), keys, "Expedited", 1); err == nil {
+		t.Fatal("deep archive was restored at Expedited")
+	}
+	if err := s.RequestRestore(context.Background(), keys, "Soon", 1); err == nil {
+		t.Fatal("an unknown tier was taken")
+	}
+	if err := s.WaitForRestore(context.Background(), keys); err == nil {
+		t.Fatal("waited on objects no restore was asked for")
+	}
+	if err := s.RequestRestore(context.Background(), keys, "Bulk", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.tiers) != 3 || store.tiers[0] != types.TierBulk {
+		t.Fatalf("restored %v, want the 3 pieces at Bulk", store.tiers)
+	}
+
+	defer func(old time.Duration) { restorePollInterval = old }(restorePollInterval)
+	restorePollInterval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForRestore(ctx, keys); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting on ongoing restores gave %v", err)
+	}
+	store.thaw()
+	if err := s.WaitForRestore(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(s.FolderPath, "big.bin"))
+	report, err := s.DownloadDiffs(context.Background(), []string{"big.bin"})
+	if err != nil || len(report.Restored) != 1 {
+		t.Fatalf("%+v, %v", report, err)
+	}
+}
+
+func TestPruneDeleted(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 20)
+	writeFixture(filepath.Join(s.FolderPath, "dir", "c.bin"), 2500)
+	syncOnce(t, s)
+
+	// b.txt is tombstoned by a walk, c.bin is only gone from the disk
+	os.Remove(filepath.Join(s.FolderPath, "b.txt"))
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	os.Remove(filepath.Join(s.FolderPath, "dir", "c.bin"))
+
+	report, err := s.PruneDeleted(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 2 || len(report.Keys) != 4 || report.Bytes != 2520 || report.Deleted {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(store.keys()) != 5 {
+		t.Fatalf("a report deleted objects: %v", store.keys())
+	}
+	report, err = s.PruneRemote(context.Background(), true)
+	if err != nil || len(report.Keys) != 4 || report.Deleted || len(store.keys()) != 5 {
+		t.Fatalf("dry run = %+v, %v, left %v", report, err, store.keys())
+	}
+
+	report, err = s.PruneDeleted(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(store.keys(), ","); got != "a.txt" || !report.Deleted {
+		t.Fatalf("left %s", got)
+	}
+	for _, p := range []string{"b.txt", filepath.Join("dir", "c.bin")} {
+		if size, _, _, _ := s.recordedContent(filepath.Join(s.FolderPath, p)); size != -1 {
+			t.Fatalf("%s is still in the manifest", p)
+		}
+		if parts, _ := s.Parts(filepath.Join(s.FolderPath, p)); len(parts) != 0 {
+			t.Fatalf("%s still has parts", p)
+		}
+	}
+	checkConsistent(t, s)
+
+	// an unmounted source doesn't get everything in it pruned
+	os.RemoveAll(s.FolderPath)
+	if _, err = s.PruneDeleted(context.Background(), true); err == nil {
+		t.Fatal("pruned a source that isn't there")
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	for _, name := range []string{"keep.txt", ".DS_Store", "cache/a.bin", "sub/cache/b.bin", "sub/x.tmp", "build/out.log", "build/keep.log", "docs/cache.txt"} {
+		writeFixture(filepath.Join(s.FolderPath, filepath.FromSlash(name)), 10)
+	}
+	rules := "# junk\n.DS_Store\ncache/\n*.tmp\n/build/*\n!build/keep.log\n"
+	os.WriteFile(filepath.Join(s.FolderPath, IgnoreFile), []byte(rules), 0644)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != ".s3syncignore,build/keep.log,docs/cache.txt,keep.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+
+	// the rules win over the filters
+	files, err := s.WalkAndHash(context.Background(), []string{".tmp", ".txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := range files {
+		if strings.HasSuffix(p, ".tmp") {
+			t.Fatalf("walked the ignored %s", p)
+		}
+	}
+
+	// a synced file that becomes ignored stays in the bucket and the manifest
+	os.WriteFile(filepath.Join(s.FolderPath, IgnoreFile), []byte(rules+"keep.txt\n"), 0644)
+	files, _ = s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	if tombstones, _ := s.Tombstones(); len(tombstones) != 0 {
+		t.Fatalf("tombstoned %v", tombstones)
+	}
+	if len(s.FilteredOut()) != 1 {
+		t.Fatalf("filtered out = %v", s.FilteredOut())
+	}
+}
+
+// flakyStore drops the first fails Puts halfway through the body, like a connection S3 reset.
+type flakyStore struct {
+	*memStore
+	fails int
+	puts  int
+	err   error
+}
+
+func (f *flakyStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (string, error) {
+	f.puts++
+	if f.puts <= f.fails {
+		io.CopyN(io.Discard, body, 5)
+		return "", f.err
+	}
+	return f.memStore.Put(ctx, key, body, opts)
+}
+
+func TestPutRetries(t *testing.T) {
+	retryBase = time.Millisecond
+	defer func() { retryBase = time.Second }()
+	s, store := newStoreSyncer(t)
+	flaky := &flakyStore{memStore: store, fails: 2, err: &smithy.GenericAPIError{Code: "InternalError"}}
+	s.Store = flaky
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 20)
+	syncOnce(t, s)
+	want, _ := os.ReadFile(filepath.Join(s.FolderPath, "a.txt"))
+	if flaky.puts != 3 || !bytes.Equal(store.objects["a.txt"].data, want) {
+		t.Fatalf("%d puts, stored %q", flaky.puts, store.objects["a.txt"].data)
+	}
+
+	// what S3 turned down isn't tried again, and neither is anything with retries off
+	for i, c := range []struct {
+		err     error
+		retries int
+	}{
+		{&smithy.GenericAPIError{Code: "AccessDenied"}, 0},
+		{&smithy.GenericAPIError{Code: "InternalError"}, -1},
+	} {
+		s.MaxRetries = c.retries
+		flaky.puts, flaky.fails, flaky.err = 0, 10, c.err
+		writeFixture(filepath.Join(s.FolderPath, "a.txt"), 30)
+		os.Chtimes(filepath.Join(s.FolderPath, "a.txt"), time.Now(), time.Now().Add(time.Duration(i+1)*time.Hour))
+		files, _ := s.WalkAndHash(context.Background(), []string{""})
+		s.UpdateManifest(files)
+		uploads, _ := s.GetUploadList()
+		if err := s.UploadDiffs(context.Background(), uploads, false); err == nil || flaky.puts != 1 {
+			t.Fatalf("%v with %d retries: %d puts, %v", c.err, c.retries, flaky.puts, err)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "kept.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "gone.txt"), 10)
+	syncOnce(t, s)
+	// tombstoned, for the purge
+	os.Remove(filepath.Join(s.FolderPath, "gone.txt"))
+	syncOnce(t, s)
+	writeFixture(filepath.Join(s.FolderPath, "new.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	writeFixture(filepath.Join(s.FolderPath, "huge.bin"), 5000)
+	s.SkipLargerThan = 4000
+	s.Retention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	dump := func() string {
+		t.Helper()
+		var b strings.Builder
+		rows, err := s.db.Query("select filepath, modified, uploaded, status from videos order by filepath")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p, status string
+			var mod, uploaded int64
+			rows.Scan(&p, &mod, &uploaded, &status)
+			fmt.Fprintln(&b, p, mod, uploaded, status)
+		}
+		return b.String()
+	}
+	before, keys := dump(), len(store.keys())
+
+	var out bytes.Buffer
+	s.DryRun, s.Output = true, &out
+	syncOnce(t, s)
+	if got := dump(); got != before {
+		t.Fatalf("the dry run changed the manifest:\n%s\nwas\n%s", got, before)
+	}
+	if len(store.keys()) != keys {
+		t.Fatalf("the dry run uploaded %v", store.keys())
+	}
+	for _, want := range []string{"new.txt", "big.bin", "to STANDARD, split into 3 pieces", "Would skip " + filepath.Join(s.FolderPath, "huge.bin"), "Would purge " + filepath.Join(s.FolderPath, "gone.txt"), "2 files"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("%q not in the report:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "kept.txt") {
+		t.Fatalf("the unchanged file is in the report:\n%s", out.String())
+	}
+	uploads, _ := s.GetUploadList()
+	report, err := s.DryRunReport(uploads, false)
+	if err != nil || len(report.Files) != 2 || report.Bytes != 2510 || report.Files[0].StorageClass != types.StorageClassStandard {
+		t.Fatalf("%+v, %v", report, err)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0].Size != 5000 || len(report.Purged) != 1 {
+		t.Fatalf("skipped %+v, purged %v", report.Skipped, report.Purged)
+	}
+
+	// the real run finds the same changes
+	s.DryRun = false
+	files, _ := s.WalkAndHash(context.Background(), []string{""})
+	s.UpdateManifest(files)
+	uploads, _ = s.GetUploadList()
+	if len(uploads) != 2 {
+		t.Fatalf("the real run found %v", uploads)
+	}
+}
+
+func TestCancelSplit(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	p := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(p, 3500)
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err == nil {
+		err = s.UpdateManifest(files)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped after the first piece
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	info, _ := os.Stat(p)
+	_, _, err = s.splitPieces(ctx, p, p, "big.bin", info, 1000, func(e ProgressEvent) {
+		if e.Type == PieceCreated {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("split returned %v", err)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Fatalf("the split left %d entries in the temp dir", len(left))
+	}
+	var multipart, parts int
+	s.db.QueryRow("select multipart from videos where filepath = ?", p).Scan(&multipart)
+	s.db.QueryRow("select count(*) from parts").Scan(&parts)
+	if multipart != 0 || parts != 0 {
+		t.Fatalf("multipart = %d with %d parts after a cancelled split", multipart, parts)
+	}
+	checkConsistent(t, s)
+
+	if _, err := s.WalkAndHash(ctx, []string{""}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("walk returned %v", err)
+	}
+}
+
+func TestDiffAgainstRemote(t *testing.T) {
+	first, store := newStoreSyncer(t)
+	first.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	for name, size := range map[string]int{"same.txt": 10, "grown.txt": 10, "edited.txt": 10, "touched.txt": 10, "big.bin": 2500} {
+		writeFixture(filepath.Join(first.FolderPath, name), size)
+	}
+	syncOnce(t, first)
+	// and since then, with the manifest lost
+	writeFixture(filepath.Join(first.FolderPath, "grown.txt"), 20)
+	writeFixture(filepath.Join(first.FolderPath, "edited.txt"), 10)
+	writeFixture(filepath.Join(first.FolderPath, "new.txt"), 10)
+	later := time.Now().Add(time.Hour)
+	for _, name := range []string{"grown.txt", "edited.txt", "touched.txt"} {
+		os.Chtimes(filepath.Join(first.FolderPath, name), later, later)
+	}
+
+	s, _ := newStoreSyncer(t)
+	s.Store = store
+	s.FolderPath = first.FolderPath
+	s.PutLimits = first.PutLimits
+	ctx := context.Background()
+	diffs, err := s.DiffAgainstRemote(ctx, []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, name := range []string{"edited.txt", "grown.txt", "new.txt"} {
+		want = append(want, filepath.Join(s.FolderPath, name))
+	}
+	if !slices.Equal(diffs, want) {
+		t.Fatalf("diffs = %v, want %v", diffs, want)
+	}
+	if status, _ := s.getStatus(filepath.Join(s.FolderPath, "big.bin")); status != StatusComplete {
+		t.Fatalf("split file matching its pieces is %q", status)
+	}
+	uploads, _ := s.GetUploadList()
+	slices.Sort(uploads)
+	if !slices.Equal(uploads, want) {
+		t.Fatalf("upload list = %v", uploads)
+	}
+
+	store.failPut = func(key string) error {
+		if key != "edited.txt" && key != "grown.txt" && key != "new.txt" {
+			t.Errorf("%s went up again", key)
+		}
+		return nil
+	}
+	err = s.UploadDiffs(ctx, diffs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(store.objects["edited.txt"].data, mustRead(t, filepath.Join(s.FolderPath, "edited.txt"))) {
+		t.Fatal("the edited file wasn't uploaded")
+	}
+	diffs, err = s.DiffAgainstRemote(ctx, []string{""})
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("diffs after the upload = %v, %v", diffs, err)
+	}
+	checkConsistent(t, s)
+}
+
+func TestSymlinksAndEmptyDirs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	s, store := newStoreSyncer(t)
+	s.Symlinks = SymlinksRecord
+	s.KeepEmptyDirs = true
+	s.PreservePermissions = true
+	a := filepath.Join(s.FolderPath, "a.txt")
+	writeFixture(a, 10)
+	mod := time.Date(2020, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	os.Chtimes(a, mod, mod)
+	os.Symlink("a.txt", filepath.Join(s.FolderPath, "link"))
+	os.Symlink("nowhere", filepath.Join(s.FolderPath, "dangling"))
+	os.MkdirAll(filepath.Join(s.FolderPath, "empty"), 0755)
+	os.MkdirAll(filepath.Join(s.FolderPath, "full"), 0755)
+	writeFixture(filepath.Join(s.FolderPath, "full", "b.txt"), 10)
+	syncOnce(t, s)
+
+	if got := strings.Join(store.keys(), ","); got != "a.txt,dangling,empty/,full/b.txt,link" {
+		t.Fatalf("bucket holds %s", got)
+	}
+	if obj := store.objects["link"]; string(obj.data) != "a.txt" || obj.info.Metadata[MetaSymlink] == "" {
+		t.Fatalf("link object = %q, %v", obj.data, obj.info.Metadata)
+	}
+	if meta := store.objects["a.txt"].info.Metadata; meta[MetaMtime] != "2020-05-01T12:00:00.123456789Z" {
+		t.Fatalf("metadata = %v", meta)
+	}
+	store.failPut = func(key string) error {
+		t.Errorf("%s went up again", key)
+		return nil
+	}
+	syncOnce(t, s)
+	if report, err := s.Fsck(context.Background(), []string{""}); err != nil || len(report.Corrupt)+len(report.Modified) != 0 {
+		t.Fatalf("fsck = %+v, %v", report, err)
+	}
+
+	dest := t.TempDir()
+	_, err := s.RestoreFolder(context.Background(), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "link")); err != nil || target != "a.txt" {
+		t.Fatalf("restored link = %q, %v", target, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "dangling")); err != nil || target != "nowhere" {
+		t.Fatalf("restored dangling link = %q, %v", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("restored empty dir = %v, %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "a.txt")); err != nil || !info.ModTime().Equal(mod) {
+		t.Fatalf("restored a.txt = %v, %v", info, err)
+	}
+}
+
+func TestSkipSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	s, store := newStoreSyncer(t)
+	s.Symlinks = SymlinksSkip
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 10)
+	os.Symlink("a.txt", filepath.Join(s.FolderPath, "link"))
+	os.MkdirAll(filepath.Join(s.FolderPath, "empty"), 0755)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "a.txt" {
+		t.Fatalf("bucket holds %s", got)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.KeyPrefix = "host-a/"
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1000}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+	// another machine in the same bucket
+	store.Put(context.Background(), "host-b/small.txt", strings.NewReader("x"), PutOptions{Metadata: map[string]string{MetaSrcPath: "small.txt"}})
+	for _, key := range []string{"host-a/small.txt", "host-a/big.bin.part0", "host-a/big.bin.part1", "host-a/big.bin.part2"} {
+		if _, ok := store.objects[key]; !ok {
+			t.Fatalf("%s wasn't uploaded, the bucket holds %v", key, store.keys())
+		}
+	}
+
+	dest := t.TempDir()
+	report, err := s.RestoreFolder(context.Background(), dest)
+	if err != nil || len(report.Restored) != 2 {
+		t.Fatalf("%+v, %v", report, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "big.bin")); len(got) != 2500 {
+		t.Fatalf("big.bin came back as %d bytes", len(got))
+	}
+
+	// catching up only takes the objects under the prefix
+	fresh, _ := newStoreSyncer(t)
+	fresh.Store = store
+	fresh.FolderPath = s.FolderPath
+	fresh.PutLimits = s.PutLimits
+	fresh.KeyPrefix = s.KeyPrefix
+	adopted, err := fresh.BuildManifestFromBucket(context.Background())
+	if err != nil || len(adopted.Adopted) != 2 {
+		t.Fatalf("%+v, %v", adopted, err)
+	}
+}
+
+func TestRelativeKeys(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.KeyFunc = nil
+	s.RelativeKeys = true
+	s.KeyPrefix = "backups/host/"
+	writeFixture(filepath.Join(s.FolderPath, "dir", "a.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "b.txt"), 10)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "backups/host/b.txt,backups/host/dir/a.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+
+	// an object put there by the same tree on another machine, without any metadata, maps back to its file
+	store.Put(context.Background(), "backups/host/dir/c.txt", strings.NewReader("c"), PutOptions{})
+	writeFixture(filepath.Join(s.FolderPath, "dir", "c.txt"), 1)
+	fresh, _ := newStoreSyncer(t)
+	fresh.Store = store
+	fresh.FolderPath = s.FolderPath
+	fresh.KeyFunc = nil
+	fresh.RelativeKeys = true
+	fresh.KeyPrefix = s.KeyPrefix
+	adopted, err := fresh.BuildManifestFromBucket(context.Background())
+	if err != nil || len(adopted.Adopted)+len(adopted.Pending) != 3 || len(adopted.Missing) != 0 {
+		t.Fatalf("%+v, %v", adopted, err)
+	}
+
+	// several folders go under their names, so they don't overwrite each other
+	other := filepath.Join(t.TempDir(), "photos")
+	writeFixture(filepath.Join(other, "b.txt"), 10)
+	s.Sources = []Source{{FolderPath: s.FolderPath}, {FolderPath: other}}
+	if key := s.keyOf(filepath.Join(other, "b.txt")); key != "backups/host/photos/b.txt" {
+		t.Fatalf("key = %s", key)
+	}
+	if key := s.keyOf(filepath.Join(s.FolderPath, "b.txt")); key != "backups/host/src/b.txt" {
+		t.Fatalf("key = %s", key)
+	}
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	s, store := newStoreSyncer(t)
+	s.MaxConcurrency = 2
+	s.MaxBytesPerSecond = 200 << 10
+	writeFixture(filepath.Join(s.FolderPath, "a.bin"), 150<<10)
+	writeFixture(filepath.Join(s.FolderPath, "b.bin"), 150<<10)
+	start := time.Now()
+	syncOnce(t, s)
+	// a second's worth goes right away, the other 100KiB at the rate shared by both uploads
+	if took := time.Since(start); took < 400*time.Millisecond || took > 5*time.Second {
+		t.Fatalf("took %s, want about half a second", took)
+	}
+	if len(store.keys()) != 2 {
+		t.Fatalf("keys = %v", store.keys())
+	}
+
+	b := newBandwidth(1000)
+	b.wait(context.Background(), 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.wait(ctx, 1000); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waiting with a cancelled ctx gave %v", err)
+	}
+	if newBandwidth(0) != nil {
+		t.Fatal("no limit made a bandwidth")
+	}
+}
+
+func TestSplitProgress(t *testing.T) {
+	s, _ := newStoreSyncer(t)
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 2 << 20}
+	big := filepath.Join(s.FolderPath, "big.bin")
+	writeFixture(big, 3<<20)
+	events := make(chan ProgressEvent, 100)
+	s.Progress = events
+	syncOnce(t, s)
+	close(events)
+	var sent []int64
+	for ev := range events {
+		if ev.Type == BytesProgress && ev.Path == big {
+			if ev.Size != 3<<20 {
+				t.Fatalf("progress of %d bytes for %d", ev.Size, 3<<20)
+			}
+			sent = append(sent, ev.Bytes)
+		}
+	}
+	// the first piece reports half way, before it is done
+	if len(sent) < 3 || sent[0] >= 2<<20 || sent[len(sent)-1] != 3<<20 {
+		t.Fatalf("bytes reported for big.bin = %v", sent)
+	}
+
+	// the spinner shows it
+	var out bytes.Buffer
+	r := &spinnerReporter{term: terminal{out: &out}}
+	r.handle(ProgressEvent{Type: FileStarted, Path: big, Index: 1, Total: 1, Size: 3 << 20})
+	r.handle(ProgressEvent{Type: BytesProgress, Path: big, Bytes: 1 << 20, Size: 3 << 20})
+	if text := r.file.Text; !strings.Contains(text, "33% at ") || !strings.Contains(text, "/s") {
+		t.Fatalf("spinner text %q", text)
+	}
+	r.handle(ProgressEvent{Type: FileCompleted, Path: big, Index: 1, Total: 1, Size: 3 << 20})
+	if len(r.sent) != 0 || len(r.started) != 0 {
+		t.Fatal("the finished file is still followed")
+	}
+}
+
+// checkManifestStore takes m through the records of a sync, every ManifestStore has to keep them like the
+// SQLite one does.
+func checkManifestStore(t *testing.T, m ManifestStore) {
+	t.Helper()
+	get := func(p string) FileRecord {
+		t.Helper()
+		rec, ok, err := m.Get(p)
+		if err != nil || !ok {
+			t.Fatalf("get %s: %v, %v", p, ok, err)
+		}
+		return rec
+	}
+	pending := func(maxFailures int) string {
+		t.Helper()
+		paths, err := m.ListPending(maxFailures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(paths)
+		return strings.Join(paths, ",")
+	}
+	if _, ok, err := m.Get("a"); ok || err != nil {
+		t.Fatalf("an empty manifest has a: %v, %v", ok, err)
+	}
+	m.UpdateRecord("a", 100, "key/a")
+	m.UpdateRecord("b", 200, "key/b")
+	if rec := get("a"); rec != (FileRecord{Path: "a", Modified: 100, Key: "key/a", Status: StatusPending, Size: -1}) {
+		t.Fatalf("new record %+v", rec)
+	}
+	if got := pending(0); got != "a,b" {
+		t.Fatalf("pending %s", got)
+	}
+
+	// two failures quarantine a file at two
+	m.RecordFailure("a")
+	m.RecordFailure("a")
+	if got := pending(2); got != "b" {
+		t.Fatalf("pending with a quarantined %s", got)
+	}
+	m.ResetFailures()
+	if got := pending(2); got != "a,b" {
+		t.Fatalf("pending after the reset %s", got)
+	}
+	m.RecordFailure("a")
+	m.CompleteUpload("a", "sum-a", 10)
+	if rec := get("a"); rec.Status != StatusComplete || !rec.Uploaded || rec.SHA256 != "sum-a" || rec.Size != 10 || rec.Failures != 0 {
+		t.Fatalf("completed record %+v", rec)
+	}
+	if got := pending(0); got != "b" {
+		t.Fatalf("pending after the upload %s", got)
+	}
+	m.SetModified("a", 150)
+	if rec := get("a"); rec.Modified != 150 || rec.Status != StatusComplete {
+		t.Fatalf("touched record %+v", rec)
+	}
+	// a changed file goes up again, what was uploaded of it stays until then
+	m.UpdateRecord("a", 160, "key/a")
+	if rec := get("a"); rec.Status != StatusPending || rec.Uploaded || rec.Size != 10 {
+		t.Fatalf("changed record %+v", rec)
+	}
+
+	err := m.RecordParts("b", []PartRecord{{Path: "b.0", Key: "key/b.part0", Offset: 0, Size: 5, SHA256: "s0"}, {Path: "b.1", Key: "key/b.part1", Offset: 5, Size: 3, SHA256: "s1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := m.Parts("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || parts[1] != (Part{Path: "b.1", Index: 1, Offset: 5, Size: 3, SHA256: "s1", Key: "key/b.part1", Status: StatusPending}) {
+		t.Fatalf("parts %+v", parts)
+	}
+	// a split file completes with its parts only
+	m.UpdateUploadStatus("b")
+	m.SetPartStatus("b.0", StatusComplete)
+	if rec := get("b"); !rec.Multipart || rec.Status != StatusPending {
+		t.Fatalf("split record with a part left %+v", rec)
+	}
+	m.SetPartStatus("b.1", StatusFailed)
+	if rec := get("b"); rec.Status != StatusFailed {
+		t.Fatalf("split record with a failed part %+v", rec)
+	}
+	m.SetPartStatus("b.1", StatusComplete)
+	if rec := get("b"); rec.Status != StatusComplete || !rec.Uploaded {
+		t.Fatalf("split record with every part up %+v", rec)
+	}
+	if parts, _ := m.Parts("a"); len(parts) != 0 {
+		t.Fatalf("a whole file has parts %+v", parts)
+	}
+
+	m.SetKey("b", "key/c")
+	if rec := get("b"); rec.Key != "key/c" || rec.Status != StatusComplete {
+		t.Fatalf("record with a new key %+v", rec)
+	}
+	m.RenameKey("b", "key/d")
+	if rec := get("b"); rec.Key != "key/d" || rec.Status != StatusPending || rec.Multipart {
+		t.Fatalf("renamed record %+v", rec)
+	}
+	m.SetLink("a", "b")
+	if rec := get("a"); rec.LinkOf != "b" {
+		t.Fatalf("linked record %+v", rec)
+	}
+	m.SetLink("a", "")
+	if rec := get("a"); rec.LinkOf != "" {
+		t.Fatalf("unlinked record %+v", rec)
+	}
+	m.SetStatus("a", StatusInProgress)
+	if rec := get("a"); rec.Status != StatusInProgress {
+		t.Fatalf("record in progress %+v", rec)
+	}
+
+	// the first tombstone stays until the file is back
+	m.SetDeleted("a", 1000)
+	m.SetDeleted("a", 2000)
+	if rec := get("a"); rec.Deleted != 1000 {
+		t.Fatalf("tombstoned record %+v", rec)
+	}
+	if got := pending(0); got != "b" {
+		t.Fatalf("pending with a deleted %s", got)
+	}
+	m.SetDeleted("a", 0)
+	if got := pending(0); got != "a,b" {
+		t.Fatalf("pending with a back %s", got)
+	}
+
+	// a failed batch keeps none of it
+	stop := errors.New("stop")
+	err = m.Batch(func() error {
+		m.UpdateRecord("c", 300, "key/c")
+		m.SetStatus("a", StatusComplete)
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("batch returned %v", err)
+	}
+	if _, ok, _ := m.Get("c"); ok || get("a").Status != StatusInProgress {
+		t.Fatal("the failed batch was kept")
+	}
+	err = m.Batch(func() error { return m.UpdateRecord("c", 300, "key/c") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 || recs[0].Path != "a" || recs[2].Path != "c" {
+		t.Fatalf("records %+v", recs)
+	}
+}
+
+func TestSQLiteManifestStore(t *testing.T) {
+	s := newTestSyncer(t)
+	checkManifestStore(t, s.records())
+}
+
+func TestJSONManifestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	m, err := OpenJSONManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkManifestStore(t, m)
+
+	// what is read back is what was saved
+	again, err := OpenJSONManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := m.List()
+	got, _ := again.List()
+	if !slices.Equal(got, want) {
+		t.Fatalf("read back %+v, want %+v", got, want)
+	}
+	if parts, _ := again.Parts("b"); len(parts) != 2 {
+		t.Fatalf("read back parts %+v", parts)
+	}
+	if err := again.SetPartStatus("b.0", StatusFailed); err != nil || again.files["b"].Status != StatusFailed {
+		t.Fatalf("a read back part doesn't roll up: %v", err)
+	}
+}
+
+func TestSyncWithJSONManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.json")
+	m, err := OpenJSONManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newMemStore()
+	s := &Syncer{FolderPath: filepath.Join(dir, "src"), Bucket: "test-bucket", Manifest: m, Store: store, NoSpinners: true, MaxConcurrency: 1}
+	s.KeyFunc = func(p string) string {
+		rel, _ := filepath.Rel(s.FolderPath, p)
+		return filepath.ToSlash(rel)
+	}
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1024}
+	writeFixture(filepath.Join(s.FolderPath, "small.txt"), 10)
+	writeFixture(filepath.Join(s.FolderPath, "big.bin"), 2500)
+	syncOnce(t, s)
+	if got := strings.Join(store.keys(), ","); got != "big.bin.part0,big.bin.part1,big.bin.part2,small.txt" {
+		t.Fatalf("keys = %s", got)
+	}
+	for _, p := range []string{"small.txt", "big.bin"} {
+		err := s.checkRoundTrip(context.Background(), filepath.Join(s.FolderPath, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another syncer on the same file knows what went up
+	m, err = OpenJSONManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Manifest = m
+	edited := filepath.Join(s.FolderPath, "small.txt")
+	writeFixture(edited, 20)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(edited, later, later)
+	var puts []string
+	store.failPut = func(key string) error {
+		puts = append(puts, key)
+		return nil
+	}
+	syncOnce(t, s)
+	if strings.Join(puts, ",") != "small.txt" {
+		t.Fatalf("uploaded %v, want only small.txt", puts)
+	}
+
+	// the features with tables of their own say they need SQLite
+	if _, err := s.Verify(context.Background()); !errors.Is(err, ErrNeedsSQLite) {
+		t.Fatalf("verify gave %v", err)
+	}
+	s.DeltaMode = true
+	if err := s.UpdateManifest(map[string]int64{}); !errors.Is(err, ErrNeedsSQLite) {
+		t.Fatalf("a delta sync gave %v", err)
+	}
+}
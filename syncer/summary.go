@@ -0,0 +1,82 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// RunSummary adds up a sync, from the WalkAndHash to the last UploadDiffs, for monitoring to alert on, like a
+// nightly run that uploaded nothing or failed. See Summary.
+type RunSummary struct {
+	// Run is the id of the last UploadDiffs in the run history, 0 when nothing was pending.
+	Run     int64     `json:"run,omitempty"`
+	Label   string    `json:"label,omitempty"`
+	Outcome string    `json:"outcome"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+	// Scanned are the local files the filters let through, Skipped the ones of them left out by SkipLargerThan
+	// or Skip.
+	Scanned        int     `json:"files_scanned"`
+	Skipped        int     `json:"files_skipped"`
+	Uploaded       int     `json:"files_uploaded"`
+	Failed         int     `json:"files_failed"`
+	Bytes          int64   `json:"bytes_uploaded"`
+	Seconds        float64 `json:"wall_seconds"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// summaryMu guards Syncer.summary, its uploads are counted from several goroutines.
+var summaryMu sync.Mutex
+
+// startSummary starts the summary over at the start of a WalkAndHash.
+func (app *Syncer) startSummary() {
+	summaryMu.Lock()
+	app.summary = RunSummary{Started: time.Now()}
+	summaryMu.Unlock()
+}
+
+// countSummary changes the summary with count, starting it when UploadDiffs runs without a WalkAndHash first.
+func (app *Syncer) countSummary(count func(s *RunSummary)) {
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+	if app.summary.Started.IsZero() {
+		app.summary.Started = time.Now()
+	}
+	count(&app.summary)
+}
+
+// Summary returns the summary of the sync so far, ending now, with runErr the error it ended with if any.
+func (app *Syncer) Summary(runErr error) RunSummary {
+	summaryMu.Lock()
+	s := app.summary
+	summaryMu.Unlock()
+	s.Ended, s.Label = time.Now(), app.RunLabel
+	if s.Started.IsZero() {
+		s.Started = s.Ended
+	}
+	s.Seconds = s.Ended.Sub(s.Started).Seconds()
+	if s.Seconds > 0 {
+		s.BytesPerSecond = float64(s.Bytes) / s.Seconds
+	}
+	switch {
+	case errors.Is(runErr, context.Canceled):
+		s.Outcome = RunCancelled
+	case runErr != nil:
+		s.Outcome, s.Error = RunFailed, runErr.Error()
+	case app.remaining > 0:
+		s.Outcome = RunStopped
+	default:
+		s.Outcome = RunSucceeded
+	}
+	return s
+}
+
+// WriteSummary writes the Summary of the sync to w as a line of JSON.
+func (app *Syncer) WriteSummary(w io.Writer, runErr error) error {
+	return json.NewEncoder(w).Encode(app.Summary(runErr))
+}
@@ -0,0 +1,113 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// What the walk does with symbolic links, see Syncer.Symlinks.
+const (
+	// SymlinksFollow uploads the file a symlink points to as if the link were that file, the default.
+	SymlinksFollow = "follow"
+	// SymlinksSkip leaves symlinks out of the walk.
+	SymlinksSkip = "skip"
+	// SymlinksRecord uploads a symlink as a small object holding its target, which Download makes a symlink again.
+	SymlinksRecord = "record"
+)
+
+// MetaSymlink marks an object holding the target of a symlink rather than content, see SymlinksRecord.
+const MetaSymlink = "symlink"
+
+// ParseSymlinks checks s names a way to handle symlinks, SymlinksFollow for the empty string.
+func ParseSymlinks(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", SymlinksFollow:
+		return SymlinksFollow, nil
+	case SymlinksSkip:
+		return SymlinksSkip, nil
+	case SymlinksRecord:
+		return SymlinksRecord, nil
+	}
+	return "", fmt.Errorf("unknown symlink handling %q, expected %s, %s or %s", s, SymlinksFollow, SymlinksSkip, SymlinksRecord)
+}
+
+// localStat is os.Stat, or os.Lstat with SymlinksRecord so a symlink is described by itself.
+func (app *Syncer) localStat(p string) (os.FileInfo, error) {
+	if app.Symlinks == SymlinksRecord {
+		return os.Lstat(p)
+	}
+	return os.Stat(p)
+}
+
+// markerContent reports whether p is uploaded as a marker object instead of its content, a symlink with
+// SymlinksRecord or a directory with KeepEmptyDirs, and returns what the object holds: the target of the link,
+// nothing for a directory.
+func (app *Syncer) markerContent(p string) (content string, ok bool, err error) {
+	if app.Symlinks != SymlinksRecord && !app.KeepEmptyDirs {
+		return "", false, nil
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return "", false, err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0 && app.Symlinks == SymlinksRecord:
+		target, err := os.Readlink(p)
+		return target, err == nil, err
+	case info.IsDir() && app.KeepEmptyDirs:
+		return "", true, nil
+	}
+	return "", false, nil
+}
+
+// putMarker uploads the marker object of obj holding content, see markerContent. An empty directory goes up
+// under its key with a trailing slash, which is recorded so Download finds it. Markers are stored as they are,
+// without the compression, encryption or transforms the content of files gets.
+func (app *Syncer) putMarker(ctx context.Context, obj string, key string, content string, info os.FileInfo, class types.StorageClass, opts PutOptions) error {
+	if info.IsDir() {
+		if !strings.HasSuffix(key, "/") {
+			key += "/"
+			err := app.setKey(obj, key)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		opts.Metadata[MetaSymlink] = "true"
+	}
+	err := app.markCompressed(obj, false, &opts)
+	if err != nil {
+		return err
+	}
+	return app.putBody(ctx, key, strings.NewReader(content), class, opts)
+}
+
+// emptyDir reports whether the directory p has nothing in it, false when it can't be read.
+func emptyDir(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
+
+// restoreSymlink turns the file dest, downloaded from an object marked with MetaSymlink, into a symlink to the
+// target it holds.
+func restoreSymlink(dest string) error {
+	target, err := os.ReadFile(dest)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(dest)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(string(target), dest)
+}
@@ -2,110 +2,839 @@ package syncer
 
 import (
 	"context"
+	"crypto/md5"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"s3sync/splitter"
-	"strings"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/pterm/pterm"
 )
 
 type Syncer struct {
-	db         *sql.DB
+	db *sql.DB
+	// manifestTx is the transaction UpdateManifest writes the inventory in, see manifest.
+	manifestTx *sql.Tx
 	FolderPath string
-	S3Client   *s3.Client
-	Bucket     string
+	// Sources, if set, replaces FolderPath with several folders synced in one run against the same manifest.
+	Sources  []Source
+	S3Client *s3.Client
+	Bucket   string
+	// Store, if set, is used for every object operation instead of the bucket behind S3Client.
+	Store ObjectStore
+	// Manifest, if set, keeps the records of the synced files instead of the SQLite manifest of InitDb, which is
+	// then not needed. The options and methods that need more than it keeps fail with ErrNeedsSQLite.
+	Manifest ManifestStore
+	// KeyFunc, if set, fully controls the S3 key for each local file path.
+	KeyFunc func(localPath string) string
+	// KeyPrefix goes in front of the key of every file, piece and snapshot index, to keep the objects of several
+	// machines apart in one bucket, e.g. "hostname/". Files keep the key they were recorded with until they change.
+	KeyPrefix string
+	// RelativeKeys keys files by their path relative to their source folder with forward slashes, under KeyPrefix,
+	// instead of by their full local path, so a tree gets the same keys from any machine or OS. See sourcePrefix.
+	RelativeKeys bool
+	// UploadTimeout bounds the upload of a single file, DefaultUploadTimeout if 0.
+	UploadTimeout time.Duration
+	// StallTimeout cancels an upload that moved no bytes for this long and starts it over, up to StallRetries
+	// times (DefaultStallRetries if 0). 0 turns stall detection off.
+	StallTimeout time.Duration
+	StallRetries int
+	// PreservePermissions stores the mode, uid, gid and modification time of each file as object metadata so a
+	// restore can reapply them.
+	PreservePermissions bool
+	// PreserveXattrs stores the extended attributes of each file with its object, in a sidecar object when they
+	// don't fit in the metadata, and Download sets them again. Linux and macOS only.
+	PreserveXattrs bool
+	// Symlinks is what the walk does with symbolic links, SymlinksFollow when empty. See ParseSymlinks.
+	Symlinks string
+	// KeepEmptyDirs uploads the empty directories under the source folders as empty objects named like a folder,
+	// with a trailing slash, so Download and restores bring them back.
+	KeepEmptyDirs bool
+	// Progress, if set, receives a ProgressEvent for every step of UploadDiffs. Sends block, so keep it drained.
+	Progress chan<- ProgressEvent
+	// NoSpinners turns off the terminal spinners, for when Progress is the only consumer.
+	NoSpinners bool
+	// Reporter, if set, is told about the run in place of the terminal output, see Reporter.
+	Reporter Reporter
+	// Output is where the spinners, progress bars and messages go instead of stdout, like a log file or a
+	// widget of the program embedding the Syncer. ErrOutput, if set, gets the warnings and errors instead.
+	Output    io.Writer
+	ErrOutput io.Writer
+	// Compact shows a run as one progress bar instead of a spinner per file.
+	Compact bool
+	// GroupByDir shows a spinner per directory counting its files up instead of one per file, the default output
+	// keeps the per file detail.
+	GroupByDir bool
+	reporter   reporter
+	// DeltaMode uploads only the blocks that changed since the last upload of a file, see delta.go.
+	DeltaMode bool
+	// DeltaBlockSize is the block size for DeltaMode signatures, DefaultDeltaBlockSize if 0.
+	DeltaBlockSize int
+	// MaxRetries is how many times a PUT that failed on a transient error, like a dropped connection or a 500, is
+	// sent again, DefaultMaxRetries if 0 and none if negative. Throttled uploads are retried by ThrottleRetries.
+	MaxRetries int
+	// ThrottleRetries is how many times an upload S3 throttled is retried, DefaultThrottleRetries if 0.
+	ThrottleRetries int
+	throttle        *throttleController
+	// WatchInterval is how often Watch looks for changes it wasn't told about, DefaultWatchInterval if 0, and
+	// WatchDebounce how long the folders have to be quiet before it syncs them, DefaultWatchDebounce if 0.
+	WatchInterval time.Duration
+	WatchDebounce time.Duration
+	// SharedManifest keeps the manifest in the bucket as well, for syncing it from several machines: a sync pulls
+	// it first when another machine pushed since, and pushes it when done. See PushManifest.
+	SharedManifest bool
+	// KeepGoing uploads the rest of the files when one fails instead of stopping the run, UploadDiffs then
+	// returns an *UploadErrors listing every failure. The failed files stay pending for the next sync.
+	KeepGoing bool
+	// StorageClass is the class for uploads when neither the source nor deep choose one, Standard if empty.
+	StorageClass types.StorageClass
+	// ClassRules pick the class of the files they match by size and age, ahead of deep and StorageClass, the
+	// first match wins. See ParseClassRule.
+	ClassRules []ClassRule
+	// MaxFailures quarantines files that failed this many runs in a row, see Quarantined. 0 retries forever.
+	MaxFailures int
+	// PutLimits overrides the largest single PUT per storage class, for S3 compatible stores with other limits.
+	PutLimits map[types.StorageClass]int64
+	// OneFileSystem keeps the walk on the filesystem each source folder is on, skipping mount points below it.
+	OneFileSystem bool
+	// Subpath restricts a run to this folder relative to FolderPath (or each source), keys stay relative to the full folder.
+	Subpath string
+	// PartKeyTemplate lays out the keys of split pieces, see partKeyFor. The keys are recorded per part, so
+	// changing it only affects files split from then on.
+	PartKeyTemplate string
+	// PartSize is the piece size for split files, 2GB by default. It is raised automatically to stay within MaxParts.
+	PartSize int64
+	// SplitConcurrency is how many pieces of one file are written at once when it is split, each read from its own
+	// offset, one after another if 0 or 1. It helps most on SSDs and RAID, a single spinning disk only seeks more.
+	SplitConcurrency int
+	// SplitBudget, if set, splits the files of each page that need splitting ahead of their upload, several at
+	// once, as long as their pieces take up no more than this many bytes of temp space together.
+	SplitBudget int64
+	// TargetParts, if set, sizes the pieces of every split file so it makes about this many even parts instead,
+	// no smaller than MinPartSize and no bigger than the PUT limit.
+	TargetParts int
+	// PartConcurrency is how many pieces of one split file upload at once, one after another if 0 or 1. It is
+	// separate from how many files upload at once, since the pieces of a file contend for the same disk.
+	PartConcurrency int
+	// PartConcurrencyAuto tunes how many pieces upload at once from their throughput instead, up to PartConcurrency
+	// or DefaultMaxPartConcurrency if that is 0 or 1. See partTuner and TunedPartConcurrency.
+	PartConcurrencyAuto bool
+	parts               *partTuner
+	// NativeMultipart uploads files over the PUT limit as one object with the S3 multipart API, the parts read
+	// straight from the file, instead of splitting them into pieces on disk and uploading each as its own key.
+	// It needs a Store that is a MultipartStore, with any other the files are split as before.
+	NativeMultipart bool
+	// StaleUploadAge is how old an unfinished upload in the bucket the manifest has no record of must be before
+	// ResumePending aborts it, DefaultStaleUploadAge when it is 0. A younger one may be going up from another
+	// machine sharing the manifest.
+	StaleUploadAge time.Duration
+	// ForceRestart splits and uploads a file over the PUT limit from scratch even when an earlier run left it
+	// partly uploaded. Without it the pieces that already went up are kept and only the rest are sent.
+	ForceRestart bool
+	// RestoreDays is how long the copies of archived objects RestoreFolder asks for stay readable,
+	// DefaultRestoreDays when it is 0.
+	RestoreDays int32
+	// MaxBytesPerSecond caps how fast a run uploads, all the files and parts going up at once together, so an
+	// archive job doesn't fill a home connection. 0 is no limit.
+	MaxBytesPerSecond int64
+	bandwidth         *bandwidth
+	// MaxConcurrency is how many files upload at once, DefaultMaxConcurrency if 0. S3 throttling lowers it for
+	// a while, see ThrottleStats.
+	MaxConcurrency int
+	// StrictWalk fails WalkAndHash on the first file or folder it can't read, naming it, instead of leaving it out.
+	StrictWalk bool
+	// ContentOnly uploads a file only when its content differs from the hash recorded at upload, whatever its
+	// modification time says. Every file is hashed on every sync, it keeps versioned buckets free of no-op versions.
+	ContentOnly bool
+	// HashMode picks how changes are told by name, mtime by default, and sha256 or etag for ContentOnly with
+	// that Checksum, see HashMode.
+	HashMode HashMode
+	// HashSkewed compares the files whose modification time is in the future or went back, see Skewed, by
+	// content like ContentOnly does, since a clock that was off can hide a change behind a time that still matches.
+	HashSkewed bool
+	skewed     []string
+	// OnlyNew uploads only paths the manifest has never seen. Files already recorded are left alone whatever
+	// their modification time or content, for append-only folders where copies rewrite the times.
+	OnlyNew bool
+	// DryRun leaves the manifest and the bucket as they are: UpdateManifest works out what changed and throws
+	// it away again, and UploadDiffs lists what it would upload instead, see DryRunReport.
+	DryRun  bool
+	dryRuns []string
+	// LargeFile is the size from which a file gets a byte progress bar of its own on the terminal, the smaller
+	// ones share a single bar and send no BytesProgress events. 0 keeps a spinner per file, with the share sent and the rate.
+	LargeFile int64
+	// Transform, if set, rewrites the content and optionally the key of every file on its way up, see TransformFunc.
+	Transform TransformFunc
+	// RunLabel names the run, like weekly-2024w23. It is recorded in the run history and put on every object the run
+	// uploads, as metadata and as the TagRunLabel tag so lifecycle rules can select on it.
+	RunLabel string
+	// Snapshot puts the objects of new and changed files under this prefix, and RecordSnapshot records every file
+	// as part of it. Run after run that keeps full point in time copies, unchanged files are stored once.
+	Snapshot string
+	// FromSnapshot makes Download restore files as they were in that snapshot.
+	FromSnapshot string
+	// Sparse uploads only the data of files with holes, like disk images, and records where the holes are so
+	// Download makes the file sparse again. Holes are found with SEEK_DATA, so on Linux only.
+	Sparse bool
+	// LowPriority runs the sync in the background: idle IO class and nice 19 on Linux, background mode on
+	// Windows and nice 19 elsewhere. It applies to the whole process from the first walk or upload on.
+	LowPriority bool
+	// FilePause is a rest before handing out the next upload, to leave the disk to others for a moment.
+	FilePause time.Duration
+	// SanitizeKeys percent encodes control characters, spaces at either end of a path segment and "." and ".."
+	// segments in new keys, and drops empty segments. Without it such keys are uploaded with a warning.
+	SanitizeKeys bool
+	// RenameCollisions gives files whose keys differ only in case keys of their own, see caseCollisions.
+	// Without it they are only warned about.
+	RenameCollisions bool
+	// ShortenKeys replaces the tail of keys over MaxKeyLength with a hash, see shortenKey. Without it those
+	// files fail with ErrKeyTooLong before anything is uploaded.
+	ShortenKeys bool
+	// SkipExisting records files as uploaded without sending them when their key already holds the same
+	// content, like after a lost manifest or a copy made by another tool. See inBucket.
+	SkipExisting bool
+	existing     *existingObjects
+	// ChecksumFile is the key WriteChecksums writes a SHA256SUMS file of the bucket to, or the sums of Checksum.
+	ChecksumFile string
+	// Checksum is the hash the manifest records file contents with, SHA256 when unset. The manifest keeps the one
+	// it was made with and InitDb refuses another, an unset Checksum takes it.
+	Checksum Checksum
+	// Headers, if set, picks the Cache-Control, Content-Disposition, Content-Language and Expires headers of every
+	// file, see HeaderRules, and may pick the Content-Type.
+	Headers HeaderFunc
+	// DetectContentType sets the Content-Type of the files Headers gives none from their extension, see
+	// mime.TypeByExtension.
+	DetectContentType bool
+	// Metadata is custom object metadata set on every file of the run, MetadataFunc picks more for each file and
+	// wins where they share a key. Both are checked with ValidateMetadata, and split pieces all carry it.
+	Metadata     map[string]string
+	MetadataFunc func(p string) map[string]string
+	// Tags are object tags set on every file of the run, TagsFunc picks more for each file and wins where they
+	// share a key, checked with ValidateTags. They go with the RunLabel tag, if any.
+	Tags     map[string]string
+	TagsFunc func(p string) map[string]string
+	// RequesterPays sends RequestPayer=requester with every object request, needed to use requester pays buckets.
+	RequesterPays bool
+	// ExpectedBucketOwner is the AWS account ID the bucket must belong to. It goes with every request as
+	// x-amz-expected-bucket-owner, and S3 rejects those for a bucket of any other account with 403.
+	ExpectedBucketOwner string
+	// ServerSideEncryption, KMSKeyID and KMSEncryptionContext encrypt every object and split piece on the server,
+	// see S3Store.ServerSideEncryption. Check the bucket and key policy take them with ValidateEncryption before a run.
+	ServerSideEncryption types.ServerSideEncryption
+	KMSKeyID             string
+	KMSEncryptionContext map[string]string
+	// EncryptionKey, a 32 byte key like one read by LoadKeyFile, encrypts every file with AES-256-GCM before it
+	// leaves the machine, after Transform, and Download decrypts it again. See CipherAESGCM.
+	EncryptionKey []byte
+	// Compression, CompressionGzip or empty for none, compresses the files matching CompressTypes before they
+	// are uploaded, after Transform and before EncryptionKey. Download decompresses them again.
+	Compression string
+	// CompressTypes are the extensions and MIME types Compression applies to, DefaultCompressTypes when empty.
+	CompressTypes []string
+	// Hardlinks uploads files with several hardlinks once, the other paths to the same inode are recorded in the
+	// manifest as links to the first one and Download links them again.
+	Hardlinks bool
+	// inodes and links are the hardlinks found by the last WalkAndHash, links maps a path to its first one.
+	inodes map[fileID]string
+	links  map[string]string
+	// restored are the files Download wrote this run, by content path, so hardlinks can be recreated.
+	restored map[string]string
+	// SkipLargerThan leaves files over this many bytes out of the sync with a warning for each, 0 means no cap.
+	// It's a safety net for strays like VM images, the files skipped by the last walk are in Oversize.
+	SkipLargerThan int64
+	// oversize are the files the last WalkAndHash skipped for SkipLargerThan.
+	oversize []string
+	// skips are all the files the last WalkAndHash skipped, for SkipLargerThan or Skip, with why.
+	skips []DryRunSkip
+	// filters are the ones the last WalkAndHash matched, nil before it ran. See inScope.
+	filters []fileFilter
+	// ignores are the IgnoreFile rules of each source folder, as the last WalkAndHash read them.
+	ignores map[string]ignoreRules
+	// filteredOut are the synced files the last UpdateManifest found no longer match filters, see FilteredOut.
+	filteredOut []string
+	// NoSplit fails files over the single PUT limit with ErrTooLarge instead of splitting them, so every file is one object.
+	NoSplit bool
+	// tempDirs are the split folders made by this Syncer, removed by Close in case an upload left one behind.
+	tempDirs map[string]bool
+	// presplits are the files split ahead of their upload, see SplitBudget.
+	presplits *presplitter
+	// sizes are the file sizes seen by the last WalkAndHash, so the upload total needs no second stat pass.
+	sizes map[string]int64
+	// transformed scales the progress of the files going up through Transform, by path, see putTransformed.
+	transformed map[string]*progressScale
+	// CheckpointWalk saves WalkAndHash progress in the manifest as it goes, so a walk that crashed picks up where it stopped.
+	CheckpointWalk bool
+	// Skip is asked about every file the filters let through, see SkipEmpty and SkipIncompressible.
+	Skip SkipFunc
+	// UploadOrder sorts the files UploadDiffs is given before uploading them.
+	UploadOrder Order
+	// StartAfter leaves out the files whose path sorts before or equal to it, like StartAfter in ListObjectsV2. It is a
+	// manual resume for a run that was interrupted, the files left out stay pending.
+	StartAfter string
+	// IncludeDirs limits the sync to these folders relative to FolderPath (or each source), on top of the filters.
+	IncludeDirs []string
+	// Retention is how long objects of files deleted locally stay in the bucket before Purge removes them.
+	Retention time.Duration
+	// DBOptions tunes the sqlite pragmas the manifest is opened with by InitDb.
+	DBOptions DBOptions
+	// DetectDrift refuses to overwrite objects that changed in the bucket since this manifest last uploaded them.
+	DetectDrift bool
+	// ContentMD5 sends the MD5 of every upload and split piece with it, so S3 turns down a body corrupted on the
+	// way with ErrBadDigest instead of storing it. It costs a second read of each file.
+	ContentMD5 bool
+	// Events, if set, gets an UploadEvent for every file that went up, see WebhookPublisher and SNSPublisher.
+	Events EventPublisher
+	// MaxDuration stops the upload cleanly once the run has taken this long, counted from WalkAndHash. The file in
+	// flight finishes, split pieces and all, and the rest stay pending for the next run, see Remaining. 0 is no limit.
+	MaxDuration time.Duration
+	// MaxFilesPerRun and MaxBytesPerRun stop the upload the same way once it uploaded this many files or would
+	// go over this many bytes with the next one, so a tree of millions of files goes up in batches over several
+	// runs. Where a batch stopped is kept in the manifest, see BatchCursor. 0 is no limit.
+	MaxFilesPerRun int
+	MaxBytesPerRun int64
+	started        time.Time
+	remaining      int
+	remainingBytes int64
+	// summary adds up the sync for Summary.
+	summary RunSummary
 }
 
 // UploadDiffs uploads the files(paths) in the diffs slice, will commit to glacier deep archive if deep is set to true
-func (app *Syncer) UploadDiffs(ctx context.Context, diffs []string, deep bool) error {
-	count := len(diffs)
-	if count == 0 {
-		pterm.Success.Println("No files to update!")
+// Every call is recorded as a run in the manifest, see RunHistory. With DryRun they are only listed.
+func (app *Syncer) UploadDiffs(ctx context.Context, diffs []string, deep bool) (err error) {
+	if app.DryRun {
+		report, err := app.DryRunReport(diffs, deep)
+		if err != nil {
+			return err
+		}
+		app.printDryRun(report)
 		return nil
 	}
+	run, err := app.startRun()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		finishErr := app.finishRun(run, err)
+		if err == nil {
+			err = finishErr
+		}
+	}()
 
-	for i, v := range diffs {
-		spinnerInfo, err := pterm.DefaultSpinner.Start(fmt.Sprintf("Uploading file: %s. %d/%d", v, i+1, count))
-		if err != nil {
-			return err
+	diffs = app.sortDiffs(app.startAfter(diffs))
+	done := false
+	next := func() ([]string, error) {
+		if done {
+			return nil, nil
 		}
+		done = true
+		return diffs, nil
+	}
+	return app.uploadPages(ctx, run, len(diffs), app.PendingBytes(diffs), next, deep)
+}
 
-		err = app.putObject(ctx, v, spinnerInfo, deep)
+// startAfter returns the diffs whose path sorts after StartAfter, all of them when it isn't set.
+func (app *Syncer) startAfter(diffs []string) []string {
+	if app.StartAfter == "" {
+		return diffs
+	}
+	var res []string
+	for _, p := range diffs {
+		if p > app.StartAfter {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// uploadPages uploads the files next returns until it returns none, count and total are the number and bytes of
+// files across all pages for the progress events. The files of a page go up MaxConcurrency at a time, the first
+// that fails stops the rest and is returned.
+func (app *Syncer) uploadPages(ctx context.Context, run int64, count int, total int64, next func() ([]string, error), deep bool) error {
+	if count == 0 {
+		if !app.NoSpinners {
+			app.term().success().Println("No files to update!")
+		}
+		return app.saveBatch(false, "")
+	}
+
+	app.background()
+	app.startClock()
+	app.throttle = newThrottleController(app.concurrency())
+	app.parts = app.newPartTuner()
+	app.bandwidth = newBandwidth(app.MaxBytesPerSecond)
+	app.existing = nil
+	app.remaining, app.remainingBytes = 0, 0
+	// the next run gets a window of its own
+	defer func() { app.started = time.Time{} }()
+	defer app.reportStopped()
+	defer app.reportTuning()
+	defer app.reportThrottling()
+	defer app.stopPresplits()
+	progress := &uploadProgress{count: count, total: total}
+	for {
+		page, err := next()
 		if err != nil {
-			spinnerInfo.Fail(err)
 			return err
 		}
-		err = app.updateUploadStatus(v)
+		if len(page) == 0 {
+			err = app.saveBatch(false, "")
+			if err != nil {
+				return err
+			}
+			return progress.failures()
+		}
+		if err = app.listExisting(ctx, page); err != nil {
+			return err
+		}
+		app.presplitPage(ctx, page, deep)
+		app.queueDirs(page)
+		stopped, err := app.uploadPage(ctx, run, page, progress, deep)
 		if err != nil {
-			spinnerInfo.Fail(err)
 			return err
 		}
-		spinnerInfo.Success(fmt.Sprintf("Successfully uploaded file: %s. %d/%d", v, i+1, count))
+		if stopped {
+			err = app.saveBatch(true, progress.last)
+			if err != nil {
+				return err
+			}
+			return progress.failures()
+		}
+	}
+}
+
+// uploadProgress counts the files of a run as they are handed out and as they finish, which with several at once
+// isn't the same order. Only the finished count is shared with the workers.
+type uploadProgress struct {
+	count   int
+	total   int64
+	started int
+	done    int64
+	// last is the last file handed out
+	last string
+	// mu guards finished and failed
+	mu       sync.Mutex
+	finished int
+	// failed are the files that failed with KeepGoing
+	failed []*UploadError
+}
+
+// failures returns the files that failed with KeepGoing as *UploadErrors, nil if none did.
+func (progress *uploadProgress) failures() error {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	if len(progress.failed) == 0 {
+		return nil
+	}
+	return &UploadErrors{Uploaded: progress.finished - len(progress.failed), Failed: progress.failed}
+}
+
+// concurrency is how many files upload at once, DefaultMaxConcurrency when MaxConcurrency isn't set.
+func (app *Syncer) concurrency() int {
+	if app.MaxConcurrency > 0 {
+		return app.MaxConcurrency
+	}
+	return DefaultMaxConcurrency
+}
+
+// uploadPage uploads the files of page with a pool of concurrency workers and returns the first error, or with
+// KeepGoing collects the failed files in progress and goes on. It reports stopped when MaxDuration ran out, or
+// MaxFilesPerRun or MaxBytesPerRun was reached, before every file was handed out.
+func (app *Syncer) uploadPage(parent context.Context, run int64, page []string, progress *uploadProgress, deep bool) (stopped bool, err error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	var once sync.Once
+	fail := func(e error) {
+		once.Do(func() {
+			err = e
+			cancel()
+		})
+	}
+
+	// a slot is taken before the checks, so they run when a worker is free to start the file
+	slots := make(chan struct{}, app.concurrency())
+	var wg sync.WaitGroup
+	for _, p := range page {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		// FilePause spaces out the files as they are handed out
+		if progress.started > 0 {
+			if e := app.pause(ctx); e != nil {
+				fail(e)
+				break
+			}
+		}
+		// only ever between files, so none is left half up
+		if app.overTime() || app.batchFull(progress, p) {
+			app.remaining, app.remainingBytes = progress.count-progress.started, max(progress.total-progress.done, 0)
+			stopped = true
+			break
+		}
+		progress.started++
+		progress.done += app.sizeOf(p)
+		progress.last = p
+		started := ProgressEvent{Type: FileStarted, Path: p, Index: progress.started, Total: progress.count, Size: app.sizeOf(p), TotalBytes: progress.total}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			e := app.uploadNext(ctx, run, started, progress, deep)
+			var failed *UploadError
+			if app.KeepGoing && errors.As(e, &failed) && parent.Err() == nil {
+				progress.mu.Lock()
+				progress.failed = append(progress.failed, failed)
+				progress.mu.Unlock()
+				return
+			}
+			if e != nil {
+				fail(e)
+			}
+		}()
+	}
+	wg.Wait()
+	if err == nil && !stopped {
+		err = parent.Err()
 	}
+	return stopped, err
+}
+
+// uploadNext uploads the file started hands out, reporting its progress.
+func (app *Syncer) uploadNext(ctx context.Context, run int64, started ProgressEvent, progress *uploadProgress, deep bool) error {
+	p := started.Path
+	app.emit(started)
+	err := app.uploadThrottled(ctx, p, deep)
+	app.dropPresplit(p)
+	app.recordRunFile(run, p, err)
 
+	// Index counts the files finished, so the count shown only goes up when they finish out of order
+	progress.mu.Lock()
+	progress.finished++
+	finished := progress.finished
+	progress.mu.Unlock()
+	if err != nil {
+		app.emit(ProgressEvent{Type: FileFailed, Path: p, Index: finished, Total: progress.count, Err: err})
+		return &UploadError{Path: p, Kind: classify(err), Err: err}
+	}
+	app.emit(ProgressEvent{Type: FileCompleted, Path: p, Index: finished, Total: progress.count, Size: fileSize(p)})
+	return nil
+}
+
+// reportThrottling prints how often S3 throttled the run, if it did at all.
+func (app *Syncer) reportThrottling() {
+	stats := app.ThrottleStats()
+	if stats.Throttled == 0 || app.NoSpinners {
+		return
+	}
+	app.term().warning().Printfln("S3 throttled %d uploads, concurrency went as low as %d of %d.", stats.Throttled, stats.MinConcurrency, stats.MaxConcurrency)
+}
+
+// uploadOne uploads the file p and walks its manifest status through in_progress to complete or failed.
+func (app *Syncer) uploadOne(ctx context.Context, p string, deep bool) error {
+	target, err := app.linkTarget(p)
+	if err != nil {
+		return err
+	}
+	if target != "" {
+		// the content goes up with target, only the manifest needs to know about p
+		return app.completeUpload(p)
+	}
+	key, err := app.keyFor(p)
+	if err != nil {
+		return err
+	}
+	if problem := keyProblem(key); problem != "" && !app.NoSpinners {
+		app.term().warning().Printfln("%s: the key %q has %s, it may be hard to get back. See --sanitize-keys.", p, key, problem)
+	}
+	if len(key) > MaxKeyLength {
+		// S3 turns it down anyway, say why before reading any of it
+		app.setStatus(p, StatusFailed)
+		app.recordFailure(p)
+		return fmt.Errorf("its key is %d bytes, over %d, see --shorten-keys: %w", len(key), MaxKeyLength, ErrKeyTooLong)
+	}
+	if app.SkipExisting {
+		done, err := app.skipExisting(ctx, p, key, app.storageClassFor(p, deep))
+		if err != nil || done {
+			return err
+		}
+	}
+	err = app.setStatus(p, StatusInProgress)
+	if err != nil {
+		return err
+	}
+	before, err := app.localStat(p)
+	if err != nil {
+		app.setStatus(p, StatusFailed)
+		app.recordFailure(p)
+		return err
+	}
+	err = app.putObjectWithTimeout(ctx, p, key, app.storageClassFor(p, deep))
+	if err != nil && ctx.Err() != nil {
+		// stopped because another file failed or the run was cancelled, not the fault of this one
+		app.setStatus(p, StatusPending)
+		return err
+	}
+	if err != nil {
+		app.setStatus(p, StatusFailed)
+		app.recordFailure(p)
+		return err
+	}
+	after, err := app.localStat(p)
+	if err != nil || !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		// what went up may be half old, half new, the next walk picks up the new modification time
+		app.setStatus(p, StatusPending)
+		return fmt.Errorf("%s: %w", p, ErrFileChanged)
+	}
+	err = app.completeUpload(p)
+	if err != nil {
+		return err
+	}
+	app.publishUpload(ctx, p, string(app.storageClassFor(p, deep)))
 	return nil
 }
 
 // UpdateManifest Updates the database for all the files (paths) specified in objs slice
+// and tombstones the recorded files that are no longer there, see Purge.
+// It all commits in one Batch, a failure leaves the manifest as it was and the next walk starts over.
 func (app *Syncer) UpdateManifest(objs map[string]int64) error {
+	if option := app.sqliteOnly(); option != "" {
+		if err := app.needSQLite(option); err != nil {
+			return err
+		}
+	}
+	var dryErr error
+	err := app.records().Batch(func() error {
+		err := app.writeInventory(objs)
+		if err != nil || !app.DryRun {
+			return err
+		}
+		// GetUploadList hands out what the inventory found, the rollback leaves the manifest untouched
+		app.dryRuns = nil
+		app.dryRuns, dryErr = app.GetUploadList()
+		if app.dryRuns == nil {
+			app.dryRuns = []string{}
+		}
+		return errDryRun
+	})
+	if err == errDryRun {
+		return dryErr
+	}
+	return err
+}
 
+// errDryRun rolls back the Batch of an UpdateManifest with DryRun.
+var errDryRun = errors.New("dry run")
+
+// writeInventory is UpdateManifest inside its transaction.
+func (app *Syncer) writeInventory(objs map[string]int64) error {
+	app.skewed = nil
 	for k, v := range objs {
-		app.updateRecord(k, v)
+		err := app.updateRecord(k, v)
+		if err == nil {
+			err = app.recordLink(k, app.links[k])
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	app.reportSkewed()
+	_, err := app.caseCollisions(objs)
+	if err != nil {
+		return err
+	}
+	err = app.markDeleted(objs)
+	if err != nil {
+		return err
+	}
+	if app.CheckpointWalk {
+		return app.clearCheckpoint()
 	}
 	return nil
 }
 
-// WalkAndHash walks the directory structure that is specifed in the Syncer.Folderpath.
-// Will filter for filetypes listed in the filters slice.
-// Returns a map of filepath[lastModDate]
-func (app *Syncer) WalkAndHash(filters []string) (map[string]int64, error) {
-	spinnerInfo, err := pterm.DefaultSpinner.Start("Taking inventory of existing files.")
+// WalkAndHash walks the directory structure that is specifed in the Syncer.Folderpath, or every folder in Syncer.Sources.
+// Will filter for the files matching the filters slice, see parseFilters. Files recorded under other filters are out of scope from
+// then on, see inScope. Returns a map of filepath[lastModDate]. It stops with the error of ctx once that is done,
+// a checkpointed walk picks up from there the next time.
+func (app *Syncer) WalkAndHash(ctx context.Context, filters []string) (map[string]int64, error) {
+	app.background()
+	app.started = time.Now()
+	app.startSummary()
+	inv := app.startInventory()
+	roots, err := app.walkRoots()
 	if err != nil {
+		inv.fail(err)
 		return nil, err
 	}
 	retMap := make(map[string]int64)
-	err = filepath.Walk(app.FolderPath, func(p string, info os.FileInfo, err error) error {
-		if err == nil {
-			if !info.IsDir() {
-				if !inFilters(info.Name(), filters) {
-					return nil
-				}
-				h, err := getLastModDate(p)
-				if err != nil {
-					spinnerInfo.Fail(err)
-					return err
-				}
-				p := app.localize(p)
-				retMap[p] = h
-			}
-
+	app.sizes = make(map[string]int64)
+	app.oversize = nil
+	app.skips = nil
+	app.inodes = make(map[fileID]string)
+	app.links = make(map[string]string)
+	app.filters, err = parseFilters(filters)
+	if err != nil {
+		inv.fail(err)
+		return nil, err
+	}
+	app.ignores = make(map[string]ignoreRules)
+	for _, src := range app.sources() {
+		app.ignores[src.FolderPath], err = loadIgnore(src.FolderPath)
+		if err != nil {
+			inv.fail(err)
+			return nil, err
 		}
-		return nil
-	})
+	}
+	cp, err := app.startCheckpoint(roots, filters)
+	if err == nil {
+		err = cp.load(retMap, app.sizes)
+	}
 	if err != nil {
-		spinnerInfo.Fail(err)
+		inv.fail(err)
 		return nil, err
 	}
-	spinnerInfo.Success("Taking Inventory of local files.")
+	sources := app.sources()
+	for _, root := range roots {
+		err = app.walkSource(ctx, root, app.filters, retMap, cp, inv)
+		if err == nil {
+			err = cp.finish()
+		}
+		if err != nil {
+			inv.fail(err)
+			return nil, err
+		}
+	}
+	if len(app.oversize) > 0 && !app.NoSpinners {
+		app.term().warning().Printfln("%d files over %s were skipped, see above.", len(app.oversize), formatBytes(app.SkipLargerThan))
+	}
+	app.countSummary(func(s *RunSummary) { s.Scanned = len(retMap) + s.Skipped })
+	if len(sources) > 1 {
+		inv.success(fmt.Sprintf("Found %d local files in %d folders.", len(retMap), len(sources)))
+		return retMap, nil
+	}
+	inv.success(fmt.Sprintf("Found %d local files.", len(retMap)))
 	return retMap, nil
 }
 
-// inFilters checks to see if the name of the file has one of the extensions listed in the filters slice, it returns true.
-func inFilters(name string, filters []string) bool {
-	for _, filter := range filters {
-		if strings.HasSuffix(name, filter) {
-			return true
+// walkSource adds every file under root that matches filters to retMap.
+// Only IncludeDirs are walked when they are set.
+// With OneFileSystem it does not descend into directories on another device than root, like find -xdev.
+// Progress is saved to cp as it goes, which may be nil, and shown on inv.
+func (app *Syncer) walkSource(ctx context.Context, root string, filters []fileFilter, retMap map[string]int64, cp *walkCheckpoint, inv *inventory) error {
+	var rootDev uint64
+	var haveDev bool
+	if app.OneFileSystem {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
 		}
+		rootDev, haveDev = device(info)
 	}
-	return false
+	src, _ := app.sourceFor(root)
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if app.StrictWalk {
+				return fmt.Errorf("walking %s: %w", p, err)
+			}
+			// unreadable, leave it out
+			return nil
+		}
+		if info.IsDir() {
+			inv.update(p, len(retMap))
+		} else {
+			inv.update(filepath.Dir(p), len(retMap))
+		}
+		if !app.included(src.FolderPath, p, info.IsDir()) || app.ignored(p, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && haveDev && p != root {
+			if dev, ok := device(info); ok && dev != rootDev {
+				if !app.NoSpinners {
+					app.term().warning().Printfln("Skipping %s, it is on another filesystem.", p)
+				}
+				return filepath.SkipDir
+			}
+		}
+		resumed, err := cp.visit(p, info.IsDir())
+		if err != nil {
+			return err
+		}
+		if resumed {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && app.KeepEmptyDirs && p != root && inFilters(app.filterPath(p), filters) && emptyDir(p) {
+			p := app.localize(p)
+			retMap[p] = info.ModTime().Unix()
+			app.sizes[p] = 0
+			return cp.file(p, retMap[p], 0)
+		}
+		if !info.IsDir() {
+			if !inFilters(app.filterPath(p), filters) {
+				return nil
+			}
+			symlink := info.Mode()&os.ModeSymlink != 0
+			if symlink && app.Symlinks == SymlinksSkip {
+				return nil
+			}
+			if app.SkipLargerThan > 0 && info.Size() > app.SkipLargerThan {
+				app.oversize = append(app.oversize, p)
+				app.skips = append(app.skips, DryRunSkip{Path: p, Size: info.Size(), Reason: fmt.Sprintf("over the %s cap", formatBytes(app.SkipLargerThan))})
+				app.countSummary(func(s *RunSummary) { s.Skipped++ })
+				if !app.NoSpinners {
+					app.term().warning().Printfln("Skipping %s, it is %s, over the %s cap.", p, formatBytes(info.Size()), formatBytes(app.SkipLargerThan))
+				}
+				return nil
+			}
+			if app.Skip != nil {
+				if skip, reason := app.Skip(p, info); skip {
+					app.skips = append(app.skips, DryRunSkip{Path: p, Size: info.Size(), Reason: reason})
+					app.countSummary(func(s *RunSummary) { s.Skipped++ })
+					if !app.NoSpinners {
+						app.term().info().Printfln("Skipping %s, %s.", p, reason)
+					}
+					return nil
+				}
+			}
+			h, err := getLastModDate(p)
+			if symlink && app.Symlinks == SymlinksRecord {
+				// the link itself, which may well point nowhere
+				h, err = info.ModTime().Unix(), nil
+			}
+			if err != nil {
+				return err
+			}
+			p := app.localize(p)
+			retMap[p] = h
+			app.sizes[p] = info.Size()
+			if app.Hardlinks {
+				app.noteHardlink(p, info)
+			}
+			err = cp.file(p, h, info.Size())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // localize converts paths to windows paths if needed, has its own function for future needs.
@@ -115,114 +844,408 @@ func (app *Syncer) localize(s string) string {
 
 }
 
-// putObject actially performs the uploading to the S3 bucket for the file (path) specified by obj.
-// if deep is true, will put it in glacier deep storage.
+// putObjectWithTimeout runs putObject bounded by the UploadTimeout so a stalled connection doesn't hang the sync forever.
+func (app *Syncer) putObjectWithTimeout(ctx context.Context, obj string, key string, class types.StorageClass) error {
+	timeout := app.UploadTimeout
+	if timeout == 0 {
+		timeout = DefaultUploadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return app.putObject(ctx, obj, key, class)
+}
+
+// putObject actially performs the uploading to the S3 bucket for the file (path) specified by obj under key,
+// in the storage class class.
 // Here is where the logic will live that will split files if they are too big
-func (app *Syncer) putObject(ctx context.Context, obj string, spinner1 *pterm.SpinnerPrinter, deep bool) error {
-	// Lets check the size first, if it is over 5GB ware are going to need to split it.
+func (app *Syncer) putObject(ctx context.Context, obj string, key string, class types.StorageClass) error {
+	// Lets check the size first, if it is over the single PUT limit for the storage class ware are going to need to split it.
 
-	info, err := os.Stat(obj)
+	info, err := app.localStat(obj)
+	if err != nil {
+		return err
+	}
+	deltaID, deltaGen, deltaBlock, err := app.takeDeltaState(obj)
 	if err != nil {
 		return err
 	}
 
-	if info.Size() > 4294967296 {
-		spinner1.Warning(fmt.Sprintf("%s too big for S3, Splitting into multiple files.", obj))
-		pieces, err := app.splitObject(obj, info)
+	opts := PutOptions{Metadata: app.fileMetadata(obj, info), Headers: app.headersFor(obj)}
+	err = app.addUserMetadata(obj, opts.Metadata)
+	if err != nil {
+		return err
+	}
+	opts.Tags, err = app.objectTags(obj)
+	if err != nil {
+		return err
+	}
+	if app.PreserveXattrs {
+		err = app.addXattrs(ctx, obj, key, &opts)
 		if err != nil {
 			return err
 		}
-		return app.putObjs(ctx, pieces, deep)
 	}
 
-	f, err := os.Open(obj)
+	content, marker, err := app.markerContent(obj)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if marker {
+		return app.putMarker(ctx, obj, key, content, info, class, opts)
+	}
 
-	storageClass := types.StorageClassStandard
-	if deep {
-		storageClass = types.StorageClassDeepArchive
+	compressed := app.compresses(obj)
+	err = app.markCompressed(obj, compressed, &opts)
+	if err != nil {
+		return err
 	}
-	_, err = app.S3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:       aws.String(app.Bucket),
-		Key:          aws.String(app.localize(obj)),
-		StorageClass: storageClass,
-		Body:         f,
-	})
+
+	if app.EncryptionKey != nil {
+		return app.putEncrypted(ctx, obj, key, class, opts, compressed)
+	}
+
+	if compressed {
+		return app.putCompressed(ctx, obj, key, class, opts)
+	}
+
+	if app.Transform != nil {
+		return app.putTransformed(ctx, obj, key, class, opts)
+	}
+
+	if app.Sparse {
+		extents, err := sparseExtents(obj, info)
+		if err != nil {
+			return err
+		}
+		if extents != nil {
+			return app.putSparse(ctx, obj, key, info, extents, class, opts)
+		}
+	}
+
+	if app.NoSplit && info.Size() > app.putLimit(class) {
+		return fmt.Errorf("%s is %d bytes, the limit for %s is %d: %w", obj, info.Size(), class, app.putLimit(class), ErrTooLarge)
+	}
+
+	// a snapshot puts the file under a prefix of its own, with no earlier version there to patch
+	if app.DeltaMode && app.Snapshot == "" {
+		uploaded, err := app.putDelta(ctx, obj, key, info, class, opts, deltaID, deltaGen, deltaBlock)
+		if err != nil || uploaded {
+			return err
+		}
+	}
+
+	err = app.putContent(ctx, obj, obj, key, info, class, opts)
 	if err != nil {
 		return err
 	}
+
+	if app.DeltaMode {
+		// a full upload starts a new delta chain
+		return app.recordSignatures(obj, 0)
+	}
 	return nil
+}
 
+// putContent uploads src, which holds the content of the synced file obj, as key. Files over the single PUT limit
+// are split, with the pieces recorded against obj.
+func (app *Syncer) putContent(ctx context.Context, obj string, src string, key string, info fs.FileInfo, class types.StorageClass, opts PutOptions) error {
+	if info.Size() <= app.putLimit(class) {
+		if app.reportsBytes(info.Size()) {
+			return app.uploadWithProgress(ctx, obj, src, key, info.Size(), class, opts)
+		}
+		return app.uploadFile(ctx, src, key, class, opts)
+	}
+	if store, ok := app.multipart(); ok {
+		return app.putMultipart(ctx, store, obj, src, key, info, class, opts)
+	}
+	pieces, keys, ok := app.takePresplit(obj, info)
+	if ok {
+		defer app.releasePresplit(obj)
+	} else {
+		if src == obj && !app.ForceRestart {
+			resumed, err := app.resumeSplit(ctx, obj, key, info, class, opts)
+			if err != nil || resumed {
+				return err
+			}
+		}
+		var err error
+		pieces, keys, err = app.splitAs(ctx, obj, src, key, info, app.putLimit(class))
+		if err != nil {
+			return err
+		}
+	}
+	err := app.putObjs(ctx, obj, pieces, keys, class, opts)
+	splitter.CleanUp(pieces)
+	return err
 }
 
-func (app *Syncer) splitObject(obj string, info fs.FileInfo) ([]string, error) {
-	id, err := app.setMultipart(obj)
+// uploadWithProgress is uploadFile for src, reporting the bytes sent as BytesProgress events for obj.
+func (app *Syncer) uploadWithProgress(ctx context.Context, obj string, src string, key string, size int64, class types.StorageClass, opts PutOptions) error {
+	f, err := os.Open(src)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer f.Close()
+	return app.putBody(ctx, key, &progressReader{file: f, size: size, report: func(read int64) {
+		app.emit(ProgressEvent{Type: BytesProgress, Path: obj, Bytes: read, Size: size})
+	}}, class, opts)
+}
+
+// reportsBytes reports whether the upload of a file of size bytes is followed with BytesProgress events, every
+// one is unless LargeFile leaves the smaller ones to a bar counting files.
+func (app *Syncer) reportsBytes(size int64) bool {
+	return app.LargeFile <= 0 || size >= app.LargeFile
+}
 
+// uploadFile sends the file at p to the bucket as key with the object metadata and headers in opts.
+func (app *Syncer) uploadFile(ctx context.Context, p string, key string, class types.StorageClass, opts PutOptions) error {
+	f, err := os.Open(p)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer f.Close()
+	return app.putBody(ctx, key, f, class, opts)
+}
 
-	progress := make(chan string)
-	retErr := make(chan error)
-	var pieces []string
-	count := 0
-	go splitter.SplitFile(obj, progress, retErr)
-	spinnerInfo, err := pterm.DefaultSpinner.Start(fmt.Sprintf("Splitting %s", obj))
+// putBody sends body to the bucket as key with the object metadata and headers in opts and records the new ETag.
+// With DetectDrift the put is conditional on the ETag recorded last time, so remote changes fail with ErrConflict.
+func (app *Syncer) putBody(ctx context.Context, key string, body io.Reader, class types.StorageClass, opts PutOptions) error {
+	opts.StorageClass = string(class)
+	if app.ContentMD5 {
+		sum, err := contentMD5(body)
+		if err != nil {
+			return err
+		}
+		opts.ContentMD5 = sum
+	}
+	if app.DetectDrift {
+		etag, err := app.recordedETag(key)
+		if err != nil {
+			return err
+		}
+		opts.IfMatch = etag
+	}
+	etag, err := app.putRetried(ctx, key, body, opts)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return app.recordETag(key, etag, class)
+}
+
+// contentMD5 returns the base64 MD5 of what is left to read of body and rewinds it, empty if body can't be
+// rewound. The file under a progressReader is read directly, so the hash pass isn't reported as progress.
+func contentMD5(body io.Reader) (string, error) {
+	seeker, ok := body.(io.ReadSeeker)
+	if pr, isProgress := body.(*progressReader); isProgress {
+		seeker = pr.file
+	}
+	if !ok {
+		return "", nil
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := md5.New()
+	_, err = io.Copy(h, seeker)
+	if err != nil {
+		return "", err
+	}
+	_, err = seeker.Seek(start, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// splitObject splits obj into pieces no bigger than limit (see pieceSize) and records them, returning the piece paths and the S3 key for each piece.
+// The caller is responsible for cleaning up the pieces once they are uploaded. A split stopped by ctx leaves
+// no pieces on disk and nothing recorded.
+func (app *Syncer) splitObject(ctx context.Context, obj string, key string, info fs.FileInfo, limit int64) ([]string, []string, error) {
+	return app.splitAs(ctx, obj, obj, key, info, limit)
+}
+
+// splitAs is splitObject for content in src that is uploaded for obj, like a transformed copy.
+func (app *Syncer) splitAs(ctx context.Context, obj string, src string, key string, info fs.FileInfo, limit int64) ([]string, []string, error) {
+	return app.splitPieces(ctx, obj, src, key, info, limit, app.emit)
+}
+
+// splitPieces is splitAs reporting its progress to emit.
+func (app *Syncer) splitPieces(ctx context.Context, obj string, src string, key string, info fs.FileInfo, limit int64, emit func(ProgressEvent)) ([]string, []string, error) {
+	size, err := app.pieceSize(info.Size(), limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", obj, err)
+	}
+	if app.PartKeyTemplate != "" {
+		err = ValidatePartTemplate(app.PartKeyTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	progress := make(chan splitter.Piece)
+	retErr := make(chan error)
+	var pieces, sums []string
+	count := 0
+	// the pieces are summed as they are written, so recording them doesn't read them all again
+	go splitter.SplitFileOptions(ctx, src, splitter.Options{Size: size, Concurrency: app.SplitConcurrency, Hash: app.checksum().New}, progress, retErr)
+	emit(ProgressEvent{Type: SplitStarted, Path: obj, Size: info.Size(), PartSize: size, Total: int((info.Size() + size - 1) / size)})
 	for {
 		select {
 		case piece := <-progress:
-			pieces = append(pieces, piece)
+			if len(pieces) == 0 {
+				app.trackTemp(filepath.Dir(piece.Path))
+			}
+			pieces = append(pieces, piece.Path)
+			sums = append(sums, hex.EncodeToString(piece.Sum))
 			count++
-			spinnerInfo.UpdateText(fmt.Sprintf("Piece: %s created successfully, now creating piece %d", piece, count))
+			emit(ProgressEvent{Type: PieceCreated, Path: piece.Path, Index: count})
 		case err = <-retErr:
-			if err == nil {
-				spinnerInfo.Success(fmt.Sprintf("Done splitting. Split %s into %d files", info.Name(), len(pieces)))
-				goto End
+			if err != nil {
+				if len(pieces) > 0 {
+					splitter.CleanUp(pieces)
+				}
+				if ctx.Err() != nil {
+					return nil, nil, fmt.Errorf("%s: %w", obj, ctx.Err())
+				}
+				return nil, nil, fmt.Errorf("%s: %w: %w", obj, ErrSplitFailed, err)
 			}
-			spinnerInfo.Fail(err)
+			emit(ProgressEvent{Type: SplitCompleted, Path: obj, Total: len(pieces)})
 			goto End
+		case <-ctx.Done():
+			// the splitter removes the piece it was writing, wait for it to stop
+			<-retErr
+			if len(pieces) > 0 {
+				splitter.CleanUp(pieces)
+			}
+			return nil, nil, fmt.Errorf("%s: %w", obj, ctx.Err())
 		}
 	}
 End:
 
-	defer splitter.CleanUp(pieces)
-
-	err = app.recordParts(id, pieces)
+	// only a finished split is recorded, so one that was stopped leaves no multipart record behind
+	keys := make([]string, len(pieces))
+	for i := range pieces {
+		keys[i] = app.partKeyFor(key, i, len(pieces))
+	}
+	err = app.recordPieces(obj, pieces, keys, sums)
 	if err != nil {
-		return nil, err
+		splitter.CleanUp(pieces)
+		return nil, nil, err
 	}
-	return pieces, nil
+	return pieces, keys, nil
 }
 
-func (app Syncer) putObjs(ctx context.Context, objs []string, deep bool) error {
-	spinnerInfo, err := pterm.DefaultSpinner.Start("uploading parts")
-	if err != nil {
-		return err
+// putObjs uploads the split pieces of src in objs, each one under the matching entry in keys.
+// Every piece carries opts, the metadata and headers of the original file.
+func (app *Syncer) putObjs(ctx context.Context, src string, objs []string, keys []string, class types.StorageClass, opts PutOptions) error {
+	sizes := make([]int64, len(objs))
+	for i, obj := range objs {
+		info, err := os.Stat(obj)
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+	}
+	return app.putPieces(ctx, src, objs, sizes, func(i int, report func(read int64)) error {
+		return app.putPart(ctx, objs[i], keys[i], class, opts, report)
+	})
+}
+
+// putPieces runs put for each of the pieces of src, sizes bytes each, reporting their progress. put hands the
+// bytes sent so far of its piece to report, the BytesProgress events of src count them across the pieces.
+func (app *Syncer) putPieces(ctx context.Context, src string, objs []string, sizes []int64, put func(i int, report func(read int64)) error) error {
+	var sent, size int64
+	for _, n := range sizes {
+		size += n
 	}
 
+	// the pieces go up as many at a time as the tuner allows, mu serializes their progress events and the first error
+	gate := app.parts
+	if gate == nil {
+		gate = app.newPartTuner()
+	}
+	gate.startRound()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	// read is how much of each piece went up so far, sent their sum
+	read := make([]int64, len(objs))
+	progress := func(i int, n int64) {
+		sent += n - read[i]
+		read[i] = n
+		app.emit(ProgressEvent{Type: BytesProgress, Path: src, Bytes: sent, Size: size})
+	}
 	for i, obj := range objs {
-		spinnerInfo.UpdateText(fmt.Sprintf("Uploading %s part %d/%d", obj, i+1, len(objs)))
-		err = app.putObject(ctx, obj, spinnerInfo, deep)
+		err := gate.acquire(ctx)
 		if err != nil {
+			wg.Wait()
 			return err
 		}
-		// update the upload status on the parts
-		err = app.updateUploadStatusPart(obj)
+		mu.Lock()
+		err = failed
+		if err == nil {
+			app.emit(ProgressEvent{Type: PartStarted, Path: obj, Index: i + 1, Total: len(objs)})
+		}
+		mu.Unlock()
+		if err != nil {
+			gate.drop()
+			break
+		}
+		wg.Add(1)
+		go func(i int, obj string) {
+			defer wg.Done()
+			err := put(i, func(n int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				progress(i, n)
+			})
+			gate.release(sizes[i], err)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if failed == nil {
+					failed = err
+				}
+				return
+			}
+			if read[i] != sizes[i] {
+				progress(i, sizes[i])
+			}
+		}(i, obj)
+	}
+	wg.Wait()
+	return failed
+}
+
+// putPart uploads the piece obj as key, keeping its part status up to date and handing the bytes sent to report.
+func (app *Syncer) putPart(ctx context.Context, obj string, key string, class types.StorageClass, opts PutOptions, report func(read int64)) error {
+	return app.trackPart(obj, func() error {
+		f, err := os.Open(obj)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
 		if err != nil {
 			return err
 		}
+		return app.putBody(ctx, key, &progressReader{file: f, size: info.Size(), report: report}, class, opts)
+	})
+}
+
+// trackPart runs upload for the part recorded as obj, keeping its part status up to date.
+func (app *Syncer) trackPart(obj string, upload func() error) error {
+	err := app.setPartStatus(obj, StatusInProgress)
+	if err != nil {
+		return err
 	}
-	spinnerInfo.Success(fmt.Sprintf("Uploaded parts 0 - %d", len(objs)))
-	return nil
+	err = upload()
+	if err != nil {
+		app.setPartStatus(obj, StatusFailed)
+		return err
+	}
+	// update the upload status on the parts
+	return app.updateUploadStatusPart(obj)
 }
 
 // get lastModDate returns the last moidified date for the file specified by f (file path).
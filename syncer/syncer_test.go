@@ -1,11 +1,29 @@
 package syncer
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 var app Syncer
@@ -29,7 +47,7 @@ func TestWalkAndHash(t *testing.T) {
 	Init()
 
 	testFilter := []string{"jpg", "txt"}
-	ret, err := app.WalkAndHash(testFilter)
+	ret, err := app.WalkAndHash(context.Background(), testFilter)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,7 +66,7 @@ func TestSelectUploadList(t *testing.T) {
 func TestUpdateRecords(t *testing.T) {
 	Init()
 	testFilter := []string{"jpg"}
-	retMap, err := app.WalkAndHash(testFilter)
+	retMap, err := app.WalkAndHash(context.Background(), testFilter)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,7 +88,11 @@ func TestRecordParts(t *testing.T) {
 		"C:\\Users\\pratersm\\AppData\\Local\\Temp\\s3sync3030611028\\Battlestar Galactica (2003)  S04e19e20  Daybreak (1080P Bluray X265 Rzerox)-1.mp4.part5",
 		"C:\\Users\\pratersm\\AppData\\Local\\Temp\\s3sync3030611028\\Battlestar Galactica (2003)  S04e19e20  Daybreak (1080P Bluray X265 Rzerox)-1.mp4.part6",
 	}
-	err := app.recordParts(1, parts)
+	keys := make([]string, len(parts))
+	for i := range parts {
+		keys[i] = partKey("daybreak.mp4", i)
+	}
+	err := app.recordParts(1, parts, keys)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,7 +107,7 @@ func TestPutObject(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = app.putObject(context.Background(), obj, false)
+	err = app.putObject(context.Background(), obj, app.objectKey(obj), types.StorageClassStandard)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -135,3 +157,1067 @@ func TestUploadDiffs(t *testing.T) {
 	}
 
 }
+
+func TestObjectKeyUsesKeyFunc(t *testing.T) {
+	s := Syncer{}
+	if got := s.objectKey("a/b.txt"); got != s.localize("a/b.txt") {
+		t.Fatalf("default key = %s", got)
+	}
+	s.KeyFunc = func(p string) string { return "host/" + p }
+	if got := s.objectKey("a/b.txt"); got != "host/a/b.txt" {
+		t.Fatalf("KeyFunc key = %s", got)
+	}
+	if got := partKey("host/a/b.txt", 2); got != "host/a/b.txt.part2" {
+		t.Fatalf("part key = %s", got)
+	}
+}
+
+func TestSanitizeKeys(t *testing.T) {
+	for key, want := range map[string]string{
+		"shows/a.mkv":             "shows/a.mkv",
+		"/data/shows/a.mkv":       "/data/shows/a.mkv",
+		"shows/../a.mkv":          "shows/%2E%2E/a.mkv",
+		"./shows/a.mkv":           "%2E/shows/a.mkv",
+		"shows//a.mkv":            "shows/a.mkv",
+		" shows/a.mkv ":           "%20shows/a.mkv%20",
+		"shows/a b.mkv":           "shows/a b.mkv",
+		"shows/a\tb\x7f.mkv":      "shows/a%09b%7F.mkv",
+		"shows/\u00e9t\u00e9.mkv": "shows/\u00e9t\u00e9.mkv",
+	} {
+		if got := sanitizeKey(key); got != want {
+			t.Errorf("sanitizeKey(%q) = %q, want %q", key, got, want)
+		}
+		if problem := keyProblem(key); (problem == "") != (key == want) {
+			t.Errorf("keyProblem(%q) = %q", key, problem)
+		}
+		if problem := keyProblem(sanitizeKey(key)); problem != "" {
+			t.Errorf("sanitized %q still has %s", key, problem)
+		}
+	}
+
+	s := Syncer{SanitizeKeys: true}
+	if got := s.objectKey("/data/x/ a.txt"); got != "/data/x/%20a.txt" {
+		t.Fatalf("sanitized key = %s", got)
+	}
+}
+
+// newTestSyncer returns a Syncer with a fresh manifest in a temp dir and no S3 client.
+func newTestSyncer(t *testing.T) *Syncer {
+	t.Helper()
+	dir := t.TempDir()
+	s := &Syncer{FolderPath: dir, Bucket: "test-bucket"}
+	err := s.InitDb(filepath.Join(dir, "manifest.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestUpdateRecordStoresKey(t *testing.T) {
+	s := newTestSyncer(t)
+	s.KeyFunc = func(p string) string { return "host/" + filepath.Base(p) }
+	err := s.updateRecord("/data/a.txt", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.keyFor("/data/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "host/a.txt" {
+		t.Fatalf("recorded key = %s", key)
+	}
+}
+
+func TestUpdateManifestTwice(t *testing.T) {
+	s := newTestSyncer(t)
+	files := map[string]int64{"/data/a.txt": 100, "/data/b.txt": 200}
+	for i := 0; i < 2; i++ {
+		err := s.UpdateManifest(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	s.db.QueryRow("select count(*) from videos").Scan(&count)
+	if count != 2 {
+		t.Fatalf("manifest has %d rows, want 2", count)
+	}
+
+	// a newer modified time replaces the recorded one and marks the file pending again
+	err := s.updateUploadStatus("/data/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["/data/a.txt"] = 300
+	err = s.UpdateManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var modified int64
+	var uploaded int
+	s.db.QueryRow("select modified, uploaded from videos where filepath = ?", "/data/a.txt").Scan(&modified, &uploaded)
+	if modified != 300 || uploaded != 0 {
+		t.Fatalf("modified = %d, uploaded = %d", modified, uploaded)
+	}
+}
+
+func TestPartsRollUpToParent(t *testing.T) {
+	s := newTestSyncer(t)
+	p := "/data/big.mkv"
+	err := s.updateRecord(p, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.setMultipart(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := []string{"/tmp/big.mkv.part0", "/tmp/big.mkv.part1"}
+	err = s.recordParts(id, parts, []string{partKey(p, 0), partKey(p, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole-file update must not complete a multipart file on its own
+	err = s.updateUploadStatus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.updateUploadStatusPart(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := s.getStatus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == StatusComplete {
+		t.Fatal("parent complete with a part still pending")
+	}
+
+	err = s.setPartStatus(parts[1], StatusFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ = s.getStatus(p)
+	if status != StatusFailed {
+		t.Fatalf("status after failed part = %s", status)
+	}
+
+	err = s.updateUploadStatusPart(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ = s.getStatus(p)
+	if status != StatusComplete {
+		t.Fatalf("status after all parts = %s", status)
+	}
+	list, err := s.GetUploadList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("upload list = %v", list)
+	}
+}
+
+func TestPermissionsMetadataRoundTrip(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "a.txt")
+	err := os.WriteFile(p, []byte("a"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Syncer{FolderPath: filepath.Dir(p)}
+	if meta := s.fileMetadata(p, info); meta[MetaMode] != "" {
+		t.Fatalf("metadata without PreservePermissions = %v", meta)
+	}
+	s.PreservePermissions = true
+	meta := s.fileMetadata(p, info)
+	if meta[MetaSrcPath] != "a.txt" {
+		t.Fatalf("srcpath = %s", meta[MetaSrcPath])
+	}
+
+	err = os.Chmod(p, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restorePosixMetadata(p, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(p)
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+		t.Fatalf("restored mode = %v", info.Mode().Perm())
+	}
+}
+
+func TestEmitSendsToProgress(t *testing.T) {
+	events := make(chan ProgressEvent, 1)
+	s := Syncer{Progress: events, NoSpinners: true}
+	s.emit(ProgressEvent{Type: FileStarted, Path: "a.txt", Index: 1, Total: 1})
+	ev := <-events
+	if ev.Type != FileStarted || ev.Path != "a.txt" {
+		t.Fatalf("event = %+v", ev)
+	}
+}
+
+func TestGenerateLifecycle(t *testing.T) {
+	policy := GenerateLifecycle(LifecycleOptions{Prefix: "host/", TransitionDays: 30, AbortIncompleteDays: 7})
+	if len(policy.Rules) != 1 {
+		t.Fatalf("rules = %d", len(policy.Rules))
+	}
+	rule := policy.Rules[0]
+	if rule.Filter.Prefix != "host/" || rule.Expiration != nil {
+		t.Fatalf("rule = %+v", rule)
+	}
+	if len(rule.Transitions) != 1 || rule.Transitions[0].StorageClass != "DEEP_ARCHIVE" || rule.Transitions[0].Days != 30 {
+		t.Fatalf("transitions = %+v", rule.Transitions)
+	}
+	cfg := policy.configuration()
+	if *cfg.Rules[0].AbortIncompleteMultipartUpload.DaysAfterInitiation != 7 {
+		t.Fatal("abort days not carried into the sdk configuration")
+	}
+	cfg = GenerateLifecycle(LifecycleOptions{NoncurrentExpireDays: 90}).configuration()
+	if cfg.Rules[0].NoncurrentVersionExpiration == nil || *cfg.Rules[0].NoncurrentVersionExpiration.NoncurrentDays != 90 {
+		t.Fatal("noncurrent days not carried into the sdk configuration")
+	}
+}
+
+func TestMultipleSources(t *testing.T) {
+	photos := t.TempDir()
+	docs := t.TempDir()
+	os.WriteFile(filepath.Join(photos, "a.jpg"), []byte("a"), 0644)
+	os.MkdirAll(filepath.Join(docs, "work"), 0755)
+	os.WriteFile(filepath.Join(docs, "work", "b.txt"), []byte("b"), 0644)
+
+	s := Syncer{Sources: []Source{
+		{FolderPath: photos, KeyPrefix: "photos/", StorageClass: types.StorageClassDeepArchive},
+		{FolderPath: docs, KeyPrefix: "docs/"},
+	}}
+	files, err := s.WalkAndHash(context.Background(), []string{"jpg", "txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("found %v", files)
+	}
+	b := filepath.Join(docs, "work", "b.txt")
+	if key := s.objectKey(b); key != "docs/work/b.txt" {
+		t.Fatalf("key = %s", key)
+	}
+	if class := s.storageClassFor(filepath.Join(photos, "a.jpg"), false); class != types.StorageClassDeepArchive {
+		t.Fatalf("photos class = %s", class)
+	}
+	if class := s.storageClassFor(b, false); class != types.StorageClassStandard {
+		t.Fatalf("docs class = %s", class)
+	}
+}
+
+func TestThrottleControllerBacksOff(t *testing.T) {
+	c := newThrottleController(8)
+	ctx := context.Background()
+	c.acquire(ctx)
+	if wait := c.release(true); wait != time.Second {
+		t.Fatalf("first backoff = %v", wait)
+	}
+	c.acquire(ctx)
+	if wait := c.release(true); wait != 2*time.Second {
+		t.Fatalf("second backoff = %v", wait)
+	}
+	stats := c.report()
+	if stats.Throttled != 2 || stats.MinConcurrency != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	for i := 0; i < 10; i++ {
+		c.acquire(ctx)
+		c.release(false)
+	}
+	if c.limit != 3 {
+		t.Fatalf("limit after recovery = %d", c.limit)
+	}
+}
+
+func TestThrottleControllerCancel(t *testing.T) {
+	c := newThrottleController(1)
+	c.acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.acquire(ctx)
+	}()
+	// let it get to waiting for the slot
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("acquire = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire didn't return after the context was cancelled")
+	}
+}
+
+func TestPutLimit(t *testing.T) {
+	s := Syncer{}
+	if got := s.putLimit(types.StorageClassDeepArchive); got != MaxPutSize {
+		t.Fatalf("deep archive limit = %d", got)
+	}
+	s.PutLimits = map[types.StorageClass]int64{types.StorageClassStandard: 1024}
+	if got := s.putLimit(types.StorageClassStandard); got != 1024 {
+		t.Fatalf("overridden limit = %d", got)
+	}
+	if got := s.putLimit("SOMETHING_ELSE"); got != MaxPutSize {
+		t.Fatalf("unknown class limit = %d", got)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	s := newTestSyncer(t)
+	s.MaxFailures = 2
+	p := "/data/bad.txt"
+	s.updateRecord(p, 1)
+	s.recordFailure(p)
+	list, _ := s.GetUploadList()
+	if len(list) != 1 {
+		t.Fatalf("upload list after one failure = %v", list)
+	}
+	s.recordFailure(p)
+	list, _ = s.GetUploadList()
+	if len(list) != 0 {
+		t.Fatalf("upload list after two failures = %v", list)
+	}
+	q, err := s.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q) != 1 || q[0].Path != p || q[0].Failures != 2 {
+		t.Fatalf("quarantined = %+v", q)
+	}
+	err = s.ResetQuarantine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ = s.GetUploadList()
+	if len(list) != 1 {
+		t.Fatalf("upload list after reset = %v", list)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		512:             "512 B",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 40:         "3.0 TiB",
+	}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Fatalf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"512":   512,
+		"1.5K":  1536,
+		"750MB": 750 << 20,
+		"4 GiB": 4 << 30,
+		"3t":    3 << 40,
+		"100 B": 100,
+	}
+	for s, want := range cases {
+		got, err := ParseSize(s)
+		if err != nil || got != want {
+			t.Fatalf("ParseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "G", "12X", "-1M", "1KBB"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Fatalf("ParseSize(%q) should fail", s)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	cases := []struct {
+		filters []string
+		rel     string
+		want    bool
+	}{
+		{[]string{".jpg"}, "trip/a.jpg", true},
+		{[]string{".jpg"}, "trip/a.png", false},
+		{[]string{""}, "anything", true},
+		{[]string{"IMG_*.CR2"}, "raw/2024/IMG_0001.CR2", true},
+		{[]string{"IMG_*.CR2"}, "raw/2024/DSC_0001.CR2", false},
+		{[]string{"raw/*"}, "raw/2024/IMG_0001.CR2", true},
+		{[]string{"raw/*"}, "cooked/IMG_0001.CR2", false},
+		{[]string{"raw/", "!raw/thumbs/"}, "raw/2024/a.CR2", true},
+		{[]string{"raw/", "!raw/thumbs/"}, "raw/thumbs/a.jpg", false},
+		{[]string{"!*.tmp"}, "notes.txt", true},
+		{[]string{"!*.tmp"}, "notes.tmp", false},
+		{[]string{`/^IMG_\d{4}\.CR2$/`}, "raw/IMG_0001.CR2", true},
+		{[]string{`/^raw/.*\.CR2$/`}, "raw/2024/IMG_0001.CR2", true},
+		{[]string{`/^raw/.*\.CR2$/`}, "other/raw/IMG_0001.CR2", false},
+		{nil, "a.txt", false},
+	}
+	for _, c := range cases {
+		filters, err := parseFilters(c.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := inFilters(c.rel, filters); got != c.want {
+			t.Fatalf("inFilters(%q, %q) = %v, want %v", c.rel, c.filters, got, c.want)
+		}
+	}
+	for _, bad := range []string{"/[/", "a[b"} {
+		if _, err := parseFilters([]string{bad}); err == nil {
+			t.Fatalf("parseFilters(%q) should fail", bad)
+		}
+	}
+}
+
+func TestDBOptions(t *testing.T) {
+	s := newTestSyncer(t)
+	var timeout int
+	var mode string
+	err := s.db.QueryRow("pragma busy_timeout").Scan(&timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.QueryRow("pragma journal_mode").Scan(&mode)
+	if timeout != int(DefaultBusyTimeout.Milliseconds()) || !strings.EqualFold(mode, DefaultJournalMode) {
+		t.Fatalf("busy_timeout = %d, journal_mode = %s", timeout, mode)
+	}
+
+	// concurrent writers wait for each other instead of failing with database is locked
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.updateRecord(fmt.Sprintf("/data/%d.txt", i), 100)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPieceSize(t *testing.T) {
+	s := &Syncer{}
+	const gib = 1024 * 1024 * 1024
+	size, err := s.pieceSize(10*gib, MaxPutSize)
+	if err != nil || size != 2*gib {
+		t.Fatalf("default piece = %d, %v", size, err)
+	}
+
+	// 100MB pieces would make 30000 parts of a 3TB file
+	s.PartSize = 100 * 1024 * 1024
+	size, err = s.pieceSize(3*1024*gib, MaxPutSize)
+	if err != nil || (3*1024*gib+size-1)/size > MaxParts {
+		t.Fatalf("adjusted piece = %d, %v", size, err)
+	}
+
+	if _, err = s.pieceSize(1024*gib, 1024*1024); err == nil {
+		t.Fatal("expected a file that needs too big parts to fail")
+	}
+	if _, err = s.pieceSize(MaxObjectSize+1, MaxPutSize); err == nil {
+		t.Fatal("expected a file over the object size limit to fail")
+	}
+}
+
+func TestAdaptivePieceSize(t *testing.T) {
+	s := &Syncer{TargetParts: DefaultTargetParts}
+	const gib = 1024 * 1024 * 1024
+	for _, size := range []int64{4*gib + 100*1024*1024, 100 * gib, 1024 * gib, MaxObjectSize} {
+		piece, err := s.pieceSize(size, MaxPutSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := (size + piece - 1) / piece
+		if piece < MinPartSize || piece > MaxPutSize || parts > DefaultTargetParts && piece != MaxPutSize {
+			t.Fatalf("%d bytes: piece = %d, %d parts", size, piece, parts)
+		}
+		// the parts are even, the last one is at most a byte per part short
+		if last := size - (parts-1)*piece; piece != MaxPutSize && last < piece-parts {
+			t.Fatalf("%d bytes: last part is %d of %d", size, last, piece)
+		}
+	}
+}
+
+func TestClientProfiles(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token")
+	os.WriteFile(token, []byte("jwt"), 0600)
+	cfgFile := filepath.Join(dir, "config")
+	os.WriteFile(cfgFile, []byte(`[profile sso]
+sso_start_url = https://example.awsapps.com/start
+sso_region = us-east-1
+sso_account_id = 123456789012
+sso_role_name = Backup
+region = us-west-2
+
+[profile irsa]
+role_arn = arn:aws:iam::123456789012:role/backup
+web_identity_token_file = `+token+`
+`), 0600)
+	t.Setenv("AWS_CONFIG_FILE", cfgFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+
+	ctx := context.Background()
+	cfg, err := ClientOptions{Profile: "sso"}.loadConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aws.IsCredentialsProvider(cfg.Credentials, (*ssocreds.Provider)(nil)) || cfg.Region != "us-west-2" {
+		t.Fatalf("sso profile loaded %T in %s", cfg.Credentials, cfg.Region)
+	}
+	cfg, err = ClientOptions{Profile: "irsa", Region: "eu-west-1"}.loadConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aws.IsCredentialsProvider(cfg.Credentials, (*stscreds.WebIdentityRoleProvider)(nil)) || cfg.Region != "eu-west-1" {
+		t.Fatalf("web identity profile loaded %T in %s", cfg.Credentials, cfg.Region)
+	}
+}
+
+type recordingTransport struct {
+	userAgent string
+	payers    []string
+	owners    []string
+	header    http.Header
+	// puts are the SSE-KMS key and context of every PUT, by path, and sse their server-side encryption
+	puts map[string]string
+	sse  map[string]string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.userAgent = req.Header.Get("User-Agent")
+	rt.header = req.Header
+	rt.payers = append(rt.payers, req.Header.Get("x-amz-request-payer"))
+	rt.owners = append(rt.owners, req.Header.Get("x-amz-expected-bucket-owner"))
+	if req.Method == http.MethodPut {
+		if rt.puts == nil {
+			rt.puts, rt.sse = map[string]string{}, map[string]string{}
+		}
+		rt.sse[req.URL.Path] = req.Header.Get("x-amz-server-side-encryption")
+		rt.puts[req.URL.Path] = req.Header.Get("x-amz-server-side-encryption-aws-kms-key-id") + " " + req.Header.Get("x-amz-server-side-encryption-context")
+	}
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}, Request: req}, nil
+}
+
+func TestClientUserAgent(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	for _, tc := range []struct{ userAgent, want string }{
+		{"", "s3sync/" + Version},
+		{"backup-host/1.2.3", "backup-host/1.2.3"},
+	} {
+		rt := &recordingTransport{}
+		client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}, UserAgent: tc.userAgent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.HeadBucket(context.Background(), &s3.HeadBucketInput{Bucket: aws.String("test-bucket")})
+		if !strings.HasSuffix(rt.userAgent, " "+tc.want) {
+			t.Fatalf("User-Agent = %q, want it to end in %q", rt.userAgent, tc.want)
+		}
+	}
+}
+
+// accelerateTransport answers GetBucketAccelerateConfiguration with status and records the host of every request.
+type accelerateTransport struct {
+	status string
+	hosts  []string
+}
+
+func (rt *accelerateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.hosts = append(rt.hosts, req.URL.Host)
+	body := ""
+	if req.URL.Query().Has("accelerate") {
+		body = `<AccelerateConfiguration><Status>` + rt.status + `</Status></AccelerateConfiguration>`
+	}
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body)), Header: http.Header{}, Request: req}, nil
+}
+
+func TestAccelerate(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	for _, status := range []string{"Enabled", "Suspended", ""} {
+		rt := &accelerateTransport{status: status}
+		client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}, Accelerate: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := &Syncer{Bucket: "test-bucket", S3Client: client}
+		on, err := app.AccelerationEnabled(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if on != (status == "Enabled") {
+			t.Fatalf("status %q: enabled = %v", status, on)
+		}
+		if rt.hosts[0] != "test-bucket.s3.us-east-1.amazonaws.com" {
+			t.Fatalf("the configuration was asked of %s", rt.hosts[0])
+		}
+		if !on {
+			app.WithoutAcceleration()
+		}
+		app.S3Client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String("a.txt")})
+		want := "test-bucket.s3-accelerate.amazonaws.com"
+		if !on {
+			want = "test-bucket.s3.us-east-1.amazonaws.com"
+		}
+		if got := rt.hosts[len(rt.hosts)-1]; got != want {
+			t.Fatalf("status %q: objects went to %s, want %s", status, got, want)
+		}
+	}
+}
+
+// urlTransport records the URL of every request and answers it with an empty 200.
+type urlTransport struct {
+	urls []string
+}
+
+func (rt *urlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.urls = append(rt.urls, req.URL.String())
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}, Request: req}, nil
+}
+
+func TestEndpoint(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_CA_BUNDLE", "")
+	cases := []struct {
+		pathStyle bool
+		want      string
+	}{
+		{false, "http://test-bucket.minio.example:9000/a.txt"},
+		{true, "http://minio.example:9000/test-bucket/a.txt"},
+	}
+	for _, c := range cases {
+		rt := &urlTransport{}
+		client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}, Endpoint: "http://minio.example:9000", PathStyle: c.pathStyle})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Options().Region != DefaultEndpointRegion {
+			t.Fatalf("region = %q", client.Options().Region)
+		}
+		client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String("a.txt")})
+		if len(rt.urls) == 0 || rt.urls[0] != c.want {
+			t.Fatalf("path style %v: requests = %v, want %s", c.pathStyle, rt.urls, c.want)
+		}
+	}
+	if _, err := NewS3Client(context.Background(), ClientOptions{Endpoint: "http://minio.example:9000", Accelerate: true}); err == nil {
+		t.Fatal("acceleration with an endpoint was accepted")
+	}
+	if _, err := NewS3Client(context.Background(), ClientOptions{Endpoint: "minio.example"}); err == nil {
+		t.Fatal("an endpoint without a scheme was accepted")
+	}
+}
+
+// bucketTransport answers a bucket that doesn't exist yet, has versioning off and a lifecycle rule set up by hand,
+// recording every request and the lifecycle configuration put.
+type bucketTransport struct {
+	requests  []string
+	lifecycle string
+}
+
+func (rt *bucketTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req.Method+" "+req.URL.RawQuery)
+	status, body := 200, ""
+	switch {
+	case req.Method == http.MethodHead:
+		status = 404
+	case req.URL.Query().Has("versioning") && req.Method == http.MethodGet:
+		body = `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></VersioningConfiguration>`
+	case req.URL.Query().Has("lifecycle") && req.Method == http.MethodGet:
+		body = `<LifecycleConfiguration><Rule><ID>by-hand</ID><Status>Enabled</Status><Filter><Prefix>logs/</Prefix></Filter><Expiration><Days>3</Days></Expiration></Rule></LifecycleConfiguration>`
+	case req.URL.Query().Has("lifecycle"):
+		b, _ := io.ReadAll(req.Body)
+		rt.lifecycle = string(b)
+	}
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: http.Header{}, Request: req}, nil
+}
+
+func TestEnsureBucket(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_CA_BUNDLE", "")
+	rt := &bucketTransport{}
+	client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}, Endpoint: "http://minio.example:9000", PathStyle: true, Region: "eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Syncer{Bucket: "test-bucket", S3Client: client}
+	if _, err = s.EnsureBucket(context.Background(), BucketOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing bucket without Create: %v", err)
+	}
+	rt.requests = nil
+	report, err := s.EnsureBucket(context.Background(), BucketOptions{
+		Create:     true,
+		Versioning: true,
+		Lifecycle:  &LifecycleOptions{TransitionDays: 30, NoncurrentExpireDays: 90},
+		Encryption: types.ServerSideEncryptionAes256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != (BucketReport{Created: true, Versioning: true, Lifecycle: true, Encryption: true}) {
+		t.Fatalf("report = %+v", report)
+	}
+	want := []string{"HEAD ", "PUT ", "GET versioning=", "PUT versioning=", "GET lifecycle=", "PUT lifecycle=", "PUT encryption="}
+	if !slices.Equal(rt.requests, want) {
+		t.Fatalf("requests = %q, want %q", rt.requests, want)
+	}
+	if !strings.Contains(rt.lifecycle, "<ID>by-hand</ID>") || !strings.Contains(rt.lifecycle, "<ID>s3sync</ID>") {
+		t.Fatalf("lifecycle put = %s, want the rule set up by hand kept next to ours", rt.lifecycle)
+	}
+	rt.requests = nil
+	if _, err = s.EnsureBucket(context.Background(), BucketOptions{Create: true, Versioning: true}); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(rt.requests, "PUT lifecycle=") {
+		t.Fatalf("requests = %q, the lifecycle was put without being asked for", rt.requests)
+	}
+	if _, err = s.EnsureBucket(context.Background(), BucketOptions{Create: true, Encryption: types.ServerSideEncryptionAes256, KMSKeyID: "key"}); err == nil {
+		t.Fatal("a KMS key with AES256 was accepted")
+	}
+}
+
+// TestEndpointIntegration syncs a file to a real S3 compatible store, like a local MinIO, when
+// S3SYNC_TEST_ENDPOINT and S3SYNC_TEST_BUCKET name one. The credentials come from the usual AWS variables.
+func TestEndpointIntegration(t *testing.T) {
+	endpoint, bucket := os.Getenv("S3SYNC_TEST_ENDPOINT"), os.Getenv("S3SYNC_TEST_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("S3SYNC_TEST_ENDPOINT and S3SYNC_TEST_BUCKET are not set")
+	}
+	client, err := NewS3Client(context.Background(), ClientOptions{Endpoint: endpoint, PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSyncer(t)
+	s.Bucket = bucket
+	s.S3Client = client
+	s.NoSpinners = true
+	s.FolderPath = filepath.Join(s.FolderPath, "src")
+	prefix := fmt.Sprintf("s3sync-test-%d/", time.Now().UnixNano())
+	s.KeyFunc = func(p string) string {
+		rel, _ := filepath.Rel(s.FolderPath, p)
+		return prefix + filepath.ToSlash(rel)
+	}
+	writeFixture(filepath.Join(s.FolderPath, "a.txt"), 1000)
+	t.Cleanup(func() {
+		client.DeleteObject(context.Background(), &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(prefix + "a.txt")})
+	})
+	files, err := s.WalkAndHash(context.Background(), []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateManifest(files)
+	uploads, _ := s.GetUploadList()
+	err = s.UploadDiffs(context.Background(), uploads, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(prefix + "a.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToInt64(head.ContentLength) != 1000 {
+		t.Fatalf("size = %d", aws.ToInt64(head.ContentLength))
+	}
+}
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{&smithy.GenericAPIError{Code: "AccessDenied"}, ErrPermission},
+		{&smithy.GenericAPIError{Code: "SlowDown"}, ErrThrottled},
+		{&smithy.GenericAPIError{Code: "NoSuchBucket"}, ErrNotFound},
+		{&fs.PathError{Op: "open", Path: "x", Err: fs.ErrPermission}, ErrPermission},
+		{fmt.Errorf("x: %w", ErrTooLarge), ErrTooLarge},
+		{fmt.Errorf("x: %w: %w", ErrSplitFailed, io.ErrShortWrite), ErrSplitFailed},
+		{io.ErrUnexpectedEOF, nil},
+	}
+	for _, c := range cases {
+		if got := classify(c.err); got != c.want {
+			t.Fatalf("classify(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRequesterPays(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	rt := &recordingTransport{}
+	client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	st := &S3Store{Client: client, Bucket: "test-bucket", RequesterPays: true}
+	st.Put(ctx, "k", strings.NewReader("data"), PutOptions{})
+	st.Head(ctx, "k")
+	st.Get(ctx, "k")
+	st.GetRange(ctx, "k", GetOptions{Offset: 2})
+	st.List(ctx, "")
+	st.SetStorageClass(ctx, "k", string(types.StorageClassGlacier))
+	st.Restore(ctx, "k", 1)
+	st.Delete(ctx, "k")
+	if len(rt.payers) < 8 {
+		t.Fatalf("only %d requests were sent", len(rt.payers))
+	}
+	for i, payer := range rt.payers {
+		if payer != "requester" {
+			t.Fatalf("request %d went out with x-amz-request-payer %q", i, payer)
+		}
+	}
+}
+
+func TestExpectedBucketOwner(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	rt := &recordingTransport{}
+	client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	st := &S3Store{Client: client, Bucket: "test-bucket", ExpectedBucketOwner: "111122223333"}
+	st.Put(ctx, "k", strings.NewReader("data"), PutOptions{})
+	st.Head(ctx, "k")
+	st.Get(ctx, "k")
+	st.List(ctx, "")
+	st.SetStorageClass(ctx, "k", string(types.StorageClassGlacier))
+	st.Delete(ctx, "k")
+	app := &Syncer{Bucket: "test-bucket", S3Client: client, ExpectedBucketOwner: "111122223333"}
+	app.ValidateStorageClass(ctx, types.StorageClassStandard)
+	if len(rt.owners) < 9 {
+		t.Fatalf("only %d requests were sent", len(rt.owners))
+	}
+	for i, owner := range rt.owners {
+		if owner != "111122223333" {
+			t.Fatalf("request %d went out with x-amz-expected-bucket-owner %q", i, owner)
+		}
+	}
+}
+
+func TestPutHeaders(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	rt := &recordingTransport{}
+	client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &S3Store{Client: client, Bucket: "test-bucket"}
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := Headers{CacheControl: "max-age=60", ContentDisposition: "attachment", Expires: expires}
+	st.Put(context.Background(), "k", strings.NewReader("data"), PutOptions{Headers: h, Tags: map[string]string{TagRunLabel: "weekly 23"}})
+	if rt.header.Get("Cache-Control") != "max-age=60" || rt.header.Get("Content-Disposition") != "attachment" || rt.header.Get("Expires") != expires.Format(http.TimeFormat) {
+		t.Fatalf("put went out with %v", rt.header)
+	}
+	if rt.header.Get("X-Amz-Tagging") != "s3sync-run=weekly+23" {
+		t.Fatalf("put went out with %v", rt.header)
+	}
+}
+
+// copyTransport answers the requests of a multipart copy of a 25 byte object. With pending it lists an
+// unfinished upload to class Glacier that already holds the first part.
+type copyTransport struct {
+	ranges    []string
+	completed bool
+	pending   bool
+	created   bool
+}
+
+func (rt *copyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	q := req.URL.Query()
+	header := http.Header{}
+	body := ""
+	switch {
+	case req.Method == http.MethodHead:
+		header.Set("Content-Length", "25")
+		header.Set("x-amz-meta-srcpath", "big.bin")
+	case q.Has("tagging"):
+		body = `<Tagging><TagSet><Tag><Key>s3sync-run</Key><Value>weekly</Value></Tag></TagSet></Tagging>`
+	case q.Has("uploads") && req.Method == http.MethodGet:
+		body = `<ListMultipartUploadsResult></ListMultipartUploadsResult>`
+		if rt.pending {
+			body = `<ListMultipartUploadsResult><Upload><Key>big.bin</Key><UploadId>u0</UploadId><StorageClass>GLACIER</StorageClass></Upload></ListMultipartUploadsResult>`
+		}
+	case q.Has("uploads"):
+		rt.created = true
+		body = `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`
+	case q.Has("uploadId") && req.Method == http.MethodGet:
+		body = `<ListPartsResult><Part><PartNumber>1</PartNumber><ETag>"p1"</ETag><Size>10</Size></Part></ListPartsResult>`
+	case q.Has("partNumber"):
+		rt.ranges = append(rt.ranges, req.Header.Get("x-amz-copy-source-range"))
+		body = `<CopyPartResult><ETag>"p"</ETag></CopyPartResult>`
+	case q.Has("uploadId"):
+		rt.completed = true
+		body = `<CompleteMultipartUploadResult><ETag>"whole-3"</ETag></CompleteMultipartUploadResult>`
+	}
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body)), Header: header, Request: req}, nil
+}
+
+func TestSetStorageClassInParts(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CA_BUNDLE", "")
+	rt := &copyTransport{}
+	client, err := NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &S3Store{Client: client, Bucket: "test-bucket", CopyLimit: 10}
+	etag, err := st.SetStorageClass(context.Background(), "big.bin", string(types.StorageClassGlacier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != `"whole-3"` || !rt.completed || strings.Join(rt.ranges, " ") != "bytes=0-9 bytes=10-19 bytes=20-24" {
+		t.Fatalf("copied %v, complete %v, etag %s", rt.ranges, rt.completed, etag)
+	}
+
+	// an upload a run left unfinished is picked up without copying its parts again
+	rt = &copyTransport{pending: true}
+	client, err = NewS3Client(context.Background(), ClientOptions{HTTPClient: &http.Client{Transport: rt}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = &S3Store{Client: client, Bucket: "test-bucket", CopyLimit: 10}
+	_, err = st.SetStorageClass(context.Background(), "big.bin", string(types.StorageClassGlacier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.created || !rt.completed || strings.Join(rt.ranges, " ") != "bytes=10-19 bytes=20-24" {
+		t.Fatalf("copied %v, created %v, complete %v", rt.ranges, rt.created, rt.completed)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	dir := t.TempDir()
+	record := func(db string, files map[string]string) string {
+		p := filepath.Join(dir, db)
+		s := &Syncer{}
+		if err := s.InitDb(p); err != nil {
+			t.Fatal(err)
+		}
+		for f, sum := range files {
+			s.updateRecord(f, 100)
+			if _, err := s.db.Exec(UPDATEHASH, sum, len(sum), f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+		return p
+	}
+	old := record("old.db", map[string]string{"/data/a": "aaaa", "/data/b": "bb", "/data/c": "cc"})
+	cur := record("new.db", map[string]string{"/data/a": "aaaa", "/data/b": "bbbbbb", "/data/d": "ddd"})
+
+	diff, err := DiffManifests(old, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0] != (FileChange{"/data/d", -1, 3}) {
+		t.Fatalf("added = %+v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0] != (FileChange{"/data/c", 2, -1}) {
+		t.Fatalf("removed = %+v", diff.Removed)
+	}
+	if len(diff.Modified) != 1 || diff.Modified[0] != (FileChange{"/data/b", 2, 6}) {
+		t.Fatalf("modified = %+v", diff.Modified)
+	}
+	if diff.Growth() != 3-2+4 {
+		t.Fatalf("growth = %d", diff.Growth())
+	}
+
+	if _, err = DiffManifests(filepath.Join(dir, "missing.db"), cur); err == nil {
+		t.Fatal("expected a missing manifest to fail, not be created")
+	}
+}
+
+func TestManifestIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.db")
+	s := &Syncer{}
+	if err := s.InitDb(good); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		s.updateRecord(fmt.Sprintf("/data/file%03d.txt", i), 100)
+	}
+	s.Close()
+	if problems, err := CheckManifest(good, false); err != nil || len(problems) != 0 {
+		t.Fatalf("sound manifest: %v, %v", problems, err)
+	}
+	if err := SoundManifest(filepath.Join(dir, "new.db")); err != nil {
+		t.Fatalf("a manifest that doesn't exist yet: %v", err)
+	}
+
+	// scribble over everything after the first page, like a disk that lost some writes
+	data, _ := os.ReadFile(good)
+	bad := filepath.Join(dir, "manifest.db")
+	damaged := append([]byte{}, data...)
+	for i := 4096; i < len(damaged); i++ {
+		damaged[i] = byte(i * 7)
+	}
+	os.WriteFile(bad, damaged, 0644)
+	if err := SoundManifest(bad); !errors.Is(err, ErrCorruptManifest) {
+		t.Fatalf("damaged manifest: %v", err)
+	}
+
+	aside, err := RestoreManifest(bad, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept, _ := os.ReadFile(aside); !bytes.Equal(kept, damaged) {
+		t.Fatal("the damaged manifest wasn't set aside")
+	}
+	if err := SoundManifest(bad); err != nil {
+		t.Fatalf("restored manifest: %v", err)
+	}
+	s = &Syncer{}
+	if err := s.InitDb(bad); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if paths, _ := s.queryPaths(SELECTLIVEPATHS); len(paths) != 500 {
+		t.Fatalf("restored %d files", len(paths))
+	}
+}
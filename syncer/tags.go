@@ -0,0 +1,65 @@
+package syncer
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxTags is how many tags S3 takes on one object.
+const MaxTags = 10
+
+// ValidateTags checks tags can be set as S3 object tags: keys of 1 to 128 characters that don't start with aws:,
+// values of up to 256, and no more than MaxTags of them.
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("%d tags, S3 takes %d per object", len(tags), MaxTags)
+	}
+	for k, v := range tags {
+		if n := utf8.RuneCountInString(k); n == 0 || n > 128 {
+			return fmt.Errorf("tag key %q: 1 to 128 characters are allowed", k)
+		}
+		if strings.HasPrefix(strings.ToLower(k), "aws:") {
+			return fmt.Errorf("tag key %q: the aws: prefix is kept for AWS", k)
+		}
+		if k == TagRunLabel {
+			return fmt.Errorf("tag key %q is used by s3sync", k)
+		}
+		if utf8.RuneCountInString(v) > 256 {
+			return fmt.Errorf("tag %s: the value is longer than 256 characters", k)
+		}
+	}
+	return nil
+}
+
+// objectTags returns the tags the file p is uploaded with: Tags, what TagsFunc picks for p and the RunLabel tag,
+// nil when there are none.
+func (app *Syncer) objectTags(p string) (map[string]string, error) {
+	var custom map[string]string
+	if app.TagsFunc != nil {
+		custom = app.TagsFunc(p)
+	}
+	var tags map[string]string
+	for _, m := range []map[string]string{app.Tags, custom} {
+		err := ValidateTags(m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		for k, v := range m {
+			if tags == nil {
+				tags = map[string]string{}
+			}
+			tags[k] = v
+		}
+	}
+	if app.RunLabel != "" {
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[TagRunLabel] = app.RunLabel
+	}
+	if len(tags) > MaxTags {
+		return nil, fmt.Errorf("%s: %d tags, S3 takes %d per object", p, len(tags), MaxTags)
+	}
+	return tags, nil
+}
@@ -0,0 +1,155 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+// DefaultThrottleRetries is how many times a throttled upload is retried when ThrottleRetries is not set.
+const DefaultThrottleRetries = 5
+
+// ThrottleStats reports how much S3 pushed back during a run.
+type ThrottleStats struct {
+	// Throttled is the number of uploads S3 rejected with SlowDown or 503.
+	Throttled int
+	// MinConcurrency is the lowest the controller had to go, MaxConcurrency when it never backed off.
+	MinConcurrency int
+	MaxConcurrency int
+}
+
+// throttleController bounds how many uploads run at once. The limit halves every time S3 throttles
+// and grows back by one after a streak of clean uploads, the same AIMD shape TCP uses.
+type throttleController struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	active  int
+	streak  int
+	backoff time.Duration
+	stats   ThrottleStats
+}
+
+func newThrottleController(max int) *throttleController {
+	if max < 1 {
+		max = 1
+	}
+	c := &throttleController{limit: max, stats: ThrottleStats{MinConcurrency: max, MaxConcurrency: max}}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire waits for a free upload slot, or for ctx to be done.
+func (c *throttleController) acquire(ctx context.Context) error {
+	// wake the waiters when ctx is done, the Cond has no way to wait on it
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.active >= c.limit {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.cond.Wait()
+	}
+	c.active++
+	return nil
+}
+
+// release gives the slot back, adjusting the limit for whether the upload was throttled.
+// Returns how long the caller should wait before trying a throttled upload again.
+func (c *throttleController) release(throttled bool) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+	defer c.cond.Broadcast()
+	if !throttled {
+		c.backoff = 0
+		c.streak++
+		if c.streak >= 10 && c.limit < c.stats.MaxConcurrency {
+			c.limit++
+			c.streak = 0
+		}
+		return 0
+	}
+	c.stats.Throttled++
+	c.streak = 0
+	if c.limit > 1 {
+		c.limit /= 2
+	}
+	if c.limit < c.stats.MinConcurrency {
+		c.stats.MinConcurrency = c.limit
+	}
+	if c.backoff == 0 {
+		c.backoff = time.Second
+	} else if c.backoff < time.Minute {
+		c.backoff *= 2
+	}
+	return c.backoff
+}
+
+func (c *throttleController) report() ThrottleStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// ThrottleStats returns how often S3 throttled the last UploadDiffs run.
+func (app *Syncer) ThrottleStats() ThrottleStats {
+	if app.throttle == nil {
+		return ThrottleStats{}
+	}
+	return app.throttle.report()
+}
+
+// isThrottle reports whether err is S3 asking us to slow down.
+func isThrottle(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "RequestThrottled", "TooManyRequestsException":
+			return true
+		}
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode() == http.StatusServiceUnavailable || respErr.HTTPStatusCode() == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// uploadThrottled uploads p inside a controller slot, waiting and retrying while S3 throttles.
+func (app *Syncer) uploadThrottled(ctx context.Context, p string, deep bool) error {
+	retries := app.ThrottleRetries
+	if retries == 0 {
+		retries = DefaultThrottleRetries
+	}
+	for attempt := 0; ; attempt++ {
+		err := app.throttle.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		err = app.uploadOne(ctx, p, deep)
+		wait := app.throttle.release(isThrottle(err))
+		if !isThrottle(err) || attempt >= retries {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
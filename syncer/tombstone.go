@@ -0,0 +1,194 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Tombstone is a file that disappeared locally but is still kept in the bucket until it is purged.
+type Tombstone struct {
+	Path    string
+	Deleted time.Time
+}
+
+// markDeleted tombstones every live manifest record that is not in objs, and brings back tombstoned files
+// that showed up again. Files outside Subpath or IncludeDirs were not walked, so they are left alone, and so
+// are files the filters no longer match, those are flagged in FilteredOut instead.
+func (app *Syncer) markDeleted(objs map[string]int64) error {
+	recs, err := app.records().List()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	app.filteredOut = nil
+	for _, rec := range recs {
+		p := rec.Path
+		if rec.Deleted != 0 {
+			continue
+		}
+		if app.filters != nil && !inFilters(app.filterPath(p), app.filters) || app.ignored(p, false) {
+			app.filteredOut = append(app.filteredOut, p)
+			continue
+		}
+		if _, ok := objs[p]; !ok && app.inScope(p) {
+			err = app.records().SetDeleted(p, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(app.filteredOut) > 0 && !app.NoSpinners {
+		app.term().warning().Printfln("%d synced files no longer match the filters, they are left in the bucket as they are.", len(app.filteredOut))
+	}
+	tombstones, err := app.Tombstones()
+	if err != nil {
+		return err
+	}
+	for _, ts := range tombstones {
+		if _, ok := objs[ts.Path]; ok {
+			err = app.records().SetDeleted(ts.Path, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FilteredOut returns the synced files the last UpdateManifest left alone because the filters of the walk no
+// longer match them. Their objects stay in the bucket and nothing is uploaded for them.
+func (app *Syncer) FilteredOut() []string {
+	return app.filteredOut
+}
+
+// Tombstones returns the files that were deleted locally and not purged yet.
+func (app *Syncer) Tombstones() ([]Tombstone, error) {
+	recs, err := app.records().List()
+	if err != nil {
+		return nil, err
+	}
+	var res []Tombstone
+	for _, rec := range recs {
+		if rec.Deleted != 0 {
+			res = append(res, Tombstone{Path: rec.Path, Deleted: time.Unix(rec.Deleted, 0)})
+		}
+	}
+	return res, nil
+}
+
+// Purge deletes the objects of files that have been tombstoned for longer than Retention, then forgets them.
+// It returns the purged paths. Nothing is purged while Retention is 0.
+func (app *Syncer) Purge(ctx context.Context) ([]string, error) {
+	if err := app.needSQLite("Purge"); err != nil {
+		return nil, err
+	}
+	if app.Retention <= 0 {
+		return nil, nil
+	}
+	tombstones, err := app.purgeable()
+	if err != nil {
+		return nil, err
+	}
+	var purged []string
+	for _, ts := range tombstones {
+		keys, err := app.remoteKeys(ts.Path)
+		if err != nil {
+			return purged, err
+		}
+		var deleted []string
+		for _, k := range keys {
+			// the object still holds the file in a snapshot
+			kept, err := app.snapshotted(k)
+			if err != nil {
+				return purged, err
+			}
+			if kept {
+				continue
+			}
+			err = app.store().Delete(ctx, k)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return purged, err
+			}
+			deleted = append(deleted, k)
+		}
+		err = app.forget(ts.Path, deleted)
+		if err != nil {
+			return purged, err
+		}
+		if !app.NoSpinners {
+			app.term().info().Printfln("Purged %s, deleted locally on %s.", ts.Path, ts.Deleted.Format(time.DateOnly))
+		}
+		purged = append(purged, ts.Path)
+	}
+	return purged, nil
+}
+
+// purgeable returns the files that have been tombstoned for longer than Retention, none while it is 0.
+func (app *Syncer) purgeable() ([]Tombstone, error) {
+	if app.Retention <= 0 {
+		return nil, nil
+	}
+	tombstones, err := app.Tombstones()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-app.Retention)
+	var res []Tombstone
+	for _, ts := range tombstones {
+		if !ts.Deleted.After(cutoff) {
+			res = append(res, ts)
+		}
+	}
+	return res, nil
+}
+
+// remoteKeys returns every object stored for p: the object or its parts, and any delta objects.
+func (app *Syncer) remoteKeys(p string) ([]string, error) {
+	key, err := app.keyFor(p)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := app.partKeys(p)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, key)
+	sidecar, err := app.recordedETag(xattrKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if sidecar != "" {
+		keys = append(keys, xattrKey(key))
+	}
+	_, gen, _, err := app.deltaState(p)
+	if err != nil {
+		return nil, err
+	}
+	for g := 1; g <= gen; g++ {
+		keys = append(keys, deltaKey(key, g), deltaKey(key, g)+".json")
+	}
+	return keys, nil
+}
+
+// forget removes p and everything recorded about it from the manifest.
+func (app *Syncer) forget(p string, keys []string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{DELETEBLOCKSBYPATH, DELETEPARTSBYPATH, DELETERECORD} {
+		_, err = tx.Exec(q, p)
+		if err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		_, err = tx.Exec(DELETEETAG, k)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,102 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// TransformFunc rewrites a file on its way to the bucket, like stripping EXIF data from photos. It gets the
+// local path and the file content and returns the content to upload instead, and a key to store it under or
+// empty to keep the usual one. The new key is recorded in the manifest, so Download and Purge find it.
+type TransformFunc func(p string, r io.Reader) (io.Reader, string, error)
+
+// ChainTransforms runs fns one after the other, each on the output of the one before. The last key set wins.
+func ChainTransforms(fns ...TransformFunc) TransformFunc {
+	return func(p string, r io.Reader) (io.Reader, string, error) {
+		var key string
+		for _, fn := range fns {
+			out, k, err := fn(p, r)
+			if err != nil {
+				return nil, "", err
+			}
+			r = out
+			if k != "" {
+				key = k
+			}
+		}
+		return r, key, nil
+	}
+}
+
+// putTransformed uploads obj through app.Transform. The output is spooled to a temp file first, so the single
+// PUT limit and the split are checked against what is really uploaded, not the local file, and its progress is
+// reported in bytes of the local file. Delta mode is skipped, the blocks of the transformed content don't line
+// up with the local file.
+func (app *Syncer) putTransformed(ctx context.Context, obj string, key string, class types.StorageClass, opts PutOptions) error {
+	return app.putTransformedWith(ctx, obj, key, class, opts, app.Transform)
+}
+
+// putTransformedWith is putTransformed through transform instead of app.Transform.
+func (app *Syncer) putTransformedWith(ctx context.Context, obj string, key string, class types.StorageClass, opts PutOptions, transform TransformFunc) error {
+	f, err := os.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, newKey, err := transform(obj, f)
+	if err != nil {
+		return fmt.Errorf("%s: transform: %w", obj, err)
+	}
+	if newKey != "" && newKey != key {
+		err = app.setKey(obj, newKey)
+		if err != nil {
+			return err
+		}
+		key = newKey
+	}
+
+	dir, err := os.MkdirTemp("", "s3sync")
+	if err != nil {
+		return err
+	}
+	app.trackTemp(dir)
+	defer os.RemoveAll(dir)
+	spool := filepath.Join(dir, filepath.Base(obj))
+	out, err := os.Create(spool)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	closeErr := out.Close()
+	if err != nil {
+		return fmt.Errorf("%s: transform: %w", obj, err)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	info, err := os.Stat(spool)
+	if err != nil {
+		return err
+	}
+	if app.NoSplit && info.Size() > app.putLimit(class) {
+		return fmt.Errorf("%s is %d bytes once transformed, the limit for %s is %d: %w", obj, info.Size(), class, app.putLimit(class), ErrTooLarge)
+	}
+	progressMu.Lock()
+	if app.transformed == nil {
+		app.transformed = map[string]*progressScale{}
+	}
+	app.transformed[obj] = &progressScale{input: app.sizeOf(obj), output: info.Size()}
+	progressMu.Unlock()
+	defer func() {
+		progressMu.Lock()
+		delete(app.transformed, obj)
+		progressMu.Unlock()
+	}()
+	return app.putContent(ctx, obj, spool, key, info, class, opts)
+}
@@ -0,0 +1,65 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// TransitionReport is what Transition did with the objects under the prefix.
+type TransitionReport struct {
+	// Moved were copied in place into the new class.
+	Moved []string
+	// Unchanged already were in the new class.
+	Unchanged []string
+	// NeedsRestore are in Glacier or Deep Archive without a restored copy, S3 can't copy them until they are restored.
+	NeedsRestore []string
+}
+
+// Transition moves every object under prefix to class with a server side copy, without uploading anything again,
+// and records the new class in the manifest. Archived objects are only moved once they have been restored.
+// S3Store copies objects over 5GiB in parts, so size doesn't matter.
+// It can be run again after a failure, objects already in class are left alone.
+func (app *Syncer) Transition(ctx context.Context, prefix string, class types.StorageClass) (TransitionReport, error) {
+	var report TransitionReport
+	objs, err := app.store().List(ctx, prefix)
+	if err != nil {
+		return report, err
+	}
+	for _, obj := range objs {
+		current := types.StorageClass(obj.StorageClass)
+		if current == "" {
+			current = types.StorageClassStandard
+		}
+		if current == class {
+			report.Unchanged = append(report.Unchanged, obj.Key)
+			continue
+		}
+		if archived(current) {
+			info, err := app.store().Head(ctx, obj.Key)
+			if err != nil {
+				return report, err
+			}
+			if !info.Restored {
+				report.NeedsRestore = append(report.NeedsRestore, obj.Key)
+				continue
+			}
+		}
+		etag, err := app.store().SetStorageClass(ctx, obj.Key, string(class))
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", obj.Key, err)
+		}
+		err = app.recordETag(obj.Key, etag, class)
+		if err != nil {
+			return report, err
+		}
+		report.Moved = append(report.Moved, obj.Key)
+	}
+	return report, nil
+}
+
+// archived reports whether objects in class have to be restored before they can be read or copied.
+func archived(class types.StorageClass) bool {
+	return class == types.StorageClassGlacier || class == types.StorageClassDeepArchive
+}
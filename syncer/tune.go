@@ -0,0 +1,152 @@
+package syncer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMaxPartConcurrency is the most pieces PartConcurrencyAuto uploads at once when PartConcurrency
+// doesn't set a ceiling.
+const DefaultMaxPartConcurrency = 16
+
+// tuneGain is how much faster a round of pieces has to be than the best one so far to keep adding pieces.
+const tuneGain = 1.1
+
+// minRound is the fewest pieces a round is measured over, so one slow start doesn't decide it.
+const minRound = 4
+
+// partTuner bounds how many pieces of a split file upload at once. With auto set it climbs from one piece at
+// a time, one more after every round that was faster than the last, until a round isn't, then it goes back to
+// the fastest and stays there. S3 throttling halves it. A round is twice as many pieces as are going up at once,
+// and at least minRound.
+type partTuner struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	ceiling int
+	active  int
+	auto    bool
+	settled bool
+	// started, parts and bytes measure the round in progress
+	started time.Time
+	parts   int
+	bytes   int64
+	// rate is the bytes per second of the fastest round so far, best the limit it ran at
+	rate float64
+	best int
+}
+
+// newPartTuner returns the tuner for the pieces of this run, a fixed PartConcurrency unless PartConcurrencyAuto is set.
+func (app *Syncer) newPartTuner() *partTuner {
+	t := &partTuner{limit: max(app.PartConcurrency, 1), ceiling: max(app.PartConcurrency, 1)}
+	if app.PartConcurrencyAuto {
+		t.auto = true
+		t.limit = 1
+		if t.ceiling <= 1 {
+			t.ceiling = DefaultMaxPartConcurrency
+		}
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// startRound drops the round in progress, so the time between two split files isn't counted against either.
+func (t *partTuner) startRound() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started = time.Time{}
+	t.parts = 0
+	t.bytes = 0
+}
+
+// acquire waits for a free piece slot.
+func (t *partTuner) acquire(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.active >= t.limit {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		t.cond.Wait()
+	}
+	t.active++
+	if t.started.IsZero() {
+		t.started = time.Now()
+	}
+	return nil
+}
+
+// drop gives back a slot that wasn't used after all.
+func (t *partTuner) drop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	t.cond.Broadcast()
+}
+
+// release gives the slot of a piece of size bytes back and, once a round is complete, tunes the limit.
+func (t *partTuner) release(size int64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	defer t.cond.Broadcast()
+	if !t.auto {
+		return
+	}
+	if isThrottle(err) {
+		t.limit = max(t.limit/2, 1)
+		t.best = t.limit
+		t.settled = true
+		return
+	}
+	if err != nil || t.settled {
+		return
+	}
+	t.parts++
+	t.bytes += size
+	if t.parts < max(2*t.limit, minRound) {
+		return
+	}
+	rate := float64(t.bytes) / time.Since(t.started).Seconds()
+	if rate > t.rate*tuneGain {
+		t.rate = rate
+		t.best = t.limit
+		if t.limit < t.ceiling {
+			t.limit++
+		} else {
+			t.settled = true
+		}
+	} else {
+		t.limit = t.best
+		t.settled = true
+	}
+	t.started = time.Now()
+	t.parts = 0
+	t.bytes = 0
+}
+
+// tuned returns the limit the tuner settled on, or the fastest so far, 0 before a round was measured.
+func (t *partTuner) tuned() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.best
+}
+
+// TunedPartConcurrency returns how many pieces at once PartConcurrencyAuto found fastest in the last run, 0 when
+// it was off or no split file was big enough to measure. Set it as PartConcurrency to skip the tuning next time.
+func (app *Syncer) TunedPartConcurrency() int {
+	if app.parts == nil || !app.parts.auto {
+		return 0
+	}
+	return app.parts.tuned()
+}
+
+// reportTuning prints what PartConcurrencyAuto settled on, if it measured anything.
+func (app *Syncer) reportTuning() {
+	n := app.TunedPartConcurrency()
+	if n == 0 || app.NoSpinners {
+		return
+	}
+	app.term().info().Printfln("Split files went up fastest %d pieces at a time, pin it with --part-concurrency %d.", n, n)
+}
@@ -0,0 +1,39 @@
+package syncer
+
+import (
+	"database/sql"
+)
+
+// The manifest is written in two kinds of transactions. UpdateManifest writes the whole inventory in one: the
+// records of new and changed files, the hardlinks, case renames, tombstones and clearing the walk checkpoint
+// commit together or not at all, so a crash during it leaves the manifest as the last sync left it and the next
+// one just walks again. Uploads commit per file and part instead, so the progress of a run survives a crash: a
+// file is completed with its hash and failure count in one transaction, see completeUpload, and a split file
+// only once the last of its parts is, by the parts_complete trigger. A crash mid upload leaves the file
+// in_progress, which GetUploadList returns like pending, and the next sync uploads it again.
+
+// querier is what the manifest is read and written through, the database or a transaction on it.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// manifest returns the inventory transaction while UpdateManifest runs, nothing else touches the manifest
+// then, and the database otherwise.
+func (app *Syncer) manifest() querier {
+	if app.manifestTx != nil {
+		return app.manifestTx
+	}
+	return app.db
+}
+
+// completeUpload marks the uploaded file p complete, with the hash and size it went up with and its failures
+// cleared, in one transaction.
+func (app *Syncer) completeUpload(p string) error {
+	sum, size, err := app.sumFile(p)
+	if err != nil {
+		return err
+	}
+	return app.records().CompleteUpload(p, sum, size)
+}
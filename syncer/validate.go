@@ -0,0 +1,137 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// RestoreCheck is whether one file could be downloaded and put back together, see ValidateRestore.
+type RestoreCheck struct {
+	Path string
+	// Objects is how many objects hold the file, its pieces when it was split.
+	Objects int
+	// Size is what the objects add up to.
+	Size int64
+	// Archived is how many of the objects are in Glacier or Deep Archive without a restored copy, so a
+	// download has to wait for them to be restored first.
+	Archived int
+	// Problems lists what would break the restore, none when it would work.
+	Problems []string
+}
+
+// Restorable reports whether nothing was found that would break the restore.
+func (c RestoreCheck) Restorable() bool {
+	return len(c.Problems) == 0
+}
+
+// ValidateRestore walks through what Download would do for each of paths without fetching any content: every
+// object must be in the bucket with the ETag and size recorded at upload, the recorded pieces of a split file
+// must follow on from each other, and together they must add up to the recorded size of the file. Only HEAD
+// requests are made, so it is cheap and safe to run against archived objects. No paths checks every uploaded file.
+func (app *Syncer) ValidateRestore(ctx context.Context, paths []string) ([]RestoreCheck, error) {
+	if err := app.needSQLite("ValidateRestore"); err != nil {
+		return nil, err
+	}
+	if paths == nil {
+		var err error
+		paths, err = app.queryPaths(SELECTVERIFY)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var res []RestoreCheck
+	for _, p := range paths {
+		check, err := app.validateRestore(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		res = append(res, check)
+	}
+	return res, nil
+}
+
+// validateRestore checks the file p for ValidateRestore.
+func (app *Syncer) validateRestore(ctx context.Context, p string) (RestoreCheck, error) {
+	check := RestoreCheck{Path: p}
+	_, _, status, err := app.recordedContent(p)
+	if err != nil {
+		return check, err
+	}
+	switch status {
+	case "":
+		check.Problems = append(check.Problems, "it is not in the manifest")
+		return check, nil
+	case StatusComplete:
+	default:
+		check.Problems = append(check.Problems, "it is not uploaded yet")
+		return check, nil
+	}
+	src, err := app.contentPath(p)
+	if err != nil {
+		return check, err
+	}
+	parts, err := app.Parts(src)
+	if err != nil {
+		return check, err
+	}
+	if len(parts) == 0 {
+		key, err := app.keyFor(src)
+		if err != nil {
+			return check, err
+		}
+		parts = []Part{{Index: 0, Offset: 0, Size: -1, Key: key}}
+	}
+	// next is where the recorded pieces say the following one starts, -1 once a piece was recorded without it
+	var next int64
+	var sparse, encrypted, compressed bool
+	for _, part := range parts {
+		if part.Offset >= 0 && next >= 0 && part.Offset != next {
+			check.Problems = append(check.Problems, fmt.Sprintf("piece %d starts at byte %d, not %d where the one before ends", part.Index, part.Offset, next))
+		}
+		next = -1
+		if part.Offset >= 0 && part.Size >= 0 {
+			next = part.Offset + part.Size
+		}
+		info, err := app.store().Head(ctx, part.Key)
+		if errors.Is(err, ErrNotFound) {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s is missing", part.Key))
+			continue
+		}
+		if err != nil {
+			return check, err
+		}
+		check.Objects++
+		check.Size += info.Size
+		sparse = sparse || info.Metadata[MetaSparse] != ""
+		encrypted = encrypted || info.Metadata[MetaCipher] != ""
+		compressed = compressed || info.Metadata[MetaCompression] != ""
+		if archived(types.StorageClass(info.StorageClass)) && !info.Restored {
+			check.Archived++
+		}
+		etag, err := app.recordedETag(part.Key)
+		if err != nil {
+			return check, err
+		}
+		if etag != "" && info.ETag != etag {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s changed since it was uploaded", part.Key))
+		}
+		if part.Size >= 0 && info.Size != part.Size {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s holds %d bytes, the piece was %d", part.Key, info.Size, part.Size))
+		}
+	}
+	if check.Objects < len(parts) || app.Transform != nil || encrypted || compressed || sparse {
+		// a missing piece is reported already, and transformed, encrypted, compressed or sparse objects don't hold the file as is
+		return check, nil
+	}
+	size, _, _, err := app.recordedContent(src)
+	if err != nil {
+		return check, err
+	}
+	if size >= 0 && size != check.Size {
+		check.Problems = append(check.Problems, fmt.Sprintf("the objects add up to %d bytes, the file was %d", check.Size, size))
+	}
+	return check, nil
+}
@@ -0,0 +1,231 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ErrVerify is a bucket missing objects of uploaded files, or holding other content for them, see Verify.
+var ErrVerify = errors.New("the bucket does not hold what was uploaded")
+
+// VerifyReport is the result of checking the bucket and the local files against the manifest, see Verify.
+type VerifyReport struct {
+	// Checked is how many uploaded files were looked up in the bucket.
+	Checked int `json:"checked"`
+	// Missing files have at least one object that is no longer in the bucket.
+	Missing []string `json:"missing"`
+	// Mismatched files have objects whose ETag or total size is not what was uploaded.
+	Mismatched []string `json:"mismatched"`
+	// Orphaned are the objects under KeyPrefix that no upload recorded in the manifest, left by another tool or
+	// by a manifest that was lost.
+	Orphaned []string `json:"orphaned"`
+	// Gone files were uploaded but aren't on the disk any more, and Modified ones have another size or
+	// modification time than the one uploaded, the next sync takes care of both.
+	Gone     []string `json:"gone"`
+	Modified []string `json:"modified"`
+}
+
+// OK is how many of the checked files have every object in the bucket as it was uploaded.
+func (r *VerifyReport) OK() int {
+	return r.Checked - len(r.Missing) - len(r.Mismatched)
+}
+
+// Err returns ErrVerify, with the counts, when a file is missing or mismatched.
+func (r *VerifyReport) Err() error {
+	if len(r.Missing) == 0 && len(r.Mismatched) == 0 {
+		return nil
+	}
+	return fmt.Errorf("checked %d files, %d are missing and %d mismatched: %w", r.Checked, len(r.Missing), len(r.Mismatched), ErrVerify)
+}
+
+// HealReport is the result of Heal.
+type HealReport struct {
+	Verify *VerifyReport
+	// Repaired files were uploaded again from the local copy.
+	Repaired []string
+	// Unrecoverable files are broken in the bucket and gone locally.
+	Unrecoverable []string
+}
+
+// Verify looks up the objects of every uploaded file in the bucket and compares them with the ETags recorded
+// at upload, or the recorded size for files without them. Files uploaded before either was recorded are only
+// checked for existence. Every piece of a split file is looked up. The local copy of each file is compared with
+// the manifest too, and the bucket is listed under KeyPrefix for objects the manifest knows nothing of. Nothing
+// is changed in the bucket or the manifest.
+func (app *Syncer) Verify(ctx context.Context) (*VerifyReport, error) {
+	if err := app.needSQLite("Verify"); err != nil {
+		return nil, err
+	}
+	paths, err := app.queryPaths(SELECTVERIFY)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	for _, p := range paths {
+		if !app.inScope(p) {
+			continue
+		}
+		report.Checked++
+		missing, mismatched, err := app.verifyFile(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case missing:
+			report.Missing = append(report.Missing, p)
+		case mismatched:
+			report.Mismatched = append(report.Mismatched, p)
+		}
+		gone, modified, err := app.verifyLocal(p)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case gone:
+			report.Gone = append(report.Gone, p)
+		case modified:
+			report.Modified = append(report.Modified, p)
+		}
+	}
+	report.Orphaned, err = app.orphanedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyLocal compares the local file p with the size and modification time the manifest has for it.
+func (app *Syncer) verifyLocal(p string) (gone bool, modified bool, err error) {
+	info, err := app.localStat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	size, _, _, err := app.recordedContent(p)
+	if err != nil {
+		return false, false, err
+	}
+	var mod int64
+	err = app.manifest().QueryRow(SELECTMODIFIED, p).Scan(&mod)
+	if err != nil {
+		return false, false, err
+	}
+	// the size of a directory is the file system's, its object is empty
+	return false, size >= 0 && !info.IsDir() && info.Size() != size || info.ModTime().Unix() != mod, nil
+}
+
+// orphanedKeys lists the bucket under KeyPrefix for the objects no upload recorded.
+func (app *Syncer) orphanedKeys(ctx context.Context) ([]string, error) {
+	known, err := app.queryPaths(SELECTKNOWNKEYS)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]bool, len(known))
+	for _, k := range known {
+		recorded[k] = true
+	}
+	objects, err := app.store().List(ctx, app.KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var orphaned []string
+	for _, obj := range objects {
+		if !recorded[obj.Key] && obj.Key != app.manifestKey() {
+			orphaned = append(orphaned, obj.Key)
+		}
+	}
+	sort.Strings(orphaned)
+	return orphaned, nil
+}
+
+// verifyFile checks the objects of the uploaded file p.
+func (app *Syncer) verifyFile(ctx context.Context, p string) (missing bool, mismatched bool, err error) {
+	p, err = app.contentPath(p)
+	if err != nil {
+		return false, false, err
+	}
+	keys, err := app.partKeys(p)
+	if err != nil {
+		return false, false, err
+	}
+	if len(keys) == 0 {
+		key, err := app.keyFor(p)
+		if err != nil {
+			return false, false, err
+		}
+		keys = []string{key}
+	}
+	var total int64
+	var unrecorded bool
+	for _, k := range keys {
+		info, err := app.store().Head(ctx, k)
+		if errors.Is(err, ErrNotFound) {
+			return true, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		etag, err := app.recordedETag(k)
+		if err != nil {
+			return false, false, err
+		}
+		if etag != "" && info.ETag != etag {
+			mismatched = true
+		}
+		if etag == "" {
+			unrecorded = true
+		}
+		total += info.Size
+	}
+	if !unrecorded {
+		// the ETags already pin down every object, and a Transform can change the size anyway
+		return false, mismatched, nil
+	}
+	size, _, _, err := app.recordedContent(p)
+	if err != nil {
+		return false, false, err
+	}
+	if size >= 0 && size != total {
+		mismatched = true
+	}
+	return false, mismatched, nil
+}
+
+// Heal runs Verify and uploads every missing or mismatched file again from the local copy, in the storage
+// class the sync settings pick for it. Files that are also gone locally are reported as unrecoverable.
+func (app *Syncer) Heal(ctx context.Context) (*HealReport, error) {
+	if err := app.needSQLite("Heal"); err != nil {
+		return nil, err
+	}
+	verify, err := app.Verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &HealReport{Verify: verify}
+	var repair []string
+	for _, p := range append(verify.Missing, verify.Mismatched...) {
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			report.Unrecoverable = append(report.Unrecoverable, p)
+			continue
+		}
+		err = app.setStatus(p, StatusPending)
+		if err != nil {
+			return report, err
+		}
+		repair = append(repair, p)
+	}
+	if len(repair) == 0 {
+		return report, nil
+	}
+	err = app.UploadDiffs(ctx, repair, false)
+	if err != nil {
+		return report, err
+	}
+	report.Repaired = repair
+	return report, nil
+}
@@ -0,0 +1,146 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultWatchInterval is how often Watch looks for changes when WatchInterval is not set, and the platform
+// can't tell it about them as they happen.
+const DefaultWatchInterval = time.Minute
+
+// DefaultWatchDebounce is how long Watch waits for the folders to go quiet when WatchDebounce is not set.
+const DefaultWatchDebounce = 2 * time.Second
+
+// watchBacklog is how many changes the platform watcher holds for Watch, more are dropped.
+const watchBacklog = 1024
+
+// watchEvent is a file or folder that was created, changed or deleted.
+type watchEvent struct {
+	path string
+	dir  bool
+}
+
+// Watch keeps the bucket in step with the source folders until ctx is done: it syncs them, waits for a change,
+// and syncs again. On Linux inotify tells it about files created, written, moved or deleted as it happens,
+// everywhere else, and as a fallback, it looks every WatchInterval. Only changes to files a walk would pick up
+// count, the filters, IncludeDirs and IgnoreFile apply. A burst of changes, like a folder being copied in, waits
+// until there were none for WatchDebounce so files aren't uploaded half written. Files that fail to upload are
+// reported and left pending for the next pass, anything else failing stops the watch.
+func (app *Syncer) Watch(ctx context.Context, filters []string, deep bool) error {
+	roots, err := app.walkRoots()
+	if err != nil {
+		return err
+	}
+	changes, stop, err := watchFolders(roots)
+	if err != nil {
+		if !app.NoSpinners {
+			app.term().warning().Printfln("Can't watch the folders for changes (%v), looking every %s instead.", err, app.watchInterval())
+		}
+		changes, stop = nil, func() {}
+	}
+	defer stop()
+	for {
+		err = app.watchPass(ctx, filters, deep)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var failed *UploadErrors
+		var one *UploadError
+		switch {
+		case errors.As(err, &failed), errors.As(err, &one):
+			if !app.NoSpinners {
+				app.term().warning().Printfln("%v, trying again on the next change.", err)
+			}
+		case err != nil:
+			return err
+		}
+		if !app.NoSpinners {
+			app.term().info().Println("Watching for changes...")
+		}
+		app.waitForChange(ctx, changes, app.watchInterval())
+		// wait for the burst to be over
+		for app.waitForChange(ctx, changes, app.watchDebounce()) {
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// waitForChange waits up to d for a change in changes that a walk would pick up and reports whether one came,
+// false when d ran out or ctx is done first.
+func (app *Syncer) waitForChange(ctx context.Context, changes <-chan watchEvent, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return false
+		case ev := <-changes:
+			if app.watched(ev) {
+				return true
+			}
+		}
+	}
+}
+
+// watched reports whether the change ev is to a file or folder the walk looks at.
+func (app *Syncer) watched(ev watchEvent) bool {
+	src, ok := app.sourceFor(ev.path)
+	if !ok || !app.included(src.FolderPath, ev.path, ev.dir) || app.ignored(ev.path, ev.dir) {
+		return false
+	}
+	return ev.dir || inFilters(app.filterPath(ev.path), app.filters)
+}
+
+// watchPass is one sync of Watch: the walk, the manifest update, the upload and the purge of files tombstoned
+// for longer than Retention, between pulling and pushing the manifest with SharedManifest.
+func (app *Syncer) watchPass(ctx context.Context, filters []string, deep bool) error {
+	if app.SharedManifest {
+		_, err := app.PullManifest(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	files, err := app.WalkAndHash(ctx, filters)
+	if err != nil {
+		return err
+	}
+	err = app.UpdateManifest(files)
+	if err != nil {
+		return err
+	}
+	uploads, err := app.GetUploadList()
+	if err != nil {
+		return err
+	}
+	err = app.UploadDiffs(ctx, uploads, deep)
+	if err != nil {
+		return err
+	}
+	_, err = app.Purge(ctx)
+	if err != nil || !app.SharedManifest {
+		return err
+	}
+	return app.PushManifest(ctx)
+}
+
+// watchInterval returns WatchInterval, or DefaultWatchInterval when it is not set.
+func (app *Syncer) watchInterval() time.Duration {
+	if app.WatchInterval > 0 {
+		return app.WatchInterval
+	}
+	return DefaultWatchInterval
+}
+
+// watchDebounce returns WatchDebounce, or DefaultWatchDebounce when it is not set.
+func (app *Syncer) watchDebounce() time.Duration {
+	if app.WatchDebounce > 0 {
+		return app.WatchDebounce
+	}
+	return DefaultWatchDebounce
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package syncer
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask are the inotify events that can change what a sync uploads.
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_ATTRIB
+
+// watchFolders watches every folder under roots with inotify, folders created later included, and sends what
+// changed on the channel it returns until stop is called. Folders that can't be watched, like ones without read
+// permission, are left to the WatchInterval of Watch, as are changes that come faster than Watch takes them.
+func watchFolders(roots []string) (<-chan watchEvent, func(), error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a non-blocking fd goes through the runtime poller, so Close wakes up the Read below
+	f := os.NewFile(uintptr(fd), "inotify")
+	var mu sync.Mutex
+	dirs := map[int]string{}
+	add := func(root string) {
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			wd, err := unix.InotifyAddWatch(fd, p, watchMask)
+			if err == nil {
+				mu.Lock()
+				dirs[wd] = p
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	for _, root := range roots {
+		add(root)
+	}
+
+	changes := make(chan watchEvent, watchBacklog)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+				mu.Lock()
+				parent := dirs[int(ev.Wd)]
+				mu.Unlock()
+				if parent == "" || ev.Len == 0 {
+					continue
+				}
+				change := watchEvent{path: filepath.Join(parent, string(bytes.TrimRight(name, "\x00"))), dir: ev.Mask&unix.IN_ISDIR != 0}
+				if change.dir && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					add(change.path)
+				}
+				select {
+				case changes <- change:
+				default:
+				}
+			}
+		}
+	}()
+	return changes, func() { f.Close() }, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package syncer
+
+import "errors"
+
+// watchFolders can't be told about changes without inotify, so Watch looks every WatchInterval here.
+func watchFolders(roots []string) (<-chan watchEvent, func(), error) {
+	return nil, nil, errors.New("only supported on Linux")
+}
@@ -0,0 +1,90 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Object metadata keys for PreserveXattrs. MetaXattrs holds the attributes themselves, MetaXattrSidecar the key
+// of the object holding them when they don't fit in the metadata.
+const (
+	MetaXattrs       = "xattrs"
+	MetaXattrSidecar = "xattrs-sidecar"
+)
+
+// xattrMetaBudget caps the encoded attributes kept in the metadata, S3 allows 2KB of metadata per object in total.
+const xattrMetaBudget = 1024
+
+// xattrKey is the key of the sidecar object holding the extended attributes of the object key.
+func xattrKey(key string) string {
+	return key + ".s3sync-xattrs"
+}
+
+// addXattrs puts the extended attributes of p in opts, or in a sidecar object next to key if there are too many
+// for the metadata. Files without any, and filesystems without support for them, add nothing.
+func (app *Syncer) addXattrs(ctx context.Context, p string, key string, opts *PutOptions) error {
+	attrs, err := listXattrs(p)
+	if err != nil || len(attrs) == 0 {
+		return err
+	}
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	if opts.Metadata == nil {
+		opts.Metadata = map[string]string{}
+	}
+	if encoded := base64.RawURLEncoding.EncodeToString(data); len(encoded) <= xattrMetaBudget {
+		opts.Metadata[MetaXattrs] = encoded
+		return nil
+	}
+	err = app.putBody(ctx, xattrKey(key), bytes.NewReader(data), types.StorageClassStandard, PutOptions{})
+	if err != nil {
+		return err
+	}
+	opts.Metadata[MetaXattrSidecar] = xattrKey(key)
+	return nil
+}
+
+// restoreXattrs sets the extended attributes recorded in meta on p. Attributes the filesystem or the user may
+// not set, like security.* without root, are left out.
+func (app *Syncer) restoreXattrs(ctx context.Context, p string, meta map[string]string) error {
+	var data []byte
+	switch {
+	case meta[MetaXattrs] != "":
+		decoded, err := base64.RawURLEncoding.DecodeString(meta[MetaXattrs])
+		if err != nil {
+			return err
+		}
+		data = decoded
+	case meta[MetaXattrSidecar] != "":
+		body, err := app.store().Get(ctx, meta[MetaXattrSidecar])
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		data, err = io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	var attrs map[string][]byte
+	err := json.Unmarshal(data, &attrs)
+	if err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		err = setXattr(p, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
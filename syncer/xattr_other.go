@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package syncer
+
+// listXattrs is a no-op where extended attributes aren't supported.
+func listXattrs(p string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// setXattr is a no-op where extended attributes aren't supported.
+func setXattr(p string, name string, value []byte) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin
+
+package syncer
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns the extended attributes of p, none where the filesystem doesn't have them.
+func listXattrs(p string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(p, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(p, buf)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string][]byte{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		n, err := unix.Getxattr(p, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		n, err = unix.Getxattr(p, name, value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value[:n]
+	}
+	return attrs, nil
+}
+
+// setXattr sets the extended attribute name of p, skipping it when the filesystem or the user can't.
+func setXattr(p string, name string, value []byte) error {
+	err := unix.Setxattr(p, name, value, 0)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		return nil
+	}
+	return err
+}